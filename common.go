@@ -1,11 +1,15 @@
 package gopenflow
 
 import (
+	"fmt"
 	"io"
 )
 
 type Datapath interface {
-	AddPort(Port) error
+	AddPort(Port) error                     // registers the port in a free port number.
+	SetPort(portNo uint32, port Port) error // registers the port in the port number. nil port unregisters.
+	RemovePort(Port) error
+	ListPorts() map[uint32]Port
 	AddChannel(conn io.ReadWriteCloser) error
 }
 
@@ -18,12 +22,12 @@ type Port interface {
 	Name() string
 	HwAddr() [6]byte
 	PhysicalPort() uint32
-	Monitor() <-chan bool // By passing false, datapath will remove this port. XXX: Monitor notifies datapath to send port_status message, so for deletion, we have to change this passing all of the member of port_mod message for concurrency.
+	Monitor() <-chan PortEvent // PortDeleted or closing the channel makes datapath remove this port.
 	Ingress() <-chan Frame
 	Egress(Frame) error
 
 	GetConfig() []PortConfig
-	SetConfig([]PortConfig)
+	SetConfig([]PortConfig) error // PortConfigError should be returned.
 	State() []PortState
 	Mtu() uint32
 	Ethernet() (PortEthernetProperty, error)
@@ -32,6 +36,66 @@ type Port interface {
 	Vendor(interface{}) interface{}
 }
 
+type PortEventKind int
+
+const (
+	PortAdded PortEventKind = iota
+	PortModified
+	PortDeleted
+)
+
+// PortEvent is a snapshot of the port properties at the change, so that
+// datapath does not need to query the port again.
+type PortEvent struct {
+	Kind     PortEventKind
+	Name     string
+	HwAddr   [6]byte
+	Config   []PortConfig
+	State    []PortState
+	Ethernet PortEthernetProperty
+}
+
+type portProperties interface {
+	Name() string
+	HwAddr() [6]byte
+	GetConfig() []PortConfig
+	State() []PortState
+	Ethernet() (PortEthernetProperty, error)
+}
+
+// MakePortEvent takes a snapshot of the port.
+func MakePortEvent(kind PortEventKind, port Port) PortEvent {
+	return makePortEvent(kind, port)
+}
+
+func makePortEvent(kind PortEventKind, port portProperties) PortEvent {
+	eth, _ := port.Ethernet()
+	return PortEvent{
+		Kind:     kind,
+		Name:     port.Name(),
+		HwAddr:   port.HwAddr(),
+		Config:   port.GetConfig(),
+		State:    port.State(),
+		Ethernet: eth,
+	}
+}
+
+// offerPortEvent replaces the pending event if the buffered channel is full,
+// so that the receiver always gets the latest snapshot. Only one sender is allowed.
+func offerPortEvent(ch chan PortEvent, ev PortEvent) {
+	for {
+		select {
+		case ch <- ev:
+			return
+		default:
+		}
+		select {
+		case <-ch:
+		default:
+		}
+	}
+}
+
 type PortConfig interface{}
 
 type PortConfigPortDown bool
@@ -42,6 +106,19 @@ type PortConfigNoFwd bool
 
 type PortConfigNoPacketIn bool
 
+// PortConfigAdvertise is ofp_port_features to be advertised by the port.
+type PortConfigAdvertise uint32
+
+// PortConfigError reports the PortConfig that could not be applied.
+type PortConfigError struct {
+	Config PortConfig
+	Err    error
+}
+
+func (self PortConfigError) Error() string {
+	return fmt.Sprintf("port config %v failed: %v", self.Config, self.Err)
+}
+
 type PortState interface{}
 
 type PortStateLinkDown bool
@@ -530,6 +530,41 @@ func (self FlowMod) Instructions() Instruction {
 	return Instruction(self[48+align8(m.Length()) : Header(self).Length()])
 }
 
+func MakeFlowMod(cookie uint64,
+	cookieMask uint64,
+	tableId uint8,
+	command uint8,
+	idleTimeout uint16,
+	hardTimeout uint16,
+	priority uint16,
+	bufferId uint32,
+	outPort uint32,
+	outGroup uint32,
+	flags uint16,
+	match Match,
+	instructions Instruction) FlowMod {
+	length := 48 + align8(len(match)) + len(instructions)
+	self := make([]byte, length)
+	self[0] = 4
+	self[1] = OFPT_FLOW_MOD
+	binary.BigEndian.PutUint16(self[2:], uint16(length))
+
+	binary.BigEndian.PutUint64(self[8:], cookie)
+	binary.BigEndian.PutUint64(self[16:], cookieMask)
+	self[24] = tableId
+	self[25] = command
+	binary.BigEndian.PutUint16(self[26:], idleTimeout)
+	binary.BigEndian.PutUint16(self[28:], hardTimeout)
+	binary.BigEndian.PutUint16(self[30:], priority)
+	binary.BigEndian.PutUint32(self[32:], bufferId)
+	binary.BigEndian.PutUint32(self[36:], outPort)
+	binary.BigEndian.PutUint32(self[40:], outGroup)
+	binary.BigEndian.PutUint16(self[44:], flags)
+	copy(self[48:], match)
+	copy(self[48+align8(len(match)):], instructions)
+	return self
+}
+
 type GroupMod []byte
 
 func (self GroupMod) Command() uint16 {
@@ -653,6 +688,34 @@ func (self QueuePropHeader) Len() int {
 	return int(binary.BigEndian.Uint16(self[2:]))
 }
 
+type QueuePropMinRate []byte
+
+func (self QueuePropMinRate) Rate() uint16 {
+	return binary.BigEndian.Uint16(self[8:])
+}
+
+func MakeQueuePropMinRate(rate uint16) QueuePropHeader {
+	self := make([]byte, 16)
+	binary.BigEndian.PutUint16(self, OFPQT_MIN_RATE)
+	binary.BigEndian.PutUint16(self[2:], 16)
+	binary.BigEndian.PutUint16(self[8:], rate)
+	return self
+}
+
+type QueuePropMaxRate []byte
+
+func (self QueuePropMaxRate) Rate() uint16 {
+	return binary.BigEndian.Uint16(self[8:])
+}
+
+func MakeQueuePropMaxRate(rate uint16) QueuePropHeader {
+	self := make([]byte, 16)
+	binary.BigEndian.PutUint16(self, OFPQT_MAX_RATE)
+	binary.BigEndian.PutUint16(self[2:], 16)
+	binary.BigEndian.PutUint16(self[8:], rate)
+	return self
+}
+
 type PacketQueue []byte
 
 func (self PacketQueue) QueueId() uint32 {
@@ -681,6 +744,16 @@ func (self PacketQueue) Properties() []QueuePropHeader {
 	return ret
 }
 
+func MakePacketQueue(queueId, port uint32, properties []byte) PacketQueue {
+	length := 16 + len(properties)
+	self := make([]byte, length)
+	binary.BigEndian.PutUint32(self, queueId)
+	binary.BigEndian.PutUint32(self[4:], port)
+	binary.BigEndian.PutUint16(self[8:], uint16(length))
+	copy(self[16:], properties)
+	return self
+}
+
 type QueueGetConfigReply []byte
 
 func (self QueueGetConfigReply) Port() uint32 {
@@ -698,6 +771,17 @@ func (self QueueGetConfigReply) Queues() []PacketQueue {
 	return ret
 }
 
+func MakeQueueGetConfigReply(port uint32, queues []byte) Header {
+	length := 16 + len(queues)
+	self := make([]byte, length)
+	self[0] = 4
+	self[1] = OFPT_QUEUE_GET_CONFIG_REPLY
+	binary.BigEndian.PutUint16(self[2:], uint16(length))
+	binary.BigEndian.PutUint32(self[8:], port)
+	copy(self[16:], queues)
+	return self
+}
+
 type RoleRequest []byte
 
 func (self RoleRequest) Role() uint32 {
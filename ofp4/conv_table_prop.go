@@ -139,6 +139,26 @@ func (self QueueStats) DurationNsec() uint32 {
 	return binary.BigEndian.Uint32(self[36:])
 }
 
+func MakeQueueStats(
+	portNo uint32,
+	queueId uint32,
+	txBytes uint64,
+	txPackets uint64,
+	txErrors uint64,
+	durationSec uint32,
+	durationNsec uint32,
+) QueueStats {
+	self := make([]byte, 40)
+	binary.BigEndian.PutUint32(self, portNo)
+	binary.BigEndian.PutUint32(self[4:], queueId)
+	binary.BigEndian.PutUint64(self[8:], txBytes)
+	binary.BigEndian.PutUint64(self[16:], txPackets)
+	binary.BigEndian.PutUint64(self[24:], txErrors)
+	binary.BigEndian.PutUint32(self[32:], durationSec)
+	binary.BigEndian.PutUint32(self[36:], durationNsec)
+	return self
+}
+
 type GroupStatsRequest []byte
 
 func (self GroupStatsRequest) GroupId() uint32 {
@@ -108,6 +108,12 @@ const (
 	OFPQT_EXPERIMENTER = 0xffff
 )
 
+const (
+	OFPQ_ALL            = 0xffffffff
+	OFPQ_MIN_RATE_UNCFG = 0xffff
+	OFPQ_MAX_RATE_UNCFG = 0xffff
+)
+
 const (
 	OFPMT_STANDARD = iota
 	OFPMT_OXM
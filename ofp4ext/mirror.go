@@ -0,0 +1,160 @@
+package ofp4ext
+
+import (
+	"encoding/binary"
+	"github.com/hkwi/gopenflow/ofp4"
+	"github.com/hkwi/gopenflow/ofp4sw"
+	"net"
+	"sort"
+)
+
+// stratos experimenter message types
+const (
+	STRATOS_MIRROR_MOD   = 1
+	STRATOS_MIRROR_STATS = 2
+)
+
+// commands for STRATOS_MIRROR_MOD
+const (
+	STRATOS_MIRROR_SET = iota // add or replace
+	STRATOS_MIRROR_DELETE
+)
+
+// STRATOS_MIRROR_STATS for all mirrors
+const STRATOS_MIRROR_ALL = 0xffffffff
+
+const (
+	stratosMirrorModLength   = 48
+	stratosMirrorStatsLength = 32
+)
+
+/*
+StratosMirrorMod implements STRATOS_MIRROR_MOD message, which configures a port
+mirror of the pipeline. There is no reply on success.
+
+	uint16_t command;     // STRATOS_MIRROR_
+	uint16_t out_vlan;    // RSPAN vlan, or 0
+	uint32_t mirror_id;
+	uint32_t out_port;
+	uint16_t n_ingress;
+	uint16_t n_egress;
+	uint16_t n_vlans;
+	uint8_t pad[6];
+	uint64_t tunnel_id;
+	uint8_t tunnel_dst[16]; // ipv4 mapped for ipv4, or all zero
+	uint32_t ingress_ports[n_ingress];
+	uint32_t egress_ports[n_egress];
+	uint16_t vlans[n_vlans];
+	// padded to 8 bytes
+*/
+type StratosMirrorMod struct{}
+
+var _ = ofp4sw.PipelineMessageHandler(StratosMirrorMod{})
+
+// Execute will not be called, because ExecutePipeline is implemented.
+func (self StratosMirrorMod) Execute(request []byte) [][]byte {
+	return nil
+}
+
+func (self StratosMirrorMod) ExecutePipeline(pipe *ofp4sw.Pipeline, request []byte) ([][]byte, error) {
+	if len(request) < stratosMirrorModLength {
+		return nil, ofp4.MakeErrorMsg(ofp4.OFPET_BAD_REQUEST, ofp4.OFPBRC_BAD_LEN)
+	}
+	mirrorId := binary.BigEndian.Uint32(request[4:])
+	switch binary.BigEndian.Uint16(request) {
+	default:
+		return nil, ofp4.MakeErrorMsg(ofp4.OFPET_BAD_REQUEST, ofp4.OFPBRC_BAD_EXP_TYPE)
+	case STRATOS_MIRROR_DELETE:
+		return nil, pipe.RemoveMirror(mirrorId)
+	case STRATOS_MIRROR_SET:
+		nIngress := int(binary.BigEndian.Uint16(request[12:]))
+		nEgress := int(binary.BigEndian.Uint16(request[14:]))
+		nVlans := int(binary.BigEndian.Uint16(request[16:]))
+		if len(request) < stratosMirrorModLength+4*(nIngress+nEgress)+2*nVlans {
+			return nil, ofp4.MakeErrorMsg(ofp4.OFPET_BAD_REQUEST, ofp4.OFPBRC_BAD_LEN)
+		}
+		config := ofp4sw.MirrorConfig{
+			OutVlan:  binary.BigEndian.Uint16(request[2:]),
+			OutPort:  binary.BigEndian.Uint32(request[8:]),
+			TunnelId: binary.BigEndian.Uint64(request[24:]),
+		}
+		if dst := net.IP(request[32:48]); !dst.IsUnspecified() {
+			config.TunnelDst = append(net.IP{}, dst...)
+		}
+		p := request[stratosMirrorModLength:]
+		for i := 0; i < nIngress; i++ {
+			config.IngressPorts = append(config.IngressPorts, binary.BigEndian.Uint32(p))
+			p = p[4:]
+		}
+		for i := 0; i < nEgress; i++ {
+			config.EgressPorts = append(config.EgressPorts, binary.BigEndian.Uint32(p))
+			p = p[4:]
+		}
+		for i := 0; i < nVlans; i++ {
+			config.Vlans = append(config.Vlans, binary.BigEndian.Uint16(p))
+			p = p[2:]
+		}
+		return nil, pipe.SetMirror(mirrorId, config)
+	}
+}
+
+/*
+StratosMirrorStats implements STRATOS_MIRROR_STATS message. The request is
+mirror_id, or STRATOS_MIRROR_ALL, followed by 4 bytes padding. The reply is the
+list of the entries in the order of mirror_id.
+
+	uint32_t mirror_id;
+	uint8_t pad[4];
+	uint64_t packet_count;
+	uint64_t byte_count;
+	uint64_t error_count;
+*/
+type StratosMirrorStats struct{}
+
+var _ = ofp4sw.PipelineMessageHandler(StratosMirrorStats{})
+
+// Execute will not be called, because ExecutePipeline is implemented.
+func (self StratosMirrorStats) Execute(request []byte) [][]byte {
+	return nil
+}
+
+func (self StratosMirrorStats) ExecutePipeline(pipe *ofp4sw.Pipeline, request []byte) ([][]byte, error) {
+	if len(request) < 8 {
+		return nil, ofp4.MakeErrorMsg(ofp4.OFPET_BAD_REQUEST, ofp4.OFPBRC_BAD_LEN)
+	}
+	mirrorId := binary.BigEndian.Uint32(request)
+	stats := pipe.MirrorStats()
+	var ids []uint32
+	for id, _ := range stats {
+		if mirrorId == STRATOS_MIRROR_ALL || id == mirrorId {
+			ids = append(ids, id)
+		}
+	}
+	sort.Sort(uint32List(ids))
+	var rep []byte
+	for _, id := range ids {
+		s := stats[id]
+		buf := make([]byte, stratosMirrorStatsLength)
+		binary.BigEndian.PutUint32(buf, id)
+		binary.BigEndian.PutUint64(buf[8:], s.PacketCount)
+		binary.BigEndian.PutUint64(buf[16:], s.ByteCount)
+		binary.BigEndian.PutUint64(buf[24:], s.ErrorCount)
+		rep = append(rep, buf...)
+	}
+	return [][]byte{rep}, nil
+}
+
+// sort.Interface for mirror ids
+type uint32List []uint32
+
+func (self uint32List) Len() int {
+	return len(self)
+}
+
+func (self uint32List) Less(i, j int) bool {
+	return self[i] < self[j]
+}
+
+func (self uint32List) Swap(i, j int) {
+	self[i], self[j] = self[j], self[i]
+}
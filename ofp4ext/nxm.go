@@ -1 +1,364 @@
 package ofp4ext
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/hkwi/gopenflow/ofp4"
+	"github.com/hkwi/gopenflow/ofp4sw"
+	"github.com/hkwi/gopenflow/oxm"
+	"hash/fnv"
+)
+
+const NX_EXPERIMENTER_ID = oxm.NX_EXPERIMENTER_ID
+
+// nicira extension action subtypes
+const (
+	NXAST_RESUBMIT       = 1
+	NXAST_REG_MOVE       = 6
+	NXAST_REG_LOAD       = 7
+	NXAST_NOTE           = 8
+	NXAST_MULTIPATH      = 10
+	NXAST_RESUBMIT_TABLE = 14
+	NXAST_OUTPUT_REG     = 15
+	NXAST_LEARN          = 16
+	NXAST_SAMPLE         = 29
+	NXAST_CONJUNCTION    = 34
+	NXAST_CT             = 35
+	NXAST_NAT            = 36
+)
+
+// fields for NXAST_MULTIPATH
+const (
+	NX_HASH_FIELDS_ETH_SRC = iota
+	NX_HASH_FIELDS_SYMMETRIC_L4
+	NX_HASH_FIELDS_SYMMETRIC_L3L4
+	NX_HASH_FIELDS_SYMMETRIC_L3L4_UDP
+	NX_HASH_FIELDS_NW_SRC
+	NX_HASH_FIELDS_NW_DST
+)
+
+// algorithms for NXAST_MULTIPATH
+const (
+	NX_MP_ALG_MODULO_N = iota
+	NX_MP_ALG_HASH_THRESHOLD
+	NX_MP_ALG_HRW
+	NX_MP_ALG_ITER_HASH
+)
+
+// NxAction implements nicira extension actions, which openvswitch controllers use.
+// Action data starts from the subtype.
+type NxAction struct{}
+
+var _ = ofp4sw.ActionHandler(NxAction{})
+
+func (self NxAction) Order(data []byte) int {
+	if len(data) < 2 {
+		return ofp4sw.ACTION_ORDER_FIRST_TO_TTLIN
+	}
+	switch binary.BigEndian.Uint16(data) {
+	case NXAST_RESUBMIT, NXAST_RESUBMIT_TABLE, NXAST_OUTPUT_REG, NXAST_CT:
+		return ofp4sw.ACTION_ORDER_GROUP_TO_OUTPUT
+	case NXAST_REG_MOVE, NXAST_REG_LOAD, NXAST_MULTIPATH, NXAST_LEARN:
+		return ofp4sw.ACTION_ORDER_DEC_TO_SET
+	default:
+		return ofp4sw.ACTION_ORDER_FIRST_TO_TTLIN
+	}
+}
+
+func (self NxAction) Execute(frame *ofp4sw.Frame, data []byte) error {
+	if len(data) < 2 {
+		return ofp4.MakeErrorMsg(ofp4.OFPET_BAD_ACTION, ofp4.OFPBAC_BAD_LEN)
+	}
+	badLen := func(length int) bool {
+		return len(data) < length
+	}
+	switch binary.BigEndian.Uint16(data) {
+	default:
+		return ofp4.MakeErrorMsg(ofp4.OFPET_BAD_ACTION, ofp4.OFPBAC_BAD_EXP_TYPE)
+	case NXAST_NOTE:
+		return nil
+	case NXAST_CONJUNCTION:
+		// conjunctive match flows are not executed
+		return nil
+	case NXAST_RESUBMIT, NXAST_RESUBMIT_TABLE:
+		if badLen(5) {
+			break
+		}
+		ret := ofp4sw.ActionResubmit{
+			InPort:  nxPort(uint32(binary.BigEndian.Uint16(data[2:]))),
+			TableId: ofp4.OFPTT_ALL,
+		}
+		if binary.BigEndian.Uint16(data) == NXAST_RESUBMIT_TABLE {
+			ret.TableId = data[4]
+		}
+		return ret
+	case NXAST_REG_LOAD:
+		if badLen(16) {
+			break
+		}
+		ofs, nBits := nxOfsNbits(binary.BigEndian.Uint16(data[2:]))
+		return nxLoad(frame, binary.BigEndian.Uint32(data[4:]), ofs, nBits, data[8:16], 0)
+	case NXAST_REG_MOVE:
+		if badLen(16) {
+			break
+		}
+		nBits := int(binary.BigEndian.Uint16(data[2:]))
+		srcOfs := int(binary.BigEndian.Uint16(data[4:]))
+		dstOfs := int(binary.BigEndian.Uint16(data[6:]))
+		src, err := frame.GetField(binary.BigEndian.Uint32(data[8:]))
+		if err != nil {
+			return err
+		}
+		if srcOfs+nBits > len(src)*8 {
+			return ofp4.MakeErrorMsg(ofp4.OFPET_BAD_ACTION, ofp4.OFPBAC_BAD_SET_ARGUMENT)
+		}
+		return nxLoad(frame, binary.BigEndian.Uint32(data[12:]), dstOfs, nBits, src, srcOfs)
+	case NXAST_OUTPUT_REG:
+		if badLen(10) {
+			break
+		}
+		ofs, nBits := nxOfsNbits(binary.BigEndian.Uint16(data[2:]))
+		src, err := frame.GetField(binary.BigEndian.Uint32(data[4:]))
+		if err != nil {
+			return err
+		}
+		if nBits > 32 || ofs+nBits > len(src)*8 {
+			return ofp4.MakeErrorMsg(ofp4.OFPET_BAD_ACTION, ofp4.OFPBAC_BAD_SET_ARGUMENT)
+		}
+		port := uint32(nxGetBits(src, ofs, nBits))
+		if nBits <= 16 {
+			port = nxPort(port)
+		}
+		return ofp4sw.ActionOutput{
+			Port:   port,
+			MaxLen: binary.BigEndian.Uint16(data[8:]),
+		}
+	case NXAST_MULTIPATH:
+		if badLen(24) {
+			break
+		}
+		hash, err := nxHashFields(frame, binary.BigEndian.Uint16(data[2:]), binary.BigEndian.Uint16(data[4:]))
+		if err != nil {
+			return err
+		}
+		link, err := nxMultipath(hash,
+			binary.BigEndian.Uint16(data[8:]),
+			uint32(binary.BigEndian.Uint16(data[10:]))+1,
+			binary.BigEndian.Uint32(data[12:]))
+		if err != nil {
+			return err
+		}
+		ofs, nBits := nxOfsNbits(binary.BigEndian.Uint16(data[18:]))
+		value := make([]byte, 4)
+		binary.BigEndian.PutUint32(value, link)
+		return nxLoad(frame, binary.BigEndian.Uint32(data[20:]), ofs, nBits, value, 0)
+	case NXAST_LEARN:
+		if mod, err := nxLearn(frame, data); err != nil {
+			return err
+		} else {
+			return mod
+		}
+	case NXAST_CT:
+		if ct, err := nxConntrack(frame, data); err != nil {
+			return err
+		} else {
+			return ct
+		}
+	case NXAST_SAMPLE:
+		if badLen(16) {
+			break
+		}
+		if binary.BigEndian.Uint16(data[2:]) == 0 {
+			return ofp4.MakeErrorMsg(ofp4.OFPET_BAD_ACTION, ofp4.OFPBAC_BAD_ARGUMENT)
+		}
+		return ofp4sw.ActionSample{
+			Probability:    binary.BigEndian.Uint16(data[2:]),
+			CollectorSetId: binary.BigEndian.Uint32(data[4:]),
+			ObsDomainId:    binary.BigEndian.Uint32(data[8:]),
+			ObsPointId:     binary.BigEndian.Uint32(data[12:]),
+		}
+	}
+	return ofp4.MakeErrorMsg(ofp4.OFPET_BAD_ACTION, ofp4.OFPBAC_BAD_LEN)
+}
+
+var _ = ofp4sw.ConjunctionHandler(NxAction{})
+
+// Conjunction reports NXAST_CONJUNCTION, of which clause is zero based.
+func (self NxAction) Conjunction(data []byte) (ofp4sw.ActionConjunction, bool) {
+	if len(data) < 8 || binary.BigEndian.Uint16(data) != NXAST_CONJUNCTION {
+		return ofp4sw.ActionConjunction{}, false
+	}
+	return ofp4sw.ActionConjunction{
+		Clause:   data[2],
+		NClauses: data[3],
+		Id:       binary.BigEndian.Uint32(data[4:]),
+	}, true
+}
+
+// nxPort converts 16 bit OF1.0 port number into 32 bit.
+func nxPort(port uint32) uint32 {
+	if port >= 0xff00 && port <= 0xffff {
+		return port | 0xffff0000
+	}
+	return port
+}
+
+func nxOfsNbits(ofsNbits uint16) (int, int) {
+	return int(ofsNbits >> 6), int(ofsNbits&0x3f) + 1
+}
+
+// bit 0 is the least significant bit of network byte order value.
+func nxBit(value []byte, i int) bool {
+	return value[len(value)-1-i/8]&(1<<uint(i%8)) != 0
+}
+
+func nxSetBit(value []byte, i int) {
+	value[len(value)-1-i/8] |= 1 << uint(i%8)
+}
+
+func nxGetBits(value []byte, ofs, nBits int) uint64 {
+	var ret uint64
+	for i := nBits - 1; i >= 0; i-- {
+		ret <<= 1
+		if nxBit(value, ofs+i) {
+			ret |= 1
+		}
+	}
+	return ret
+}
+
+// nxLoad copies nBits from src at srcOfs into the field at ofs, keeping other bits of the field.
+func nxLoad(frame *ofp4sw.Frame, field uint32, ofs, nBits int, src []byte, srcOfs int) error {
+	current, err := frame.GetField(field)
+	if err != nil {
+		return err
+	}
+	if ofs+nBits > len(current)*8 || srcOfs+nBits > len(src)*8 {
+		return ofp4.MakeErrorMsg(ofp4.OFPET_BAD_ACTION, ofp4.OFPBAC_BAD_SET_ARGUMENT)
+	}
+	value := make([]byte, len(current))
+	mask := make([]byte, len(current))
+	for i := 0; i < nBits; i++ {
+		if nxBit(src, srcOfs+i) {
+			nxSetBit(value, ofs+i)
+		}
+		nxSetBit(mask, ofs+i)
+	}
+	return frame.SetField(field, value, mask)
+}
+
+// nxHashFields calculates the hash of the flow for NXAST_MULTIPATH.
+// Absent fields are skipped. Symmetric fields are combined so that
+// both directions of the flow have the same hash.
+func nxHashFields(frame *ofp4sw.Frame, fields uint16, basis uint16) (uint32, error) {
+	hasher := fnv.New32a()
+	buf := make([]byte, 2)
+	binary.BigEndian.PutUint16(buf, basis)
+	hasher.Write(buf)
+
+	single := func(field uint32) {
+		if value, err := frame.GetField(field); err == nil {
+			hasher.Write(value)
+		}
+	}
+	pair := func(a, b uint32) {
+		x, err := frame.GetField(a)
+		if err != nil {
+			return
+		}
+		y, err := frame.GetField(b)
+		if err != nil || len(x) != len(y) {
+			return
+		}
+		v := make([]byte, len(x))
+		for i, _ := range v {
+			v[i] = x[i] ^ y[i]
+		}
+		hasher.Write(v)
+	}
+	l3l4 := func(udp bool) {
+		pair(oxm.OXM_OF_IPV4_SRC, oxm.OXM_OF_IPV4_DST)
+		pair(oxm.OXM_OF_IPV6_SRC, oxm.OXM_OF_IPV6_DST)
+		single(oxm.OXM_OF_IP_PROTO)
+		pair(oxm.OXM_OF_TCP_SRC, oxm.OXM_OF_TCP_DST)
+		pair(oxm.OXM_OF_SCTP_SRC, oxm.OXM_OF_SCTP_DST)
+		if udp {
+			pair(oxm.OXM_OF_UDP_SRC, oxm.OXM_OF_UDP_DST)
+		}
+	}
+	switch fields {
+	default:
+		return 0, ofp4.MakeErrorMsg(ofp4.OFPET_BAD_ACTION, ofp4.OFPBAC_BAD_ARGUMENT)
+	case NX_HASH_FIELDS_ETH_SRC:
+		single(oxm.OXM_OF_ETH_SRC)
+	case NX_HASH_FIELDS_SYMMETRIC_L4:
+		pair(oxm.OXM_OF_ETH_SRC, oxm.OXM_OF_ETH_DST)
+		single(oxm.OXM_OF_ETH_TYPE)
+		single(oxm.OXM_OF_VLAN_VID)
+		l3l4(true)
+	case NX_HASH_FIELDS_SYMMETRIC_L3L4:
+		l3l4(false)
+	case NX_HASH_FIELDS_SYMMETRIC_L3L4_UDP:
+		l3l4(true)
+	case NX_HASH_FIELDS_NW_SRC:
+		single(oxm.OXM_OF_IPV4_SRC)
+		single(oxm.OXM_OF_IPV6_SRC)
+	case NX_HASH_FIELDS_NW_DST:
+		single(oxm.OXM_OF_IPV4_DST)
+		single(oxm.OXM_OF_IPV6_DST)
+	}
+	return nxMix(hasher.Sum32()), nil
+}
+
+// nxMix spreads fnv hash into higher bits, which hash_threshold uses.
+func nxMix(h uint32) uint32 {
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
+
+func nxHashInt(hash, i uint32) uint32 {
+	hasher := fnv.New32a()
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint32(buf, hash)
+	binary.BigEndian.PutUint32(buf[4:], i)
+	hasher.Write(buf)
+	return nxMix(hasher.Sum32())
+}
+
+// nxMultipath chooses the link in 0 to nLinks-1.
+func nxMultipath(hash uint32, algorithm uint16, nLinks uint32, arg uint32) (uint32, error) {
+	switch algorithm {
+	case NX_MP_ALG_MODULO_N:
+		return hash % nLinks, nil
+	case NX_MP_ALG_HASH_THRESHOLD:
+		return hash / (0xffffffff/nLinks + 1), nil
+	case NX_MP_ALG_HRW:
+		var link, best uint32
+		for i := uint32(0); i < nLinks; i++ {
+			if h := nxHashInt(hash, i); i == 0 || h > best {
+				link = i
+				best = h
+			}
+		}
+		return link, nil
+	case NX_MP_ALG_ITER_HASH:
+		mask := uint32(0)
+		for mask < nLinks-1 {
+			mask = mask<<1 | 1
+		}
+		link := hash & mask
+		for i := uint32(1); link >= nLinks; i++ {
+			if i > arg {
+				return hash % nLinks, nil
+			}
+			hash = nxHashInt(hash, i)
+			link = hash & mask
+		}
+		return link, nil
+	}
+	return 0, fmt.Errorf("unknown multipath algorithm %d", algorithm)
+}
@@ -0,0 +1,226 @@
+package ofp4ext
+
+import (
+	"encoding/binary"
+	"github.com/hkwi/gopenflow/ofp4"
+	"github.com/hkwi/gopenflow/ofp4sw"
+	"github.com/hkwi/gopenflow/oxm"
+	"net"
+)
+
+// flags for NXAST_CT
+const (
+	NX_CT_F_COMMIT = 1 << 0
+	NX_CT_F_FORCE  = 1 << 1
+)
+
+// flags for NXAST_NAT
+const (
+	NX_NAT_F_SRC          = 1 << 0
+	NX_NAT_F_DST          = 1 << 1
+	NX_NAT_F_PERSISTENT   = 1 << 2
+	NX_NAT_F_PROTO_HASH   = 1 << 3
+	NX_NAT_F_PROTO_RANDOM = 1 << 4
+)
+
+// range_present bits for NXAST_NAT
+const (
+	NX_NAT_RANGE_IPV4_MIN  = 1 << 0
+	NX_NAT_RANGE_IPV4_MAX  = 1 << 1
+	NX_NAT_RANGE_IPV6_MIN  = 1 << 2
+	NX_NAT_RANGE_IPV6_MAX  = 1 << 3
+	NX_NAT_RANGE_PROTO_MIN = 1 << 4
+	NX_NAT_RANGE_PROTO_MAX = 1 << 5
+)
+
+const nxCtHeaderLength = 16 // from subtype to nested actions
+const nxNatHeaderLength = 8 // from subtype to ranges
+
+// nxConntrack builds the conntrack request of NXAST_CT.
+// Nested actions may set ct_mark and ct_label with commit flag, and NXAST_NAT
+// may translate the connection.
+// Application layer gateways are not supported.
+func nxConntrack(frame *ofp4sw.Frame, data []byte) (ofp4sw.ActionConntrack, error) {
+	badLen := ofp4.MakeErrorMsg(ofp4.OFPET_BAD_ACTION, ofp4.OFPBAC_BAD_LEN)
+	badArgument := ofp4.MakeErrorMsg(ofp4.OFPET_BAD_ACTION, ofp4.OFPBAC_BAD_ARGUMENT)
+	if len(data) < nxCtHeaderLength {
+		return ofp4sw.ActionConntrack{}, badLen
+	}
+	flags := binary.BigEndian.Uint16(data[2:])
+	ret := ofp4sw.ActionConntrack{
+		Commit: flags&NX_CT_F_COMMIT != 0,
+		Force:  flags&NX_CT_F_FORCE != 0,
+		Table:  data[10],
+	}
+	if ret.Force && !ret.Commit {
+		return ofp4sw.ActionConntrack{}, badArgument
+	}
+	if binary.BigEndian.Uint16(data[14:]) != 0 {
+		return ofp4sw.ActionConntrack{}, badArgument
+	}
+	if zoneSrc := binary.BigEndian.Uint32(data[4:]); zoneSrc == 0 {
+		ret.Zone = binary.BigEndian.Uint16(data[8:])
+	} else {
+		ofs, nBits := nxOfsNbits(binary.BigEndian.Uint16(data[8:]))
+		src, err := frame.GetField(zoneSrc)
+		if err != nil {
+			return ofp4sw.ActionConntrack{}, err
+		}
+		if nBits > 16 || ofs+nBits > len(src)*8 {
+			return ofp4sw.ActionConntrack{}, badArgument
+		}
+		ret.Zone = uint16(nxGetBits(src, ofs, nBits))
+	}
+
+	actions := data[nxCtHeaderLength:]
+	for len(actions) >= 4 {
+		length := int(binary.BigEndian.Uint16(actions[2:]))
+		if length < 4 || length > len(actions) {
+			return ofp4sw.ActionConntrack{}, badLen
+		}
+		act := actions[:length]
+		actions = actions[length:]
+		if binary.BigEndian.Uint16(act) == ofp4.OFPAT_EXPERIMENTER {
+			if len(act) < 10 {
+				return ofp4sw.ActionConntrack{}, badLen
+			}
+			if binary.BigEndian.Uint32(act[4:]) != NX_EXPERIMENTER_ID ||
+				binary.BigEndian.Uint16(act[8:]) != NXAST_NAT || ret.Nat != nil {
+				return ofp4sw.ActionConntrack{}, badArgument
+			}
+			if nat, err := nxNat(act[8:]); err != nil {
+				return ofp4sw.ActionConntrack{}, err
+			} else if (nat.Src || nat.Dst) && !ret.Commit {
+				return ofp4sw.ActionConntrack{}, badArgument
+			} else {
+				ret.Nat = &nat
+			}
+			continue
+		}
+		if binary.BigEndian.Uint16(act) != ofp4.OFPAT_SET_FIELD || !ret.Commit {
+			return ofp4sw.ActionConntrack{}, badArgument
+		}
+		if len(act) < 8 {
+			return ofp4sw.ActionConntrack{}, badLen
+		}
+		hdr := oxm.Header(binary.BigEndian.Uint32(act[4:]))
+		if 8+hdr.Length() > len(act) {
+			return ofp4sw.ActionConntrack{}, badLen
+		}
+		payload := act[8 : 8+hdr.Length()]
+		switch hdr.Type() {
+		case oxm.NXM_NX_CT_MARK:
+			switch {
+			case !hdr.HasMask() && len(payload) == 4:
+				ret.Mark = binary.BigEndian.Uint32(payload)
+				ret.MarkMask = 0xffffffff
+			case hdr.HasMask() && len(payload) == 8:
+				ret.MarkMask = binary.BigEndian.Uint32(payload[4:])
+				ret.Mark = binary.BigEndian.Uint32(payload) & ret.MarkMask
+			default:
+				return ofp4sw.ActionConntrack{}, badLen
+			}
+		case oxm.NXM_NX_CT_LABEL:
+			switch {
+			case !hdr.HasMask() && len(payload) == 16:
+				copy(ret.Label[:], payload)
+				for i, _ := range ret.LabelMask {
+					ret.LabelMask[i] = 0xff
+				}
+			case hdr.HasMask() && len(payload) == 32:
+				copy(ret.LabelMask[:], payload[16:])
+				for i, m := range ret.LabelMask {
+					ret.Label[i] = payload[i] & m
+				}
+			default:
+				return ofp4sw.ActionConntrack{}, badLen
+			}
+		default:
+			return ofp4sw.ActionConntrack{}, badArgument
+		}
+	}
+	return ret, nil
+}
+
+// nxNat parses NXAST_NAT from the subtype.
+func nxNat(data []byte) (ofp4sw.ConntrackNat, error) {
+	badLen := ofp4.MakeErrorMsg(ofp4.OFPET_BAD_ACTION, ofp4.OFPBAC_BAD_LEN)
+	badArgument := ofp4.MakeErrorMsg(ofp4.OFPET_BAD_ACTION, ofp4.OFPBAC_BAD_ARGUMENT)
+	if len(data) < nxNatHeaderLength {
+		return ofp4sw.ConntrackNat{}, badLen
+	}
+	flags := binary.BigEndian.Uint16(data[4:])
+	present := binary.BigEndian.Uint16(data[6:])
+	ret := ofp4sw.ConntrackNat{
+		Src:        flags&NX_NAT_F_SRC != 0,
+		Dst:        flags&NX_NAT_F_DST != 0,
+		Persistent: flags&NX_NAT_F_PERSISTENT != 0,
+		Random:     flags&NX_NAT_F_PROTO_RANDOM != 0,
+	}
+	if ret.Src && ret.Dst {
+		return ofp4sw.ConntrackNat{}, badArgument
+	}
+	if flags&(NX_NAT_F_PROTO_HASH|NX_NAT_F_PROTO_RANDOM) == NX_NAT_F_PROTO_HASH|NX_NAT_F_PROTO_RANDOM {
+		return ofp4sw.ConntrackNat{}, badArgument
+	}
+	if present != 0 && !ret.Src && !ret.Dst {
+		return ofp4sw.ConntrackNat{}, badArgument
+	}
+
+	ranges := data[nxNatHeaderLength:]
+	field := func(bit uint16, length int) []byte {
+		if present&bit == 0 || len(ranges) < length {
+			return nil
+		}
+		value := ranges[:length]
+		ranges = ranges[length:]
+		return value
+	}
+	ipv4Min := field(NX_NAT_RANGE_IPV4_MIN, 4)
+	ipv4Max := field(NX_NAT_RANGE_IPV4_MAX, 4)
+	ipv6Min := field(NX_NAT_RANGE_IPV6_MIN, 16)
+	ipv6Max := field(NX_NAT_RANGE_IPV6_MAX, 16)
+	protoMin := field(NX_NAT_RANGE_PROTO_MIN, 2)
+	protoMax := field(NX_NAT_RANGE_PROTO_MAX, 2)
+	for _, f := range []struct {
+		bit   uint16
+		value []byte
+	}{
+		{NX_NAT_RANGE_IPV4_MIN, ipv4Min},
+		{NX_NAT_RANGE_IPV4_MAX, ipv4Max},
+		{NX_NAT_RANGE_IPV6_MIN, ipv6Min},
+		{NX_NAT_RANGE_IPV6_MAX, ipv6Max},
+		{NX_NAT_RANGE_PROTO_MIN, protoMin},
+		{NX_NAT_RANGE_PROTO_MAX, protoMax},
+	} {
+		if present&f.bit != 0 && f.value == nil {
+			return ofp4sw.ConntrackNat{}, badLen
+		}
+	}
+
+	switch {
+	case ipv4Min != nil && ipv6Min != nil:
+		return ofp4sw.ConntrackNat{}, badArgument
+	case ipv4Min != nil:
+		ret.AddrMin = net.IP(append([]byte{}, ipv4Min...))
+		if ipv4Max != nil {
+			ret.AddrMax = net.IP(append([]byte{}, ipv4Max...))
+		}
+	case ipv6Min != nil:
+		ret.AddrMin = net.IP(append([]byte{}, ipv6Min...))
+		if ipv6Max != nil {
+			ret.AddrMax = net.IP(append([]byte{}, ipv6Max...))
+		}
+	case ipv4Max != nil || ipv6Max != nil:
+		return ofp4sw.ConntrackNat{}, badArgument
+	}
+	if protoMin != nil {
+		ret.PortMin = binary.BigEndian.Uint16(protoMin)
+		if protoMax != nil {
+			ret.PortMax = binary.BigEndian.Uint16(protoMax)
+		}
+	} else if protoMax != nil {
+		return ofp4sw.ConntrackNat{}, badArgument
+	}
+	return ret, nil
+}
@@ -0,0 +1,205 @@
+package ofp4ext
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/hkwi/gopenflow/ofp4"
+	"github.com/hkwi/gopenflow/ofp4sw"
+	"github.com/hkwi/gopenflow/oxm"
+)
+
+// flags for NXAST_LEARN
+const (
+	NX_LEARN_F_SEND_FLOW_REM  = 1 << 0
+	NX_LEARN_F_DELETE_LEARNED = 1 << 1
+)
+
+// flow_mod_spec header for NXAST_LEARN
+const (
+	NX_LEARN_N_BITS_MASK   = 0x3ff
+	NX_LEARN_SRC_FIELD     = 0 << 13
+	NX_LEARN_SRC_IMMEDIATE = 1 << 13
+	NX_LEARN_SRC_MASK      = 1 << 13
+	NX_LEARN_DST_MATCH     = 0 << 11
+	NX_LEARN_DST_LOAD      = 1 << 11
+	NX_LEARN_DST_OUTPUT    = 2 << 11
+	NX_LEARN_DST_MASK      = 3 << 11
+)
+
+const nxLearnHeaderLength = 24 // from subtype to flow_mod_specs
+
+type nxLearnMatch struct {
+	field uint32
+	value []byte
+	mask  []byte
+}
+
+// nxLearn builds the flow_mod of NXAST_LEARN from the current frame.
+// NX_LEARN_F_DELETE_LEARNED is not supported, and ignored.
+func nxLearn(frame *ofp4sw.Frame, data []byte) (ofp4sw.ActionFlowMod, error) {
+	badLen := ofp4.MakeErrorMsg(ofp4.OFPET_BAD_ACTION, ofp4.OFPBAC_BAD_LEN)
+	badArgument := ofp4.MakeErrorMsg(ofp4.OFPET_BAD_ACTION, ofp4.OFPBAC_BAD_ARGUMENT)
+	if len(data) < nxLearnHeaderLength {
+		return ofp4sw.ActionFlowMod{}, badLen
+	}
+	if data[18] == ofp4.OFPTT_ALL {
+		return ofp4sw.ActionFlowMod{}, badArgument
+	}
+
+	var matches []*nxLearnMatch
+	var actions []byte
+	specs := data[nxLearnHeaderLength:]
+	for len(specs) >= 2 {
+		hdr := binary.BigEndian.Uint16(specs)
+		if hdr == 0 {
+			break // padding
+		}
+		nBits := int(hdr & NX_LEARN_N_BITS_MASK)
+		specs = specs[2:]
+
+		var src []byte
+		var srcOfs int
+		if hdr&NX_LEARN_SRC_MASK == NX_LEARN_SRC_FIELD {
+			if len(specs) < 6 {
+				return ofp4sw.ActionFlowMod{}, badLen
+			}
+			if value, err := frame.GetField(binary.BigEndian.Uint32(specs)); err != nil {
+				return ofp4sw.ActionFlowMod{}, err
+			} else {
+				src = value
+			}
+			srcOfs = int(binary.BigEndian.Uint16(specs[4:]))
+			specs = specs[6:]
+		} else {
+			length := (nBits + 15) / 16 * 2
+			if len(specs) < length {
+				return ofp4sw.ActionFlowMod{}, badLen
+			}
+			src = specs[:length]
+			specs = specs[length:]
+		}
+		if srcOfs+nBits > len(src)*8 {
+			return ofp4sw.ActionFlowMod{}, badArgument
+		}
+
+		switch hdr & NX_LEARN_DST_MASK {
+		case NX_LEARN_DST_MATCH, NX_LEARN_DST_LOAD:
+			if len(specs) < 6 {
+				return ofp4sw.ActionFlowMod{}, badLen
+			}
+			dst := oxm.Header(binary.BigEndian.Uint32(specs))
+			dstOfs := int(binary.BigEndian.Uint16(specs[4:]))
+			specs = specs[6:]
+
+			width := dst.Length()
+			if dst.HasMask() {
+				width /= 2
+			}
+			if dstOfs+nBits > width*8 {
+				return ofp4sw.ActionFlowMod{}, badArgument
+			}
+			value := make([]byte, width)
+			mask := make([]byte, width)
+			for i := 0; i < nBits; i++ {
+				if nxBit(src, srcOfs+i) {
+					nxSetBit(value, dstOfs+i)
+				}
+				nxSetBit(mask, dstOfs+i)
+			}
+
+			if hdr&NX_LEARN_DST_MASK == NX_LEARN_DST_MATCH {
+				var m *nxLearnMatch
+				for _, c := range matches {
+					if c.field == dst.Type() {
+						m = c
+					}
+				}
+				if m == nil {
+					m = &nxLearnMatch{
+						field: dst.Type(),
+						value: make([]byte, width),
+						mask:  make([]byte, width),
+					}
+					matches = append(matches, m)
+				} else if len(m.value) != width {
+					return ofp4sw.ActionFlowMod{}, badArgument
+				}
+				for i, _ := range value {
+					m.value[i] = m.value[i]&^mask[i] | value[i]
+					m.mask[i] |= mask[i]
+				}
+			} else if nBits <= 64 {
+				load := make([]byte, 24)
+				binary.BigEndian.PutUint16(load, ofp4.OFPAT_EXPERIMENTER)
+				binary.BigEndian.PutUint16(load[2:], 24)
+				binary.BigEndian.PutUint32(load[4:], NX_EXPERIMENTER_ID)
+				binary.BigEndian.PutUint16(load[8:], NXAST_REG_LOAD)
+				binary.BigEndian.PutUint16(load[10:], uint16(dstOfs<<6|(nBits-1)))
+				binary.BigEndian.PutUint32(load[12:], uint32(dst.Type())|uint32(width))
+				binary.BigEndian.PutUint64(load[16:], nxGetBits(src, srcOfs, nBits))
+				actions = append(actions, load...)
+			} else if nBits == width*8 {
+				field := make([]byte, 4+width)
+				binary.BigEndian.PutUint32(field, uint32(dst.Type())|uint32(width))
+				copy(field[4:], value)
+				actions = append(actions, ofp4.MakeActionSetField(field)...)
+			} else {
+				return ofp4sw.ActionFlowMod{}, badArgument
+			}
+		case NX_LEARN_DST_OUTPUT:
+			if hdr&NX_LEARN_SRC_MASK != NX_LEARN_SRC_FIELD || nBits > 32 {
+				return ofp4sw.ActionFlowMod{}, badArgument
+			}
+			port := uint32(nxGetBits(src, srcOfs, nBits))
+			if nBits <= 16 {
+				port = nxPort(port)
+			}
+			actions = append(actions, ofp4.MakeActionOutput(port, ofp4.OFPCML_NO_BUFFER)...)
+		default:
+			return ofp4sw.ActionFlowMod{}, badArgument
+		}
+	}
+
+	var fields []byte
+	for _, m := range matches {
+		hdr := oxm.Header(m.field)
+		if bytes.Equal(m.mask, bytes.Repeat([]byte{0xff}, len(m.mask))) {
+			hdr.SetLength(len(m.value))
+			buf := make([]byte, 4)
+			binary.BigEndian.PutUint32(buf, uint32(hdr))
+			fields = append(append(fields, buf...), m.value...)
+		} else {
+			hdr.SetMask(true)
+			hdr.SetLength(len(m.value) * 2)
+			buf := make([]byte, 4)
+			binary.BigEndian.PutUint32(buf, uint32(hdr))
+			fields = append(append(append(fields, buf...), m.value...), m.mask...)
+		}
+	}
+	var instructions []byte
+	if len(actions) > 0 {
+		instructions = ofp4.MakeInstructionActions(ofp4.OFPIT_APPLY_ACTIONS, actions)
+	}
+	var flags uint16
+	if binary.BigEndian.Uint16(data[16:])&NX_LEARN_F_SEND_FLOW_REM != 0 {
+		flags |= ofp4.OFPFF_SEND_FLOW_REM
+	}
+	return ofp4sw.ActionFlowMod{
+		FlowMod: ofp4.MakeFlowMod(
+			binary.BigEndian.Uint64(data[8:]),
+			0,
+			data[18],
+			ofp4.OFPFC_ADD,
+			binary.BigEndian.Uint16(data[2:]),
+			binary.BigEndian.Uint16(data[4:]),
+			binary.BigEndian.Uint16(data[6:]),
+			ofp4.OFP_NO_BUFFER,
+			ofp4.OFPP_ANY,
+			ofp4.OFPG_ANY,
+			flags,
+			ofp4.MakeMatch(fields),
+			instructions),
+		FinIdleTimeout: binary.BigEndian.Uint16(data[20:]),
+		FinHardTimeout: binary.BigEndian.Uint16(data[22:]),
+	}, nil
+}
@@ -0,0 +1,398 @@
+package ofp4ext
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/hkwi/gopenflow/ofp4"
+	"github.com/hkwi/gopenflow/ofp4sw"
+	"github.com/hkwi/gopenflow/oxm"
+	"net"
+	"testing"
+)
+
+func nxTestFrame(t *testing.T, src, dst net.IP, srcPort, dstPort layers.TCPPort) *ofp4sw.Frame {
+	buf := gopacket.NewSerializeBuffer()
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    src,
+		DstIP:    dst,
+	}
+	tcp := &layers.TCP{
+		SrcPort: srcPort,
+		DstPort: dstPort,
+	}
+	tcp.SetNetworkLayerForChecksum(ip)
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true},
+		&layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{2, 0, 0, 0, 0, 1},
+			DstMAC:       net.HardwareAddr{2, 0, 0, 0, 0, 2},
+			EthernetType: layers.EthernetTypeIPv4,
+		}, ip, tcp); err != nil {
+		t.Fatal(err)
+	}
+	fr := &ofp4sw.Frame{}
+	fr.SetSerialized(buf.Bytes())
+	return fr
+}
+
+func nxHeader(field uint32, length int) uint32 {
+	return field | uint32(length)
+}
+
+func TestNxRegLoadMove(t *testing.T) {
+	fr := nxTestFrame(t, net.IP{192, 0, 2, 1}, net.IP{192, 0, 2, 2}, 1024, 80)
+	nx := NxAction{}
+
+	load := make([]byte, 16)
+	binary.BigEndian.PutUint16(load, NXAST_REG_LOAD)
+	binary.BigEndian.PutUint16(load[2:], 8<<6|15) // reg0[8..23]
+	binary.BigEndian.PutUint32(load[4:], nxHeader(oxm.NXM_NX_REG0, 4))
+	binary.BigEndian.PutUint64(load[8:], 0xabcd)
+	if err := nx.Execute(fr, load); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := fr.GetField(oxm.NXM_NX_REG0); err != nil || !bytes.Equal(v, []byte{0, 0xab, 0xcd, 0}) {
+		t.Errorf("reg_load failed %v %v", v, err)
+	}
+
+	move := make([]byte, 16)
+	binary.BigEndian.PutUint16(move, NXAST_REG_MOVE)
+	binary.BigEndian.PutUint16(move[2:], 16)
+	binary.BigEndian.PutUint16(move[4:], 0)
+	binary.BigEndian.PutUint16(move[6:], 16)
+	binary.BigEndian.PutUint32(move[8:], nxHeader(oxm.NXM_OF_TCP_DST, 2))
+	binary.BigEndian.PutUint32(move[12:], nxHeader(oxm.NXM_NX_REG0, 4))
+	if err := nx.Execute(fr, move); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := fr.GetField(oxm.NXM_NX_REG0); err != nil || !bytes.Equal(v, []byte{0, 80, 0xcd, 0}) {
+		t.Errorf("reg_move failed %v %v", v, err)
+	}
+
+	// out of the field
+	binary.BigEndian.PutUint16(load[2:], 24<<6|15)
+	if err := nx.Execute(fr, load); err == nil {
+		t.Error("reg_load beyond the field must fail")
+	}
+}
+
+func TestNxOutputResubmit(t *testing.T) {
+	fr := nxTestFrame(t, net.IP{192, 0, 2, 1}, net.IP{192, 0, 2, 2}, 1024, 80)
+	nx := NxAction{}
+
+	load := make([]byte, 16)
+	binary.BigEndian.PutUint16(load, NXAST_REG_LOAD)
+	binary.BigEndian.PutUint16(load[2:], 15)
+	binary.BigEndian.PutUint32(load[4:], nxHeader(oxm.NXM_NX_REG1, 4))
+	binary.BigEndian.PutUint64(load[8:], 3)
+	if err := nx.Execute(fr, load); err != nil {
+		t.Fatal(err)
+	}
+
+	output := make([]byte, 16)
+	binary.BigEndian.PutUint16(output, NXAST_OUTPUT_REG)
+	binary.BigEndian.PutUint16(output[2:], 15)
+	binary.BigEndian.PutUint32(output[4:], nxHeader(oxm.NXM_NX_REG1, 4))
+	binary.BigEndian.PutUint16(output[8:], 128)
+	if err := nx.Execute(fr, output); err != (ofp4sw.ActionOutput{Port: 3, MaxLen: 128}) {
+		t.Errorf("output_reg failed %v", err)
+	}
+
+	resubmit := make([]byte, 8)
+	binary.BigEndian.PutUint16(resubmit, NXAST_RESUBMIT_TABLE)
+	binary.BigEndian.PutUint16(resubmit[2:], 0xfff8)
+	resubmit[4] = 3
+	if err := nx.Execute(fr, resubmit); err != (ofp4sw.ActionResubmit{InPort: ofp4.OFPP_IN_PORT, TableId: 3}) {
+		t.Errorf("resubmit failed %v", err)
+	}
+	binary.BigEndian.PutUint16(resubmit, NXAST_RESUBMIT)
+	binary.BigEndian.PutUint16(resubmit[2:], 5)
+	if err := nx.Execute(fr, resubmit); err != (ofp4sw.ActionResubmit{InPort: 5, TableId: ofp4.OFPTT_ALL}) {
+		t.Errorf("resubmit failed %v", err)
+	}
+
+	note := []byte{0, NXAST_NOTE, 1, 2, 3, 4, 5, 6}
+	if err := nx.Execute(fr, note); err != nil {
+		t.Errorf("note failed %v", err)
+	}
+	if err := nx.Execute(fr, []byte{0, 0xfe}); err == nil {
+		t.Error("unknown subtype must fail")
+	}
+}
+
+func TestNxMultipath(t *testing.T) {
+	nx := NxAction{}
+	multipath := func(fr *ofp4sw.Frame, algorithm uint16) uint32 {
+		data := make([]byte, 24)
+		binary.BigEndian.PutUint16(data, NXAST_MULTIPATH)
+		binary.BigEndian.PutUint16(data[2:], NX_HASH_FIELDS_SYMMETRIC_L4)
+		binary.BigEndian.PutUint16(data[4:], 50)
+		binary.BigEndian.PutUint16(data[8:], algorithm)
+		binary.BigEndian.PutUint16(data[10:], 2) // 3 links
+		binary.BigEndian.PutUint32(data[12:], 8)
+		binary.BigEndian.PutUint16(data[18:], 4<<6|15)
+		binary.BigEndian.PutUint32(data[20:], nxHeader(oxm.NXM_NX_REG2, 4))
+		if err := nx.Execute(fr, data); err != nil {
+			t.Fatal(err)
+		}
+		v, err := fr.GetField(oxm.NXM_NX_REG2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return binary.BigEndian.Uint32(v)
+	}
+	for _, algorithm := range []uint16{NX_MP_ALG_MODULO_N, NX_MP_ALG_HASH_THRESHOLD, NX_MP_ALG_HRW, NX_MP_ALG_ITER_HASH} {
+		links := make(map[uint32]bool)
+		for port := layers.TCPPort(1024); port < 1088; port++ {
+			forward := multipath(nxTestFrame(t, net.IP{192, 0, 2, 1}, net.IP{192, 0, 2, 2}, port, 80), algorithm)
+			reverse := multipath(nxTestFrame(t, net.IP{192, 0, 2, 2}, net.IP{192, 0, 2, 1}, 80, port), algorithm)
+			if forward != reverse {
+				t.Errorf("algorithm %d not symmetric %d %d", algorithm, forward, reverse)
+			}
+			if forward&0xf != 0 || forward>>4 > 2 {
+				t.Errorf("algorithm %d link out of range %x", algorithm, forward)
+			}
+			links[forward>>4] = true
+		}
+		if len(links) != 3 {
+			t.Errorf("algorithm %d links not distributed %v", algorithm, links)
+		}
+	}
+}
+
+func TestNxLearn(t *testing.T) {
+	fr := nxTestFrame(t, net.IP{192, 0, 2, 1}, net.IP{192, 0, 2, 2}, 1024, 80)
+	if err := fr.SetField(oxm.NXM_OF_IN_PORT, []byte{0, 3}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// learn(table=2,idle_timeout=30,fin_idle_timeout=5,priority=100,
+	//   NXM_OF_ETH_DST[]=NXM_OF_ETH_SRC[],eth_type=0x0800,
+	//   load:0x1->NXM_NX_REG0[4],output:NXM_OF_IN_PORT[])
+	learn := make([]byte, 24)
+	binary.BigEndian.PutUint16(learn, NXAST_LEARN)
+	binary.BigEndian.PutUint16(learn[2:], 30)
+	binary.BigEndian.PutUint16(learn[6:], 100)
+	binary.BigEndian.PutUint64(learn[8:], 0xcafe)
+	binary.BigEndian.PutUint16(learn[16:], NX_LEARN_F_SEND_FLOW_REM)
+	learn[18] = 2
+	binary.BigEndian.PutUint16(learn[20:], 5)
+	spec := func(hdr uint16) {
+		buf := make([]byte, 2)
+		binary.BigEndian.PutUint16(buf, hdr)
+		learn = append(learn, buf...)
+	}
+	field := func(hdr uint32, ofs uint16) {
+		buf := make([]byte, 6)
+		binary.BigEndian.PutUint32(buf, hdr)
+		binary.BigEndian.PutUint16(buf[4:], ofs)
+		learn = append(learn, buf...)
+	}
+	spec(NX_LEARN_SRC_FIELD | NX_LEARN_DST_MATCH | 48)
+	field(nxHeader(oxm.NXM_OF_ETH_SRC, 6), 0)
+	field(nxHeader(oxm.NXM_OF_ETH_DST, 6), 0)
+	spec(NX_LEARN_SRC_IMMEDIATE | NX_LEARN_DST_MATCH | 16)
+	learn = append(learn, 0x08, 0x00)
+	field(nxHeader(oxm.NXM_OF_ETH_TYPE, 2), 0)
+	spec(NX_LEARN_SRC_IMMEDIATE | NX_LEARN_DST_LOAD | 1)
+	learn = append(learn, 0, 1)
+	field(nxHeader(oxm.NXM_NX_REG0, 4), 4)
+	spec(NX_LEARN_SRC_FIELD | NX_LEARN_DST_OUTPUT | 16)
+	field(nxHeader(oxm.NXM_OF_IN_PORT, 2), 0)
+
+	var mod ofp4sw.ActionFlowMod
+	if err := (NxAction{}).Execute(fr, learn); err == nil {
+		t.Fatal("learn must return ActionFlowMod")
+	} else if m, ok := err.(ofp4sw.ActionFlowMod); !ok {
+		t.Fatal(err)
+	} else {
+		mod = m
+	}
+	req := mod.FlowMod
+	if req.TableId() != 2 || req.IdleTimeout() != 30 || req.Priority() != 100 || req.Cookie() != 0xcafe ||
+		req.Command() != ofp4.OFPFC_ADD || req.Flags() != ofp4.OFPFF_SEND_FLOW_REM || mod.FinIdleTimeout != 5 {
+		t.Errorf("unexpected flow_mod header %v", req)
+	}
+
+	var fields []byte
+	fields = append(fields, 0, 0, 2, 6, 2, 0, 0, 0, 0, 1) // NXM_OF_ETH_DST
+	fields = append(fields, 0, 0, 6, 2, 8, 0)             // NXM_OF_ETH_TYPE
+	if !bytes.Equal(req.Match().OxmFields(), fields) {
+		t.Errorf("unexpected match %v", req.Match().OxmFields())
+	}
+
+	var actions []byte
+	load := make([]byte, 24)
+	binary.BigEndian.PutUint16(load, ofp4.OFPAT_EXPERIMENTER)
+	binary.BigEndian.PutUint16(load[2:], 24)
+	binary.BigEndian.PutUint32(load[4:], NX_EXPERIMENTER_ID)
+	binary.BigEndian.PutUint16(load[8:], NXAST_REG_LOAD)
+	binary.BigEndian.PutUint16(load[10:], 4<<6)
+	binary.BigEndian.PutUint32(load[12:], nxHeader(oxm.NXM_NX_REG0, 4))
+	binary.BigEndian.PutUint64(load[16:], 1)
+	actions = append(actions, load...)
+	actions = append(actions, ofp4.MakeActionOutput(3, ofp4.OFPCML_NO_BUFFER)...)
+	if !bytes.Equal(req.Instructions(), ofp4.MakeInstructionActions(ofp4.OFPIT_APPLY_ACTIONS, actions)) {
+		t.Errorf("unexpected instructions %v", req.Instructions())
+	}
+
+	// output from immediate is not allowed
+	bad := append([]byte{}, learn[:24]...)
+	bad = append(bad, 0x28, 0x10, 0, 1)
+	if err := (NxAction{}).Execute(fr, bad); err == nil {
+		t.Error("output from immediate must fail")
+	} else if _, ok := err.(ofp4sw.ActionFlowMod); ok {
+		t.Error("output from immediate must fail")
+	}
+}
+
+func TestNxConntrack(t *testing.T) {
+	fr := nxTestFrame(t, net.IP{192, 0, 2, 1}, net.IP{192, 0, 2, 2}, 1024, 80)
+	nx := NxAction{}
+
+	load := make([]byte, 16)
+	binary.BigEndian.PutUint16(load, NXAST_REG_LOAD)
+	binary.BigEndian.PutUint16(load[2:], 0<<6|15) // reg0[0..15]
+	binary.BigEndian.PutUint32(load[4:], nxHeader(oxm.NXM_NX_REG0, 4))
+	binary.BigEndian.PutUint64(load[8:], 0x1234)
+	if err := nx.Execute(fr, load); err != nil {
+		t.Fatal(err)
+	}
+
+	ct := make([]byte, 16)
+	binary.BigEndian.PutUint16(ct, NXAST_CT)
+	binary.BigEndian.PutUint16(ct[2:], NX_CT_F_COMMIT)
+	binary.BigEndian.PutUint32(ct[4:], nxHeader(oxm.NXM_NX_REG0, 4))
+	binary.BigEndian.PutUint16(ct[8:], 0<<6|15)
+	ct[10] = 3
+	mark := make([]byte, 8)
+	binary.BigEndian.PutUint32(mark, nxHeader(oxm.NXM_NX_CT_MARK, 4))
+	binary.BigEndian.PutUint32(mark[4:], 7)
+	ct = append(ct, ofp4.MakeActionSetField(mark)...)
+	label := make([]byte, 36)
+	hdr := oxm.Header(oxm.NXM_NX_CT_LABEL)
+	hdr.SetMask(true)
+	hdr.SetLength(32)
+	binary.BigEndian.PutUint32(label, uint32(hdr))
+	label[19] = 0xff
+	label[35] = 0x0f
+	ct = append(ct, ofp4.MakeActionSetField(label)...)
+
+	if err := nx.Execute(fr, ct); err == nil {
+		t.Fatal("no conntrack request")
+	} else if req, ok := err.(ofp4sw.ActionConntrack); !ok {
+		t.Fatal(err)
+	} else {
+		if req.Zone != 0x1234 || !req.Commit || req.Force || req.Table != 3 {
+			t.Errorf("unexpected request %v", req)
+		}
+		if req.Mark != 7 || req.MarkMask != 0xffffffff {
+			t.Errorf("unexpected mark %x/%x", req.Mark, req.MarkMask)
+		}
+		if req.Label[15] != 0x0f || req.LabelMask[15] != 0x0f || req.LabelMask[0] != 0 {
+			t.Errorf("unexpected label %x/%x", req.Label, req.LabelMask)
+		}
+	}
+
+	// nested actions require commit
+	binary.BigEndian.PutUint16(ct[2:], 0)
+	if err := nx.Execute(fr, ct); err == nil {
+		t.Error("set_field without commit accepted")
+	} else if _, ok := err.(ofp4sw.ActionConntrack); ok {
+		t.Error("set_field without commit accepted")
+	}
+}
+
+func TestNxConntrackNat(t *testing.T) {
+	fr := nxTestFrame(t, net.IP{192, 0, 2, 1}, net.IP{192, 0, 2, 2}, 1024, 80)
+	nx := NxAction{}
+
+	nat := make([]byte, 24)
+	binary.BigEndian.PutUint16(nat, ofp4.OFPAT_EXPERIMENTER)
+	binary.BigEndian.PutUint16(nat[2:], 24)
+	binary.BigEndian.PutUint32(nat[4:], NX_EXPERIMENTER_ID)
+	binary.BigEndian.PutUint16(nat[8:], NXAST_NAT)
+	binary.BigEndian.PutUint16(nat[12:], NX_NAT_F_SRC|NX_NAT_F_PERSISTENT)
+	binary.BigEndian.PutUint16(nat[14:], NX_NAT_RANGE_IPV4_MIN|NX_NAT_RANGE_PROTO_MIN|NX_NAT_RANGE_PROTO_MAX)
+	copy(nat[16:], []byte{203, 0, 113, 1})
+	binary.BigEndian.PutUint16(nat[20:], 4000)
+	binary.BigEndian.PutUint16(nat[22:], 4999)
+
+	ct := make([]byte, 16)
+	binary.BigEndian.PutUint16(ct, NXAST_CT)
+	binary.BigEndian.PutUint16(ct[2:], NX_CT_F_COMMIT)
+	ct[10] = 3
+	ct = append(ct, nat...)
+
+	if err := nx.Execute(fr, ct); err == nil {
+		t.Fatal("no conntrack request")
+	} else if req, ok := err.(ofp4sw.ActionConntrack); !ok {
+		t.Fatal(err)
+	} else if req.Nat == nil {
+		t.Error("nat not parsed")
+	} else {
+		n := *req.Nat
+		if !n.Src || n.Dst || !n.Persistent || n.Random {
+			t.Errorf("unexpected nat flags %v", n)
+		}
+		if !n.AddrMin.Equal(net.IP{203, 0, 113, 1}) || n.AddrMax != nil || n.PortMin != 4000 || n.PortMax != 4999 {
+			t.Errorf("unexpected nat range %v", n)
+		}
+	}
+
+	// translation requires commit
+	binary.BigEndian.PutUint16(ct[2:], 0)
+	if _, ok := nx.Execute(fr, ct).(ofp4sw.ActionConntrack); ok {
+		t.Error("nat without commit accepted")
+	}
+	// nat without arguments applies the existing translation
+	ct = append(ct[:16], nat[:16]...)
+	binary.BigEndian.PutUint16(ct[18:], 16)
+	binary.BigEndian.PutUint16(ct[28:], 0)
+	binary.BigEndian.PutUint16(ct[30:], 0)
+	if req, ok := nx.Execute(fr, ct).(ofp4sw.ActionConntrack); !ok || req.Nat == nil || req.Nat.Src {
+		t.Errorf("nat without arguments %v", req)
+	}
+}
+
+func TestNxConjunction(t *testing.T) {
+	nx := NxAction{}
+	conj := make([]byte, 8)
+	binary.BigEndian.PutUint16(conj, NXAST_CONJUNCTION)
+	conj[2], conj[3] = 1, 3
+	binary.BigEndian.PutUint32(conj[4:], 0x1234)
+	if c, ok := nx.Conjunction(conj); !ok || c.Id != 0x1234 || c.Clause != 1 || c.NClauses != 3 {
+		t.Errorf("unexpected conjunction %v", c)
+	}
+	if err := nx.Execute(nxTestFrame(t, net.IP{192, 0, 2, 1}, net.IP{192, 0, 2, 2}, 1024, 80), conj); err != nil {
+		t.Error(err)
+	}
+	binary.BigEndian.PutUint16(conj, NXAST_NOTE)
+	if _, ok := nx.Conjunction(conj); ok {
+		t.Error("note reported as conjunction")
+	}
+}
+
+func TestNxSample(t *testing.T) {
+	fr := nxTestFrame(t, net.IP{192, 0, 2, 1}, net.IP{192, 0, 2, 2}, 1024, 80)
+	nx := NxAction{}
+	sample := make([]byte, 16)
+	binary.BigEndian.PutUint16(sample, NXAST_SAMPLE)
+	binary.BigEndian.PutUint16(sample[2:], 0x8000)
+	binary.BigEndian.PutUint32(sample[4:], 5)
+	binary.BigEndian.PutUint32(sample[8:], 6)
+	binary.BigEndian.PutUint32(sample[12:], 7)
+	if req, ok := nx.Execute(fr, sample).(ofp4sw.ActionSample); !ok {
+		t.Error("no sample request")
+	} else if req.Probability != 0x8000 || req.CollectorSetId != 5 || req.ObsDomainId != 6 || req.ObsPointId != 7 {
+		t.Errorf("unexpected request %v", req)
+	}
+	binary.BigEndian.PutUint16(sample[2:], 0)
+	if _, ok := nx.Execute(fr, sample).(ofp4sw.ActionSample); ok {
+		t.Error("zero probability accepted")
+	}
+}
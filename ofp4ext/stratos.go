@@ -11,6 +11,8 @@ import (
 	bytes2 "github.com/hkwi/suppl/bytes"
 )
 
+const STRATOS_EXPERIMENTER_ID = oxm.STRATOS_EXPERIMENTER_ID
+
 type StratosOxm struct{}
 
 var _ = ofp4sw.OxmHandler(StratosOxm{})
@@ -531,3 +533,19 @@ func (self OxmKeyStratos) IsEmpty(payload ofp4sw.OxmPayload) bool {
 	}
 	return false
 }
+
+// StratosMeterBand is a MeterBandHandler which sets oxm fields in band data
+// when the band was triggered. Band data is a sequence of stratos oxm TLVs.
+type StratosMeterBand struct{}
+
+var _ = ofp4sw.MeterBandHandler(StratosMeterBand{})
+
+func (self StratosMeterBand) Execute(frame *ofp4sw.Frame, bandData []byte) error {
+	handler := StratosOxm{}
+	for key, payload := range handler.Parse(bandData) {
+		if err := handler.SetField(frame, key, payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
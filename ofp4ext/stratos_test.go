@@ -1,8 +1,11 @@
 package ofp4ext
 
 import (
+	"encoding/binary"
+	"github.com/hkwi/gopenflow/ofp4"
 	"github.com/hkwi/gopenflow/ofp4sw"
 	"github.com/hkwi/gopenflow/oxm"
+	"net"
 	"testing"
 )
 
@@ -55,3 +58,61 @@ func TestDot11(t *testing.T) {
 		t.Errorf("pkt two / match two")
 	}
 }
+
+func TestStratosMirror(t *testing.T) {
+	pipe := ofp4sw.NewPipeline()
+
+	req := make([]byte, 48, 64)
+	binary.BigEndian.PutUint16(req, STRATOS_MIRROR_SET)
+	binary.BigEndian.PutUint16(req[2:], 20)
+	binary.BigEndian.PutUint32(req[4:], 7)
+	binary.BigEndian.PutUint32(req[8:], 3)
+	binary.BigEndian.PutUint16(req[12:], 1)
+	binary.BigEndian.PutUint16(req[14:], 1)
+	binary.BigEndian.PutUint16(req[16:], 1)
+	binary.BigEndian.PutUint64(req[24:], 100)
+	copy(req[32:], net.ParseIP("192.0.2.1").To16())
+	if _, err := (StratosMirrorMod{}).ExecutePipeline(pipe, req); err == nil {
+		t.Error("short port list")
+	} else if e, ok := err.(ofp4.ErrorMsg); !ok || e.Code() != ofp4.OFPBRC_BAD_LEN {
+		t.Errorf("error %v", err)
+	}
+	req = append(req, 0, 0, 0, 1, 0, 0, 0, 2, 0, 10, 0, 0, 0, 0, 0, 0)
+	if reps, err := (StratosMirrorMod{}).ExecutePipeline(pipe, req); err != nil || len(reps) != 0 {
+		t.Fatalf("mirror mod %v %v", reps, err)
+	}
+
+	statsReq := []byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0}
+	if reps, err := (StratosMirrorStats{}).ExecutePipeline(pipe, statsReq); err != nil {
+		t.Error(err)
+	} else if len(reps) != 1 || len(reps[0]) != 32 || binary.BigEndian.Uint32(reps[0]) != 7 {
+		t.Errorf("mirror stats %v", reps)
+	}
+	if reps, err := (StratosMirrorStats{}).ExecutePipeline(pipe, []byte{0, 0, 0, 8, 0, 0, 0, 0}); err != nil || len(reps) != 1 || len(reps[0]) != 0 {
+		t.Errorf("unknown mirror stats %v %v", reps, err)
+	}
+
+	del := make([]byte, 48)
+	binary.BigEndian.PutUint16(del, STRATOS_MIRROR_DELETE)
+	binary.BigEndian.PutUint32(del[4:], 7)
+	if _, err := (StratosMirrorMod{}).ExecutePipeline(pipe, del); err != nil {
+		t.Error(err)
+	}
+	if _, err := (StratosMirrorMod{}).ExecutePipeline(pipe, del); err == nil {
+		t.Error("deleted twice")
+	}
+	if stats := pipe.MirrorStats(); len(stats) != 0 {
+		t.Errorf("mirrors left %v", stats)
+	}
+}
+
+func TestStratosMeterBand(t *testing.T) {
+	k := OxmKeyStratos(oxm.STROXM_BASIC_DOT11)
+	frame := &ofp4sw.Frame{Oob: make(map[ofp4sw.OxmKey]ofp4sw.OxmPayload)}
+	if err := (StratosMeterBand{}).Execute(frame, k.Bytes(ofp4sw.OxmValueMask{Value: []byte{1}})); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := frame.Oob[k].(ofp4sw.OxmValueMask); !ok || len(v.Value) != 1 || v.Value[0] != 1 {
+		t.Errorf("dot11 not set %v", frame.Oob)
+	}
+}
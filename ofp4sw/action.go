@@ -539,13 +539,7 @@ func (self actionSetField) Process(data *Frame) (*outputToPort, *outputToGroup,
 		return nil, nil, err
 	} else {
 		for oxmKey, oxmPayload := range ms {
-			var handler OxmHandler
-			switch oxmKey.(type) {
-			case OxmKeyBasic:
-				handler = oxmBasicHandler
-			default:
-				handler = oxmHandlers[oxmKeys[oxmKey]]
-			}
+			handler := oxmHandlerFor(oxmKey)
 			if handler == nil {
 				return nil, nil, ofp4.MakeErrorMsg(
 					ofp4.OFPBAC_BAD_EXPERIMENTER,
@@ -576,6 +570,14 @@ func (self actionExperimenter) Key() actionKey {
 func (self actionExperimenter) Process(data *Frame) (*outputToPort, *outputToGroup, error) {
 	if handler, ok := actionHandlers[self.Experimenter]; ok {
 		if err := handler.Execute(data, self.Data); err != nil {
+			if output, ok := err.(ActionOutput); ok {
+				return &outputToPort{
+					Frame:   data.clone(),
+					outPort: output.Port,
+					maxLen:  output.MaxLen,
+					reason:  ofp4.OFPR_ACTION,
+				}, nil, nil
+			}
 			return nil, nil, err
 		}
 	} else {
@@ -755,7 +757,11 @@ func (self *actionSet) UnmarshalBinary(data []byte) error {
 	return nil
 }
 
-func (self actionSet) Process(data *Frame) (pouts []outputToPort, gouts []outputToGroup) {
+// actionExtension processes the request returned by ActionHandler on data,
+// returning the outputs made by the request. Returns false if err was not a request.
+type actionExtension func(data *Frame, err error) ([]outputToPort, bool)
+
+func (self actionSet) Process(data *Frame, ext actionExtension) (pouts []outputToPort, gouts []outputToGroup) {
 	builtinExecute := func(key uint16) (stop bool) {
 		if act, ok := self.hash[key]; ok {
 			if pout, gout, err := act.Process(data); err != nil {
@@ -781,8 +787,12 @@ func (self actionSet) Process(data *Frame) (pouts []outputToPort, gouts []output
 	expExecute := func(order int) (stop bool) {
 		for _, act := range self.exp[order] {
 			if pout, gout, err := act.Process(data); err != nil {
-				log.Print(err)
-				return true
+				if p, ok := ext(data, err); ok {
+					pouts = append(pouts, p...)
+				} else {
+					log.Print(err)
+					return true
+				}
 			} else {
 				if pout != nil {
 					pouts = append(pouts, *pout)
@@ -0,0 +1,644 @@
+package ofp4sw
+
+import (
+	"encoding/binary"
+	"github.com/google/gopacket/layers"
+	"github.com/hkwi/gopenflow/oxm"
+	"log"
+	"sync"
+	"time"
+)
+
+// NXST_CT_DUMP is exp_type of OFPMP_EXPERIMENTER under oxm.NX_EXPERIMENTER_ID,
+// which dumps the connection tracking table.
+//
+// The request body is empty for all zones, or 2 bytes of zone followed by 6 bytes of pad.
+// The reply body is a sequence of 136 bytes records:
+//
+//	zone(2) eth_type(2) ip_proto(1) tcp_state(1) flags(2)
+//	orig_src(16) orig_dst(16) orig_src_port(2) orig_dst_port(2)
+//	reply_src(16) reply_dst(16) reply_src_port(2) reply_dst_port(2)
+//	mark(4) timeout(4) label(16)
+//	orig_packets(8) orig_bytes(8) reply_packets(8) reply_bytes(8)
+//
+// IPv4 addresses are in the first 4 bytes of the address fields. Ports are
+// the identifier for ICMP echo. timeout is the remaining seconds.
+const NXST_CT_DUMP = 0xff00
+
+// flags in NXST_CT_DUMP record
+const (
+	CT_DUMP_F_SEEN_REPLY = 1 << iota
+	CT_DUMP_F_SNAT
+	CT_DUMP_F_DNAT
+)
+
+// tcp_state in NXST_CT_DUMP record, zero for other protocols
+const (
+	CT_TCPS_SYN_SENT = iota + 1
+	CT_TCPS_SYN_RECV
+	CT_TCPS_ESTABLISHED
+	CT_TCPS_FIN_WAIT
+	CT_TCPS_TIME_WAIT
+	CT_TCPS_CLOSE
+)
+
+const (
+	ctDumpRecordLength = 136
+	ctMax              = 65536
+	recirculateMax     = 64
+	recirculateQueue   = 1024
+)
+
+// ConntrackTimeouts is the lifetime of idle connections for each state.
+// Default value will be used for zero fields.
+type ConntrackTimeouts struct {
+	TcpOpening     time.Duration // SYN_SENT and SYN_RECV
+	TcpEstablished time.Duration
+	TcpClosing     time.Duration // FIN_WAIT
+	TcpClosed      time.Duration // TIME_WAIT and CLOSE
+	Udp            time.Duration // before a reply
+	UdpStream      time.Duration
+	Icmp           time.Duration
+}
+
+var defaultConntrackTimeouts = ConntrackTimeouts{
+	TcpOpening:     30 * time.Second,
+	TcpEstablished: 24 * time.Hour,
+	TcpClosing:     15 * time.Minute,
+	TcpClosed:      30 * time.Second,
+	Udp:            30 * time.Second,
+	UdpStream:      120 * time.Second,
+	Icmp:           30 * time.Second,
+}
+
+func (self ConntrackTimeouts) merge(base ConntrackTimeouts) ConntrackTimeouts {
+	for _, d := range []struct {
+		value *time.Duration
+		base  time.Duration
+	}{
+		{&self.TcpOpening, base.TcpOpening},
+		{&self.TcpEstablished, base.TcpEstablished},
+		{&self.TcpClosing, base.TcpClosing},
+		{&self.TcpClosed, base.TcpClosed},
+		{&self.Udp, base.Udp},
+		{&self.UdpStream, base.UdpStream},
+		{&self.Icmp, base.Icmp},
+	} {
+		if *d.value <= 0 {
+			*d.value = d.base
+		}
+	}
+	return self
+}
+
+// SetConntrackTimeouts sets the timeouts of the connection tracker of NXAST_CT.
+func (self *Pipeline) SetConntrackTimeouts(timeouts ConntrackTimeouts) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.ctTimeouts = timeouts
+}
+
+func (self *Pipeline) conntrackTimeouts() ConntrackTimeouts {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.ctTimeouts.merge(defaultConntrackTimeouts)
+}
+
+// ctTuple identifies a direction of a connection.
+// Ports are the identifier for ICMP echo.
+type ctTuple struct {
+	zone    uint16
+	ethType uint16
+	proto   uint8
+	src     [16]byte
+	dst     [16]byte
+	sport   uint16
+	dport   uint16
+}
+
+func (self ctTuple) reverse() ctTuple {
+	ret := self
+	ret.src, ret.dst = self.dst, self.src
+	ret.sport, ret.dport = self.dport, self.sport
+	return ret
+}
+
+// ctPacket is the conntrack view of a frame.
+type ctPacket struct {
+	tuple    ctTuple
+	tcpFlags uint16
+	icmpType uint8
+	related  *ctTuple // inner tuple of icmp error
+	length   int
+}
+
+type ctEntry struct {
+	orig      ctTuple
+	reply     ctTuple
+	tcpState  uint8
+	finOrig   bool
+	finReply  bool
+	seenReply bool
+	nat       uint32 // NX_CT_STATE_SNAT or NX_CT_STATE_DNAT in the original direction
+	mark      uint32
+	label     [16]byte
+	expires   time.Time
+	packets   [2]uint64 // orig, reply
+	bytes     [2]uint64
+}
+
+type conntrack struct {
+	lock    *sync.Mutex
+	entries map[ctTuple]*ctEntry // both orig and reply tuples
+}
+
+func newConntrack() *conntrack {
+	return &conntrack{
+		lock:    &sync.Mutex{},
+		entries: make(map[ctTuple]*ctEntry),
+	}
+}
+
+func (self *conntrack) expire(now time.Time) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for key, entry := range self.entries {
+		if now.After(entry.expires) {
+			delete(self.entries, key)
+		}
+	}
+}
+
+func (self *conntrack) remove(entry *ctEntry) {
+	delete(self.entries, entry.orig)
+	delete(self.entries, entry.reply)
+}
+
+// process looks up the connection of the frame, and updates the ct fields of the frame.
+// The frame is translated if the connection has NAT and req has Nat.
+func (self *conntrack) process(data *Frame, req ActionConntrack, timeouts ConntrackTimeouts) {
+	data.ctZone = req.Zone
+	data.ctMark = 0
+	data.ctLabel = [16]byte{}
+
+	pkt, ok := ctParse(data, req.Zone)
+	if !ok {
+		data.ctState = oxm.NX_CT_STATE_TRK | oxm.NX_CT_STATE_INV
+		return
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	now := time.Now()
+	lookup := func(tuple ctTuple) *ctEntry {
+		if entry, ok := self.entries[tuple]; ok {
+			if now.After(entry.expires) {
+				self.remove(entry)
+			} else {
+				return entry
+			}
+		}
+		return nil
+	}
+
+	if pkt.related != nil {
+		inner := *pkt.related
+		entry := lookup(inner)
+		if entry == nil {
+			entry = lookup(inner.reverse())
+		}
+		if entry == nil {
+			data.ctState = oxm.NX_CT_STATE_TRK | oxm.NX_CT_STATE_INV
+			return
+		}
+		data.ctState = oxm.NX_CT_STATE_TRK | oxm.NX_CT_STATE_REL
+		// the inner packet was sent in the original direction
+		reply := inner == entry.orig || inner.reverse() == entry.reply
+		if reply {
+			data.ctState |= oxm.NX_CT_STATE_RPL
+		}
+		data.ctMark = entry.mark
+		data.ctLabel = entry.label
+		if req.Nat != nil && entry.nat != 0 {
+			if err := ctRewriteRelated(data, entry, reply); err != nil {
+				log.Print(err)
+			} else {
+				data.ctState |= entry.natState(reply)
+			}
+		}
+		return
+	}
+
+	entry := lookup(pkt.tuple)
+	var reply bool
+	if entry != nil {
+		reply = pkt.tuple == entry.reply && pkt.tuple != entry.orig
+		if reply && req.Force {
+			self.remove(entry)
+			entry = nil
+		} else if !reply && pkt.tuple.proto == uint8(layers.IPProtocolTCP) && ctTcpReopen(entry, pkt.tcpFlags) {
+			self.remove(entry)
+			entry = nil
+		}
+	}
+	if entry != nil {
+		if !entry.update(pkt, reply, now, timeouts) {
+			data.ctState = oxm.NX_CT_STATE_TRK | oxm.NX_CT_STATE_INV
+			return
+		}
+		if reply {
+			data.ctState = oxm.NX_CT_STATE_TRK | oxm.NX_CT_STATE_EST | oxm.NX_CT_STATE_RPL
+		} else if entry.seenReply {
+			data.ctState = oxm.NX_CT_STATE_TRK | oxm.NX_CT_STATE_EST
+		} else {
+			data.ctState = oxm.NX_CT_STATE_TRK | oxm.NX_CT_STATE_NEW
+		}
+		if req.Commit {
+			entry.setMark(req)
+		}
+	} else {
+		reply = false
+		entry = ctNewEntry(pkt)
+		if entry == nil {
+			data.ctState = oxm.NX_CT_STATE_TRK | oxm.NX_CT_STATE_INV
+			return
+		}
+		data.ctState = oxm.NX_CT_STATE_TRK | oxm.NX_CT_STATE_NEW
+		if !req.Commit || len(self.entries) >= ctMax*2 {
+			return
+		}
+		if req.Nat != nil && (req.Nat.Src || req.Nat.Dst) && !self.allocate(entry, *req.Nat) {
+			log.Print("nat allocation failed")
+			data.ctState = oxm.NX_CT_STATE_TRK | oxm.NX_CT_STATE_INV
+			return
+		}
+		entry.update(pkt, false, now, timeouts)
+		entry.setMark(req)
+		self.entries[entry.orig] = entry
+		self.entries[entry.reply] = entry
+	}
+	data.ctMark = entry.mark
+	data.ctLabel = entry.label
+	if req.Nat != nil && entry.nat != 0 {
+		to := entry.reply.reverse()
+		if reply {
+			to = entry.orig.reverse()
+		}
+		if err := ctRewrite(data, to); err != nil {
+			log.Print(err)
+		} else {
+			data.ctState |= entry.natState(reply)
+		}
+	}
+}
+
+// dump returns NXST_CT_DUMP records. zone is nil for all zones.
+func (self *conntrack) dump(zone *uint16) [][]byte {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	now := time.Now()
+	var ret [][]byte
+	for key, entry := range self.entries {
+		if key != entry.orig || zone != nil && *zone != key.zone {
+			continue
+		}
+		buf := make([]byte, ctDumpRecordLength)
+		binary.BigEndian.PutUint16(buf, key.zone)
+		binary.BigEndian.PutUint16(buf[2:], key.ethType)
+		buf[4] = key.proto
+		buf[5] = entry.tcpState
+		var flags uint16
+		if entry.seenReply {
+			flags |= CT_DUMP_F_SEEN_REPLY
+		}
+		switch entry.nat {
+		case oxm.NX_CT_STATE_SNAT:
+			flags |= CT_DUMP_F_SNAT
+		case oxm.NX_CT_STATE_DNAT:
+			flags |= CT_DUMP_F_DNAT
+		}
+		binary.BigEndian.PutUint16(buf[6:], flags)
+		for i, t := range []ctTuple{entry.orig, entry.reply} {
+			p := buf[8+36*i:]
+			copy(p, t.src[:])
+			copy(p[16:], t.dst[:])
+			binary.BigEndian.PutUint16(p[32:], t.sport)
+			binary.BigEndian.PutUint16(p[34:], t.dport)
+		}
+		binary.BigEndian.PutUint32(buf[80:], entry.mark)
+		if remain := entry.expires.Sub(now); remain > 0 {
+			binary.BigEndian.PutUint32(buf[84:], uint32(remain/time.Second))
+		}
+		copy(buf[88:], entry.label[:])
+		for i := 0; i < 2; i++ {
+			binary.BigEndian.PutUint64(buf[104+16*i:], entry.packets[i])
+			binary.BigEndian.PutUint64(buf[112+16*i:], entry.bytes[i])
+		}
+		ret = append(ret, buf)
+	}
+	return ret
+}
+
+func (self *ctEntry) setMark(req ActionConntrack) {
+	self.mark = self.mark&^req.MarkMask | req.Mark&req.MarkMask
+	for i, m := range req.LabelMask {
+		self.label[i] = self.label[i]&^m | req.Label[i]&m
+	}
+}
+
+// update runs the protocol state machine, and returns false if the packet was invalid.
+func (self *ctEntry) update(pkt ctPacket, reply bool, now time.Time, timeouts ConntrackTimeouts) bool {
+	var timeout time.Duration
+	switch layers.IPProtocol(pkt.tuple.proto) {
+	case layers.IPProtocolTCP:
+		if !self.updateTcp(pkt.tcpFlags, reply) {
+			return false
+		}
+		switch self.tcpState {
+		case CT_TCPS_SYN_SENT, CT_TCPS_SYN_RECV:
+			timeout = timeouts.TcpOpening
+		case CT_TCPS_ESTABLISHED:
+			timeout = timeouts.TcpEstablished
+		case CT_TCPS_FIN_WAIT:
+			timeout = timeouts.TcpClosing
+		default:
+			timeout = timeouts.TcpClosed
+		}
+	case layers.IPProtocolUDP:
+		timeout = timeouts.Udp
+		if self.seenReply || reply {
+			timeout = timeouts.UdpStream
+		}
+	default:
+		if reply != ctIcmpReply(pkt.tuple.ethType, pkt.icmpType) {
+			return false
+		}
+		timeout = timeouts.Icmp
+	}
+	dir := 0
+	if reply {
+		dir = 1
+		self.seenReply = true
+	}
+	self.packets[dir]++
+	self.bytes[dir] += uint64(pkt.length)
+	self.expires = now.Add(timeout)
+	return true
+}
+
+// tcp flags in NXM_NX_TCP_FLAGS bit order
+const (
+	ctTcpFin = 1 << 0
+	ctTcpSyn = 1 << 1
+	ctTcpRst = 1 << 2
+	ctTcpAck = 1 << 4
+)
+
+func (self *ctEntry) updateTcp(flags uint16, reply bool) bool {
+	if ctTcpInvalid(flags) {
+		return false
+	}
+	if flags&ctTcpRst != 0 {
+		self.tcpState = CT_TCPS_CLOSE
+		return true
+	}
+	syn := flags&ctTcpSyn != 0
+	ack := flags&ctTcpAck != 0
+	switch self.tcpState {
+	case CT_TCPS_SYN_SENT:
+		if !reply {
+			return syn && !ack // retransmission
+		} else if syn && ack {
+			self.tcpState = CT_TCPS_SYN_RECV
+			return true
+		}
+		return false
+	case CT_TCPS_SYN_RECV:
+		if syn {
+			return ack == reply // retransmission
+		} else if !reply && ack {
+			self.tcpState = CT_TCPS_ESTABLISHED
+		} else if !ack {
+			return false
+		}
+	case CT_TCPS_ESTABLISHED, CT_TCPS_FIN_WAIT:
+		if syn {
+			return false
+		}
+	case CT_TCPS_TIME_WAIT, CT_TCPS_CLOSE:
+		return !syn
+	}
+	if flags&ctTcpFin != 0 {
+		if reply {
+			self.finReply = true
+		} else {
+			self.finOrig = true
+		}
+		if self.finOrig && self.finReply {
+			self.tcpState = CT_TCPS_TIME_WAIT
+		} else {
+			self.tcpState = CT_TCPS_FIN_WAIT
+		}
+	}
+	return true
+}
+
+func ctTcpInvalid(flags uint16) bool {
+	switch {
+	case flags&(ctTcpFin|ctTcpSyn|ctTcpRst|ctTcpAck) == 0:
+		return true
+	case flags&ctTcpSyn != 0 && flags&(ctTcpFin|ctTcpRst) != 0:
+		return true
+	case flags&ctTcpFin != 0 && flags&ctTcpRst != 0:
+		return true
+	}
+	return false
+}
+
+// ctTcpReopen returns true if a new SYN reuses the tuple of the closing connection.
+func ctTcpReopen(entry *ctEntry, flags uint16) bool {
+	switch entry.tcpState {
+	case CT_TCPS_TIME_WAIT, CT_TCPS_CLOSE:
+		return flags&(ctTcpSyn|ctTcpAck) == ctTcpSyn
+	}
+	return false
+}
+
+// ctNewEntry returns nil if the packet can not start a connection.
+// TCP connections may be picked up in the middle, except for SYN+ACK.
+func ctNewEntry(pkt ctPacket) *ctEntry {
+	entry := &ctEntry{
+		orig:  pkt.tuple,
+		reply: pkt.tuple.reverse(),
+	}
+	switch layers.IPProtocol(pkt.tuple.proto) {
+	case layers.IPProtocolTCP:
+		if ctTcpInvalid(pkt.tcpFlags) || pkt.tcpFlags&(ctTcpSyn|ctTcpAck) == ctTcpSyn|ctTcpAck {
+			return nil
+		} else if pkt.tcpFlags&ctTcpSyn != 0 {
+			entry.tcpState = CT_TCPS_SYN_SENT
+		} else {
+			entry.tcpState = CT_TCPS_ESTABLISHED
+		}
+	case layers.IPProtocolUDP:
+	default:
+		if !ctIcmpRequest(pkt.tuple.ethType, pkt.icmpType) {
+			return nil
+		}
+	}
+	return entry
+}
+
+func ctIcmpRequest(ethType uint16, icmpType uint8) bool {
+	if ethType == uint16(layers.EthernetTypeIPv4) {
+		return icmpType == layers.ICMPv4TypeEchoRequest
+	}
+	return icmpType == layers.ICMPv6TypeEchoRequest
+}
+
+func ctIcmpReply(ethType uint16, icmpType uint8) bool {
+	if ethType == uint16(layers.EthernetTypeIPv4) {
+		return icmpType == layers.ICMPv4TypeEchoReply
+	}
+	return icmpType == layers.ICMPv6TypeEchoReply
+}
+
+func ctIcmpError(ethType uint16, icmpType uint8) bool {
+	if ethType == uint16(layers.EthernetTypeIPv4) {
+		switch icmpType {
+		case layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4TypeSourceQuench,
+			layers.ICMPv4TypeRedirect, layers.ICMPv4TypeTimeExceeded, layers.ICMPv4TypeParameterProblem:
+			return true
+		}
+		return false
+	}
+	switch icmpType {
+	case layers.ICMPv6TypeDestinationUnreachable, layers.ICMPv6TypePacketTooBig,
+		layers.ICMPv6TypeTimeExceeded, layers.ICMPv6TypeParameterProblem:
+		return true
+	}
+	return false
+}
+
+// ctParse returns false for frames that the connection tracker does not handle,
+// which are non-IP, fragments, and other than TCP, UDP, ICMP echo and ICMP errors.
+func ctParse(data *Frame, zone uint16) (ctPacket, bool) {
+	var pkt ctPacket
+	pkt.tuple.zone = zone
+	if eth, err := data.Serialized(); err != nil {
+		return pkt, false
+	} else {
+		pkt.length = len(eth)
+	}
+	var icmp bool
+	var icmpPayload []byte
+	for _, layer := range data.Layers() {
+		switch t := layer.(type) {
+		case *layers.IPv4:
+			if t.Flags&layers.IPv4MoreFragments != 0 || t.FragOffset != 0 {
+				return pkt, false
+			}
+			pkt.tuple.ethType = uint16(layers.EthernetTypeIPv4)
+			pkt.tuple.proto = uint8(t.Protocol)
+			copy(pkt.tuple.src[:], t.SrcIP.To4())
+			copy(pkt.tuple.dst[:], t.DstIP.To4())
+		case *layers.IPv6:
+			pkt.tuple.ethType = uint16(layers.EthernetTypeIPv6)
+			copy(pkt.tuple.src[:], t.SrcIP.To16())
+			copy(pkt.tuple.dst[:], t.DstIP.To16())
+		case *layers.IPv6Fragment:
+			return pkt, false
+		case *layers.TCP:
+			pkt.tuple.proto = uint8(layers.IPProtocolTCP)
+			pkt.tuple.sport = uint16(t.SrcPort)
+			pkt.tuple.dport = uint16(t.DstPort)
+			for i, f := range []bool{t.FIN, t.SYN, t.RST, t.PSH, t.ACK} {
+				if f {
+					pkt.tcpFlags |= 1 << uint(i)
+				}
+			}
+			return pkt, pkt.tuple.ethType != 0
+		case *layers.UDP:
+			pkt.tuple.proto = uint8(layers.IPProtocolUDP)
+			pkt.tuple.sport = uint16(t.SrcPort)
+			pkt.tuple.dport = uint16(t.DstPort)
+			return pkt, pkt.tuple.ethType != 0
+		case *layers.ICMPv4:
+			pkt.tuple.proto = uint8(layers.IPProtocolICMPv4)
+			pkt.icmpType = t.TypeCode.Type()
+			pkt.tuple.sport = t.Id
+			pkt.tuple.dport = t.Id
+			icmp = true
+			icmpPayload = t.Payload
+		case *layers.ICMPv6:
+			pkt.tuple.proto = uint8(layers.IPProtocolICMPv6)
+			pkt.icmpType = t.TypeCode.Type()
+			if len(t.Payload) < 4 {
+				return pkt, false
+			}
+			pkt.tuple.sport = binary.BigEndian.Uint16(t.Payload)
+			pkt.tuple.dport = pkt.tuple.sport
+			icmp = true
+			icmpPayload = t.Payload[4:]
+		}
+		if icmp {
+			break
+		}
+	}
+	if pkt.tuple.ethType == 0 || !icmp {
+		return pkt, false
+	}
+	if ctIcmpError(pkt.tuple.ethType, pkt.icmpType) {
+		if inner, ok := ctParseInner(pkt.tuple.ethType, icmpPayload); !ok {
+			return pkt, false
+		} else {
+			inner.zone = zone
+			pkt.related = &inner
+		}
+		return pkt, true
+	}
+	return pkt, ctIcmpRequest(pkt.tuple.ethType, pkt.icmpType) || ctIcmpReply(pkt.tuple.ethType, pkt.icmpType)
+}
+
+// ctParseInner parses the packet quoted in the icmp error, which may be truncated after the ports.
+func ctParseInner(ethType uint16, data []byte) (ctTuple, bool) {
+	var tuple ctTuple
+	tuple.ethType = ethType
+	if ethType == uint16(layers.EthernetTypeIPv4) {
+		if len(data) < 20 {
+			return tuple, false
+		}
+		hlen := int(data[0]&0x0f) * 4
+		if hlen < 20 || hlen > len(data) {
+			return tuple, false
+		}
+		tuple.proto = data[9]
+		copy(tuple.src[:], data[12:16])
+		copy(tuple.dst[:], data[16:20])
+		data = data[hlen:]
+	} else {
+		if len(data) < 40 {
+			return tuple, false
+		}
+		tuple.proto = data[6]
+		copy(tuple.src[:], data[8:24])
+		copy(tuple.dst[:], data[24:40])
+		data = data[40:]
+	}
+	if len(data) < 8 {
+		return tuple, false
+	}
+	switch layers.IPProtocol(tuple.proto) {
+	case layers.IPProtocolTCP, layers.IPProtocolUDP:
+		tuple.sport = binary.BigEndian.Uint16(data)
+		tuple.dport = binary.BigEndian.Uint16(data[2:])
+	case layers.IPProtocolICMPv4, layers.IPProtocolICMPv6:
+		tuple.sport = binary.BigEndian.Uint16(data[4:])
+		tuple.dport = tuple.sport
+	default:
+		return tuple, false
+	}
+	return tuple, true
+}
@@ -0,0 +1,270 @@
+package ofp4sw
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/hkwi/gopenflow/oxm"
+	"hash/fnv"
+	"math/big"
+	"math/rand"
+	"net"
+)
+
+const (
+	ctNatTriesMax     = 65536
+	ctNatEphemeralMin = 1024
+)
+
+// natState returns ct_state bits of the translation for the direction.
+// Replies of source translated connection are destination translated, and vice versa.
+func (self *ctEntry) natState(reply bool) uint32 {
+	if !reply {
+		return self.nat
+	}
+	switch self.nat {
+	case oxm.NX_CT_STATE_SNAT:
+		return oxm.NX_CT_STATE_DNAT
+	case oxm.NX_CT_STATE_DNAT:
+		return oxm.NX_CT_STATE_SNAT
+	}
+	return 0
+}
+
+// allocate chooses the reply tuple of the new connection, which must not be used
+// by other connections in the zone.
+func (self *conntrack) allocate(entry *ctEntry, nat ConntrackNat) bool {
+	if nat.Src && nat.Dst {
+		return false
+	}
+	reply := entry.reply
+	addr, port := &reply.dst, &reply.dport
+	entry.nat = oxm.NX_CT_STATE_SNAT
+	if nat.Dst {
+		addr, port = &reply.src, &reply.sport
+		entry.nat = oxm.NX_CT_STATE_DNAT
+	}
+
+	addrLen := 4
+	if entry.orig.ethType == uint16(layers.EthernetTypeIPv6) {
+		addrLen = 16
+	}
+	addrMin := new(big.Int).SetBytes(addr[:addrLen])
+	addrCount := uint64(1)
+	if nat.AddrMin != nil {
+		min, max := ctNatAddr(nat.AddrMin, addrLen), ctNatAddr(nat.AddrMax, addrLen)
+		if min == nil {
+			return false
+		}
+		if max == nil {
+			max = min
+		}
+		addrMin.SetBytes(min)
+		count := new(big.Int).SetBytes(max)
+		count.Sub(count, addrMin)
+		if count.Sign() < 0 {
+			return false
+		} else if count.IsUint64() && count.Uint64() < ctNatTriesMax {
+			addrCount = count.Uint64() + 1
+		} else {
+			addrCount = ctNatTriesMax
+		}
+	}
+
+	// port candidates are portMin + offset, and the first candidate is the current port if keepPort.
+	keepPort := nat.PortMin == 0
+	portMin := uint32(nat.PortMin)
+	portMax := uint32(nat.PortMax)
+	if keepPort {
+		portMin, portMax = ctNatEphemeralMin, 0xffff
+	} else if portMax < portMin {
+		portMax = portMin
+	}
+	portCount := portMax - portMin + 1
+	switch layers.IPProtocol(entry.orig.proto) {
+	case layers.IPProtocolICMPv4, layers.IPProtocolICMPv6:
+		keepPort = true
+		portCount = 0
+	}
+
+	hasher := fnv.New32a()
+	hasher.Write(entry.orig.src[:])
+	if !nat.Persistent {
+		hasher.Write(entry.orig.dst[:])
+	}
+	hash := hasher.Sum32()
+	addrStart := uint64(hash) % addrCount
+	var portStart uint32
+	if portCount > 0 {
+		if nat.Random {
+			portStart = uint32(rand.Int63n(int64(portCount)))
+		} else {
+			portStart = hash % portCount
+		}
+	}
+
+	current := *port
+	tries := 0
+	for i := uint64(0); i < addrCount; i++ {
+		a := new(big.Int).SetUint64((addrStart + i) % addrCount)
+		a.Add(a, addrMin)
+		b := a.Bytes()
+		if len(b) > addrLen {
+			b = b[len(b)-addrLen:]
+		}
+		*addr = [16]byte{}
+		copy(addr[addrLen-len(b):addrLen], b)
+
+		if keepPort {
+			*port = current
+			if _, used := self.entries[reply]; !used {
+				entry.reply = reply
+				return true
+			}
+			tries++
+		}
+		for j := uint32(0); j < portCount && tries < ctNatTriesMax; j++ {
+			*port = uint16(portMin + (portStart+j)%portCount)
+			if _, used := self.entries[reply]; !used {
+				entry.reply = reply
+				return true
+			}
+			tries++
+		}
+		if tries >= ctNatTriesMax {
+			break
+		}
+	}
+	entry.nat = 0
+	return false
+}
+
+func ctNatAddr(ip net.IP, addrLen int) []byte {
+	if ip == nil {
+		return nil
+	}
+	if addrLen == 4 {
+		return ip.To4()
+	} else if ip.To4() != nil {
+		return nil
+	}
+	return ip.To16()
+}
+
+func ctNatIP(addr [16]byte, ethType uint16) net.IP {
+	if ethType == uint16(layers.EthernetTypeIPv4) {
+		return net.IP(append([]byte{}, addr[:4]...))
+	}
+	return net.IP(append([]byte{}, addr[:]...))
+}
+
+// ctRewrite rewrites addresses and ports of the frame into the tuple.
+// Checksums will be recalculated in Frame.Serialized.
+func ctRewrite(data *Frame, to ctTuple) error {
+	for _, layer := range data.Layers() {
+		switch t := layer.(type) {
+		case *layers.IPv4:
+			t.SrcIP = ctNatIP(to.src, to.ethType)
+			t.DstIP = ctNatIP(to.dst, to.ethType)
+		case *layers.IPv6:
+			t.SrcIP = ctNatIP(to.src, to.ethType)
+			t.DstIP = ctNatIP(to.dst, to.ethType)
+		case *layers.TCP:
+			t.SrcPort = layers.TCPPort(to.sport)
+			t.DstPort = layers.TCPPort(to.dport)
+			return nil
+		case *layers.UDP:
+			t.SrcPort = layers.UDPPort(to.sport)
+			t.DstPort = layers.UDPPort(to.dport)
+			return nil
+		case *layers.ICMPv4, *layers.ICMPv6:
+			return nil
+		}
+	}
+	return fmt.Errorf("nat target layer not found")
+}
+
+// ctRewriteRelated translates the icmp error and the packet quoted in the error.
+func ctRewriteRelated(data *Frame, entry *ctEntry, reply bool) error {
+	from, to := entry.orig, entry.reply.reverse()
+	if reply {
+		from, to = entry.reply, entry.orig.reverse()
+	}
+	var outer, inner []byte
+	for _, layer := range data.Layers() {
+		switch t := layer.(type) {
+		case *layers.IPv4:
+			if net.IP(from.src[:4]).Equal(t.SrcIP) {
+				t.SrcIP = ctNatIP(to.src, to.ethType)
+			}
+			if net.IP(from.dst[:4]).Equal(t.DstIP) {
+				t.DstIP = ctNatIP(to.dst, to.ethType)
+			}
+			outer = t.Contents
+		case *layers.IPv6:
+			if net.IP(from.src[:]).Equal(t.SrcIP) {
+				t.SrcIP = ctNatIP(to.src, to.ethType)
+			}
+			if net.IP(from.dst[:]).Equal(t.DstIP) {
+				t.DstIP = ctNatIP(to.dst, to.ethType)
+			}
+			outer = t.Contents
+		case *gopacket.Payload:
+			inner = []byte(*t)
+			if entry.orig.ethType == uint16(layers.EthernetTypeIPv6) {
+				if len(inner) < 4 {
+					return fmt.Errorf("short icmp error")
+				}
+				inner = inner[4:] // unused field of icmpv6 error
+			}
+		}
+	}
+	if outer == nil || inner == nil {
+		return fmt.Errorf("icmp error not found")
+	}
+	// quoted packet was sent in the opposite direction
+	quote := to.reverse()
+	var ports []byte
+	if entry.orig.ethType == uint16(layers.EthernetTypeIPv4) {
+		if len(inner) < 20 || len(inner) < int(inner[0]&0x0f)*4 {
+			return fmt.Errorf("short quoted packet")
+		}
+		hlen := int(inner[0]&0x0f) * 4
+		copy(inner[12:16], quote.src[:4])
+		copy(inner[16:20], quote.dst[:4])
+		inner[10], inner[11] = 0, 0
+		binary.BigEndian.PutUint16(inner[10:], ctChecksum(inner[:hlen]))
+		ports = inner[hlen:]
+	} else {
+		if len(inner) < 40 {
+			return fmt.Errorf("short quoted packet")
+		}
+		copy(inner[8:24], quote.src[:])
+		copy(inner[24:40], quote.dst[:])
+		ports = inner[40:]
+	}
+	switch layers.IPProtocol(entry.orig.proto) {
+	case layers.IPProtocolTCP, layers.IPProtocolUDP:
+		if len(ports) >= 4 {
+			binary.BigEndian.PutUint16(ports, quote.sport)
+			binary.BigEndian.PutUint16(ports[2:], quote.dport)
+		}
+	}
+	return nil
+}
+
+// ctChecksum is the internet checksum.
+func ctChecksum(data []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
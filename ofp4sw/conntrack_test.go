@@ -0,0 +1,398 @@
+package ofp4sw
+
+import (
+	"encoding/binary"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/hkwi/gopenflow"
+	"github.com/hkwi/gopenflow/ofp4"
+	"github.com/hkwi/gopenflow/oxm"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func ctTestFrame(t *testing.T, src, dst net.IP, proto layers.IPProtocol, l4 ...gopacket.SerializableLayer) *Frame {
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: proto,
+		SrcIP:    src,
+		DstIP:    dst,
+	}
+	for _, layer := range l4 {
+		switch l := layer.(type) {
+		case *layers.TCP:
+			l.SetNetworkLayerForChecksum(ip)
+		case *layers.UDP:
+			l.SetNetworkLayerForChecksum(ip)
+		}
+	}
+	buf := gopacket.NewSerializeBuffer()
+	ls := []gopacket.SerializableLayer{
+		&layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{2, 0, 0, 0, 0, 1},
+			DstMAC:       net.HardwareAddr{2, 0, 0, 0, 0, 2},
+			EthernetType: layers.EthernetTypeIPv4,
+		},
+		ip,
+	}
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true},
+		append(ls, l4...)...); err != nil {
+		t.Fatal(err)
+	}
+	return &Frame{serialized: buf.Bytes()}
+}
+
+var (
+	ctTestA = net.IP{192, 0, 2, 1}
+	ctTestB = net.IP{192, 0, 2, 2}
+)
+
+func TestConntrackTcp(t *testing.T) {
+	ct := newConntrack()
+	tcp := func(forward bool, flags string) *Frame {
+		l := &layers.TCP{SrcPort: 1024, DstPort: 80}
+		src, dst := ctTestA, ctTestB
+		if !forward {
+			l.SrcPort, l.DstPort = l.DstPort, l.SrcPort
+			src, dst = dst, src
+		}
+		for _, f := range flags {
+			switch f {
+			case 'S':
+				l.SYN = true
+			case 'A':
+				l.ACK = true
+			case 'F':
+				l.FIN = true
+			case 'R':
+				l.RST = true
+			}
+		}
+		return ctTestFrame(t, src, dst, layers.IPProtocolTCP, l)
+	}
+	commit := ActionConntrack{Zone: 1, Commit: true, Table: ofp4.OFPTT_ALL, Mark: 0x10, MarkMask: 0xf0}
+	check := func(fr *Frame, req ActionConntrack, state uint32) {
+		ct.process(fr, req, defaultConntrackTimeouts)
+		if fr.ctState != state {
+			t.Errorf("ct_state %x expected %x", fr.ctState, state)
+		}
+		if fr.ctZone != req.Zone {
+			t.Errorf("ct_zone %d", fr.ctZone)
+		}
+	}
+	const trk = oxm.NX_CT_STATE_TRK
+
+	check(tcp(true, "SA"), commit, trk|oxm.NX_CT_STATE_INV)
+	check(tcp(true, "S"), ActionConntrack{Zone: 1}, trk|oxm.NX_CT_STATE_NEW)
+	if len(ct.entries) != 0 {
+		t.Error("uncommitted connection was stored")
+	}
+	check(tcp(true, "S"), commit, trk|oxm.NX_CT_STATE_NEW)
+	// zone separates the connections
+	check(tcp(false, "SA"), ActionConntrack{Zone: 2}, trk|oxm.NX_CT_STATE_INV)
+	check(tcp(true, "A"), ActionConntrack{Zone: 1}, trk|oxm.NX_CT_STATE_INV)
+	fr := tcp(false, "SA")
+	check(fr, ActionConntrack{Zone: 1}, trk|oxm.NX_CT_STATE_EST|oxm.NX_CT_STATE_RPL)
+	if fr.ctMark != 0x10 {
+		t.Errorf("ct_mark %x", fr.ctMark)
+	}
+	check(tcp(true, "A"), ActionConntrack{Zone: 1}, trk|oxm.NX_CT_STATE_EST)
+	check(tcp(true, "S"), ActionConntrack{Zone: 1}, trk|oxm.NX_CT_STATE_INV)
+
+	recs := ct.dump(nil)
+	if len(recs) != 1 {
+		t.Fatalf("dump %v", recs)
+	}
+	if recs[0][5] != CT_TCPS_ESTABLISHED {
+		t.Errorf("tcp state %d", recs[0][5])
+	}
+	if binary.BigEndian.Uint16(recs[0][40:]) != 1024 || binary.BigEndian.Uint16(recs[0][78:]) != 1024 {
+		t.Errorf("dump ports %v", recs[0])
+	}
+	if binary.BigEndian.Uint64(recs[0][104:]) != 2 || binary.BigEndian.Uint64(recs[0][120:]) != 1 {
+		t.Errorf("dump counters %v", recs[0])
+	}
+	zone := uint16(2)
+	if recs := ct.dump(&zone); len(recs) != 0 {
+		t.Errorf("dump zone filter %v", recs)
+	}
+
+	check(tcp(true, "FA"), ActionConntrack{Zone: 1}, trk|oxm.NX_CT_STATE_EST)
+	check(tcp(false, "FA"), ActionConntrack{Zone: 1}, trk|oxm.NX_CT_STATE_EST|oxm.NX_CT_STATE_RPL)
+	if recs := ct.dump(nil); recs[0][5] != CT_TCPS_TIME_WAIT {
+		t.Errorf("tcp state %d", recs[0][5])
+	}
+	// new SYN reuses the tuple
+	check(tcp(true, "S"), commit, trk|oxm.NX_CT_STATE_NEW)
+	check(tcp(false, "R"), ActionConntrack{Zone: 1}, trk|oxm.NX_CT_STATE_EST|oxm.NX_CT_STATE_RPL)
+	if recs := ct.dump(nil); recs[0][5] != CT_TCPS_CLOSE {
+		t.Errorf("tcp state %d", recs[0][5])
+	}
+
+	ct.expire(time.Now().Add(time.Minute))
+	if len(ct.entries) != 0 {
+		t.Errorf("closed connection not expired")
+	}
+}
+
+func TestConntrackIcmp(t *testing.T) {
+	ct := newConntrack()
+	commit := ActionConntrack{Commit: true, Table: ofp4.OFPTT_ALL}
+
+	echo := func(src, dst net.IP, typ uint8) *Frame {
+		return ctTestFrame(t, src, dst, layers.IPProtocolICMPv4, &layers.ICMPv4{
+			TypeCode: layers.CreateICMPv4TypeCode(typ, 0),
+			Id:       7,
+		})
+	}
+	fr := echo(ctTestB, ctTestA, layers.ICMPv4TypeEchoReply)
+	ct.process(fr, commit, defaultConntrackTimeouts)
+	if fr.ctState != oxm.NX_CT_STATE_TRK|oxm.NX_CT_STATE_INV {
+		t.Errorf("ct_state %x", fr.ctState)
+	}
+	ct.process(echo(ctTestA, ctTestB, layers.ICMPv4TypeEchoRequest), commit, defaultConntrackTimeouts)
+	fr = echo(ctTestB, ctTestA, layers.ICMPv4TypeEchoReply)
+	ct.process(fr, ActionConntrack{}, defaultConntrackTimeouts)
+	if fr.ctState != oxm.NX_CT_STATE_TRK|oxm.NX_CT_STATE_EST|oxm.NX_CT_STATE_RPL {
+		t.Errorf("ct_state %x", fr.ctState)
+	}
+
+	// icmp error for udp
+	udp := ctTestFrame(t, ctTestA, ctTestB, layers.IPProtocolUDP, &layers.UDP{SrcPort: 5000, DstPort: 53})
+	ct.process(udp, commit, defaultConntrackTimeouts)
+	quote, err := udp.Serialized()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreach := ctTestFrame(t, ctTestB, ctTestA, layers.IPProtocolICMPv4, &layers.ICMPv4{
+		TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodePort),
+	}, gopacket.Payload(quote[14:42]))
+	ct.process(unreach, ActionConntrack{}, defaultConntrackTimeouts)
+	if unreach.ctState != oxm.NX_CT_STATE_TRK|oxm.NX_CT_STATE_REL|oxm.NX_CT_STATE_RPL {
+		t.Errorf("ct_state %x", unreach.ctState)
+	}
+	// quoted header length beyond the quote
+	malformed := append([]byte{}, quote[14:42]...)
+	malformed[0] = 0x4f
+	unreach = ctTestFrame(t, ctTestB, ctTestA, layers.IPProtocolICMPv4, &layers.ICMPv4{
+		TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodePort),
+	}, gopacket.Payload(malformed))
+	ct.process(unreach, ActionConntrack{}, defaultConntrackTimeouts)
+	if unreach.ctState != oxm.NX_CT_STATE_TRK|oxm.NX_CT_STATE_INV {
+		t.Errorf("ct_state %x", unreach.ctState)
+	}
+
+	arp := &Frame{serialized: make([]byte, 64)}
+	ct.process(arp, commit, defaultConntrackTimeouts)
+	if arp.ctState != oxm.NX_CT_STATE_TRK|oxm.NX_CT_STATE_INV {
+		t.Errorf("ct_state %x", arp.ctState)
+	}
+}
+
+func TestConntrackNat(t *testing.T) {
+	ct := newConntrack()
+	snat := ActionConntrack{Commit: true, Table: ofp4.OFPTT_ALL, Nat: &ConntrackNat{
+		Src:     true,
+		AddrMin: net.IP{203, 0, 113, 1},
+		PortMin: 4000,
+		PortMax: 4001,
+	}}
+	nat := ActionConntrack{Table: ofp4.OFPTT_ALL, Nat: &ConntrackNat{}}
+	const trk = oxm.NX_CT_STATE_TRK
+
+	translated := func(fr *Frame) (*layers.IPv4, *layers.UDP) {
+		eth, err := fr.Serialized()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkt := gopacket.NewPacket(eth, layers.LayerTypeEthernet, gopacket.Default)
+		ip, _ := pkt.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		udp, _ := pkt.Layer(layers.LayerTypeUDP).(*layers.UDP)
+		if ip == nil {
+			t.Fatal("ip layer not found")
+		}
+		return ip, udp
+	}
+	udp := func(src, dst net.IP, sport, dport layers.UDPPort) *Frame {
+		return ctTestFrame(t, src, dst, layers.IPProtocolUDP, &layers.UDP{SrcPort: sport, DstPort: dport})
+	}
+
+	fr := udp(ctTestA, ctTestB, 5000, 53)
+	ct.process(fr, snat, defaultConntrackTimeouts)
+	if fr.ctState != trk|oxm.NX_CT_STATE_NEW|oxm.NX_CT_STATE_SNAT {
+		t.Errorf("ct_state %x", fr.ctState)
+	}
+	ip, l4 := translated(fr)
+	if !ip.SrcIP.Equal(net.IP{203, 0, 113, 1}) || !ip.DstIP.Equal(ctTestB) {
+		t.Errorf("translated address %v %v", ip.SrcIP, ip.DstIP)
+	}
+	port := l4.SrcPort
+	if port != 4000 && port != 4001 || l4.DstPort != 53 {
+		t.Errorf("translated port %d %d", l4.SrcPort, l4.DstPort)
+	}
+
+	// the other port is allocated for the next connection, and no more
+	fr = udp(net.IP{192, 0, 2, 3}, ctTestB, 5000, 53)
+	ct.process(fr, snat, defaultConntrackTimeouts)
+	if _, l4 := translated(fr); l4.SrcPort == port || l4.SrcPort != 4000 && l4.SrcPort != 4001 {
+		t.Errorf("translated port %d", l4.SrcPort)
+	}
+	fr = udp(net.IP{192, 0, 2, 4}, ctTestB, 5000, 53)
+	ct.process(fr, snat, defaultConntrackTimeouts)
+	if fr.ctState != trk|oxm.NX_CT_STATE_INV {
+		t.Errorf("ct_state %x", fr.ctState)
+	}
+
+	// replies are translated back
+	fr = udp(ctTestB, net.IP{203, 0, 113, 1}, 53, port)
+	ct.process(fr, nat, defaultConntrackTimeouts)
+	if fr.ctState != trk|oxm.NX_CT_STATE_EST|oxm.NX_CT_STATE_RPL|oxm.NX_CT_STATE_DNAT {
+		t.Errorf("ct_state %x", fr.ctState)
+	}
+	ip, l4 = translated(fr)
+	if !ip.SrcIP.Equal(ctTestB) || !ip.DstIP.Equal(ctTestA) || l4.SrcPort != 53 || l4.DstPort != 5000 {
+		t.Errorf("reverse translation %v:%d %v:%d", ip.SrcIP, l4.SrcPort, ip.DstIP, l4.DstPort)
+	}
+	// without nat, the frame is kept
+	fr = udp(ctTestB, net.IP{203, 0, 113, 1}, 53, port)
+	ct.process(fr, ActionConntrack{Table: ofp4.OFPTT_ALL}, defaultConntrackTimeouts)
+	if ip, _ := translated(fr); !ip.DstIP.Equal(net.IP{203, 0, 113, 1}) {
+		t.Errorf("translated without nat %v", ip.DstIP)
+	}
+
+	// icmp error for the translated packet
+	quote, err := udp(net.IP{203, 0, 113, 1}, ctTestB, port, 53).Serialized()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreach := ctTestFrame(t, ctTestB, net.IP{203, 0, 113, 1}, layers.IPProtocolICMPv4, &layers.ICMPv4{
+		TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodePort),
+	}, gopacket.Payload(quote[14:42]))
+	ct.process(unreach, nat, defaultConntrackTimeouts)
+	if unreach.ctState != trk|oxm.NX_CT_STATE_REL|oxm.NX_CT_STATE_RPL|oxm.NX_CT_STATE_DNAT {
+		t.Errorf("ct_state %x", unreach.ctState)
+	}
+	if ip, _ := translated(unreach); !ip.DstIP.Equal(ctTestA) {
+		t.Errorf("icmp error destination %v", ip.DstIP)
+	}
+	eth, err := unreach.Serialized()
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner := gopacket.NewPacket(eth[14+20+8:], layers.LayerTypeIPv4, gopacket.Default)
+	if ip, ok := inner.Layer(layers.LayerTypeIPv4).(*layers.IPv4); !ok || !ip.SrcIP.Equal(ctTestA) {
+		t.Errorf("quoted packet %v", inner)
+	} else if ctChecksum(eth[14+20+8:14+20+8+20]) != 0 {
+		t.Errorf("quoted checksum")
+	}
+	if l4, ok := inner.Layer(layers.LayerTypeUDP).(*layers.UDP); !ok || l4.SrcPort != 5000 {
+		t.Errorf("quoted packet %v", inner)
+	}
+
+	dump := ct.dump(nil)
+	if len(dump) != 2 {
+		t.Fatalf("dump %v", dump)
+	}
+	for _, rec := range dump {
+		if binary.BigEndian.Uint16(rec[6:])&CT_DUMP_F_SNAT == 0 {
+			t.Errorf("dump flags %v", rec)
+		}
+	}
+}
+
+func TestConntrackPipeline(t *testing.T) {
+	AddActionHandler(flowTaskTestExperimenter, flowTaskTestAction{})
+
+	pipe := NewPipeline()
+	host1, sw1 := gopenflow.NewMemPortPair("h1", [6]byte{2, 0, 0, 0, 0, 1}, "sw1", [6]byte{2, 0, 0, 0, 1, 1})
+	host2, sw2 := gopenflow.NewMemPortPair("h2", [6]byte{2, 0, 0, 0, 0, 2}, "sw2", [6]byte{2, 0, 0, 0, 1, 2})
+	if err := pipe.SetPort(1, sw1); err != nil {
+		t.Fatal(err)
+	}
+	if err := pipe.SetPort(2, sw2); err != nil {
+		t.Fatal(err)
+	}
+	// untracked frames are sent to the connection tracker, and only the new connection from port 1 is allowed.
+	if err := pipe.addFlowEntry(nxmTestFlowMod(0, nxmTestField(oxm.NXM_NX_CT_STATE, []byte{0, 0, 0, 0}, []byte{0, 0, 0, 0x20}),
+		ofp4.MakeInstructionActions(ofp4.OFPIT_APPLY_ACTIONS, flowTaskTestActionBytes(4, 1)))); err != nil {
+		t.Fatal(err)
+	}
+	fields := nxmTestField(oxm.NXM_OF_IN_PORT, []byte{0, 1}, nil)
+	fields = append(fields, nxmTestField(oxm.NXM_NX_CT_STATE, []byte{0, 0, 0, 0x21}, []byte{0, 0, 0, 0x21})...)
+	if err := pipe.addFlowEntry(nxmTestFlowMod(1, fields,
+		ofp4.MakeInstructionActions(ofp4.OFPIT_APPLY_ACTIONS,
+			append(flowTaskTestActionBytes(5, 0), ofp4.MakeActionOutput(2, 0)...)))); err != nil {
+		t.Fatal(err)
+	}
+	fields = nxmTestField(oxm.NXM_NX_CT_STATE, []byte{0, 0, 0, 0x22}, []byte{0, 0, 0, 0x22})
+	fields = append(fields, nxmTestField(oxm.NXM_NX_CT_ZONE, []byte{0, 3}, nil)...)
+	if err := pipe.addFlowEntry(nxmTestFlowMod(1, fields,
+		ofp4.MakeInstructionActions(ofp4.OFPIT_APPLY_ACTIONS, ofp4.MakeActionOutput(ofp4.OFPP_IN_PORT, 0)))); err != nil {
+		t.Fatal(err)
+	}
+
+	udp := func(src, dst net.IP, sport, dport layers.UDPPort) gopenflow.Frame {
+		fr := ctTestFrame(t, src, dst, layers.IPProtocolUDP, &layers.UDP{SrcPort: sport, DstPort: dport})
+		return gopenflow.Frame{Data: fr.serialized}
+	}
+	host2.Egress(udp(ctTestB, ctTestA, 53, 5000))
+	select {
+	case fr := <-host1.Ingress():
+		t.Errorf("unexpected frame %v", fr)
+	case <-time.After(100 * time.Millisecond):
+	}
+	host1.Egress(udp(ctTestA, ctTestB, 5000, 53))
+	select {
+	case <-host2.Ingress():
+	case <-time.After(time.Second):
+		t.Fatal("new connection not forwarded")
+	}
+	host2.Egress(udp(ctTestB, ctTestA, 53, 5000))
+	select {
+	case <-host2.Ingress():
+	case <-time.After(time.Second):
+		t.Fatal("established connection not forwarded")
+	}
+
+	msg := ofp4.MakeMultipartRequest(ofp4.OFPMP_EXPERIMENTER, 0, nil)
+	req := make([]byte, 8)
+	binary.BigEndian.PutUint32(req, oxm.NX_EXPERIMENTER_ID)
+	binary.BigEndian.PutUint32(req[4:], NXST_CT_DUMP)
+	mp := &ofmMpExperimenter{ofmMulti{ofmReply: ofmReply{pipe: pipe, req: msg}, reqs: [][]byte{req}}}
+	mp.Map()
+	if len(mp.resps) != 0 || len(mp.chunks) != 1 {
+		t.Fatalf("dump %v %v", mp.resps, mp.chunks)
+	}
+	if zone := binary.BigEndian.Uint16(mp.chunks[0]); zone != 3 {
+		t.Errorf("zone %d", zone)
+	}
+
+	binary.BigEndian.PutUint32(req[4:], 0)
+	mp = &ofmMpExperimenter{ofmMulti{ofmReply: ofmReply{pipe: pipe, req: msg}, reqs: [][]byte{req}}}
+	mp.Map()
+	if len(mp.resps) != 1 {
+		t.Error("unknown exp_type must be an error")
+	}
+}
+
+func TestConntrackRecirculateQueue(t *testing.T) {
+	// the queue is not drained without the datapath
+	pipe := &Pipeline{
+		lock:          &sync.RWMutex{},
+		conntrack:     newConntrack(),
+		recirculation: make(chan MapReducable, 1),
+	}
+	task := &flowTask{
+		Frame:     *ctTestFrame(t, ctTestA, ctTestB, layers.IPProtocolUDP, &layers.UDP{SrcPort: 5000, DstPort: 53}),
+		pipe:      pipe,
+		actionSet: makeActionSet(),
+	}
+	task.conntrack(ActionConntrack{Table: 1})
+	task.conntrack(ActionConntrack{Table: 1})
+	if len(pipe.recirculation) != 1 || pipe.recirculationDrops != 1 {
+		t.Errorf("queued %d dropped %d", len(pipe.recirculation), pipe.recirculationDrops)
+	}
+}
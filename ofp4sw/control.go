@@ -1,12 +1,14 @@
 package ofp4sw
 
 import (
+	"encoding/binary"
 	"github.com/hkwi/gopenflow"
 	"github.com/hkwi/gopenflow/ofp4"
 	"github.com/hkwi/gopenflow/oxm"
 	"log"
 	"math"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -78,7 +80,22 @@ func (self *ofmExperimenter) Map() Reducable {
 		ExpType:      exp.ExpType(),
 	}
 	if handler, ok := messageHandlers[key]; ok {
-		for _, rep := range handler.Execute(exp[16:]) {
+		var reps [][]byte
+		if h, ok := handler.(PipelineMessageHandler); ok {
+			var err error
+			if reps, err = h.ExecutePipeline(self.pipe, exp[16:]); err != nil {
+				if e, ok := err.(ofp4.ErrorMsg); ok {
+					self.putError(e)
+				} else {
+					log.Print(err)
+					self.putError(ofp4.MakeErrorMsg(ofp4.OFPET_BAD_REQUEST, ofp4.OFPBRC_EPERM))
+				}
+				return self
+			}
+		} else {
+			reps = handler.Execute(exp[16:])
+		}
+		for _, rep := range reps {
 			msg := ofp4.MakeExperimenterHeader(exp.Experimenter(), exp.ExpType()).AppendData(rep).SetXid(self.req.Xid())
 			self.resps = append(self.resps, msg)
 		}
@@ -98,7 +115,7 @@ func (self *ofmFeaturesRequest) Map() Reducable {
 		0x7fffffff,
 		0xff, // nTables
 		0,    // XXX: auxiliaryId
-		ofp4.OFPC_FLOW_STATS|ofp4.OFPC_TABLE_STATS|ofp4.OFPC_PORT_STATS|ofp4.OFPC_GROUP_STATS, // XXX: capabilities
+		ofp4.OFPC_FLOW_STATS|ofp4.OFPC_TABLE_STATS|ofp4.OFPC_PORT_STATS|ofp4.OFPC_GROUP_STATS|ofp4.OFPC_QUEUE_STATS, // XXX: capabilities
 	)
 	self.resps = append(self.resps, msg.SetXid(self.req.Xid()))
 	return self
@@ -195,31 +212,55 @@ func (self *ofmPortMod) Map() Reducable {
 	pipe := self.pipe
 	msg := ofp4.PortMod(self.req)
 
+	// ofp_port_mod looks for normal port only.
+	var port gopenflow.Port
+	if isPortNo(msg.PortNo()) {
+		port = pipe.getPort(msg.PortNo())
+	}
+	if port == nil {
+		self.putError(ofp4.MakeErrorMsg(ofp4.OFPET_PORT_MOD_FAILED, ofp4.OFPPMFC_BAD_PORT))
+		return self
+	}
+	if msg.HwAddr() != port.HwAddr() {
+		self.putError(ofp4.MakeErrorMsg(ofp4.OFPET_PORT_MOD_FAILED, ofp4.OFPPMFC_BAD_HW_ADDR))
+		return self
+	}
+	known := uint32(ofp4.OFPPC_PORT_DOWN | ofp4.OFPPC_NO_RECV | ofp4.OFPPC_NO_FWD | ofp4.OFPPC_NO_PACKET_IN)
+	if msg.Mask()&^known != 0 {
+		self.putError(ofp4.MakeErrorMsg(ofp4.OFPET_PORT_MOD_FAILED, ofp4.OFPPMFC_BAD_CONFIG))
+		return self
+	}
+
+	// bits not in the mask are kept, and the port gets the whole config.
+	config := portConfig(port)&^msg.Mask() | msg.Config()&msg.Mask()
 	var confs []gopenflow.PortConfig
-	for _, config := range []uint32{
-		ofp4.OFPPC_PORT_DOWN,
-		ofp4.OFPPC_NO_RECV,
-		ofp4.OFPPC_NO_FWD,
-		ofp4.OFPPC_NO_PACKET_IN,
-	} {
-		if msg.Mask()&config != 0 {
-			switch config {
-			case ofp4.OFPPC_PORT_DOWN:
-				confs = append(confs, gopenflow.PortConfigPortDown(msg.Config()&config != 0))
-			case ofp4.OFPPC_NO_RECV:
-				confs = append(confs, gopenflow.PortConfigNoRecv(msg.Config()&config != 0))
-			case ofp4.OFPPC_NO_FWD:
-				confs = append(confs, gopenflow.PortConfigNoFwd(msg.Config()&config != 0))
-			case ofp4.OFPPC_NO_PACKET_IN:
-				confs = append(confs, gopenflow.PortConfigNoPacketIn(msg.Config()&config != 0))
-			}
+	for _, conf := range port.GetConfig() {
+		switch conf.(type) {
+		case gopenflow.PortConfigPortDown, gopenflow.PortConfigNoRecv, gopenflow.PortConfigNoFwd,
+			gopenflow.PortConfigNoPacketIn, gopenflow.PortConfigAdvertise:
+		default:
+			confs = append(confs, conf)
 		}
 	}
-	// ofp_port_mod looks for normal port only.
-	if port := pipe.getPort(msg.PortNo()); port != nil {
-		port.SetConfig(confs)
-	} else {
-		self.putError(ofp4.MakeErrorMsg(ofp4.OFPET_PORT_MOD_FAILED, ofp4.OFPPMFC_BAD_PORT))
+	confs = append(confs,
+		gopenflow.PortConfigPortDown(config&ofp4.OFPPC_PORT_DOWN != 0),
+		gopenflow.PortConfigNoRecv(config&ofp4.OFPPC_NO_RECV != 0),
+		gopenflow.PortConfigNoFwd(config&ofp4.OFPPC_NO_FWD != 0),
+		gopenflow.PortConfigNoPacketIn(config&ofp4.OFPPC_NO_PACKET_IN != 0))
+	if msg.Advertise() != 0 {
+		confs = append(confs, gopenflow.PortConfigAdvertise(msg.Advertise()))
+	}
+	if err := port.SetConfig(confs); err != nil {
+		log.Print(err)
+		code := uint16(ofp4.OFPPMFC_BAD_CONFIG)
+		if e, ok := err.(gopenflow.PortConfigError); ok {
+			if e.Err == syscall.EPERM || e.Err == syscall.EACCES {
+				code = ofp4.OFPPMFC_EPERM
+			} else if _, ok := e.Config.(gopenflow.PortConfigAdvertise); ok {
+				code = ofp4.OFPPMFC_BAD_ADVERTISE
+			}
+		}
+		self.putError(ofp4.MakeErrorMsg(ofp4.OFPET_PORT_MOD_FAILED, code))
 	}
 	return self
 }
@@ -292,16 +333,27 @@ func (self *ofmPacketOut) Map() Reducable {
 			serialized: eth,
 			inPort:     msg.InPort(),
 		}
-		if data.inPort > 0 && data.inPort <= ofp4.OFPP_MAX {
-			data.inPhyPort = self.pipe.getPort(msg.InPort()).PhysicalPort()
+		if isPortNo(data.inPort) {
+			if port := self.pipe.getPort(data.inPort); port != nil {
+				data.inPhyPort = port.PhysicalPort()
+			}
 		}
 		var actions actionList
 		actions.UnmarshalBinary(msg.Actions())
 
+		// OFPTT_ALL of resubmit means table 0 here
+		task := &flowTask{
+			pipe:      self.pipe,
+			actionSet: makeActionSet(),
+		}
 		var gouts []outputToGroup
 		for _, act := range []action(actions) {
 			if pout, gout, e := act.Process(data); e != nil {
-				log.Print(e)
+				if pouts, ok := task.frameExtension(data, e); ok {
+					self.outputs = append(self.outputs, pouts...)
+				} else {
+					log.Print(e)
+				}
 			} else {
 				if pout != nil {
 					self.outputs = append(self.outputs, *pout)
@@ -311,7 +363,7 @@ func (self *ofmPacketOut) Map() Reducable {
 				}
 			}
 		}
-		self.outputs = append(self.outputs, self.pipe.groupToOutput(gouts, nil)...)
+		self.outputs = append(self.outputs, self.pipe.groupToOutput(gouts, nil, task.frameExtension)...)
 	}
 	return self
 }
@@ -400,9 +452,7 @@ func (self *ofmFlowMod) Map() Reducable {
 						}
 					}
 				}
-				if stat.flow.flags&ofp4.OFPFF_SEND_FLOW_REM != 0 {
-					self.pipe.sendFlowRem(stat.tableId, stat.priority, stat.flow, ofp4.OFPRR_DELETE)
-				}
+				self.pipe.flowRemoved(stat.tableId, stat.priority, stat.flow, ofp4.OFPRR_DELETE)
 			}
 		}
 		bufferId = ofp4.OFP_NO_BUFFER // nothing to do with buffer by specification.
@@ -421,9 +471,10 @@ func (self *ofmFlowMod) Map() Reducable {
 		if ok {
 			pipe := self.pipe
 			pipe.datapath <- &flowTask{
-				Frame:   original.Frame,
-				pipe:    self.pipe,
-				tableId: 0,
+				Frame:     original.Frame,
+				pipe:      self.pipe,
+				tableId:   0,
+				actionSet: makeActionSet(),
 			}
 		} else {
 			self.putError(ofp4.MakeErrorMsg(ofp4.OFPET_BAD_REQUEST, ofp4.OFPBRC_BUFFER_UNKNOWN))
@@ -619,7 +670,7 @@ func (self *ofmMpPortStats) Map() Reducable {
 				ethinfo = *p.Ethernet
 			}
 		}
-		duration := self.pipe.portAlive[portNo].Total()
+		duration := self.pipe.portDuration(portNo)
 		chunk := ofp4.MakePortStats(
 			portNo,
 			pstats.RxPackets,
@@ -643,7 +694,7 @@ func (self *ofmMpPortStats) Map() Reducable {
 	portNo := ofp4.PortStatsRequest(mpreq.Body()).PortNo()
 	switch portNo {
 	default:
-		if portNo > 0 && portNo <= ofp4.OFPP_MAX {
+		if isPortNo(portNo) {
 			if port := self.pipe.getPort(portNo); port != nil {
 				proc(portNo, port)
 			} else {
@@ -665,7 +716,43 @@ type ofmMpQueue struct {
 }
 
 func (self *ofmMpQueue) Map() Reducable {
-	// XXX: TODO
+	mpreq := ofp4.MultipartRequest(self.req)
+	req := ofp4.QueueStatsRequest(mpreq.Body())
+
+	portNo := req.PortNo()
+	if portNo != ofp4.OFPP_ANY {
+		if !isPortNo(portNo) || self.pipe.getPort(portNo) == nil {
+			self.putError(ofp4.MakeErrorMsg(ofp4.OFPET_QUEUE_OP_FAILED, ofp4.OFPQOFC_BAD_PORT))
+			return self
+		}
+	}
+
+	found := false
+	for portNo, sched := range self.pipe.getSchedulers(portNo) {
+		func() {
+			sched.lock.Lock()
+			defer sched.lock.Unlock()
+			for queueId, q := range sched.queues {
+				if req.QueueId() != ofp4.OFPQ_ALL && req.QueueId() != queueId {
+					continue
+				}
+				found = true
+				duration := time.Now().Sub(q.created)
+				self.chunks = append(self.chunks, ofp4.MakeQueueStats(
+					portNo,
+					queueId,
+					q.txBytes,
+					q.txPackets,
+					q.txErrors,
+					uint32(duration.Seconds()),
+					uint32(duration.Nanoseconds()%int64(time.Second)),
+				))
+			}
+		}()
+	}
+	if !found && req.QueueId() != ofp4.OFPQ_ALL {
+		self.putError(ofp4.MakeErrorMsg(ofp4.OFPET_QUEUE_OP_FAILED, ofp4.OFPQOFC_BAD_QUEUE))
+	}
 	return self
 }
 
@@ -917,10 +1004,52 @@ type ofmMpExperimenter struct {
 }
 
 func (self *ofmMpExperimenter) Map() Reducable {
-	// XXX:
+	for _, req := range self.reqs {
+		if len(req) < 8 {
+			self.createError(ofp4.OFPET_BAD_REQUEST, ofp4.OFPBRC_BAD_LEN)
+			return self
+		}
+	}
+	exp := ofp4.ExperimenterMultipartHeader(self.reqs[0])
+	switch {
+	case exp.Experimenter() == oxm.NX_EXPERIMENTER_ID && exp.ExpType() == NXST_CT_DUMP:
+		for _, req := range self.reqs {
+			var zone *uint16
+			if len(req) >= 10 {
+				z := binary.BigEndian.Uint16(req[8:])
+				zone = &z
+			}
+			self.chunks = append(self.chunks, self.pipe.conntrack.dump(zone)...)
+		}
+	default:
+		self.createError(ofp4.OFPET_BAD_REQUEST, ofp4.OFPBRC_BAD_EXPERIMENTER)
+	}
 	return self
 }
 
+// Reduce puts ofp_experimenter_multipart_header in each reply.
+func (self *ofmMpExperimenter) Reduce() {
+	if len(self.resps) > 0 {
+		self.ofmReply.Reduce() // error
+		return
+	}
+	hdr := self.reqs[0][:8]
+	payloadMaxLength := math.MaxUint16 - 16
+
+	payload := append([]byte{}, hdr...)
+	for _, chunk := range self.chunks {
+		if len(payload)+len(chunk) >= payloadMaxLength {
+			msg := ofp4.MakeMultipartReply(ofp4.OFPMP_EXPERIMENTER, ofp4.OFPMPF_REPLY_MORE, payload)
+			self.resps = append(self.resps, msg.SetXid(self.req.Xid()))
+			payload = append([]byte{}, hdr...)
+		}
+		payload = append(payload, chunk...)
+	}
+	msg := ofp4.MakeMultipartReply(ofp4.OFPMP_EXPERIMENTER, 0, payload)
+	self.resps = append(self.resps, msg.SetXid(self.req.Xid()))
+	self.ofmReply.Reduce()
+}
+
 type ofmBarrierRequest struct {
 	ofmReply
 }
@@ -936,6 +1065,32 @@ type ofmQueueGetConfigRequest struct {
 }
 
 func (self *ofmQueueGetConfigRequest) Map() Reducable {
+	portNo := ofp4.QueueGetConfigRequest(self.req).Port()
+	if portNo != ofp4.OFPP_ANY {
+		if !isPortNo(portNo) || self.pipe.getPort(portNo) == nil {
+			self.putError(ofp4.MakeErrorMsg(ofp4.OFPET_QUEUE_OP_FAILED, ofp4.OFPQOFC_BAD_PORT))
+			return self
+		}
+	}
+
+	var queues []byte
+	for portNo, sched := range self.pipe.getSchedulers(portNo) {
+		func() {
+			sched.lock.Lock()
+			defer sched.lock.Unlock()
+			for queueId, q := range sched.queues {
+				var props []byte
+				if q.config.MinRate <= 1000 {
+					props = append(props, ofp4.MakeQueuePropMinRate(q.config.MinRate)...)
+				}
+				if q.config.MaxRate <= 1000 {
+					props = append(props, ofp4.MakeQueuePropMaxRate(q.config.MaxRate)...)
+				}
+				queues = append(queues, ofp4.MakePacketQueue(queueId, portNo, props)...)
+			}
+		}()
+	}
+	self.resps = append(self.resps, ofp4.MakeQueueGetConfigReply(portNo, queues).SetXid(self.req.Xid()))
 	return self
 }
 
@@ -979,7 +1134,12 @@ func (self *ofmMeterMod) Map() Reducable {
 		} else {
 			var bands bandList
 			if err := bands.UnmarshalBinary(req.Bands()); err != nil {
-				log.Print(err)
+				if e, ok := err.(ofp4.ErrorMsg); ok {
+					self.putError(e)
+				} else {
+					log.Print(err)
+				}
+				return self
 			}
 
 			var highestBand band
@@ -0,0 +1,63 @@
+package ofp4sw
+
+import (
+	"encoding/binary"
+	"github.com/hkwi/gopenflow"
+	"github.com/hkwi/gopenflow/ofp4"
+	"testing"
+)
+
+func TestPortMod(t *testing.T) {
+	pipe := NewPipeline()
+	hwAddr := [6]byte{2, 0, 0, 0, 1, 1}
+	_, sw := gopenflow.NewMemPortPair("host", [6]byte{2, 0, 0, 0, 0, 1}, "sw", hwAddr)
+	if err := pipe.SetPort(1, sw); err != nil {
+		t.Fatal(err)
+	}
+
+	portMod := func(portNo uint32, hwAddr [6]byte, config, mask uint32) []ofp4.Header {
+		msg := make([]byte, 40)
+		msg[0] = 4
+		msg[1] = ofp4.OFPT_PORT_MOD
+		binary.BigEndian.PutUint16(msg[2:], 40)
+		binary.BigEndian.PutUint32(msg[8:], portNo)
+		copy(msg[16:], hwAddr[:])
+		binary.BigEndian.PutUint32(msg[24:], config)
+		binary.BigEndian.PutUint32(msg[28:], mask)
+		req := &ofmPortMod{ofmReply{pipe: pipe, req: msg}}
+		req.Map()
+		return req.resps
+	}
+	errorCode := func(resps []ofp4.Header) int {
+		if len(resps) == 0 {
+			return -1
+		}
+		return int(binary.BigEndian.Uint16(resps[0][10:]))
+	}
+
+	if code := errorCode(portMod(2, hwAddr, 0, 0)); code != ofp4.OFPPMFC_BAD_PORT {
+		t.Errorf("unexpected error %d", code)
+	}
+	if code := errorCode(portMod(1, [6]byte{}, 0, 0)); code != ofp4.OFPPMFC_BAD_HW_ADDR {
+		t.Errorf("unexpected error %d", code)
+	}
+	if code := errorCode(portMod(1, hwAddr, 0, 0x80000000)); code != ofp4.OFPPMFC_BAD_CONFIG {
+		t.Errorf("unexpected error %d", code)
+	}
+	if code := errorCode(portMod(1, hwAddr, ofp4.OFPPC_NO_FWD, ofp4.OFPPC_NO_FWD)); code != -1 {
+		t.Errorf("unexpected error %d", code)
+	}
+	// config bits not in the mask are kept
+	if code := errorCode(portMod(1, hwAddr, ofp4.OFPPC_NO_RECV, ofp4.OFPPC_NO_RECV)); code != -1 {
+		t.Errorf("unexpected error %d", code)
+	}
+	if config := portConfig(sw); config != ofp4.OFPPC_NO_FWD|ofp4.OFPPC_NO_RECV {
+		t.Errorf("unexpected config %x", config)
+	}
+	if code := errorCode(portMod(1, hwAddr, 0, ofp4.OFPPC_NO_FWD)); code != -1 {
+		t.Errorf("unexpected error %d", code)
+	}
+	if config := portConfig(sw); config != ofp4.OFPPC_NO_RECV {
+		t.Errorf("unexpected config %x", config)
+	}
+}
@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"github.com/hkwi/gopenflow/ofp4"
 	"github.com/hkwi/gopenflow/oxm"
 	bytes2 "github.com/hkwi/suppl/bytes"
+	"net"
 )
 
 /*
@@ -24,6 +26,141 @@ type ActionHandler interface {
 	Execute(frame *Frame, actionData []byte) error
 }
 
+/*
+AddMeterBandHandler registers this MeterBandHandler.
+
+Execute will be called when the experimenter meter band was triggered.
+The handler may modify the frame, for example setting some mark field,
+or return MeterDrop to drop the frame, or return MeterRedirect to send
+the frame out to another port instead of continuing the pipeline.
+*/
+type MeterBandHandler interface {
+	Execute(frame *Frame, bandData []byte) error
+}
+
+// MeterDrop is returned by MeterBandHandler to drop the frame.
+var MeterDrop error = &packetDrop{}
+
+// MeterRedirect is returned by MeterBandHandler to redirect the frame to Port.
+type MeterRedirect struct {
+	Port uint32
+}
+
+func (self MeterRedirect) Error() string {
+	return fmt.Sprintf("meter redirect to port %d", self.Port)
+}
+
+// ActionOutput is returned by ActionHandler to send the frame out to Port, as OFPAT_OUTPUT does.
+type ActionOutput struct {
+	Port   uint32
+	MaxLen uint16
+}
+
+func (self ActionOutput) Error() string {
+	return fmt.Sprintf("action output to port %d", self.Port)
+}
+
+// ActionResubmit is returned by ActionHandler to look up TableId as if the frame
+// was received on InPort, and then continue the rest of the actions.
+// OFPP_IN_PORT and OFPTT_ALL means the current in_port and the current table.
+type ActionResubmit struct {
+	InPort  uint32
+	TableId uint8
+}
+
+func (self ActionResubmit) Error() string {
+	return fmt.Sprintf("action resubmit to table %d", self.TableId)
+}
+
+// ActionFlowMod is returned by ActionHandler to add a flow from the datapath,
+// and then continue the rest of the actions. The flow is validated as OFPFC_ADD.
+// Non-zero FinIdleTimeout and FinHardTimeout shorten the timeouts
+// after the flow matched TCP FIN or RST.
+type ActionFlowMod struct {
+	FlowMod        ofp4.FlowMod
+	FinIdleTimeout uint16
+	FinHardTimeout uint16
+}
+
+func (self ActionFlowMod) Error() string {
+	return fmt.Sprintf("action flow mod for table %d", self.FlowMod.TableId())
+}
+
+// ActionConntrack is returned by ActionHandler to send a copy of the frame to the
+// connection tracker in Zone, and then continue the rest of the actions.
+// The copy is recirculated into Table with ct_state, ct_zone, ct_mark and ct_label
+// set, unless Table is OFPTT_ALL. Mark and Label are written within their masks
+// into the connection on Commit. Force commits the connection as a new one if the
+// frame was in the reply direction of an existing connection. With Nat, both the
+// frame and the copy are translated, while the ct fields of the frame are kept.
+type ActionConntrack struct {
+	Zone      uint16
+	Commit    bool
+	Force     bool
+	Table     uint8
+	Mark      uint32
+	MarkMask  uint32
+	Label     [16]byte
+	LabelMask [16]byte
+	Nat       *ConntrackNat
+}
+
+func (self ActionConntrack) Error() string {
+	return fmt.Sprintf("action conntrack in zone %d", self.Zone)
+}
+
+// ActionSample is returned by ActionHandler to export the frame to the sFlow
+// exporter of CollectorSetId by the probability of Probability/65535, and then
+// continue the rest of the actions. See Pipeline.SetSflow.
+type ActionSample struct {
+	Probability    uint16
+	CollectorSetId uint32
+	ObsDomainId    uint32
+	ObsPointId     uint32
+}
+
+func (self ActionSample) Error() string {
+	return fmt.Sprintf("action sample for collector set %d", self.CollectorSetId)
+}
+
+// ConntrackNat is the address translation of ActionConntrack. Connections
+// translated on Commit are translated for every ActionConntrack with Nat, and
+// replies are translated back. Without Src nor Dst, only existing translation
+// is applied.
+//
+// New connection gets an address in AddrMin to AddrMax, or keeps the address if
+// AddrMin is nil. The port is chosen in PortMin to PortMax, or kept if possible
+// when PortMin is zero. ICMP identifiers are always kept.
+type ConntrackNat struct {
+	Src        bool
+	Dst        bool
+	AddrMin    net.IP
+	AddrMax    net.IP
+	PortMin    uint16
+	PortMax    uint16
+	Persistent bool // address selection does not depend on the destination
+	Random     bool // port selection starts from a random port, instead of a hash
+}
+
+// ActionConjunction is the clause of the conjunctive match Id, reported by
+// ConjunctionHandler. Clause is the zero based index in NClauses.
+type ActionConjunction struct {
+	Id       uint32
+	Clause   uint8
+	NClauses uint8
+}
+
+/*
+ConjunctionHandler may be implemented by ActionHandler.
+
+Flows of which apply-actions are all conjunctions are not executed. Instead,
+the flow matching conj_id is looked up when all the clauses of the conjunction
+matched in the same priority.
+*/
+type ConjunctionHandler interface {
+	Conjunction(actionData []byte) (ActionConjunction, bool)
+}
+
 // common oxm representation for extension API
 
 // OxmKey is experimenter oxm key.
@@ -97,7 +234,7 @@ func (self OxmValueMask) Set(value []byte) error {
 		return fmt.Errorf("field length mismatch")
 	}
 	if len(self.Mask) > 0 {
-		for i,v := range value {
+		for i, v := range value {
 			value[i] = (v &^ self.Mask[i]) | (self.Value[i] & self.Mask[i])
 		}
 	} else {
@@ -128,7 +265,7 @@ func (self OxmKeyExp) Bytes(payload OxmPayload) []byte {
 	if len(mask) > 0 {
 		hdr.SetMask(true)
 	}
-	buf = make([]byte, 8+len(value)+len(mask))
+	buf := make([]byte, 8+len(value)+len(mask))
 	hdr.SetLength(4 + len(value) + len(mask))
 	binary.BigEndian.PutUint32(buf, uint32(hdr))
 	binary.BigEndian.PutUint32(buf[4:], self.Experimenter)
@@ -196,3 +333,14 @@ func AddTableHandler(experimenter uint32, expType uint32, handler TableHandler)
 type MessageHandler interface {
 	Execute(request []byte) (response [][]byte)
 }
+
+/*
+PipelineMessageHandler may be implemented by MessageHandler.
+
+ExecutePipeline is called instead of Execute, with the pipeline which received
+the request, so that the handler can configure the pipeline. Returning
+ofp4.ErrorMsg responds with the error message.
+*/
+type PipelineMessageHandler interface {
+	ExecutePipeline(pipe *Pipeline, request []byte) (response [][]byte, err error)
+}
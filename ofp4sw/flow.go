@@ -6,6 +6,7 @@ import (
 	"github.com/hkwi/gopenflow"
 	"github.com/hkwi/gopenflow/ofp4"
 	"github.com/hkwi/gopenflow/oxm"
+	"hash/fnv"
 	"log"
 	"sort"
 	"sync"
@@ -13,6 +14,32 @@ import (
 )
 
 func (pipe Pipeline) addFlowEntry(req ofp4.FlowMod) error {
+	flow, err := newFlowEntry(req)
+	if err != nil {
+		return err
+	}
+	return pipe.insertFlowEntry(req, flow)
+}
+
+// learn adds the flow for ActionFlowMod. This is safe inside flowTask.Map,
+// because no lock is held while actions are executed.
+func (pipe Pipeline) learn(mod ActionFlowMod) error {
+	if mod.FlowMod.Command() != ofp4.OFPFC_ADD {
+		return ofp4.MakeErrorMsg(
+			ofp4.OFPET_FLOW_MOD_FAILED,
+			ofp4.OFPFMFC_BAD_COMMAND,
+		)
+	}
+	flow, err := newFlowEntry(mod.FlowMod)
+	if err != nil {
+		return err
+	}
+	flow.finIdleTimeout = mod.FinIdleTimeout
+	flow.finHardTimeout = mod.FinHardTimeout
+	return pipe.insertFlowEntry(mod.FlowMod, flow)
+}
+
+func (pipe Pipeline) insertFlowEntry(req ofp4.FlowMod, flow *flowEntry) error {
 	tableId := req.TableId()
 	if tableId > ofp4.OFPTT_MAX {
 		return ofp4.MakeErrorMsg(
@@ -33,14 +60,18 @@ func (pipe Pipeline) addFlowEntry(req ofp4.FlowMod) error {
 		}
 		pipe.flows[tableId] = table
 	}
-	return table.addFlowEntry(req, pipe)
+	return table.addFlowEntry(req, flow, pipe)
 }
 
-func (self Pipeline) validate(now time.Time) {
+func (self *Pipeline) validate(now time.Time) {
 	self.lock.Lock()
 	defer self.lock.Unlock()
 
-	for _, table := range self.flows {
+	for tableId, table := range self.flows {
+		if table == nil {
+			continue
+		}
+		tableId := tableId
 		table := table
 		go func() {
 			table.lock.Lock()
@@ -61,9 +92,7 @@ func (self Pipeline) validate(now time.Time) {
 								validFlows = append(validFlows, flow)
 							} else {
 								do_rebuild = true
-								if flow.flags&ofp4.OFPFF_SEND_FLOW_REM != 0 {
-									//
-								}
+								self.flowRemoved(tableId, prio.priority, flow, uint8(reason))
 							}
 						}
 					}
@@ -85,11 +114,7 @@ type flowTable struct {
 	feature     flowTableFeature
 }
 
-func (self *flowTable) addFlowEntry(req ofp4.FlowMod, pipe Pipeline) error {
-	flow, e1 := newFlowEntry(req)
-	if e1 != nil {
-		return e1
-	}
+func (self *flowTable) addFlowEntry(req ofp4.FlowMod, flow *flowEntry, pipe Pipeline) error {
 	if err := self.feature.accepts(flow, req.Priority()); err != nil {
 		return err
 	}
@@ -166,6 +191,94 @@ type flowPriority struct {
 	flows    map[uint32][]*flowEntry // entries in the same priority
 }
 
+// lookup returns the flow entry for the frame, in the order of priority.
+// When all the clauses of a conjunction matched in a priority, the flow matching
+// conj_id is looked up again in the whole table, without conjunctive matches.
+// invoke this method inside a mutex guard.
+func (self *flowTable) lookup(data *Frame, conjunctive bool) (*flowEntry, uint16) {
+	for _, prio := range self.priorities {
+		flow, conjIds := prio.lookup(*data, conjunctive)
+		if flow != nil {
+			return flow, prio.priority
+		}
+		for _, id := range conjIds {
+			key := OxmKeyBasic(oxm.NXM_NX_CONJ_ID)
+			if data.Oob == nil {
+				data.Oob = make(map[OxmKey]OxmPayload)
+			}
+			last, exists := data.Oob[key]
+			value := make([]byte, 4)
+			binary.BigEndian.PutUint32(value, id)
+			data.Oob[key] = OxmValueMask{Value: value}
+
+			flow, priority := self.lookup(data, false)
+
+			if exists {
+				data.Oob[key] = last
+			} else {
+				delete(data.Oob, key)
+			}
+			if flow != nil {
+				return flow, priority
+			}
+		}
+	}
+	return nil, 0
+}
+
+// lookup returns the first matching flow which is not a conjunctive match.
+// If there was no such flow, the conjunction ids of which all the clauses
+// matched are returned in ascending order.
+func (self *flowPriority) lookup(data Frame, conjunctive bool) (*flowEntry, []uint32) {
+	hasher := fnv.New32()
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	for hashKey, hashPayload := range self.hash {
+		basicKey := hashKey.(OxmKeyBasic)
+		basicPayload := hashPayload.(OxmValueMask)
+		if buf, err := data.getValue(uint32(basicKey)); err != nil {
+			log.Println(err)
+			return nil, nil
+		} else {
+			hasher.Write(maskBytes(buf, basicPayload.Mask))
+		}
+	}
+	type clauses struct {
+		n       uint8
+		matched uint64
+	}
+	var conjs map[uint32]*clauses
+	for _, flow := range self.flows[hasher.Sum32()] {
+		if len(flow.conjunctions) > 0 && !conjunctive {
+			continue
+		}
+		if !flow.fields.Match(data) {
+			continue
+		}
+		if len(flow.conjunctions) == 0 {
+			return flow, nil
+		}
+		if conjs == nil {
+			conjs = make(map[uint32]*clauses)
+		}
+		for _, conj := range flow.conjunctions {
+			if c, ok := conjs[conj.Id]; !ok {
+				conjs[conj.Id] = &clauses{conj.NClauses, 1 << conj.Clause}
+			} else if c.n == conj.NClauses {
+				c.matched |= 1 << conj.Clause
+			}
+		}
+	}
+	var ids []uint32
+	for id, c := range conjs {
+		if c.matched == 1<<c.n-1 {
+			ids = append(ids, id)
+		}
+	}
+	sort.Sort(uint32List(ids))
+	return nil, ids
+}
+
 /* invoke this method inside a mutex guard. */
 func (self *flowPriority) rebuildIndex(flows []*flowEntry) {
 	hash := matchHash(make(map[OxmKey]OxmPayload))
@@ -202,6 +315,9 @@ type flowEntry struct {
 	flags       uint16 // OFPFF_
 	idleTimeout uint16
 	hardTimeout uint16
+	// timeouts after TCP FIN or RST, for ActionFlowMod
+	finIdleTimeout uint16
+	finHardTimeout uint16
 
 	instMeter    uint32
 	instApply    actionList
@@ -210,6 +326,8 @@ type flowEntry struct {
 	instMetadata *metadataInstruction
 	instGoto     uint8
 	instExp      map[int][]instExperimenter
+	// clauses of conjunctive match, instead of instructions
+	conjunctions []ActionConjunction
 }
 
 func newFlowEntry(req ofp4.FlowMod) (*flowEntry, error) {
@@ -217,11 +335,15 @@ func newFlowEntry(req ofp4.FlowMod) (*flowEntry, error) {
 	if err := reqMatch.UnmarshalBinary(req.Match().OxmFields()); err != nil {
 		return nil, err
 	}
+	if _, err := reqMatch.Expand(); err != nil {
+		return nil, err
+	}
 	entry := &flowEntry{
 		lock:        &sync.RWMutex{},
 		fields:      reqMatch,
 		cookie:      req.Cookie(),
 		created:     time.Now(),
+		flags:       req.Flags(),
 		idleTimeout: req.IdleTimeout(),
 		hardTimeout: req.HardTimeout(),
 		instWrite:   makeActionSet(),
@@ -230,9 +352,58 @@ func newFlowEntry(req ofp4.FlowMod) (*flowEntry, error) {
 	if err := entry.importInstructions(req.Instructions()); err != nil {
 		return nil, err
 	}
+	if err := entry.importConjunctions(); err != nil {
+		return nil, err
+	}
 	return entry, nil
 }
 
+// importConjunctions collects the conjunction actions. Conjunctive match flow
+// must not have other actions nor instructions.
+func (entry *flowEntry) importConjunctions() error {
+	var conjunctions []ActionConjunction
+	for _, act := range entry.instApply {
+		if exp, ok := act.(actionExperimenter); ok {
+			if handler, ok := exp.Handler.(ConjunctionHandler); ok {
+				if conj, ok := handler.Conjunction(exp.Data); ok {
+					if conj.NClauses < 2 || conj.NClauses > 64 || conj.Clause >= conj.NClauses {
+						return ofp4.MakeErrorMsg(ofp4.OFPET_BAD_ACTION, ofp4.OFPBAC_BAD_ARGUMENT)
+					}
+					conjunctions = append(conjunctions, conj)
+				}
+			}
+		}
+	}
+	if len(conjunctions) == 0 {
+		return nil
+	}
+	if len(conjunctions) != len(entry.instApply) || entry.instMeter != 0 || entry.instClear ||
+		entry.instWrite.Len() != 0 || entry.instMetadata != nil || entry.instGoto != 0 || len(entry.instExp) != 0 {
+		return ofp4.MakeErrorMsg(ofp4.OFPET_BAD_ACTION, ofp4.OFPBAC_BAD_ARGUMENT)
+	}
+	entry.conjunctions = conjunctions
+	return nil
+}
+
+// finTimeout shortens the timeouts if the frame was TCP FIN or RST.
+// invoke this method inside a mutex guard.
+func (self *flowEntry) finTimeout(data *Frame) {
+	if self.finIdleTimeout == 0 && self.finHardTimeout == 0 {
+		return
+	}
+	if flags, err := oxmNxmHandler.getValue(data, OxmKeyBasic(oxm.NXM_NX_TCP_FLAGS)); err != nil || len(flags) != 2 {
+		return
+	} else if flags[1]&0x05 == 0 { // FIN, RST
+		return
+	}
+	if self.finIdleTimeout != 0 && (self.idleTimeout == 0 || self.idleTimeout > self.finIdleTimeout) {
+		self.idleTimeout = self.finIdleTimeout
+	}
+	if self.finHardTimeout != 0 && (self.hardTimeout == 0 || self.hardTimeout > self.finHardTimeout) {
+		self.hardTimeout = self.finHardTimeout
+	}
+}
+
 func (self flowEntry) valid(now time.Time) int {
 	if self.idleTimeout != 0 && now.Sub(self.touched) > time.Duration(self.idleTimeout)*time.Second {
 		return ofp4.OFPRR_IDLE_TIMEOUT
@@ -266,7 +437,7 @@ func (entry *flowEntry) importInstructions(instructions ofp4.Instruction) error
 			i := ofp4.InstructionActions(inst)
 			switch inst.Type() {
 			case ofp4.OFPIT_WRITE_ACTIONS:
-				var aset actionSet
+				aset := makeActionSet()
 				if err := aset.UnmarshalBinary(i.Actions()); err != nil {
 					return err
 				}
@@ -363,6 +534,21 @@ func (self flowEntryList) Swap(i, j int) {
 	l[i], l[j] = l[j], l[i]
 }
 
+// sort.Interface for conjunction ids
+type uint32List []uint32
+
+func (self uint32List) Len() int {
+	return len(self)
+}
+
+func (self uint32List) Less(i, j int) bool {
+	return self[i] < self[j]
+}
+
+func (self uint32List) Swap(i, j int) {
+	self[i], self[j] = self[j], self[i]
+}
+
 type metadataInstruction struct {
 	metadata uint64
 	mask     uint64
@@ -414,6 +600,9 @@ func (pipe Pipeline) filterFlowsInside(req flowFilter) []flowStats {
 		waits := 0
 		reducer := make(chan []flowStats)
 		for tableId, table := range pipe.flows {
+			if table == nil {
+				continue
+			}
 			tableId := tableId
 			table := table
 			go func() {
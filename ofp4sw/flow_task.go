@@ -2,11 +2,16 @@ package ofp4sw
 
 import (
 	"github.com/hkwi/gopenflow/ofp4"
-	"hash/fnv"
+	"github.com/hkwi/gopenflow/oxm"
 	"log"
 	"time"
 )
 
+const (
+	resubmitDepthMax = 64
+	resubmitMax      = 4096
+)
+
 type flowTask struct {
 	Frame
 	// ref
@@ -20,6 +25,11 @@ type flowTask struct {
 	// output will be set only by standard action
 	outputs   []outputToPort
 	nextTable uint8
+	// nested lookup by ActionResubmit
+	depth     int
+	resubmits int
+	// recirculation by ActionConntrack
+	recirculations int
 }
 
 func (self *flowTask) Map() Reducable {
@@ -27,6 +37,15 @@ func (self *flowTask) Map() Reducable {
 	self.outputs = self.outputs[:0]
 	self.nextTable = 0
 
+	if self.tableId == 0 && self.pipe.standalone() {
+		self.outputs = append(self.outputs, outputToPort{
+			Frame:   self.Frame.clone(),
+			outPort: ofp4.OFPP_NORMAL,
+			reason:  ofp4.OFPR_ACTION,
+		})
+		return self
+	}
+
 	// lookup phase
 	var entry *flowEntry
 	var priority uint16
@@ -43,35 +62,7 @@ func (self *flowTask) Map() Reducable {
 	func() {
 		table.lock.RLock()
 		defer table.lock.RUnlock()
-		for _, prio := range table.priorities {
-			entry, priority = func() (*flowEntry, uint16) {
-				hasher := fnv.New32()
-				prio.lock.RLock()
-				defer prio.lock.RUnlock()
-				for hashKey, hashPayload := range prio.hash {
-					basicKey := hashKey.(OxmKeyBasic)
-					basicPayload := hashPayload.(OxmValueMask)
-					if buf, err := self.getValue(uint32(basicKey)); err != nil {
-						log.Println(err)
-						return nil, 0
-					} else {
-						hasher.Write(maskBytes(buf, basicPayload.Mask))
-					}
-				}
-				if flows, ok := prio.flows[hasher.Sum32()]; ok {
-					for _, flow := range flows {
-						if flow.fields.Match(self.Frame) {
-							return flow, prio.priority
-						}
-					}
-				}
-				return nil, 0
-			}()
-			if entry != nil {
-				return
-			}
-		}
-		return
+		entry, priority = table.lookup(&self.Frame, true)
 	}()
 	// execution
 	var groups []outputToGroup
@@ -95,6 +86,7 @@ func (self *flowTask) Map() Reducable {
 				}
 			}
 			entry.touched = time.Now()
+			entry.finTimeout(&self.Frame)
 		}()
 
 		instExp := func(pos int) error {
@@ -117,6 +109,14 @@ func (self *flowTask) Map() Reducable {
 				if err := meter.process(&self.Frame); err != nil {
 					if _, ok := err.(*packetDrop); ok {
 						// no log
+					} else if redirect, ok := err.(MeterRedirect); ok {
+						self.outputs = append(self.outputs, outputToPort{
+							Frame:   self.Frame.clone(),
+							outPort: redirect.Port,
+							maxLen:  ofp4.OFPCML_NO_BUFFER,
+							tableId: self.tableId,
+							reason:  ofp4.OFPR_ACTION,
+						})
 					} else {
 						log.Println(err)
 					}
@@ -132,7 +132,9 @@ func (self *flowTask) Map() Reducable {
 
 		for _, act := range entry.instApply {
 			if pout, gout, err := act.Process(&self.Frame); err != nil {
-				log.Print(err)
+				if !self.extension(err) {
+					log.Print(err)
+				}
 			} else {
 				if pout != nil {
 					pout.tableId = self.tableId
@@ -184,8 +186,9 @@ func (self *flowTask) Map() Reducable {
 
 		if entry.instGoto != 0 {
 			self.nextTable = entry.instGoto
-		} else {
-			pouts, gouts := actionSet(self.actionSet).Process(&self.Frame)
+		} else if self.depth == 0 {
+			// action set of resubmitted lookup is executed at the end of the pipeline
+			pouts, gouts := actionSet(self.actionSet).Process(&self.Frame, self.frameExtension)
 			self.outputs = append(self.outputs, pouts...)
 			groups = append(groups, gouts...)
 		}
@@ -197,13 +200,129 @@ func (self *flowTask) Map() Reducable {
 	}
 	// process groups if any
 	if len(groups) > 0 {
-		self.outputs = append(self.outputs, self.pipe.groupToOutput(groups, nil)...)
+		self.outputs = append(self.outputs, self.pipe.groupToOutput(groups, nil, self.frameExtension)...)
 	}
 	return self
 }
 
+// resubmit runs nested lookup on the frame. Modifications and action set
+// written in the nested lookup are kept, while in_port is restored.
+func (self *flowTask) resubmit(r ActionResubmit) {
+	if self.depth >= resubmitDepthMax || self.resubmits >= resubmitMax {
+		log.Print("resubmit limit exceeded")
+		return
+	}
+	sub := &flowTask{
+		Frame:          self.Frame,
+		pipe:           self.pipe,
+		tableId:        r.TableId,
+		actionSet:      self.actionSet,
+		depth:          self.depth + 1,
+		resubmits:      self.resubmits + 1,
+		recirculations: self.recirculations,
+	}
+	if r.TableId == ofp4.OFPTT_ALL {
+		sub.tableId = self.tableId
+	}
+	if r.InPort != ofp4.OFPP_IN_PORT {
+		sub.inPort = r.InPort
+	}
+	for {
+		sub.Map()
+		self.outputs = append(self.outputs, sub.outputs...)
+		if sub.nextTable == 0 || sub.isInvalid() {
+			break
+		}
+		sub.tableId = sub.nextTable
+	}
+	inPort := self.inPort
+	self.Frame = sub.Frame
+	self.inPort = inPort
+	self.resubmits = sub.resubmits
+}
+
+// extension processes the request returned by ActionHandler.
+// Returns false if err was not a request.
+func (self *flowTask) extension(err error) bool {
+	switch req := err.(type) {
+	case ActionResubmit:
+		self.resubmit(req)
+	case ActionFlowMod:
+		if err := self.pipe.learn(req); err != nil {
+			log.Print(err)
+		}
+	case ActionConntrack:
+		self.conntrack(req)
+	case ActionSample:
+		self.pipe.sample(&self.Frame, req)
+	default:
+		return false
+	}
+	return true
+}
+
+// frameExtension processes the request on data, which is the frame of the
+// action set or of a group bucket. Resubmit limits are shared with the task.
+func (self *flowTask) frameExtension(data *Frame, err error) ([]outputToPort, bool) {
+	task := &flowTask{
+		Frame:          *data,
+		pipe:           self.pipe,
+		tableId:        self.tableId,
+		actionSet:      makeActionSet(),
+		depth:          self.depth,
+		resubmits:      self.resubmits,
+		recirculations: self.recirculations,
+	}
+	if !task.extension(err) {
+		return nil, false
+	}
+	*data = task.Frame
+	self.resubmits = task.resubmits
+	return task.outputs, true
+}
+
+// conntrack sends a copy of the frame to the connection tracker, and
+// recirculates the copy. The frame itself is only translated by NAT.
+func (self *flowTask) conntrack(req ActionConntrack) {
+	if req.Table != ofp4.OFPTT_ALL && self.recirculations >= recirculateMax {
+		log.Print("recirculation limit exceeded")
+		return
+	}
+	data := self.Frame.clone()
+	if data.isInvalid() {
+		return
+	}
+	pipe := self.pipe
+	pipe.conntrack.process(&data, req, pipe.conntrackTimeouts())
+	if data.ctState&(oxm.NX_CT_STATE_SNAT|oxm.NX_CT_STATE_DNAT) != 0 {
+		if eth, err := data.Serialized(); err != nil {
+			log.Print(err)
+		} else {
+			self.SetSerialized(append([]byte{}, eth...))
+		}
+	}
+	if req.Table != ofp4.OFPTT_ALL {
+		task := &flowTask{
+			Frame:          data,
+			pipe:           pipe,
+			tableId:        req.Table,
+			actionSet:      makeActionSet(),
+			recirculations: self.recirculations + 1,
+		}
+		task.actionSet.Write(self.actionSet)
+		select {
+		case pipe.recirculation <- task:
+		default:
+			pipe.lock.Lock()
+			pipe.recirculationDrops++
+			pipe.lock.Unlock()
+			log.Print("recirculation queue full")
+		}
+	}
+}
+
 /* groupToOutput is for recursive call */
-func (self Pipeline) groupToOutput(groups []outputToGroup, processed []uint32) []outputToPort {
+func (self Pipeline) groupToOutput(groups []outputToGroup, processed []uint32, ext actionExtension) []outputToPort {
 	var result []outputToPort
 	for _, gout := range groups {
 		for _, gid := range processed {
@@ -213,10 +332,10 @@ func (self Pipeline) groupToOutput(groups []outputToGroup, processed []uint32) [
 			}
 		}
 		if group := self.getGroup(gout.groupId); group != nil {
-			p, g := group.process(&gout.Frame, self)
+			p, g := group.process(&gout.Frame, self, ext)
 			processed := append(processed, gout.groupId)
 			result = append(result, p...)
-			result = append(result, self.groupToOutput(g, processed)...)
+			result = append(result, self.groupToOutput(g, processed, ext)...)
 		}
 	}
 	return result
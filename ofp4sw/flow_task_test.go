@@ -0,0 +1,325 @@
+package ofp4sw
+
+import (
+	"encoding/binary"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/hkwi/gopenflow"
+	"github.com/hkwi/gopenflow/ofp4"
+	"github.com/hkwi/gopenflow/oxm"
+	"net"
+	"testing"
+	"time"
+)
+
+const flowTaskTestExperimenter = 0xFF0000F1
+
+// flowTaskTestAction resubmits to table data[1] if data[0] is 1, outputs to port data[1] if data[0] is 2,
+// adds a flow to table data[1] which outputs to port 2 if data[0] is 3, tracks the connection in zone 3
+// and recirculates into table data[1] if data[0] is 4, and commits the connection in zone 3 if data[0] is 5.
+// data[0] 6 is the clause data[2] of data[3] in the conjunction data[1].
+// data[0] 7 samples every frame for the collector set data[1].
+type flowTaskTestAction struct{}
+
+func (self flowTaskTestAction) Order(data []byte) int {
+	return ACTION_ORDER_GROUP_TO_OUTPUT
+}
+
+func (self flowTaskTestAction) Execute(frame *Frame, data []byte) error {
+	switch data[0] {
+	case 1:
+		return ActionResubmit{
+			InPort:  ofp4.OFPP_IN_PORT,
+			TableId: data[1],
+		}
+	case 2:
+		return ActionOutput{
+			Port: uint32(data[1]),
+		}
+	case 3:
+		return ActionFlowMod{
+			FlowMod: nxmTestFlowMod(data[1], nxmTestField(oxm.OXM_OF_IN_PORT, []byte{0, 0, 0, 1}, nil),
+				ofp4.MakeInstructionActions(ofp4.OFPIT_APPLY_ACTIONS, ofp4.MakeActionOutput(2, 0))),
+			FinIdleTimeout: 1,
+		}
+	case 4:
+		return ActionConntrack{
+			Zone:  3,
+			Table: data[1],
+		}
+	case 5:
+		return ActionConntrack{
+			Zone:   3,
+			Commit: true,
+			Table:  ofp4.OFPTT_ALL,
+		}
+	case 7:
+		return ActionSample{
+			Probability:    0xffff,
+			CollectorSetId: uint32(data[1]),
+		}
+	}
+	return nil
+}
+
+func (self flowTaskTestAction) Conjunction(data []byte) (ActionConjunction, bool) {
+	if data[0] != 6 {
+		return ActionConjunction{}, false
+	}
+	return ActionConjunction{
+		Id:       uint32(data[1]),
+		Clause:   data[2],
+		NClauses: data[3],
+	}, true
+}
+
+func flowTaskTestActionBytes(op, arg uint8) []byte {
+	buf := append(ofp4.MakeActionExperimenterHeader(flowTaskTestExperimenter), op, arg, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(buf[2:], uint16(len(buf)))
+	return buf
+}
+
+func TestFlowTaskResubmit(t *testing.T) {
+	AddActionHandler(flowTaskTestExperimenter, flowTaskTestAction{})
+
+	pipe := NewPipeline()
+	host1, sw1 := gopenflow.NewMemPortPair("h1", [6]byte{2, 0, 0, 0, 0, 1}, "sw1", [6]byte{2, 0, 0, 0, 1, 1})
+	host2, sw2 := gopenflow.NewMemPortPair("h2", [6]byte{2, 0, 0, 0, 0, 2}, "sw2", [6]byte{2, 0, 0, 0, 1, 2})
+	if err := pipe.SetPort(1, sw1); err != nil {
+		t.Fatal(err)
+	}
+	if err := pipe.SetPort(2, sw2); err != nil {
+		t.Fatal(err)
+	}
+
+	var actions []byte
+	actions = append(actions, ofp4.MakeActionSetField(nxmTestField(oxm.NXM_NX_REG0, []byte{0, 0, 0, 5}, nil))...)
+	actions = append(actions, flowTaskTestActionBytes(1, 1)...)
+	actions = append(actions, ofp4.MakeActionSetField(nxmTestField(oxm.NXM_NX_REG0, []byte{0, 0, 0, 6}, nil))...)
+	actions = append(actions, flowTaskTestActionBytes(1, 1)...)
+	if err := pipe.addFlowEntry(nxmTestFlowMod(0, nxmTestField(oxm.OXM_OF_IN_PORT, []byte{0, 0, 0, 1}, nil),
+		ofp4.MakeInstructionActions(ofp4.OFPIT_APPLY_ACTIONS, actions))); err != nil {
+		t.Fatal(err)
+	}
+	// reg0=5 is sent out by the experimenter, while reg0=6 is sent out by the action set at the end
+	if err := pipe.addFlowEntry(nxmTestFlowMod(1, nxmTestField(oxm.NXM_NX_REG0, []byte{0, 0, 0, 5}, nil),
+		ofp4.MakeInstructionActions(ofp4.OFPIT_APPLY_ACTIONS, flowTaskTestActionBytes(2, 2)))); err != nil {
+		t.Fatal(err)
+	}
+	if err := pipe.addFlowEntry(nxmTestFlowMod(1, nxmTestField(oxm.NXM_NX_REG0, []byte{0, 0, 0, 6}, nil),
+		ofp4.MakeInstructionActions(ofp4.OFPIT_WRITE_ACTIONS, ofp4.MakeActionOutput(2, 0)))); err != nil {
+		t.Fatal(err)
+	}
+	// infinite loop
+	if err := pipe.addFlowEntry(nxmTestFlowMod(0, nxmTestField(oxm.OXM_OF_IN_PORT, []byte{0, 0, 0, 2}, nil),
+		ofp4.MakeInstructionActions(ofp4.OFPIT_APPLY_ACTIONS, flowTaskTestActionBytes(1, ofp4.OFPTT_ALL)))); err != nil {
+		t.Fatal(err)
+	}
+
+	host1.Egress(gopenflow.Frame{Data: make([]byte, 64)})
+	for i := 0; i < 2; i++ {
+		select {
+		case <-host2.Ingress():
+		case <-time.After(time.Second):
+			t.Fatalf("resubmit output %d not delivered", i)
+		}
+	}
+
+	host2.Egress(gopenflow.Frame{Data: make([]byte, 64)})
+	select {
+	case fr := <-host1.Ingress():
+		t.Errorf("unexpected frame %v", fr)
+	case <-time.After(100 * time.Millisecond):
+	}
+	// pipeline must be alive after the loop
+	host1.Egress(gopenflow.Frame{Data: make([]byte, 64)})
+	select {
+	case <-host2.Ingress():
+	case <-time.After(time.Second):
+		t.Fatal("pipeline stalled by resubmit loop")
+	}
+}
+
+func TestFlowTaskResubmitActionSet(t *testing.T) {
+	AddActionHandler(flowTaskTestExperimenter, flowTaskTestAction{})
+
+	pipe := NewPipeline()
+	host1, sw1 := gopenflow.NewMemPortPair("h1", [6]byte{2, 0, 0, 0, 0, 1}, "sw1", [6]byte{2, 0, 0, 0, 1, 1})
+	host2, sw2 := gopenflow.NewMemPortPair("h2", [6]byte{2, 0, 0, 0, 0, 2}, "sw2", [6]byte{2, 0, 0, 0, 1, 2})
+	if err := pipe.SetPort(1, sw1); err != nil {
+		t.Fatal(err)
+	}
+	if err := pipe.SetPort(2, sw2); err != nil {
+		t.Fatal(err)
+	}
+
+	// resubmit in write-actions
+	if err := pipe.addFlowEntry(nxmTestFlowMod(0, nxmTestField(oxm.OXM_OF_IN_PORT, []byte{0, 0, 0, 1}, nil),
+		ofp4.MakeInstructionActions(ofp4.OFPIT_WRITE_ACTIONS, flowTaskTestActionBytes(1, 1)))); err != nil {
+		t.Fatal(err)
+	}
+	if err := pipe.addFlowEntry(nxmTestFlowMod(1, nil,
+		ofp4.MakeInstructionActions(ofp4.OFPIT_APPLY_ACTIONS, ofp4.MakeActionOutput(2, 0)))); err != nil {
+		t.Fatal(err)
+	}
+	// resubmit in group bucket
+	gmod := []byte{0, 0, ofp4.OFPGT_ALL, 0, 0, 0, 0, 1}
+	gmod = append(gmod, ofp4.MakeBucket(0, ofp4.OFPP_ANY, ofp4.OFPG_ANY, flowTaskTestActionBytes(1, 2))...)
+	if err := pipe.addGroup(ofp4.GroupMod(ofp4.MakeHeader(ofp4.OFPT_GROUP_MOD).AppendData(gmod))); err != nil {
+		t.Fatal(err)
+	}
+	if err := pipe.addFlowEntry(nxmTestFlowMod(0, nxmTestField(oxm.OXM_OF_IN_PORT, []byte{0, 0, 0, 2}, nil),
+		ofp4.MakeInstructionActions(ofp4.OFPIT_APPLY_ACTIONS, ofp4.MakeActionGroup(1)))); err != nil {
+		t.Fatal(err)
+	}
+	if err := pipe.addFlowEntry(nxmTestFlowMod(2, nil,
+		ofp4.MakeInstructionActions(ofp4.OFPIT_APPLY_ACTIONS, ofp4.MakeActionOutput(1, 0)))); err != nil {
+		t.Fatal(err)
+	}
+
+	host1.Egress(gopenflow.Frame{Data: make([]byte, 64)})
+	select {
+	case <-host2.Ingress():
+	case <-time.After(time.Second):
+		t.Error("resubmit in action set not delivered")
+	}
+	host2.Egress(gopenflow.Frame{Data: make([]byte, 64)})
+	select {
+	case <-host1.Ingress():
+	case <-time.After(time.Second):
+		t.Error("resubmit in group bucket not delivered")
+	}
+}
+
+func TestFlowTaskLearn(t *testing.T) {
+	AddActionHandler(flowTaskTestExperimenter, flowTaskTestAction{})
+
+	pipe := NewPipeline()
+	host1, sw1 := gopenflow.NewMemPortPair("h1", [6]byte{2, 0, 0, 0, 0, 1}, "sw1", [6]byte{2, 0, 0, 0, 1, 1})
+	host2, sw2 := gopenflow.NewMemPortPair("h2", [6]byte{2, 0, 0, 0, 0, 2}, "sw2", [6]byte{2, 0, 0, 0, 1, 2})
+	if err := pipe.SetPort(1, sw1); err != nil {
+		t.Fatal(err)
+	}
+	if err := pipe.SetPort(2, sw2); err != nil {
+		t.Fatal(err)
+	}
+	if err := pipe.addFlowEntry(nxmTestFlowMod(0, nil,
+		ofp4.MakeInstructionActions(ofp4.OFPIT_APPLY_ACTIONS, flowTaskTestActionBytes(3, 1)),
+		ofp4.MakeInstructionGotoTable(1))); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    net.IP{192, 0, 2, 1},
+		DstIP:    net.IP{192, 0, 2, 2},
+	}
+	tcp := &layers.TCP{
+		SrcPort: 1024,
+		DstPort: 80,
+		FIN:     true,
+	}
+	tcp.SetNetworkLayerForChecksum(ip)
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true},
+		&layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{2, 0, 0, 0, 0, 1},
+			DstMAC:       net.HardwareAddr{2, 0, 0, 0, 0, 2},
+			EthernetType: layers.EthernetTypeIPv4,
+		}, ip, tcp); err != nil {
+		t.Fatal(err)
+	}
+
+	host1.Egress(gopenflow.Frame{Data: buf.Bytes()})
+	select {
+	case <-host2.Ingress():
+	case <-time.After(time.Second):
+		t.Fatal("learned flow did not forward")
+	}
+	stats := pipe.filterFlows(flowFilter{
+		tableId:  1,
+		outPort:  ofp4.OFPP_ANY,
+		outGroup: ofp4.OFPG_ANY,
+	})
+	if len(stats) != 1 {
+		t.Fatalf("learned flow not found %v", stats)
+	}
+	if stats[0].flow.idleTimeout != 1 {
+		t.Errorf("fin_idle_timeout not applied %d", stats[0].flow.idleTimeout)
+	}
+}
+
+func TestFlowTaskConjunction(t *testing.T) {
+	AddActionHandler(flowTaskTestExperimenter, flowTaskTestAction{})
+
+	pipe := NewPipeline()
+	conjunction := func(id, clause, n uint8) ofp4.Instruction {
+		act := flowTaskTestActionBytes(6, id)
+		act[10], act[11] = clause, n
+		return ofp4.MakeInstructionActions(ofp4.OFPIT_APPLY_ACTIONS, act)
+	}
+	ipv4 := nxmTestField(oxm.OXM_OF_ETH_TYPE, []byte{0x08, 0x00}, nil)
+	tcp := append(ipv4, nxmTestField(oxm.OXM_OF_IP_PROTO, []byte{6}, nil)...)
+	// (ip_src=A or C) and (tcp_dst=80 or 443) in 4 flows, instead of 4 cross products
+	for _, src := range []net.IP{ctTestA, net.IP{192, 0, 2, 3}} {
+		if err := pipe.addFlowEntry(nxmTestFlowMod(0, append(ipv4, nxmTestField(oxm.OXM_OF_IPV4_SRC, src, nil)...),
+			conjunction(1, 0, 2))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, port := range []uint16{80, 443} {
+		value := make([]byte, 2)
+		binary.BigEndian.PutUint16(value, port)
+		if err := pipe.addFlowEntry(nxmTestFlowMod(0, append(tcp, nxmTestField(oxm.OXM_OF_TCP_DST, value, nil)...),
+			conjunction(1, 1, 2))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pipe.addFlowEntry(nxmTestFlowMod(0, nxmTestField(oxm.NXM_NX_CONJ_ID, []byte{0, 0, 0, 1}, nil),
+		ofp4.MakeInstructionActions(ofp4.OFPIT_APPLY_ACTIONS, ofp4.MakeActionOutput(2, 0)))); err != nil {
+		t.Fatal(err)
+	}
+	miss := nxmTestFlowMod(0, nil, ofp4.MakeInstructionActions(ofp4.OFPIT_APPLY_ACTIONS, ofp4.MakeActionOutput(3, 0)))
+	binary.BigEndian.PutUint16(miss[30:], 0) // priority
+	if err := pipe.addFlowEntry(miss); err != nil {
+		t.Fatal(err)
+	}
+
+	table := pipe.getFlowTable(0)
+	lookup := func(src net.IP, port layers.TCPPort) *flowEntry {
+		fr := ctTestFrame(t, src, ctTestB, layers.IPProtocolTCP, &layers.TCP{SrcPort: 1024, DstPort: port})
+		entry, _ := table.lookup(fr, true)
+		if _, ok := fr.Oob[OxmKeyBasic(oxm.NXM_NX_CONJ_ID)]; ok {
+			t.Error("conj_id was left in the frame")
+		}
+		return entry
+	}
+	isConj := func(entry *flowEntry) bool {
+		return entry != nil && len(entry.fields) == 1
+	}
+	if entry := lookup(ctTestA, 80); !isConj(entry) {
+		t.Errorf("conjunction not matched %v", entry)
+	}
+	if entry := lookup(net.IP{192, 0, 2, 3}, 443); !isConj(entry) {
+		t.Errorf("conjunction not matched %v", entry)
+	}
+	if entry := lookup(ctTestA, 22); entry == nil || len(entry.fields) != 0 {
+		t.Errorf("partial conjunction matched %v", entry)
+	}
+	if entry := lookup(net.IP{192, 0, 2, 4}, 80); entry == nil || len(entry.fields) != 0 {
+		t.Errorf("partial conjunction matched %v", entry)
+	}
+
+	// conjunction must not be mixed with other actions
+	act := append(flowTaskTestActionBytes(6, 2), ofp4.MakeActionOutput(2, 0)...)
+	act[10], act[11] = 0, 2
+	if err := pipe.addFlowEntry(nxmTestFlowMod(0, ipv4,
+		ofp4.MakeInstructionActions(ofp4.OFPIT_APPLY_ACTIONS, act))); err == nil {
+		t.Error("conjunction with output accepted")
+	}
+	if err := pipe.addFlowEntry(nxmTestFlowMod(0, ipv4, conjunction(2, 1, 1))); err == nil {
+		t.Error("conjunction of single clause accepted")
+	}
+}
@@ -0,0 +1,66 @@
+package ofp4sw
+
+import (
+	"encoding/binary"
+	"github.com/hkwi/gopenflow/ofp4"
+	"github.com/hkwi/gopenflow/oxm"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFlowRemovedTimeout(t *testing.T) {
+	pipe := NewPipeline()
+	conn, ctrl := net.Pipe()
+	defer ctrl.Close()
+	pipe.channels = append(pipe.channels, &channel{Conn: conn})
+
+	flowMod := func(inPort uint32, cookie uint64, idle, hard, flags uint16) ofp4.FlowMod {
+		buf := make([]byte, 4)
+		binary.BigEndian.PutUint32(buf, inPort)
+		req := nxmTestFlowMod(0, nxmTestField(oxm.OXM_OF_IN_PORT, buf, nil),
+			ofp4.MakeInstructionActions(ofp4.OFPIT_APPLY_ACTIONS, ofp4.MakeActionOutput(2, 0)))
+		binary.BigEndian.PutUint64(req[8:], cookie)
+		binary.BigEndian.PutUint16(req[26:], idle)
+		binary.BigEndian.PutUint16(req[28:], hard)
+		binary.BigEndian.PutUint16(req[44:], flags)
+		return req
+	}
+	if err := pipe.addFlowEntry(flowMod(1, 1, 0, 1, ofp4.OFPFF_SEND_FLOW_REM)); err != nil {
+		t.Fatal(err)
+	}
+	if err := pipe.addFlowEntry(flowMod(2, 2, 1, 0, ofp4.OFPFF_SEND_FLOW_REM)); err != nil {
+		t.Fatal(err)
+	}
+	// removed silently
+	if err := pipe.addFlowEntry(flowMod(3, 3, 0, 1, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	pipe.validate(time.Now().Add(2 * time.Second))
+
+	reasons := make(map[uint64]uint8)
+	for i := 0; i < 2; i++ {
+		ctrl.SetReadDeadline(time.Now().Add(time.Second))
+		msg, err := readOfpMessage(ctrl, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ofp4.Header(msg).Type() != ofp4.OFPT_FLOW_REMOVED {
+			t.Fatalf("unexpected message %v", msg)
+		}
+		rem := ofp4.FlowRemoved(msg)
+		reasons[rem.Cookie()] = rem.Reason()
+		if rem.TableId() != 0 || rem.Priority() != 10 {
+			t.Errorf("unexpected flow removed %v", msg)
+		}
+	}
+	if reasons[1] != ofp4.OFPRR_HARD_TIMEOUT || reasons[2] != ofp4.OFPRR_IDLE_TIMEOUT {
+		t.Errorf("unexpected reasons %v", reasons)
+	}
+
+	ctrl.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if msg, err := readOfpMessage(ctrl, nil); err == nil {
+		t.Errorf("flow removed without OFPFF_SEND_FLOW_REM %v", msg)
+	}
+}
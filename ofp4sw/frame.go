@@ -22,12 +22,19 @@ type Frame struct {
 	serialized []byte
 	layers     []gopacket.Layer // Not a gopacket.Packet, because Data() returns original packet bytes even when layers were modified.
 	// out-of-band data
-	Oob map[OxmKey]OxmPayload // only experimenter out-of-band will be stored here.
+	Oob map[OxmKey]OxmPayload // only experimenter or nicira out-of-band will be stored here.
 	// pipeline match fields
 	inPort    uint32
 	inPhyPort uint32
 	metadata  uint64
 	tunnelId  uint64
+	regs      [8]uint32 // NXM_NX_REG0 to NXM_NX_REG7
+	pktMark   uint32
+	// connection tracking state, valid after NXAST_CT recirculation
+	ctState uint32
+	ctZone  uint16
+	ctMark  uint32
+	ctLabel [16]byte
 	// queue id is pipeline processing specific data, but put in Frame because:
 	// 1. queue id is set by action
 	// 2. action may be put in action-set
@@ -56,6 +63,13 @@ func (self Frame) clone() Frame {
 			inPhyPort:  self.inPhyPort,
 			metadata:   self.metadata,
 			tunnelId:   self.tunnelId,
+			regs:       self.regs,
+			pktMark:    self.pktMark,
+			ctState:    self.ctState,
+			ctZone:     self.ctZone,
+			ctMark:     self.ctMark,
+			ctLabel:    self.ctLabel,
+			queueId:    self.queueId,
 		}
 	}
 }
@@ -117,6 +131,51 @@ func (self *Frame) Serialized() ([]byte, error) {
 	return self.serialized, nil
 }
 
+// GetField returns the value of OXM or NXM field, for extension API.
+func (self *Frame) GetField(field uint32) ([]byte, error) {
+	key := OxmKeyBasic(oxm.Header(field).Type())
+	switch oxm.Header(field).Class() {
+	case ofp4.OFPXMC_OPENFLOW_BASIC:
+		return self.getValue(uint32(key))
+	case ofp4.OFPXMC_NXM_0, ofp4.OFPXMC_NXM_1:
+		if value, err := oxmNxmHandler.getValue(self, key); err != nil {
+			return nil, err
+		} else if value == nil {
+			return nil, fmt.Errorf("oxm value not found for %d", field)
+		} else {
+			return value, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported oxm class %x", field)
+}
+
+// SetField sets the value of OXM or NXM field, for extension API.
+// Bits out of the mask are kept. nil mask means exact value.
+func (self *Frame) SetField(field uint32, value, mask []byte) error {
+	key := OxmKeyBasic(oxm.Header(field).Type())
+	handler := oxmHandlerFor(key)
+	if handler == nil {
+		return fmt.Errorf("unsupported oxm class %x", field)
+	}
+	vm := OxmValueMask{
+		Value: value,
+		Mask:  mask,
+	}
+	if len(mask) > 0 && oxm.Header(field).Class() == ofp4.OFPXMC_OPENFLOW_BASIC {
+		current, err := self.getValue(uint32(key))
+		if err != nil {
+			return err
+		}
+		merged := make([]byte, len(current))
+		copy(merged, current)
+		if err := vm.Set(merged); err != nil {
+			return err
+		}
+		vm = OxmValueMask{Value: merged}
+	}
+	return handler.SetField(self, key, vm)
+}
+
 // hash calculates packet characteric specific hash code.
 func (self *Frame) hash() uint32 {
 	hashKeys := [...]uint32{
@@ -505,6 +564,11 @@ func (self *Frame) getValue(oxmType uint32) ([]byte, error) {
 		}
 	case oxm.OXM_OF_TUNNEL_ID:
 		return toMatchBytes(self.tunnelId)
+	case oxm.NXM_NX_REG0, oxm.NXM_NX_REG1, oxm.NXM_NX_REG2, oxm.NXM_NX_REG3,
+		oxm.NXM_NX_REG4, oxm.NXM_NX_REG5, oxm.NXM_NX_REG6, oxm.NXM_NX_REG7:
+		return toMatchBytes(self.regs[oxm.Header(oxmType).Field()])
+	case oxm.NXM_NX_PKT_MARK:
+		return toMatchBytes(self.pktMark)
 	case oxm.OXM_OF_IPV6_EXTHDR:
 		exthdr := uint16(0)
 		for _, layer := range self.Layers() {
@@ -623,6 +687,22 @@ func (self *Frame) getFrozen() (gopenflow.Frame, error) {
 			Mask:  mask,
 		})...)
 	}
+	for i, reg := range self.regs {
+		if reg != 0 {
+			buf := make([]byte, 4)
+			binary.BigEndian.PutUint32(buf, reg)
+			oob = append(oob, OxmKeyBasic(nxmRegs[i]).Bytes(OxmValueMask{
+				Value: buf,
+			})...)
+		}
+	}
+	if self.pktMark != 0 {
+		buf := make([]byte, 4)
+		binary.BigEndian.PutUint32(buf, self.pktMark)
+		oob = append(oob, OxmKeyBasic(oxm.NXM_NX_PKT_MARK).Bytes(OxmValueMask{
+			Value: buf,
+		})...)
+	}
 	var sorter []string
 	for k, v := range self.Oob {
 		sorter = append(sorter, string(k.Bytes(v)))
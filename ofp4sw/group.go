@@ -69,7 +69,7 @@ type group struct {
 	buckets   []bucket
 }
 
-func (g *group) process(data *Frame, pipe Pipeline) (pouts []outputToPort, gouts []outputToGroup) {
+func (g *group) process(data *Frame, pipe Pipeline, ext actionExtension) (pouts []outputToPort, gouts []outputToGroup) {
 	buckets := make([]bucket, 0, len(g.buckets))
 	func() {
 		g.lock.RLock()
@@ -80,7 +80,7 @@ func (g *group) process(data *Frame, pipe Pipeline) (pouts []outputToPort, gouts
 	switch g.groupType {
 	case ofp4.OFPGT_ALL, ofp4.OFPGT_INDIRECT:
 		for _, b := range buckets {
-			p, g := actionSet(b.actionSet).Process(data)
+			p, g := actionSet(b.actionSet).Process(data, ext)
 			pouts = append(pouts, p...)
 			gouts = append(gouts, g...)
 		}
@@ -94,7 +94,7 @@ func (g *group) process(data *Frame, pipe Pipeline) (pouts []outputToPort, gouts
 		for _, b := range buckets {
 			weightSum += float64(b.weight)
 			if step <= weightSum {
-				p, g := actionSet(b.actionSet).Process(data)
+				p, g := actionSet(b.actionSet).Process(data, ext)
 				pouts = append(pouts, p...)
 				gouts = append(gouts, g...)
 				break
@@ -127,7 +127,7 @@ func (g *group) process(data *Frame, pipe Pipeline) (pouts []outputToPort, gouts
 			}
 			if live {
 				fdata := data.clone()
-				p, g := actionSet(b.actionSet).Process(&fdata)
+				p, g := actionSet(b.actionSet).Process(&fdata, ext)
 				pouts = append(pouts, p...)
 				gouts = append(gouts, g...)
 				break
@@ -168,11 +168,13 @@ func (pipe *Pipeline) deleteGroupInside(groupId uint32) error {
 			if _, exists := pipe.groups[chainId]; exists {
 				delete(pipe.groups, chainId)
 			}
-			pipe.filterFlowsInside(flowFilter{
+			for _, stat := range pipe.filterFlowsInside(flowFilter{
 				opUnregister: true,
 				outPort:      ofp4.OFPP_ANY,
 				outGroup:     chainId,
-			})
+			}) {
+				pipe.flowRemoved(stat.tableId, stat.priority, stat.flow, ofp4.OFPRR_GROUP_DELETE)
+			}
 		}
 	} else {
 		return ofp4.MakeErrorMsg(ofp4.OFPET_GROUP_MOD_FAILED, ofp4.OFPGMFC_GROUP_EXISTS)
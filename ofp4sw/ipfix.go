@@ -0,0 +1,539 @@
+package ofp4sw
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/hkwi/gopenflow/ofp4"
+	"github.com/hkwi/gopenflow/oxm"
+	"log"
+	"math"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// IpfixConfig is an IPFIX exporter configuration, used in Pipeline.SetIpfix.
+//
+// Records of flow entries are sent to Collector, which is an UDP "host:port",
+// every ActiveTimeout (60 seconds if zero), and finally when the entry was
+// removed. Counters in the record are the delta from the last record, and
+// periodic records are skipped for the entries without new packets.
+// Templates are derived from the match fields of each flow entry, and resent
+// every TemplateRefresh, 600 seconds if zero. Template ids are reused after
+// no flow entry uses the template.
+type IpfixConfig struct {
+	Collector           string
+	ObservationDomainId uint32
+	ActiveTimeout       time.Duration
+	TemplateRefresh     time.Duration
+}
+
+const (
+	defaultIpfixActiveTimeout   = 60 * time.Second
+	defaultIpfixTemplateRefresh = 600 * time.Second
+	ipfixMessageMax             = 1400
+	ipfixTemplateIdMin          = 256
+)
+
+// IPFIX set ids
+const (
+	IPFIX_TEMPLATE_SET = 2
+)
+
+// IPFIX information elements, RFC 5102
+const (
+	IPFIX_OCTET_DELTA_COUNT              = 1
+	IPFIX_PACKET_DELTA_COUNT             = 2
+	IPFIX_PROTOCOL_IDENTIFIER            = 4
+	IPFIX_SOURCE_TRANSPORT_PORT          = 7
+	IPFIX_SOURCE_IPV4_ADDRESS            = 8
+	IPFIX_SOURCE_IPV4_PREFIX_LENGTH      = 9
+	IPFIX_INGRESS_INTERFACE              = 10
+	IPFIX_DESTINATION_TRANSPORT_PORT     = 11
+	IPFIX_DESTINATION_IPV4_ADDRESS       = 12
+	IPFIX_DESTINATION_IPV4_PREFIX_LENGTH = 13
+	IPFIX_SOURCE_IPV6_ADDRESS            = 27
+	IPFIX_DESTINATION_IPV6_ADDRESS       = 28
+	IPFIX_SOURCE_IPV6_PREFIX_LENGTH      = 29
+	IPFIX_DESTINATION_IPV6_PREFIX_LENGTH = 30
+	IPFIX_FLOW_LABEL_IPV6                = 31
+	IPFIX_SOURCE_MAC_ADDRESS             = 56
+	IPFIX_VLAN_ID                        = 58
+	IPFIX_DESTINATION_MAC_ADDRESS        = 80
+	IPFIX_FLOW_END_REASON                = 136
+	IPFIX_FLOW_ID                        = 148
+	IPFIX_FLOW_START_MILLISECONDS        = 152
+	IPFIX_FLOW_END_MILLISECONDS          = 153
+	IPFIX_ICMP_TYPE_IPV4                 = 176
+	IPFIX_ICMP_CODE_IPV4                 = 177
+	IPFIX_ICMP_TYPE_IPV6                 = 178
+	IPFIX_ICMP_CODE_IPV6                 = 179
+	IPFIX_IP_DIFF_SERV_CODE_POINT        = 195
+	IPFIX_DOT1Q_PRIORITY                 = 244
+	IPFIX_ETHERNET_TYPE                  = 256
+)
+
+// flowEndReason values
+const (
+	IPFIX_END_IDLE_TIMEOUT   = 1
+	IPFIX_END_ACTIVE_TIMEOUT = 2
+	IPFIX_END_OF_FLOW        = 3
+	IPFIX_END_FORCED         = 4
+)
+
+// ipfixMatchFields maps oxm basic fields into information elements.
+// Masked fields are exported only if the field has a prefix length element.
+var ipfixMatchFields = map[uint32]struct {
+	id     uint16
+	prefix uint16
+}{
+	oxm.OXM_OF_IN_PORT:     {IPFIX_INGRESS_INTERFACE, 0},
+	oxm.OXM_OF_ETH_DST:     {IPFIX_DESTINATION_MAC_ADDRESS, 0},
+	oxm.OXM_OF_ETH_SRC:     {IPFIX_SOURCE_MAC_ADDRESS, 0},
+	oxm.OXM_OF_ETH_TYPE:    {IPFIX_ETHERNET_TYPE, 0},
+	oxm.OXM_OF_VLAN_VID:    {IPFIX_VLAN_ID, 0},
+	oxm.OXM_OF_VLAN_PCP:    {IPFIX_DOT1Q_PRIORITY, 0},
+	oxm.OXM_OF_IP_DSCP:     {IPFIX_IP_DIFF_SERV_CODE_POINT, 0},
+	oxm.OXM_OF_IP_PROTO:    {IPFIX_PROTOCOL_IDENTIFIER, 0},
+	oxm.OXM_OF_IPV4_SRC:    {IPFIX_SOURCE_IPV4_ADDRESS, IPFIX_SOURCE_IPV4_PREFIX_LENGTH},
+	oxm.OXM_OF_IPV4_DST:    {IPFIX_DESTINATION_IPV4_ADDRESS, IPFIX_DESTINATION_IPV4_PREFIX_LENGTH},
+	oxm.OXM_OF_TCP_SRC:     {IPFIX_SOURCE_TRANSPORT_PORT, 0},
+	oxm.OXM_OF_TCP_DST:     {IPFIX_DESTINATION_TRANSPORT_PORT, 0},
+	oxm.OXM_OF_UDP_SRC:     {IPFIX_SOURCE_TRANSPORT_PORT, 0},
+	oxm.OXM_OF_UDP_DST:     {IPFIX_DESTINATION_TRANSPORT_PORT, 0},
+	oxm.OXM_OF_SCTP_SRC:    {IPFIX_SOURCE_TRANSPORT_PORT, 0},
+	oxm.OXM_OF_SCTP_DST:    {IPFIX_DESTINATION_TRANSPORT_PORT, 0},
+	oxm.OXM_OF_ICMPV4_TYPE: {IPFIX_ICMP_TYPE_IPV4, 0},
+	oxm.OXM_OF_ICMPV4_CODE: {IPFIX_ICMP_CODE_IPV4, 0},
+	oxm.OXM_OF_IPV6_SRC:    {IPFIX_SOURCE_IPV6_ADDRESS, IPFIX_SOURCE_IPV6_PREFIX_LENGTH},
+	oxm.OXM_OF_IPV6_DST:    {IPFIX_DESTINATION_IPV6_ADDRESS, IPFIX_DESTINATION_IPV6_PREFIX_LENGTH},
+	oxm.OXM_OF_IPV6_FLABEL: {IPFIX_FLOW_LABEL_IPV6, 0},
+	oxm.OXM_OF_ICMPV6_TYPE: {IPFIX_ICMP_TYPE_IPV6, 0},
+	oxm.OXM_OF_ICMPV6_CODE: {IPFIX_ICMP_CODE_IPV6, 0},
+}
+
+type ipfixValue struct {
+	id    uint16
+	value []byte
+}
+
+type ipfixValueList []ipfixValue
+
+func (self ipfixValueList) Len() int {
+	return len(self)
+}
+
+func (self ipfixValueList) Less(i, j int) bool {
+	return self[i].id < self[j].id
+}
+
+func (self ipfixValueList) Swap(i, j int) {
+	self[i], self[j] = self[j], self[i]
+}
+
+type ipfixTemplate struct {
+	id     uint16
+	record []byte // template record
+	sent   time.Time
+}
+
+type ipfixRecord struct {
+	template *ipfixTemplate
+	data     []byte
+}
+
+type ipfixRecordList []ipfixRecord
+
+func (self ipfixRecordList) Len() int {
+	return len(self)
+}
+
+func (self ipfixRecordList) Less(i, j int) bool {
+	return self[i].template.id < self[j].template.id
+}
+
+func (self ipfixRecordList) Swap(i, j int) {
+	self[i], self[j] = self[j], self[i]
+}
+
+// ipfixFlow is the state of the exported flow entry.
+type ipfixFlow struct {
+	id       uint64
+	packets  uint64
+	bytes    uint64
+	template *ipfixTemplate // last used
+}
+
+type ipfixExporter struct {
+	lock       *sync.Mutex
+	config     IpfixConfig
+	conn       net.Conn // nil if disabled
+	lastExport time.Time
+	sequence   uint32 // data records sent
+	templates  map[string]*ipfixTemplate
+	flows      map[*flowEntry]*ipfixFlow
+	nextFlowId uint64
+}
+
+func newIpfixExporter() *ipfixExporter {
+	return &ipfixExporter{
+		lock:      &sync.Mutex{},
+		templates: make(map[string]*ipfixTemplate),
+		flows:     make(map[*flowEntry]*ipfixFlow),
+	}
+}
+
+// SetIpfix starts the IPFIX exporter of flow entries, replacing the last configuration.
+func (self *Pipeline) SetIpfix(config IpfixConfig) error {
+	conn, err := net.Dial("udp", config.Collector)
+	if err != nil {
+		return err
+	}
+	if config.ActiveTimeout <= 0 {
+		config.ActiveTimeout = defaultIpfixActiveTimeout
+	}
+	if config.TemplateRefresh <= 0 {
+		config.TemplateRefresh = defaultIpfixTemplateRefresh
+	}
+
+	exporter := self.ipfix
+	exporter.lock.Lock()
+	defer exporter.lock.Unlock()
+	if exporter.conn != nil {
+		exporter.conn.Close()
+	}
+	exporter.config = config
+	exporter.conn = conn
+	exporter.lastExport = time.Now()
+	for _, t := range exporter.templates {
+		t.sent = time.Time{}
+	}
+	return nil
+}
+
+// RemoveIpfix stops the IPFIX exporter.
+func (self *Pipeline) RemoveIpfix() error {
+	exporter := self.ipfix
+	exporter.lock.Lock()
+	defer exporter.lock.Unlock()
+	if exporter.conn == nil {
+		return fmt.Errorf("ipfix exporter not running")
+	}
+	exporter.conn.Close()
+	exporter.conn = nil
+	exporter.flows = make(map[*flowEntry]*ipfixFlow)
+	return nil
+}
+
+// expire sends the records of active flow entries every ActiveTimeout.
+func (self *ipfixExporter) expire(now time.Time, pipe *Pipeline) {
+	if !func() bool {
+		self.lock.Lock()
+		defer self.lock.Unlock()
+		return self.conn != nil && now.Sub(self.lastExport) >= self.config.ActiveTimeout
+	}() {
+		return
+	}
+	// pipeline lock must not be taken inside the exporter lock
+	stats := pipe.filterFlows(flowFilter{
+		tableId:  ofp4.OFPTT_ALL,
+		outPort:  ofp4.OFPP_ANY,
+		outGroup: ofp4.OFPG_ANY,
+		match:    match{},
+	})
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.conn == nil {
+		return
+	}
+	self.lastExport = now
+
+	alive := make(map[*flowEntry]bool)
+	var records []ipfixRecord
+	for _, stat := range stats {
+		alive[stat.flow] = true
+		if record, ok := self.record(stat.flow, IPFIX_END_ACTIVE_TIMEOUT, false); ok {
+			records = append(records, record)
+		}
+	}
+	// entries may be replaced without removal
+	for flow, _ := range self.flows {
+		if !alive[flow] {
+			delete(self.flows, flow)
+		}
+	}
+	// ids of templates without flows are recycled
+	used := make(map[*ipfixTemplate]bool)
+	for _, state := range self.flows {
+		used[state.template] = true
+	}
+	for key, template := range self.templates {
+		if !used[template] {
+			delete(self.templates, key)
+		}
+	}
+	if err := self.send(records, now); err != nil {
+		log.Print(err)
+	}
+}
+
+// removed sends the final record of the flow entry.
+func (self *ipfixExporter) removed(flow *flowEntry, reason uint8, now time.Time) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.conn == nil {
+		return
+	}
+	var endReason uint8
+	switch reason {
+	case ofp4.OFPRR_IDLE_TIMEOUT:
+		endReason = IPFIX_END_IDLE_TIMEOUT
+	case ofp4.OFPRR_HARD_TIMEOUT:
+		endReason = IPFIX_END_OF_FLOW
+	default:
+		endReason = IPFIX_END_FORCED
+	}
+	record, ok := self.record(flow, endReason, true)
+	delete(self.flows, flow)
+	if !ok {
+		return
+	}
+	if err := self.send([]ipfixRecord{record}, now); err != nil {
+		log.Print(err)
+	}
+}
+
+// record builds the data record of the flow entry. Returns false if there
+// was no new packets and not final, or template ids ran out. invoke this
+// method inside a mutex guard.
+func (self *ipfixExporter) record(flow *flowEntry, endReason uint8, final bool) (ipfixRecord, bool) {
+	var packets, bytes uint64
+	var start, end time.Time
+	func() {
+		flow.lock.RLock()
+		defer flow.lock.RUnlock()
+		packets, bytes = flow.packetCount, flow.byteCount
+		start, end = flow.created, flow.touched
+	}()
+	if end.IsZero() {
+		end = start
+	}
+
+	state, ok := self.flows[flow]
+	if !ok {
+		self.nextFlowId++
+		state = &ipfixFlow{id: self.nextFlowId}
+		self.flows[flow] = state
+	}
+	if packets < state.packets || bytes < state.bytes {
+		// counters were reset
+		state.packets, state.bytes = 0, 0
+	}
+	deltaPackets, deltaBytes := packets-state.packets, bytes-state.bytes
+	if deltaPackets == 0 && !final {
+		return ipfixRecord{}, false
+	}
+	state.packets, state.bytes = packets, bytes
+
+	values := ipfixFlowValues(flow.fields)
+	u64 := func(v uint64) []byte {
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, v)
+		return buf
+	}
+	values = append(values,
+		ipfixValue{IPFIX_FLOW_ID, u64(state.id)},
+		ipfixValue{IPFIX_FLOW_START_MILLISECONDS, u64(uint64(start.UnixNano() / int64(time.Millisecond)))},
+		ipfixValue{IPFIX_FLOW_END_MILLISECONDS, u64(uint64(end.UnixNano() / int64(time.Millisecond)))},
+		ipfixValue{IPFIX_OCTET_DELTA_COUNT, u64(deltaBytes)},
+		ipfixValue{IPFIX_PACKET_DELTA_COUNT, u64(deltaPackets)},
+		ipfixValue{IPFIX_FLOW_END_REASON, []byte{endReason}},
+	)
+
+	var key, data []byte
+	for _, v := range values {
+		spec := make([]byte, 4)
+		binary.BigEndian.PutUint16(spec, v.id)
+		binary.BigEndian.PutUint16(spec[2:], uint16(len(v.value)))
+		key = append(key, spec...)
+		data = append(data, v.value...)
+	}
+	template, ok := self.templates[string(key)]
+	if !ok {
+		id, ok := self.templateId()
+		if !ok {
+			return ipfixRecord{}, false
+		}
+		template = &ipfixTemplate{
+			id:     id,
+			record: make([]byte, 4, 4+len(key)),
+		}
+		binary.BigEndian.PutUint16(template.record, template.id)
+		binary.BigEndian.PutUint16(template.record[2:], uint16(len(values)))
+		template.record = append(template.record, key...)
+		self.templates[string(key)] = template
+	}
+	state.template = template
+	return ipfixRecord{template: template, data: data}, true
+}
+
+// templateId returns the lowest template id not in use.
+func (self *ipfixExporter) templateId() (uint16, bool) {
+	used := make(map[uint16]bool, len(self.templates))
+	for _, template := range self.templates {
+		used[template.id] = true
+	}
+	for id := ipfixTemplateIdMin; id <= math.MaxUint16; id++ {
+		if !used[uint16(id)] {
+			return uint16(id), true
+		}
+	}
+	return 0, false
+}
+
+// ipfixFlowValues returns information elements of the match fields, in the order of id.
+func ipfixFlowValues(fields match) []ipfixValue {
+	var values []ipfixValue
+	for key, payload := range fields {
+		k, ok := key.(OxmKeyBasic)
+		if !ok {
+			continue
+		}
+		field := uint32(k)
+		if basic, ok := nxmBasicFields[field]; ok {
+			field = basic
+		}
+		ie, ok := ipfixMatchFields[field]
+		if !ok {
+			continue
+		}
+		vm, ok := payload.(OxmValueMask)
+		if !ok {
+			continue
+		}
+		value := append([]byte{}, vm.Value...)
+		switch field {
+		case oxm.OXM_OF_IN_PORT:
+			if len(value) == 2 { // NXM_OF_IN_PORT
+				value = append([]byte{0, 0}, value...)
+			}
+		case oxm.OXM_OF_VLAN_VID:
+			if len(vm.Mask) > 0 || len(value) != 2 || value[0]&0x10 == 0 {
+				continue // OFPVID_PRESENT
+			}
+			value[0] &= 0x0f
+		}
+		if len(vm.Mask) > 0 && !bytes.Equal(vm.Mask, bytes.Repeat([]byte{0xff}, len(vm.Mask))) {
+			prefix, ok := ipfixPrefixLength(vm.Mask)
+			if ie.prefix == 0 || !ok {
+				continue
+			}
+			for i, m := range vm.Mask {
+				value[i] &= m
+			}
+			values = append(values, ipfixValue{ie.prefix, []byte{prefix}})
+		}
+		values = append(values, ipfixValue{ie.id, value})
+	}
+	sort.Sort(ipfixValueList(values))
+	return values
+}
+
+// ipfixPrefixLength returns the prefix length if the mask was a prefix mask.
+func ipfixPrefixLength(mask []byte) (uint8, bool) {
+	var length uint8
+	for i, m := range mask {
+		for bit := uint(7); bit < 8; bit-- {
+			if m&(1<<bit) != 0 {
+				length++
+				continue
+			}
+			if m&^(0xff<<bit) != 0 || !bytes.Equal(mask[i+1:], make([]byte, len(mask)-i-1)) {
+				return 0, false
+			}
+			return length, true
+		}
+	}
+	return length, true
+}
+
+// send writes the records in messages. invoke this method inside a mutex guard.
+func (self *ipfixExporter) send(records []ipfixRecord, now time.Time) error {
+	sort.Stable(ipfixRecordList(records))
+
+	var templates, sets []byte
+	var used []*ipfixTemplate
+	var count uint32
+	var setId uint16
+	var setStart int
+	flush := func() error {
+		if count == 0 {
+			return nil
+		}
+		msg := make([]byte, 16)
+		if len(templates) > 0 {
+			set := make([]byte, 4)
+			binary.BigEndian.PutUint16(set, IPFIX_TEMPLATE_SET)
+			binary.BigEndian.PutUint16(set[2:], uint16(4+len(templates)))
+			msg = append(msg, set...)
+			msg = append(msg, templates...)
+		}
+		msg = append(msg, sets...)
+		binary.BigEndian.PutUint16(msg, 10) // version
+		binary.BigEndian.PutUint16(msg[2:], uint16(len(msg)))
+		binary.BigEndian.PutUint32(msg[4:], uint32(now.Unix()))
+		binary.BigEndian.PutUint32(msg[8:], self.sequence)
+		binary.BigEndian.PutUint32(msg[12:], self.config.ObservationDomainId)
+		if _, err := self.conn.Write(msg); err != nil {
+			return err
+		}
+		self.sequence += count
+		for _, t := range used {
+			t.sent = now
+		}
+		templates, sets, used, count, setId = nil, nil, nil, 0, 0
+		return nil
+	}
+	needTemplate := func(t *ipfixTemplate) bool {
+		for _, u := range used {
+			if u == t {
+				return false
+			}
+		}
+		return t.sent.IsZero() || now.Sub(t.sent) >= self.config.TemplateRefresh
+	}
+	for _, r := range records {
+		size := len(r.data)
+		if needTemplate(r.template) {
+			size += len(r.template.record)
+			if len(templates) == 0 {
+				size += 4
+			}
+		}
+		if r.template.id != setId {
+			size += 4
+		}
+		if count > 0 && 16+len(templates)+len(sets)+4+size > ipfixMessageMax {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		if needTemplate(r.template) {
+			templates = append(templates, r.template.record...)
+			used = append(used, r.template)
+		}
+		if r.template.id != setId {
+			setId = r.template.id
+			setStart = len(sets)
+			sets = append(sets, 0, 0, 0, 0)
+			binary.BigEndian.PutUint16(sets[setStart:], setId)
+		}
+		sets = append(sets, r.data...)
+		binary.BigEndian.PutUint16(sets[setStart+2:], uint16(len(sets)-setStart))
+		count++
+	}
+	return flush()
+}
@@ -0,0 +1,236 @@
+package ofp4sw
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/hkwi/gopenflow"
+	"github.com/hkwi/gopenflow/ofp4"
+	"github.com/hkwi/gopenflow/oxm"
+	"math"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ipfixTestMessage decodes the message into the sequence number,
+// templates by id and data records by template id.
+func ipfixTestMessage(t *testing.T, msg []byte) (uint32, map[uint16][]byte, map[uint16][][]byte) {
+	if binary.BigEndian.Uint16(msg) != 10 || int(binary.BigEndian.Uint16(msg[2:])) != len(msg) {
+		t.Fatalf("ipfix header %v", msg)
+	}
+	templates := make(map[uint16][]byte)
+	records := make(map[uint16][][]byte)
+	for sets := msg[16:]; len(sets) > 0; {
+		setId := binary.BigEndian.Uint16(sets)
+		set := sets[4:binary.BigEndian.Uint16(sets[2:])]
+		sets = sets[binary.BigEndian.Uint16(sets[2:]):]
+		if setId == IPFIX_TEMPLATE_SET {
+			for len(set) > 0 {
+				n := 4 + 4*int(binary.BigEndian.Uint16(set[2:]))
+				templates[binary.BigEndian.Uint16(set)] = set[4:n]
+				set = set[n:]
+			}
+		} else {
+			records[setId] = append(records[setId], set)
+		}
+	}
+	return binary.BigEndian.Uint32(msg[8:]), templates, records
+}
+
+// ipfixTestValues splits the data record by the template.
+func ipfixTestValues(template, record []byte) map[uint16][]byte {
+	values := make(map[uint16][]byte)
+	for ; len(template) > 0; template = template[4:] {
+		n := binary.BigEndian.Uint16(template[2:])
+		values[binary.BigEndian.Uint16(template)] = record[:n]
+		record = record[n:]
+	}
+	return values
+}
+
+func TestIpfix(t *testing.T) {
+	collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+
+	pipe := NewPipeline()
+	host1, sw1 := gopenflow.NewMemPortPair("h1", [6]byte{2, 0, 0, 0, 0, 1}, "sw1", [6]byte{2, 0, 0, 0, 1, 1})
+	host2, sw2 := gopenflow.NewMemPortPair("h2", [6]byte{2, 0, 0, 0, 0, 2}, "sw2", [6]byte{2, 0, 0, 0, 1, 2})
+	if err := pipe.SetPort(1, sw1); err != nil {
+		t.Fatal(err)
+	}
+	if err := pipe.SetPort(2, sw2); err != nil {
+		t.Fatal(err)
+	}
+	if err := pipe.RemoveIpfix(); err == nil {
+		t.Error("removed before set")
+	}
+	// active timeout is driven by hand in this test
+	if err := pipe.SetIpfix(IpfixConfig{
+		Collector:           collector.LocalAddr().String(),
+		ObservationDomainId: 7,
+		ActiveTimeout:       time.Hour,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	req := nxmTestFlowMod(0, nxmTestField(oxm.OXM_OF_IN_PORT, []byte{0, 0, 0, 1}, nil),
+		ofp4.MakeInstructionActions(ofp4.OFPIT_APPLY_ACTIONS, ofp4.MakeActionOutput(2, 0)))
+	binary.BigEndian.PutUint16(req[28:], 10) // hard_timeout
+	if err := pipe.addFlowEntry(req); err != nil {
+		t.Fatal(err)
+	}
+
+	read := func() []byte {
+		buf := make([]byte, 2048)
+		collector.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := collector.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf = buf[:n]
+		if binary.BigEndian.Uint32(buf[12:]) != 7 {
+			t.Errorf("observation domain %v", buf)
+		}
+		return buf
+	}
+
+	for i := 0; i < 2; i++ {
+		host1.Egress(gopenflow.Frame{Data: make([]byte, 64)})
+		select {
+		case <-host2.Ingress():
+		case <-time.After(time.Second):
+			t.Fatal("frame not forwarded")
+		}
+	}
+
+	// periodic record
+	now := time.Now()
+	pipe.ipfix.expire(now.Add(2*time.Hour), pipe)
+	seq, templates, records := ipfixTestMessage(t, read())
+	if seq != 0 || len(templates) != 1 || len(records) != 1 {
+		t.Fatalf("message %d %v %v", seq, templates, records)
+	}
+	var template []byte
+	var templateId uint16
+	for templateId, template = range templates {
+	}
+	if templateId < 256 || len(records[templateId]) != 1 {
+		t.Fatalf("template id %d", templateId)
+	}
+	if len(template) != 4*7 || binary.BigEndian.Uint16(template) != IPFIX_INGRESS_INTERFACE {
+		t.Errorf("template %v", template)
+	}
+	values := ipfixTestValues(template, records[templateId][0])
+	if !bytes.Equal(values[IPFIX_INGRESS_INTERFACE], []byte{0, 0, 0, 1}) {
+		t.Errorf("ingress interface %v", values)
+	}
+	if binary.BigEndian.Uint64(values[IPFIX_PACKET_DELTA_COUNT]) != 2 || binary.BigEndian.Uint64(values[IPFIX_OCTET_DELTA_COUNT]) != 128 {
+		t.Errorf("counters %v", values)
+	}
+	if values[IPFIX_FLOW_END_REASON][0] != IPFIX_END_ACTIVE_TIMEOUT {
+		t.Errorf("end reason %v", values)
+	}
+	start := binary.BigEndian.Uint64(values[IPFIX_FLOW_START_MILLISECONDS])
+	if end := binary.BigEndian.Uint64(values[IPFIX_FLOW_END_MILLISECONDS]); start == 0 || end < start {
+		t.Errorf("flow time %d %d", start, end)
+	}
+	flowId := binary.BigEndian.Uint64(values[IPFIX_FLOW_ID])
+
+	// no new packets
+	pipe.ipfix.expire(now.Add(4*time.Hour), pipe)
+
+	// final record on expiry, without the template sent recently
+	pipe.validate(now.Add(20 * time.Second))
+	seq, templates, records = ipfixTestMessage(t, read())
+	if seq != 1 || len(templates) != 0 || len(records[templateId]) != 1 {
+		t.Fatalf("message %d %v %v", seq, templates, records)
+	}
+	values = ipfixTestValues(template, records[templateId][0])
+	if binary.BigEndian.Uint64(values[IPFIX_FLOW_ID]) != flowId {
+		t.Errorf("flow id %v", values)
+	}
+	if binary.BigEndian.Uint64(values[IPFIX_PACKET_DELTA_COUNT]) != 0 {
+		t.Errorf("counters %v", values)
+	}
+	if values[IPFIX_FLOW_END_REASON][0] != IPFIX_END_OF_FLOW {
+		t.Errorf("end reason %v", values)
+	}
+
+	if err := pipe.RemoveIpfix(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestIpfixTemplateId(t *testing.T) {
+	collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+
+	pipe := NewPipeline()
+	if err := pipe.SetIpfix(IpfixConfig{
+		Collector:     collector.LocalAddr().String(),
+		ActiveTimeout: time.Hour,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	exporter := pipe.ipfix
+	func() {
+		exporter.lock.Lock()
+		defer exporter.lock.Unlock()
+		for id := ipfixTemplateIdMin; id <= math.MaxUint16; id++ {
+			exporter.templates[fmt.Sprint(id)] = &ipfixTemplate{id: uint16(id)}
+		}
+		flow := &flowEntry{
+			lock:    &sync.RWMutex{},
+			fields:  match{},
+			created: time.Now(),
+		}
+		if _, ok := exporter.record(flow, IPFIX_END_FORCED, true); ok {
+			t.Error("record without template id")
+		}
+	}()
+
+	// templates without flows are recycled
+	exporter.expire(time.Now().Add(2*time.Hour), pipe)
+	exporter.lock.Lock()
+	defer exporter.lock.Unlock()
+	if len(exporter.templates) != 0 {
+		t.Errorf("%d templates left", len(exporter.templates))
+	}
+	if id, ok := exporter.templateId(); !ok || id != ipfixTemplateIdMin {
+		t.Errorf("template id %d", id)
+	}
+}
+
+func TestIpfixFlowValues(t *testing.T) {
+	fields := match{}
+	if err := fields.UnmarshalBinary(bytes.Join([][]byte{
+		nxmTestField(oxm.OXM_OF_ETH_TYPE, []byte{8, 0}, nil),
+		nxmTestField(oxm.OXM_OF_IPV4_SRC, []byte{10, 1, 2, 3}, []byte{255, 255, 0, 0}),
+		nxmTestField(oxm.OXM_OF_IPV4_DST, []byte{10, 0, 0, 1}, []byte{255, 0, 255, 0}),
+		nxmTestField(oxm.OXM_OF_VLAN_VID, []byte{0x10, 0x05}, nil),
+	}, nil)); err != nil {
+		t.Fatal(err)
+	}
+	values := ipfixFlowValues(fields)
+	expect := []ipfixValue{
+		{IPFIX_SOURCE_IPV4_ADDRESS, []byte{10, 1, 0, 0}},
+		{IPFIX_SOURCE_IPV4_PREFIX_LENGTH, []byte{16}},
+		{IPFIX_VLAN_ID, []byte{0, 5}},
+		{IPFIX_ETHERNET_TYPE, []byte{8, 0}},
+	}
+	if len(values) != len(expect) {
+		t.Fatalf("values %v", values)
+	}
+	for i, v := range values {
+		if v.id != expect[i].id || !bytes.Equal(v.value, expect[i].value) {
+			t.Errorf("value %v expected %v", v, expect[i])
+		}
+	}
+}
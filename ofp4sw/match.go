@@ -27,22 +27,30 @@ func AddOxmHandler(experimenter uint32, handle OxmHandler) {
 	oxmHandlers[experimenter] = handle
 }
 
+// oxmHandlerFor returns the handler for the key, or nil if not found.
+func oxmHandlerFor(oxmKey OxmKey) OxmHandler {
+	switch k := oxmKey.(type) {
+	case OxmKeyBasic:
+		switch oxm.Header(k).Class() {
+		case ofp4.OFPXMC_OPENFLOW_BASIC:
+			return oxmBasicHandler
+		case ofp4.OFPXMC_NXM_0, ofp4.OFPXMC_NXM_1:
+			return oxmNxmHandler
+		}
+		return nil
+	default:
+		if handler, ok := oxmHandlers[oxmKeys[oxmKey]]; ok {
+			return handler
+		}
+		return nil
+	}
+}
+
 type match map[OxmKey]OxmPayload
 
 func (self match) Match(data Frame) bool {
 	for oxmKey, oxmPayload := range self {
-		var handler OxmHandler
-		switch k := oxmKey.(type) {
-		case OxmKeyBasic:
-			switch oxm.Header(k).Class() {
-			case ofp4.OFPXMC_OPENFLOW_BASIC:
-				handler = oxmBasicHandler
-			case ofp4.OFPXMC_NXM_0, OFPXMC_NXM_1:
-				handler = oxmNxmHandler
-			}
-		default:
-			handler = oxmHandlers[oxmKeys[oxmKey]]
-		}
+		handler := oxmHandlerFor(oxmKey)
 		if handler == nil {
 			log.Printf("oxm handler not found for %v", oxmKey)
 			return false
@@ -64,13 +72,7 @@ You must pass expanded match.
 func (self match) Fit(target match) (bool, error) {
 	for oxmKey, sPayload := range self {
 		if tPayload, ok := target[oxmKey]; ok {
-			var handler OxmHandler
-			switch oxmKey.(type) {
-			case OxmKeyBasic:
-				handler = oxmBasicHandler
-			default:
-				handler = oxmHandlers[oxmKeys[oxmKey]]
-			}
+			handler := oxmHandlerFor(oxmKey)
 			if handler == nil {
 				return false, fmt.Errorf("oxm handler not found")
 			}
@@ -110,15 +112,7 @@ func (self match) Conflict(target match) (bool, error) {
 		} else if tPayload, ok := target[oxmKey]; !ok {
 			continue
 		} else {
-			var handle OxmHandler
-			switch k := oxmKey.(type) {
-			case OxmKeyBasic:
-				if oxm.Header(k).Class() == ofp4.OFPXMC_OPENFLOW_BASIC {
-					handle = oxmBasicHandler
-				}
-			default:
-				handle = oxmHandlers[oxmKeys[oxmKey]]
-			}
+			handle := oxmHandlerFor(oxmKey)
 			if handle == nil {
 				return false, ofp4.MakeErrorMsg(
 					ofp4.OFPET_BAD_MATCH,
@@ -158,6 +152,14 @@ func (self match) UnmarshalBinary(msg []byte) error {
 				Value: oxm.Value(),
 				Mask:  oxm.Mask(),
 			}
+		case ofp4.OFPXMC_NXM_0, ofp4.OFPXMC_NXM_1:
+			if err := nxmValidate(uint32(hdr)); err != nil {
+				return err
+			}
+			self[OxmKeyBasic(hdr.Type())] = OxmValueMask{
+				Value: oxm.Value(),
+				Mask:  oxm.Mask(),
+			}
 		case ofp4.OFPXMC_EXPERIMENTER:
 			exps[ofp4.OxmExperimenterHeader(oxm).Experimenter()] = true
 		default:
@@ -194,6 +196,9 @@ func (self match) Expand() (match, error) {
 		ret[k] = v
 	}
 	oxmBasicHandler.Expand(ret)
+	if err := oxmNxmHandler.Expand(ret); err != nil {
+		return nil, err
+	}
 	for _, exp := range exps {
 		if handle, ok := oxmHandlers[exp]; !ok {
 			return nil, ofp4.MakeErrorMsg(
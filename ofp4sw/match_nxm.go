@@ -4,29 +4,24 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
-	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/hkwi/gopenflow/ofp4"
 	"github.com/hkwi/gopenflow/oxm"
-	layers2 "github.com/hkwi/suppl/gopacket/layers"
-	"net"
 )
 
+// oxmNxm handles OFPXMC_NXM_0 and OFPXMC_NXM_1 classes.
+// Tunnel metadata other than tunnel id are carried in Frame.Oob.
 type oxmNxm struct{}
 
 func (self oxmNxm) Parse(buf []byte) map[OxmKey]OxmPayload {
 	ret := make(map[OxmKey]OxmPayload)
 	for _, oxm := range ofp4.Oxm(buf).Iter() {
 		hdr := oxm.Header()
-		length := hdr.Length()
-		if hdr.HasMask() {
-			length = length / 2
-		}
 		switch hdr.Class() {
 		case ofp4.OFPXMC_NXM_0, ofp4.OFPXMC_NXM_1:
 			ret[OxmKeyBasic(hdr.Type())] = OxmValueMask{
-				Value: oxm[4 : 4+length],
-				Mask:  oxm[4+length:],
+				Value: oxm.Value(),
+				Mask:  oxm.Mask(),
 			}
 		}
 	}
@@ -35,109 +30,254 @@ func (self oxmNxm) Parse(buf []byte) map[OxmKey]OxmPayload {
 
 func nxmDefs(hdr uint32) (length int, mayMask bool) {
 	switch oxm.Header(hdr).Type() {
-	case NXM_OF_IN_PORT:
+	case oxm.NXM_OF_IN_PORT:
 		return 2, false
-	case NXM_OF_ETH_DST:
-		return 6, false
-	case NXM_OF_ETH_SRC:
-		return 6, false
-	case NXM_OF_ETH_TYPE:
+	case oxm.NXM_OF_ETH_DST:
+		return 6, true
+	case oxm.NXM_OF_ETH_SRC:
+		return 6, true
+	case oxm.NXM_OF_ETH_TYPE:
 		return 2, false
-	case NXM_OF_VLAN_TCI:
-		return 4, false
-	case NXM_OF_IP_TOS:
+	case oxm.NXM_OF_VLAN_TCI:
+		return 2, true
+	case oxm.NXM_OF_IP_TOS:
 		return 1, false
-	case NXM_OF_IP_PROTO:
+	case oxm.NXM_OF_IP_PROTO:
 		return 1, false
-	case NXM_OF_IP_SRC:
-		return 4, false
-	case NXM_OF_IP_DST:
-		return 4, false
-	case NXM_OF_TCP_SRC:
-		return 2, false
-	case NXM_OF_TCP_DST:
-		return 2, false
-	case NXM_OF_UDP_SRC:
-		return 2, false
-	case NXM_OF_UDP_DST:
-		return 2, false
-	case NXM_OF_ICMP_TYPE:
+	case oxm.NXM_OF_IP_SRC:
+		return 4, true
+	case oxm.NXM_OF_IP_DST:
+		return 4, true
+	case oxm.NXM_OF_TCP_SRC:
+		return 2, true
+	case oxm.NXM_OF_TCP_DST:
+		return 2, true
+	case oxm.NXM_OF_UDP_SRC:
+		return 2, true
+	case oxm.NXM_OF_UDP_DST:
+		return 2, true
+	case oxm.NXM_OF_ICMP_TYPE:
 		return 1, false
-	case NXM_OF_ICMP_CODE:
+	case oxm.NXM_OF_ICMP_CODE:
 		return 1, false
-	case NXM_OF_ARP_OP:
+	case oxm.NXM_OF_ARP_OP:
 		return 2, false
-	case NXM_OF_ARP_SPA:
-		return 4, false
-	case NXM_OF_ARP_TPA:
-		return 4, false
-	case NXM_NX_REG0:
+	case oxm.NXM_OF_ARP_SPA:
+		return 4, true
+	case oxm.NXM_OF_ARP_TPA:
+		return 4, true
+	case oxm.NXM_NX_REG0:
 		return 4, true
-	case NXM_NX_REG1:
+	case oxm.NXM_NX_REG1:
 		return 4, true
-	case NXM_NX_REG2:
+	case oxm.NXM_NX_REG2:
 		return 4, true
-	case NXM_NX_REG3:
+	case oxm.NXM_NX_REG3:
 		return 4, true
-	case NXM_NX_REG4:
+	case oxm.NXM_NX_REG4:
 		return 4, true
-	case NXM_NX_REG5:
+	case oxm.NXM_NX_REG5:
 		return 4, true
-	case NXM_NX_REG6:
+	case oxm.NXM_NX_REG6:
 		return 4, true
-	case NXM_NX_REG7:
+	case oxm.NXM_NX_REG7:
 		return 4, true
-	case NXM_NX_TUN_ID:
+	case oxm.NXM_NX_TUN_ID:
 		return 8, true
-	case NXM_NX_ARP_SHA:
+	case oxm.NXM_NX_ARP_SHA:
 		return 6, true
-	case NXM_NX_ARP_THA:
+	case oxm.NXM_NX_ARP_THA:
 		return 6, true
-	case NXM_NX_IPV6_SRC:
+	case oxm.NXM_NX_IPV6_SRC:
 		return 16, true
-	case NXM_NX_IPV6_DST:
+	case oxm.NXM_NX_IPV6_DST:
 		return 16, true
-	case NXM_NX_ICMPV6_TYPE:
-		return 1, true
-	case NXM_NX_ICMPV6_CODE:
-		return 1, true
-	case NXM_NX_ND_TARGET:
+	case oxm.NXM_NX_ICMPV6_TYPE:
+		return 1, false
+	case oxm.NXM_NX_ICMPV6_CODE:
+		return 1, false
+	case oxm.NXM_NX_ND_TARGET:
 		return 16, true
-	case NXM_NX_ND_SLL:
+	case oxm.NXM_NX_ND_SLL:
 		return 6, true
-	case NXM_NX_ND_TLL:
+	case oxm.NXM_NX_ND_TLL:
 		return 6, true
-	case NXM_NX_IP_FRAG:
+	case oxm.NXM_NX_IP_FRAG:
 		return 1, true
-	case NXM_NX_IPV6_LABEL:
+	case oxm.NXM_NX_IPV6_LABEL:
 		return 4, true
-	case NXM_NX_IP_ECN:
-		return 1, true
-	case NXM_NX_IP_TTL:
-		return 1, true
-	case NXM_NX_TUN_IPV4_SRC:
+	case oxm.NXM_NX_IP_ECN:
+		return 1, false
+	case oxm.NXM_NX_IP_TTL:
+		return 1, false
+	case oxm.NXM_NX_TUN_IPV4_SRC:
 		return 4, true
-	case NXM_NX_TUN_IPV4_DST:
+	case oxm.NXM_NX_TUN_IPV4_DST:
 		return 4, true
-	case NXM_NX_PKT_MARK:
+	case oxm.NXM_NX_PKT_MARK:
 		return 4, true
-	case NXM_NX_TCP_FLAGS:
+	case oxm.NXM_NX_TCP_FLAGS:
 		return 2, true
-	case NXM_NX_DP_HASH:
-		return 4, true
-	case NXM_NX_RECIRC_ID:
+	case oxm.NXM_NX_DP_HASH:
 		return 4, true
-	case NXM_NX_CONJ_ID:
-		return 4, true
-	case NXM_NX_TUN_GBP_ID:
+	case oxm.NXM_NX_RECIRC_ID:
+		return 4, false
+	case oxm.NXM_NX_CONJ_ID:
+		return 4, false
+	case oxm.NXM_NX_TUN_GBP_ID:
 		return 2, true
-	case NXM_NX_TUN_GBP_FLAGS:
+	case oxm.NXM_NX_TUN_GBP_FLAGS:
 		return 1, true
+	case oxm.NXM_NX_TUN_IPV6_SRC:
+		return 16, true
+	case oxm.NXM_NX_TUN_IPV6_DST:
+		return 16, true
+	case oxm.NXM_NX_CT_STATE:
+		return 4, true
+	case oxm.NXM_NX_CT_ZONE:
+		return 2, false
+	case oxm.NXM_NX_CT_MARK:
+		return 4, true
+	case oxm.NXM_NX_CT_LABEL:
+		return 16, true
 	default:
+		if nxmTunMetadata(hdr) {
+			return 124, true
+		}
 		return 0, false
 	}
 }
 
+// nxmBasicFields maps nicira fields to openflow basic fields of the same semantics.
+var nxmBasicFields = map[uint32]uint32{
+	oxm.NXM_OF_ETH_DST:     oxm.OXM_OF_ETH_DST,
+	oxm.NXM_OF_ETH_SRC:     oxm.OXM_OF_ETH_SRC,
+	oxm.NXM_OF_ETH_TYPE:    oxm.OXM_OF_ETH_TYPE,
+	oxm.NXM_OF_IP_PROTO:    oxm.OXM_OF_IP_PROTO,
+	oxm.NXM_OF_IP_SRC:      oxm.OXM_OF_IPV4_SRC,
+	oxm.NXM_OF_IP_DST:      oxm.OXM_OF_IPV4_DST,
+	oxm.NXM_OF_TCP_SRC:     oxm.OXM_OF_TCP_SRC,
+	oxm.NXM_OF_TCP_DST:     oxm.OXM_OF_TCP_DST,
+	oxm.NXM_OF_UDP_SRC:     oxm.OXM_OF_UDP_SRC,
+	oxm.NXM_OF_UDP_DST:     oxm.OXM_OF_UDP_DST,
+	oxm.NXM_OF_ICMP_TYPE:   oxm.OXM_OF_ICMPV4_TYPE,
+	oxm.NXM_OF_ICMP_CODE:   oxm.OXM_OF_ICMPV4_CODE,
+	oxm.NXM_OF_ARP_OP:      oxm.OXM_OF_ARP_OP,
+	oxm.NXM_OF_ARP_SPA:     oxm.OXM_OF_ARP_SPA,
+	oxm.NXM_OF_ARP_TPA:     oxm.OXM_OF_ARP_TPA,
+	oxm.NXM_NX_TUN_ID:      oxm.OXM_OF_TUNNEL_ID,
+	oxm.NXM_NX_ARP_SHA:     oxm.OXM_OF_ARP_SHA,
+	oxm.NXM_NX_ARP_THA:     oxm.OXM_OF_ARP_THA,
+	oxm.NXM_NX_IPV6_SRC:    oxm.OXM_OF_IPV6_SRC,
+	oxm.NXM_NX_IPV6_DST:    oxm.OXM_OF_IPV6_DST,
+	oxm.NXM_NX_ICMPV6_TYPE: oxm.OXM_OF_ICMPV6_TYPE,
+	oxm.NXM_NX_ICMPV6_CODE: oxm.OXM_OF_ICMPV6_CODE,
+	oxm.NXM_NX_ND_TARGET:   oxm.OXM_OF_IPV6_ND_TARGET,
+	oxm.NXM_NX_ND_SLL:      oxm.OXM_OF_IPV6_ND_SLL,
+	oxm.NXM_NX_ND_TLL:      oxm.OXM_OF_IPV6_ND_TLL,
+	oxm.NXM_NX_IPV6_LABEL:  oxm.OXM_OF_IPV6_FLABEL,
+	oxm.NXM_NX_IP_ECN:      oxm.OXM_OF_IP_ECN,
+}
+
+// nxmValidate checks the length and the mask of the field.
+func nxmValidate(hdr uint32) error {
+	length, mayMask := nxmDefs(hdr)
+	h := oxm.Header(hdr)
+	if length == 0 {
+		return ofp4.MakeErrorMsg(
+			ofp4.OFPET_BAD_MATCH,
+			ofp4.OFPBMC_BAD_FIELD,
+		)
+	}
+	if h.HasMask() && !mayMask {
+		return ofp4.MakeErrorMsg(
+			ofp4.OFPET_BAD_MATCH,
+			ofp4.OFPBMC_BAD_MASK,
+		)
+	}
+	l := h.Length()
+	if h.HasMask() {
+		l = l / 2
+	}
+	if nxmTunMetadata(hdr) {
+		if l == 0 || l > length || h.HasMask() && h.Length()%2 != 0 {
+			return ofp4.MakeErrorMsg(
+				ofp4.OFPET_BAD_MATCH,
+				ofp4.OFPBMC_BAD_LEN,
+			)
+		}
+	} else if h.HasMask() && h.Length() != length*2 || !h.HasMask() && h.Length() != length {
+		return ofp4.MakeErrorMsg(
+			ofp4.OFPET_BAD_MATCH,
+			ofp4.OFPBMC_BAD_LEN,
+		)
+	}
+	return nil
+}
+
+func nxmTunMetadata(hdr uint32) bool {
+	t := oxm.Header(hdr).Type()
+	return t >= oxm.NXM_NX_TUN_METADATA0 && t <= oxm.NXM_NX_TUN_METADATA63
+}
+
+// nxmOob returns true if the field is stored in Frame.Oob.
+func nxmOob(key OxmKey) bool {
+	if k, ok := key.(OxmKeyBasic); ok {
+		switch uint32(k) {
+		case oxm.NXM_NX_DP_HASH, oxm.NXM_NX_RECIRC_ID, oxm.NXM_NX_CONJ_ID:
+			return true
+		}
+		return nxmTunnel(key)
+	}
+	return false
+}
+
+var nxmRegs = [...]uint32{
+	oxm.NXM_NX_REG0,
+	oxm.NXM_NX_REG1,
+	oxm.NXM_NX_REG2,
+	oxm.NXM_NX_REG3,
+	oxm.NXM_NX_REG4,
+	oxm.NXM_NX_REG5,
+	oxm.NXM_NX_REG6,
+	oxm.NXM_NX_REG7,
+}
+
+// nxmRegister returns the register index if the field is a register.
+func nxmRegister(hdr uint32) (int, bool) {
+	t := oxm.Header(hdr).Type()
+	for i, reg := range nxmRegs {
+		if t == reg {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// nxmTunnel returns true for tunnel metadata, which does not match if the frame
+// did not come from a tunnel. Other out-of-band fields are zero by default.
+func nxmTunnel(key OxmKey) bool {
+	switch key {
+	case OxmKeyBasic(oxm.NXM_NX_TUN_IPV4_SRC), OxmKeyBasic(oxm.NXM_NX_TUN_IPV4_DST),
+		OxmKeyBasic(oxm.NXM_NX_TUN_IPV6_SRC), OxmKeyBasic(oxm.NXM_NX_TUN_IPV6_DST),
+		OxmKeyBasic(oxm.NXM_NX_TUN_GBP_ID), OxmKeyBasic(oxm.NXM_NX_TUN_GBP_FLAGS):
+		return true
+	}
+	if k, ok := key.(OxmKeyBasic); ok {
+		return nxmTunMetadata(uint32(k))
+	}
+	return false
+}
+
+// nxmPort converts openflow 1.3 port number into openflow 1.0 port number.
+func nxmPort(port uint32) uint16 {
+	if port >= ofp4.OFPP_MAX {
+		return uint16(port)
+	} else if port >= 0xff00 {
+		return 0xffff // OFPP_NONE
+	}
+	return uint16(port)
+}
 
 func (self oxmNxm) OxmId(id uint32) uint32 {
 	length, mask := nxmDefs(id)
@@ -151,57 +291,233 @@ func (self oxmNxm) OxmId(id uint32) uint32 {
 	return uint32(hdr)
 }
 
-func (self oxmNxm) Match(data Frame, key OxmKey, payload OxmPayload) (bool, error) {
-	val := payload.(OxmValueMask)
-	switch key {
-	case oxm.NXM_NX_TUN_ID:
-		if value, err := data.getValue(oxm.OXM_OF_TUNNEL_ID); err!=nil{
-			return false, err
-		} else {
-			return bytes.Equal(maskBytes(value, val.Mask), val.Value), nil
-		}
-	case oxm.NXM_NX_TUN_IPV4_SRC, oxm.NXM_NX_TUN_IPV4_DST:
+// getValue returns nil for absent tunnel metadata.
+func (self oxmNxm) getValue(data *Frame, key OxmKey) ([]byte, error) {
+	k, ok := key.(OxmKeyBasic)
+	if !ok {
+		return nil, fmt.Errorf("unsupported oxm key %v", key)
+	}
+	if basic, ok := nxmBasicFields[uint32(k)]; ok {
+		return data.getValue(basic)
+	}
+	if nxmOob(key) {
 		if val, ok := data.Oob[key]; ok && val != nil {
-			if v, ok := val.(ofp4sw.OxmValueMask); ok && len(v.Value) > 0 {
-				if len(p.Mask) > 0 {
-					return bytes.Equal(p.Value, bytes2.And(v.Value, p.Mask)), nil
-				} else {
-					return bytes.Equal(p.Value, v.Value), nil
+			if v, ok := val.(OxmValueMask); ok && len(v.Value) > 0 {
+				return v.Value, nil
+			}
+		}
+		if nxmTunnel(key) {
+			return nil, nil
+		}
+		length, _ := nxmDefs(uint32(k))
+		return make([]byte, length), nil
+	}
+	if _, ok := nxmRegister(uint32(k)); ok || uint32(k) == oxm.NXM_NX_PKT_MARK {
+		return data.getValue(uint32(k))
+	}
+	switch uint32(k) {
+	case oxm.NXM_OF_IN_PORT:
+		return toMatchBytes(nxmPort(data.inPort))
+	case oxm.NXM_NX_CT_STATE:
+		return toMatchBytes(data.ctState)
+	case oxm.NXM_NX_CT_ZONE:
+		return toMatchBytes(data.ctZone)
+	case oxm.NXM_NX_CT_MARK:
+		return toMatchBytes(data.ctMark)
+	case oxm.NXM_NX_CT_LABEL:
+		return data.ctLabel[:], nil
+	case oxm.NXM_OF_VLAN_TCI:
+		for _, layer := range data.Layers() {
+			if t, ok := layer.(*layers.Dot1Q); ok {
+				return toMatchBytes(uint16(t.Priority)<<13 | 0x1000 | t.VLANIdentifier&0x0fff)
+			}
+		}
+		return toMatchBytes(uint16(0x0000))
+	case oxm.NXM_OF_IP_TOS:
+		for _, layer := range data.Layers() {
+			if t, ok := layer.(*layers.IPv4); ok {
+				return toMatchBytes(t.TOS & 0xFC)
+			}
+			if t, ok := layer.(*layers.IPv6); ok {
+				return toMatchBytes(t.TrafficClass & 0xFC)
+			}
+		}
+	case oxm.NXM_NX_IP_TTL:
+		for _, layer := range data.Layers() {
+			if t, ok := layer.(*layers.IPv4); ok {
+				return toMatchBytes(t.TTL)
+			}
+			if t, ok := layer.(*layers.IPv6); ok {
+				return toMatchBytes(t.HopLimit)
+			}
+		}
+	case oxm.NXM_NX_IP_FRAG:
+		// bit 0 for any fragment, bit 1 for later fragment
+		var frag uint8
+		for _, layer := range data.Layers() {
+			switch t := layer.(type) {
+			case *layers.IPv4:
+				if t.Flags&layers.IPv4MoreFragments != 0 || t.FragOffset != 0 {
+					frag |= 1
+				}
+				if t.FragOffset != 0 {
+					frag |= 2
 				}
+				return toMatchBytes(frag)
+			case *layers.IPv6Fragment:
+				frag |= 1
+				if t.FragmentOffset != 0 {
+					frag |= 2
+				}
+				return toMatchBytes(frag)
 			}
 		}
+		for _, layer := range data.Layers() {
+			if _, ok := layer.(*layers.IPv6); ok {
+				return toMatchBytes(frag)
+			}
+		}
+	case oxm.NXM_NX_TCP_FLAGS:
+		for _, layer := range data.Layers() {
+			if t, ok := layer.(*layers.TCP); ok {
+				var flags uint16
+				for i, f := range []bool{t.FIN, t.SYN, t.RST, t.PSH, t.ACK, t.URG, t.ECE, t.CWR, t.NS} {
+					if f {
+						flags |= 1 << uint(i)
+					}
+				}
+				return toMatchBytes(flags)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported oxm key %v", key)
 	}
-	return false, fmt.Errorf("unsupported oxm key")
+	return nil, fmt.Errorf("oxm value not found for %v", key)
 }
 
-func (self oxmNxm) SetField(data *Frame, key OxmKey, payload OxmPayload) error {
-	vm := payload.(OxmValueMask)
-	switch key {
-	case oxm.NXM_NX_TUN_ID:
-		buf := make([]byte, 8)
-		binary.BigEndian.PutUint64(buf, data.tunnelId)
-		if err := vm.Set(buf); err != nil {
-			return err
-		} else {
-			data.tunnelId = binary.BigEndian.Uint64(buf)
+func (self oxmNxm) setValue(data *Frame, key OxmKey, value []byte) error {
+	k := uint32(key.(OxmKeyBasic))
+	if basic, ok := nxmBasicFields[k]; ok {
+		return oxmBasicHandler.SetField(data, OxmKeyBasic(basic), OxmValueMask{
+			Value: value,
+		})
+	}
+	if nxmOob(key) {
+		if data.Oob == nil {
+			data.Oob = make(map[OxmKey]OxmPayload)
+		}
+		data.Oob[key] = OxmValueMask{
+			Value: value,
 		}
 		return nil
-	case oxm.NXM_NX_TUN_IPV4_SRC, oxm.NXM_NX_TUN_IPV4_DST:
-		if val, ok := data.Oob[key]; ok && val != nil {
-			if v, ok := val.(OxmValueMask); ok && len(v.Value) > 0 {
-				if err := vm.Set(v.Value); err != nil {
-					return err
-				} else {
-					data.Oob[key] = v
+	}
+	if i, ok := nxmRegister(k); ok {
+		data.regs[i] = binary.BigEndian.Uint32(value)
+		return nil
+	}
+	switch k {
+	case oxm.NXM_NX_PKT_MARK:
+		data.pktMark = binary.BigEndian.Uint32(value)
+		return nil
+	case oxm.NXM_OF_IN_PORT:
+		port := uint32(binary.BigEndian.Uint16(value))
+		if port >= 0xff00 {
+			port |= 0xffff0000
+		}
+		data.inPort = port
+		return nil
+	case oxm.NXM_OF_VLAN_TCI:
+		tci := binary.BigEndian.Uint16(value)
+		var vlan *layers.Dot1Q
+		for _, layer := range data.Layers() {
+			if t, ok := layer.(*layers.Dot1Q); ok {
+				vlan = t
+				break
+			}
+		}
+		if tci&0x1000 == 0 {
+			if vlan == nil {
+				return nil
+			}
+			_, _, err := actionGeneric{Type: ofp4.OFPAT_POP_VLAN}.Process(data)
+			return err
+		}
+		if vlan == nil {
+			if _, _, err := (actionPush{Type: ofp4.OFPAT_PUSH_VLAN, Ethertype: 0x8100}).Process(data); err != nil {
+				return err
+			}
+			for _, layer := range data.Layers() {
+				if t, ok := layer.(*layers.Dot1Q); ok {
+					vlan = t
+					break
 				}
 			}
-		} else {
-			data.Oob[key] = OxmValueMask {
-				Value: vm.Value,
+			if vlan == nil {
+				return fmt.Errorf("vlan push failed")
+			}
+		}
+		vlan.Priority = uint8(tci >> 13)
+		vlan.VLANIdentifier = tci & 0x0fff
+		return nil
+	case oxm.NXM_OF_IP_TOS:
+		for _, layer := range data.Layers() {
+			if t, ok := layer.(*layers.IPv4); ok {
+				t.TOS = t.TOS&0x03 | value[0]&0xFC
+				return nil
+			}
+			if t, ok := layer.(*layers.IPv6); ok {
+				t.TrafficClass = t.TrafficClass&0x03 | value[0]&0xFC
+				return nil
 			}
 		}
+	case oxm.NXM_NX_IP_TTL:
+		for _, layer := range data.Layers() {
+			if t, ok := layer.(*layers.IPv4); ok {
+				t.TTL = value[0]
+				return nil
+			}
+			if t, ok := layer.(*layers.IPv6); ok {
+				t.HopLimit = value[0]
+				return nil
+			}
+		}
+	case oxm.NXM_NX_IP_FRAG, oxm.NXM_NX_TCP_FLAGS:
+		return fmt.Errorf("read-only oxm key %v", key)
+	case oxm.NXM_NX_CT_STATE, oxm.NXM_NX_CT_ZONE, oxm.NXM_NX_CT_MARK, oxm.NXM_NX_CT_LABEL:
+		// ct_mark and ct_label are set by the connection tracker on commit
+		return fmt.Errorf("read-only oxm key %v", key)
+	default:
+		return fmt.Errorf("unsupported oxm key %v", key)
 	}
-	return fmt.Errorf("layer not found: %v", m)
+	return fmt.Errorf("layer not found: %v", key)
+}
+
+func (self oxmNxm) Match(data Frame, key OxmKey, payload OxmPayload) (bool, error) {
+	p := payload.(OxmValueMask)
+	if value, err := self.getValue(&data, key); err != nil {
+		return false, err
+	} else if value == nil {
+		return false, nil
+	} else {
+		return bytes.Equal(maskBytes(value, p.Mask), maskBytes(p.Value, p.Mask)), nil
+	}
+}
+
+func (self oxmNxm) SetField(data *Frame, key OxmKey, payload OxmPayload) error {
+	vm := payload.(OxmValueMask)
+	value := make([]byte, len(vm.Value))
+	if len(vm.Mask) > 0 {
+		// keep bits out of the mask
+		if current, err := self.getValue(data, key); err != nil {
+			return err
+		} else if len(current) == len(value) {
+			copy(value, current)
+		}
+	}
+	if err := vm.Set(value); err != nil {
+		return err
+	}
+	return self.setValue(data, key, value)
 }
 
 func (self oxmNxm) Fit(k OxmKey, narrow, wide OxmPayload) (bool, error) {
@@ -217,7 +533,101 @@ func (self oxmNxm) Conflict(k OxmKey, a, b OxmPayload) (bool, error) {
 	return !bytes.Equal(maskBytes(x.Value, mask), maskBytes(y.Value, mask)), nil
 }
 
+// Expand adds the prerequisites. Prerequisites chain, for example tcp_dst
+// requires ip_proto, which requires eth_type of IPv4 or IPv6 in turn.
 func (self oxmNxm) Expand(info map[OxmKey]OxmPayload) error {
-	return nil
+	badPrereq := ofp4.MakeErrorMsg(
+		ofp4.OFPET_BAD_MATCH,
+		ofp4.OFPBMC_BAD_PREREQ,
+	)
+	// prerequisite may be given in openflow basic field as well
+	current := func(field uint32) ([]byte, bool) {
+		keys := []OxmKey{OxmKeyBasic(field)}
+		if basic, ok := nxmBasicFields[field]; ok {
+			keys = append(keys, OxmKeyBasic(basic))
+		}
+		for _, key := range keys {
+			if e, ok := info[key]; ok {
+				vm := e.(OxmValueMask)
+				for _, m := range vm.Mask {
+					if m != 0xFF {
+						return nil, true // masked prerequisite is rejected
+					}
+				}
+				return vm.Value, true
+			}
+		}
+		return nil, false
+	}
+	for {
+		req := make(map[uint32][]byte)
+		prereq := func(field uint32, value []byte) error {
+			if v, ok := req[field]; ok && !bytes.Equal(v, value) {
+				return badPrereq
+			}
+			req[field] = value
+			return nil
+		}
+		ipAny := false // eth_type must be IPv4 or IPv6
+		for t, _ := range info {
+			k, ok := t.(OxmKeyBasic)
+			if !ok {
+				continue
+			}
+			var err error
+			switch uint32(k) {
+			case oxm.NXM_OF_IP_SRC, oxm.NXM_OF_IP_DST:
+				err = prereq(oxm.NXM_OF_ETH_TYPE, []byte{0x08, 0x00})
+			case oxm.NXM_OF_IP_PROTO, oxm.NXM_OF_IP_TOS, oxm.NXM_NX_IP_ECN, oxm.NXM_NX_IP_TTL:
+				ipAny = true
+			case oxm.NXM_OF_TCP_SRC, oxm.NXM_OF_TCP_DST, oxm.NXM_NX_TCP_FLAGS:
+				err = prereq(oxm.NXM_OF_IP_PROTO, []byte{0x06})
+			case oxm.NXM_OF_UDP_SRC, oxm.NXM_OF_UDP_DST:
+				err = prereq(oxm.NXM_OF_IP_PROTO, []byte{0x11})
+			case oxm.NXM_OF_ICMP_TYPE, oxm.NXM_OF_ICMP_CODE:
+				if err = prereq(oxm.NXM_OF_IP_PROTO, []byte{0x01}); err == nil {
+					err = prereq(oxm.NXM_OF_ETH_TYPE, []byte{0x08, 0x00})
+				}
+			case oxm.NXM_OF_ARP_OP, oxm.NXM_OF_ARP_SPA, oxm.NXM_OF_ARP_TPA,
+				oxm.NXM_NX_ARP_SHA, oxm.NXM_NX_ARP_THA:
+				err = prereq(oxm.NXM_OF_ETH_TYPE, []byte{0x08, 0x06})
+			case oxm.NXM_NX_IPV6_SRC, oxm.NXM_NX_IPV6_DST, oxm.NXM_NX_IPV6_LABEL:
+				err = prereq(oxm.NXM_OF_ETH_TYPE, []byte{0x86, 0xDD})
+			case oxm.NXM_NX_ICMPV6_TYPE, oxm.NXM_NX_ICMPV6_CODE, oxm.NXM_NX_ND_TARGET:
+				if err = prereq(oxm.NXM_OF_IP_PROTO, []byte{0x3A}); err == nil {
+					err = prereq(oxm.NXM_OF_ETH_TYPE, []byte{0x86, 0xDD})
+				}
+			case oxm.NXM_NX_ND_SLL:
+				err = prereq(oxm.NXM_NX_ICMPV6_TYPE, []byte{135})
+			case oxm.NXM_NX_ND_TLL:
+				err = prereq(oxm.NXM_NX_ICMPV6_TYPE, []byte{136})
+			}
+			if err != nil {
+				return err
+			}
+		}
+		added := false
+		for field, value := range req {
+			if v, ok := current(field); ok {
+				if !bytes.Equal(v, value) {
+					return badPrereq
+				}
+			} else {
+				info[OxmKeyBasic(field)] = OxmValueMask{
+					Value: value,
+				}
+				added = true
+			}
+		}
+		if added {
+			continue
+		}
+		if ipAny {
+			if v, ok := current(oxm.NXM_OF_ETH_TYPE); !ok ||
+				!(bytes.Equal(v, []byte{0x08, 0x00}) || bytes.Equal(v, []byte{0x86, 0xDD})) {
+				return badPrereq
+			}
+		}
+		return nil
+	}
 }
-
@@ -0,0 +1,263 @@
+package ofp4sw
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/hkwi/gopenflow"
+	"github.com/hkwi/gopenflow/ofp4"
+	"github.com/hkwi/gopenflow/oxm"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNxmTunMetadata(t *testing.T) {
+	fr := Frame{
+		serialized: make([]byte, 64),
+		Oob: map[OxmKey]OxmPayload{
+			OxmKeyBasic(oxm.NXM_NX_TUN_METADATA0): OxmValueMask{Value: []byte{1, 2, 3, 4}},
+		},
+	}
+
+	m := match{}
+	if err := m.UnmarshalBinary(OxmKeyBasic(oxm.NXM_NX_TUN_METADATA0).Bytes(OxmValueMask{
+		Value: []byte{1, 2, 0, 0},
+		Mask:  []byte{0xff, 0xff, 0, 0},
+	})); err != nil {
+		t.Fatal(err)
+	}
+	if !m.Match(fr) {
+		t.Error("tun_metadata0 match failed")
+	}
+	m = match{}
+	m.UnmarshalBinary(OxmKeyBasic(oxm.NXM_NX_TUN_METADATA1).Bytes(OxmValueMask{Value: []byte{1, 2, 3, 4}}))
+	if m.Match(fr) {
+		t.Error("absent tun_metadata1 should not match")
+	}
+
+	set := actionSetField{
+		Field: OxmKeyBasic(oxm.NXM_NX_TUN_METADATA1).Bytes(OxmValueMask{Value: []byte{5, 6, 7, 8}}),
+	}
+	if _, _, err := set.Process(&fr); err != nil {
+		t.Fatal(err)
+	}
+	m = match{}
+	m.UnmarshalBinary(OxmKeyBasic(oxm.NXM_NX_TUN_METADATA1).Bytes(OxmValueMask{Value: []byte{5, 6, 7, 8}}))
+	if !m.Match(fr) {
+		t.Error("tun_metadata1 set failed")
+	}
+	if frozen, err := fr.getFrozen(); err != nil {
+		t.Fatal(err)
+	} else {
+		found := false
+		for _, x := range ofp4.Oxm(frozen.Oob).Iter() {
+			if x.Header().Type() == oxm.NXM_NX_TUN_METADATA1 && bytes.Equal(x.Value(), []byte{5, 6, 7, 8}) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("tun_metadata1 not in oob %v", frozen.Oob)
+		}
+	}
+}
+
+func TestNxmRegister(t *testing.T) {
+	fr := Frame{
+		serialized: make([]byte, 64),
+	}
+	for _, field := range [][]byte{
+		nxmTestField(oxm.NXM_NX_REG3, []byte{0, 0, 0x12, 0x34}, nil),
+		nxmTestField(oxm.NXM_NX_REG3, []byte{0, 0, 0, 0x56}, []byte{0, 0, 0, 0xff}),
+		nxmTestField(oxm.NXM_NX_PKT_MARK, []byte{0, 0, 0, 9}, nil),
+	} {
+		if _, _, err := (actionSetField{Field: field}).Process(&fr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cloned := fr.clone()
+	m := match{}
+	if err := m.UnmarshalBinary(append(nxmTestField(oxm.NXM_NX_REG3, []byte{0, 0, 0x12, 0x56}, nil),
+		nxmTestField(oxm.NXM_NX_PKT_MARK, []byte{0, 0, 0, 9}, nil)...)); err != nil {
+		t.Fatal(err)
+	}
+	if !m.Match(cloned) {
+		t.Errorf("register not kept in clone %v", cloned.regs)
+	}
+	m = match{}
+	m.UnmarshalBinary(nxmTestField(oxm.NXM_NX_REG4, []byte{0, 0, 0, 0}, nil))
+	if !m.Match(cloned) {
+		t.Error("unset register must be zero")
+	}
+	if frozen, err := cloned.getFrozen(); err != nil {
+		t.Fatal(err)
+	} else {
+		found := 0
+		for _, x := range ofp4.Oxm(frozen.Oob).Iter() {
+			switch x.Header().Type() {
+			case oxm.NXM_NX_REG3:
+				if bytes.Equal(x.Value(), []byte{0, 0, 0x12, 0x56}) {
+					found++
+				}
+			case oxm.NXM_NX_PKT_MARK:
+				if bytes.Equal(x.Value(), []byte{0, 0, 0, 9}) {
+					found++
+				}
+			}
+		}
+		if found != 2 {
+			t.Errorf("packet_in match lacks registers %v", frozen.Oob)
+		}
+	}
+}
+
+func nxmTestFlowMod(tableId uint8, fields []byte, insts ...ofp4.Instruction) ofp4.FlowMod {
+	buf := make([]byte, 48)
+	buf[0] = 4
+	buf[1] = ofp4.OFPT_FLOW_MOD
+	buf[24] = tableId
+	buf[25] = ofp4.OFPFC_ADD
+	binary.BigEndian.PutUint16(buf[30:], 10)
+	binary.BigEndian.PutUint32(buf[32:], ofp4.OFP_NO_BUFFER)
+	binary.BigEndian.PutUint32(buf[36:], ofp4.OFPP_ANY)
+	binary.BigEndian.PutUint32(buf[40:], ofp4.OFPG_ANY)
+	buf = append(buf, ofp4.MakeMatch(fields)...)
+	for _, inst := range insts {
+		buf = append(buf, inst...)
+	}
+	binary.BigEndian.PutUint16(buf[2:], uint16(len(buf)))
+	return ofp4.FlowMod(buf)
+}
+
+func nxmTestField(field uint32, value, mask []byte) []byte {
+	return OxmKeyBasic(field).Bytes(OxmValueMask{Value: value, Mask: mask})
+}
+
+func TestNxmPipeline(t *testing.T) {
+	pipe := NewPipeline()
+	host1, sw1 := gopenflow.NewMemPortPair("h1", [6]byte{2, 0, 0, 0, 0, 1}, "sw1", [6]byte{2, 0, 0, 0, 1, 1})
+	host2, sw2 := gopenflow.NewMemPortPair("h2", [6]byte{2, 0, 0, 0, 0, 2}, "sw2", [6]byte{2, 0, 0, 0, 1, 2})
+	if err := pipe.SetPort(1, sw1); err != nil {
+		t.Fatal(err)
+	}
+	if err := pipe.SetPort(2, sw2); err != nil {
+		t.Fatal(err)
+	}
+
+	var fields []byte
+	fields = append(fields, nxmTestField(oxm.NXM_OF_IN_PORT, []byte{0, 1}, nil)...)
+	fields = append(fields, nxmTestField(oxm.NXM_OF_IP_SRC, []byte{192, 0, 2, 0}, []byte{255, 255, 255, 0})...)
+	fields = append(fields, nxmTestField(oxm.NXM_OF_TCP_DST, []byte{0, 80}, nil)...)
+	fields = append(fields, nxmTestField(oxm.NXM_NX_IP_TTL, []byte{64}, nil)...)
+	fields = append(fields, nxmTestField(oxm.NXM_NX_TCP_FLAGS, []byte{0, 0x02}, []byte{0, 0x02})...)
+	var actions []byte
+	actions = append(actions, ofp4.MakeActionSetField(nxmTestField(oxm.NXM_NX_REG0, []byte{0, 0, 0, 7}, nil))...)
+	actions = append(actions, ofp4.MakeActionSetField(nxmTestField(oxm.NXM_OF_IP_TOS, []byte{0xb8}, nil))...)
+	actions = append(actions, ofp4.MakeActionSetField(nxmTestField(oxm.NXM_OF_VLAN_TCI, []byte{0x30, 0x0a}, nil))...)
+	if err := pipe.addFlowEntry(nxmTestFlowMod(0, fields,
+		ofp4.MakeInstructionActions(ofp4.OFPIT_APPLY_ACTIONS, actions),
+		ofp4.MakeInstructionGotoTable(1))); err != nil {
+		t.Fatal(err)
+	}
+	if err := pipe.addFlowEntry(nxmTestFlowMod(1, nxmTestField(oxm.NXM_NX_REG0, []byte{0, 0, 0, 7}, []byte{0, 0, 0, 0xff}),
+		ofp4.MakeInstructionActions(ofp4.OFPIT_APPLY_ACTIONS, ofp4.MakeActionOutput(2, 0)))); err != nil {
+		t.Fatal(err)
+	}
+
+	packet := func(src net.IP) []byte {
+		buf := gopacket.NewSerializeBuffer()
+		ip := &layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Protocol: layers.IPProtocolTCP,
+			SrcIP:    src,
+			DstIP:    net.IP{198, 51, 100, 1},
+		}
+		tcp := &layers.TCP{
+			SrcPort: 1024,
+			DstPort: 80,
+			SYN:     true,
+		}
+		tcp.SetNetworkLayerForChecksum(ip)
+		if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true},
+			&layers.Ethernet{
+				SrcMAC:       net.HardwareAddr{2, 0, 0, 0, 0, 1},
+				DstMAC:       net.HardwareAddr{2, 0, 0, 0, 0, 2},
+				EthernetType: layers.EthernetTypeIPv4,
+			}, ip, tcp); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	host1.Egress(gopenflow.Frame{Data: packet(net.IP{192, 0, 2, 10})})
+	select {
+	case fr := <-host2.Ingress():
+		pkt := gopacket.NewPacket(fr.Data, layers.LinkTypeEthernet, gopacket.Default)
+		if vlan, ok := pkt.Layer(layers.LayerTypeDot1Q).(*layers.Dot1Q); !ok || vlan.VLANIdentifier != 10 || vlan.Priority != 1 {
+			t.Errorf("vlan_tci set failed %v", pkt)
+		}
+		if ip, ok := pkt.Layer(layers.LayerTypeIPv4).(*layers.IPv4); !ok || ip.TOS != 0xb8 {
+			t.Errorf("ip_tos set failed %v", pkt)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("frame did not pass the pipeline")
+	}
+
+	host1.Egress(gopenflow.Frame{Data: packet(net.IP{203, 0, 113, 10})})
+	select {
+	case fr := <-host2.Ingress():
+		t.Errorf("unexpected frame %v", fr)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestNxmValidate(t *testing.T) {
+	pipe := NewPipeline()
+	errorCode := func(fields []byte) int {
+		if err := pipe.addFlowEntry(nxmTestFlowMod(0, fields)); err == nil {
+			return -1
+		} else if e, ok := err.(ofp4.ErrorMsg); ok {
+			return int(e.Code())
+		} else {
+			t.Fatal(err)
+		}
+		return 0
+	}
+	if code := errorCode(nxmTestField(oxm.NXM_NX_REG1, []byte{0, 1}, nil)); code != ofp4.OFPBMC_BAD_LEN {
+		t.Errorf("unexpected error %d", code)
+	}
+	if code := errorCode(nxmTestField(oxm.NXM_OF_ETH_TYPE, []byte{8, 0}, []byte{0xff, 0xff})); code != ofp4.OFPBMC_BAD_MASK {
+		t.Errorf("unexpected error %d", code)
+	}
+	if code := errorCode(append(nxmTestField(oxm.NXM_OF_IP_PROTO, []byte{17}, nil),
+		nxmTestField(oxm.NXM_OF_TCP_DST, []byte{0, 80}, nil)...)); code != ofp4.OFPBMC_BAD_PREREQ {
+		t.Errorf("unexpected error %d", code)
+	}
+	// prerequisite in openflow basic field
+	if code := errorCode(append(nxmTestField(oxm.OXM_OF_ETH_TYPE, []byte{0x86, 0xdd}, nil),
+		nxmTestField(oxm.NXM_NX_IPV6_LABEL, []byte{0, 0, 0, 1}, nil)...)); code != -1 {
+		t.Errorf("unexpected error %d", code)
+	}
+	// ip_proto requires eth_type of IPv4 or IPv6
+	if code := errorCode(nxmTestField(oxm.NXM_OF_TCP_DST, []byte{0, 80}, nil)); code != ofp4.OFPBMC_BAD_PREREQ {
+		t.Errorf("unexpected error %d", code)
+	}
+	if code := errorCode(append(nxmTestField(oxm.NXM_OF_ETH_TYPE, []byte{0x08, 0x06}, nil),
+		nxmTestField(oxm.NXM_OF_IP_PROTO, []byte{6}, nil)...)); code != ofp4.OFPBMC_BAD_PREREQ {
+		t.Errorf("unexpected error %d", code)
+	}
+	if code := errorCode(append(nxmTestField(oxm.NXM_OF_ETH_TYPE, []byte{0x86, 0xdd}, nil),
+		nxmTestField(oxm.NXM_OF_TCP_DST, []byte{0, 80}, nil)...)); code != -1 {
+		t.Errorf("unexpected error %d", code)
+	}
+	// nd_sll chains to icmpv6_type, ip_proto and eth_type
+	if code := errorCode(nxmTestField(oxm.NXM_NX_ND_SLL, []byte{2, 0, 0, 0, 0, 1}, nil)); code != -1 {
+		t.Errorf("unexpected error %d", code)
+	}
+	if code := errorCode(append(nxmTestField(oxm.OXM_OF_ETH_TYPE, []byte{0x08, 0x00}, nil),
+		nxmTestField(oxm.NXM_NX_ND_SLL, []byte{2, 0, 0, 0, 0, 1}, nil)...)); code != ofp4.OFPBMC_BAD_PREREQ {
+		t.Errorf("unexpected error %d", code)
+	}
+}
@@ -13,6 +13,14 @@ func (_ packetDrop) Error() string {
 	return "meter drop packet"
 }
 
+var meterBandHandlers map[uint32]MeterBandHandler = make(map[uint32]MeterBandHandler)
+
+// AddMeterBandHandler registers the handler for OFPMBT_EXPERIMENTER bands of the experimenter.
+// Meter mod with an experimenter band that has no handler is rejected with OFPMMFC_BAD_BAND.
+func AddMeterBandHandler(experimenter uint32, handle MeterBandHandler) {
+	meterBandHandlers[experimenter] = handle
+}
+
 const baseInterval = 2.0
 
 type meter struct {
@@ -102,12 +110,11 @@ func (m *meter) process(data *Frame) error {
 				}
 			case bandExperimenter:
 				if b.bucket+inc > float64(b.burstSize) {
-					// do nothing
 					if m.flagStats {
 						b.packetCount++
 						b.byteCount += uint64(length)
 					}
-					return nil
+					return b.trigger(data)
 				}
 			default:
 				panic("Unexpected band")
@@ -144,12 +151,11 @@ func (m *meter) process(data *Frame) error {
 			}
 			return b.remark(data)
 		case bandExperimenter:
-			// do nothing
 			if m.flagStats {
 				b.packetCount++
 				b.byteCount += uint64(length)
 			}
-			return nil
+			return b.trigger(data)
 		default:
 			panic("Unexpected band")
 		}
@@ -230,6 +236,11 @@ type bandExperimenter struct {
 	bandCommon
 	experimenter uint32
 	data         []byte
+	handler      MeterBandHandler
+}
+
+func (self bandExperimenter) trigger(data *Frame) error {
+	return self.handler.Execute(data, self.data)
 }
 
 func (self bandExperimenter) MarshalBinary() ([]byte, error) {
@@ -260,14 +271,28 @@ func (self *bandList) UnmarshalBinary(data []byte) error {
 				precLevel: ofp4.MeterBandDscpRemark(msg).PrecLevel(),
 			}
 		case ofp4.OFPMBT_EXPERIMENTER:
-			b = bandExperimenter{
-				bandCommon: bandCommon{
-					rate:      msg.Rate(),
-					burstSize: msg.BurstSize(),
-				},
-				experimenter: ofp4.MeterBandExperimenter(msg).Experimenter(),
-				data:         msg[16:],
+			experimenter := ofp4.MeterBandExperimenter(msg).Experimenter()
+			if handler, ok := meterBandHandlers[experimenter]; ok {
+				b = bandExperimenter{
+					bandCommon: bandCommon{
+						rate:      msg.Rate(),
+						burstSize: msg.BurstSize(),
+					},
+					experimenter: experimenter,
+					data:         msg[16:],
+					handler:      handler,
+				}
+			} else {
+				return ofp4.MakeErrorMsg(
+					ofp4.OFPET_METER_MOD_FAILED,
+					ofp4.OFPMMFC_BAD_BAND,
+				)
 			}
+		default:
+			return ofp4.MakeErrorMsg(
+				ofp4.OFPET_METER_MOD_FAILED,
+				ofp4.OFPMMFC_BAD_BAND,
+			)
 		}
 		bands[i] = b
 	}
@@ -278,12 +303,14 @@ func (self *bandList) UnmarshalBinary(data []byte) error {
 func (pipe *Pipeline) deleteMeterInside(meterId uint32) error {
 	if _, exists := pipe.meters[meterId]; exists {
 		delete(pipe.meters, meterId)
-		pipe.filterFlowsInside(flowFilter{
+		for _, stat := range pipe.filterFlowsInside(flowFilter{
 			opUnregister: true,
 			outPort:      ofp4.OFPP_ANY,
 			outGroup:     ofp4.OFPG_ANY,
 			meterId:      meterId,
-		})
+		}) {
+			pipe.flowRemoved(stat.tableId, stat.priority, stat.flow, ofp4.OFPRR_DELETE)
+		}
 	} else {
 		return ofp4.MakeErrorMsg(
 			ofp4.OFPET_METER_MOD_FAILED,
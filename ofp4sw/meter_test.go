@@ -0,0 +1,120 @@
+package ofp4sw
+
+import (
+	"encoding/binary"
+	"github.com/hkwi/gopenflow"
+	"github.com/hkwi/gopenflow/ofp4"
+	"github.com/hkwi/gopenflow/oxm"
+	"testing"
+	"time"
+)
+
+const meterTestExperimenter = 0xFF0000F2
+
+// meterTestBand drops the frame if data[0] is 1, redirects to port data[1] if data[0] is 2,
+// and sets reg0 to data[1] and continues the pipeline if data[0] is 3.
+type meterTestBand struct{}
+
+func (self meterTestBand) Execute(frame *Frame, data []byte) error {
+	switch data[0] {
+	case 1:
+		return MeterDrop
+	case 2:
+		return MeterRedirect{
+			Port: uint32(data[1]),
+		}
+	case 3:
+		return oxmNxmHandler.SetField(frame, OxmKeyBasic(oxm.NXM_NX_REG0), OxmValueMask{
+			Value: []byte{0, 0, 0, data[1]},
+		})
+	}
+	return nil
+}
+
+func meterTestMod(pipe *Pipeline, meterId uint32, bands ...[]byte) []ofp4.Header {
+	msg := make([]byte, 16)
+	msg[0] = 4
+	msg[1] = ofp4.OFPT_METER_MOD
+	binary.BigEndian.PutUint16(msg[8:], ofp4.OFPMC_ADD)
+	binary.BigEndian.PutUint16(msg[10:], ofp4.OFPMF_PKTPS)
+	binary.BigEndian.PutUint32(msg[12:], meterId)
+	for _, band := range bands {
+		msg = append(msg, band...)
+	}
+	binary.BigEndian.PutUint16(msg[2:], uint16(len(msg)))
+	req := &ofmMeterMod{ofmReply{pipe: pipe, req: msg}}
+	req.Map()
+	return req.resps
+}
+
+func TestMeterBandExperimenter(t *testing.T) {
+	AddMeterBandHandler(meterTestExperimenter, meterTestBand{})
+
+	// band rate 0 is triggered by any frame
+	band := func(op, arg uint8) []byte {
+		return ofp4.MakeMeterBandExperimenter(0, 0, meterTestExperimenter).AppendData([]byte{op, arg, 0, 0, 0, 0, 0, 0})
+	}
+	for _, c := range []struct {
+		name   string
+		band   []byte
+		output int // host index receiving the frame, -1 for drop
+	}{
+		{"drop", band(1, 0), -1},
+		{"redirect", band(2, 3), 2},
+		{"continue", band(3, 9), 1},
+	} {
+		pipe := NewPipeline()
+		var hosts []*gopenflow.MemPort
+		for i := byte(1); i <= 3; i++ {
+			host, sw := gopenflow.NewMemPortPair("host", [6]byte{2, 0, 0, 0, 0, i}, "sw", [6]byte{2, 0, 0, 0, 1, i})
+			if err := pipe.SetPort(uint32(i), sw); err != nil {
+				t.Fatal(err)
+			}
+			hosts = append(hosts, host)
+		}
+		if resps := meterTestMod(pipe, 1, c.band); len(resps) != 0 {
+			t.Fatalf("%s: unexpected response %v", c.name, resps)
+		}
+		if err := pipe.addFlowEntry(nxmTestFlowMod(0, nxmTestField(oxm.OXM_OF_IN_PORT, []byte{0, 0, 0, 1}, nil),
+			ofp4.MakeInstructionMeter(1),
+			ofp4.MakeInstructionGotoTable(1))); err != nil {
+			t.Fatal(err)
+		}
+		if err := pipe.addFlowEntry(nxmTestFlowMod(1, nxmTestField(oxm.NXM_NX_REG0, []byte{0, 0, 0, 9}, nil),
+			ofp4.MakeInstructionActions(ofp4.OFPIT_APPLY_ACTIONS, ofp4.MakeActionOutput(2, 0)))); err != nil {
+			t.Fatal(err)
+		}
+
+		hosts[0].Egress(gopenflow.Frame{Data: []byte{2, 0, 0, 0, 0, 2, 2, 0, 0, 0, 0, 1, 0x08, 0x00, 0, 0}})
+		for i, host := range hosts[1:] {
+			wait := 100 * time.Millisecond
+			if i+1 == c.output {
+				wait = time.Second
+			}
+			select {
+			case <-host.Ingress():
+				if i+1 != c.output {
+					t.Errorf("%s: unexpected frame on host%d", c.name, i+2)
+				}
+			case <-time.After(wait):
+				if i+1 == c.output {
+					t.Errorf("%s: frame not received on host%d", c.name, i+2)
+				}
+			}
+		}
+	}
+}
+
+func TestMeterBandUnknown(t *testing.T) {
+	pipe := NewPipeline()
+	resps := meterTestMod(pipe, 1, ofp4.MakeMeterBandExperimenter(1000, 0, 0xFF0000FF).AppendData(make([]byte, 8)))
+	if len(resps) != 1 || resps[0].Type() != ofp4.OFPT_ERROR {
+		t.Fatalf("unexpected response %v", resps)
+	}
+	if code := binary.BigEndian.Uint16(resps[0][10:]); code != ofp4.OFPMMFC_BAD_BAND {
+		t.Errorf("unexpected error %d", code)
+	}
+	if pipe.getMeter(1) != nil {
+		t.Error("meter added with unknown band")
+	}
+}
@@ -0,0 +1,202 @@
+package ofp4sw
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/hkwi/gopenflow"
+	"github.com/hkwi/gopenflow/ofp4"
+	"github.com/hkwi/gopenflow/oxm"
+	"net"
+	"sync"
+)
+
+// MirrorConfig is a port mirror configuration, used in Pipeline.SetMirror.
+//
+// Frames received on IngressPorts and frames sent out from EgressPorts are copied
+// to OutPort, independently of flows. If Vlans is not empty, only the frames in
+// those vlans are mirrored, where vlan 0 means untagged frames. Non-zero OutVlan
+// replaces the vlan tag of the copies, for RSPAN. TunnelId and TunnelDst are
+// passed to OutPort, so that the copies are sent to a remote analyzer through a
+// tunnel port.
+type MirrorConfig struct {
+	IngressPorts []uint32
+	EgressPorts  []uint32
+	Vlans        []uint16
+	OutPort      uint32
+	OutVlan      uint16
+	TunnelId     uint64
+	TunnelDst    net.IP
+}
+
+// MirrorStats is the counters of a mirror.
+type MirrorStats struct {
+	PacketCount uint64 // copies sent out
+	ByteCount   uint64
+	ErrorCount  uint64 // copies failed to send out
+}
+
+type mirror struct {
+	config  MirrorConfig
+	ingress map[uint32]bool
+	egress  map[uint32]bool
+	vlans   map[uint16]bool // all vlans if empty
+	stats   MirrorStats
+}
+
+type mirrorTable struct {
+	lock    *sync.RWMutex
+	mirrors map[uint32]*mirror
+}
+
+func newMirrorTable() *mirrorTable {
+	return &mirrorTable{
+		lock:    &sync.RWMutex{},
+		mirrors: make(map[uint32]*mirror),
+	}
+}
+
+// SetMirror adds or replaces the port mirror. Counters are reset on replacement.
+func (self *Pipeline) SetMirror(mirrorId uint32, config MirrorConfig) error {
+	if !isPortNo(config.OutPort) {
+		return fmt.Errorf("invalid mirror output port %d", config.OutPort)
+	}
+	if config.OutVlan > 0x0fff {
+		return fmt.Errorf("invalid mirror output vlan %d", config.OutVlan)
+	}
+	if config.TunnelDst != nil && config.TunnelDst.To16() == nil {
+		return fmt.Errorf("invalid mirror tunnel destination %v", config.TunnelDst)
+	}
+	m := &mirror{
+		config:  config,
+		ingress: make(map[uint32]bool),
+		egress:  make(map[uint32]bool),
+		vlans:   make(map[uint16]bool),
+	}
+	for _, ports := range []struct {
+		list []uint32
+		set  map[uint32]bool
+	}{
+		{config.IngressPorts, m.ingress},
+		{config.EgressPorts, m.egress},
+	} {
+		for _, portNo := range ports.list {
+			if !isPortNo(portNo) {
+				return fmt.Errorf("invalid mirror source port %d", portNo)
+			} else if portNo == config.OutPort {
+				return fmt.Errorf("mirror output port %d is a source port", portNo)
+			}
+			ports.set[portNo] = true
+		}
+	}
+	if len(m.ingress) == 0 && len(m.egress) == 0 {
+		return fmt.Errorf("mirror without source ports")
+	}
+	for _, vlan := range config.Vlans {
+		if vlan > 0x0fff {
+			return fmt.Errorf("invalid mirror vlan %d", vlan)
+		}
+		m.vlans[vlan] = true
+	}
+
+	self.mirrors.lock.Lock()
+	defer self.mirrors.lock.Unlock()
+	self.mirrors.mirrors[mirrorId] = m
+	return nil
+}
+
+// RemoveMirror removes the port mirror.
+func (self *Pipeline) RemoveMirror(mirrorId uint32) error {
+	self.mirrors.lock.Lock()
+	defer self.mirrors.lock.Unlock()
+	if _, ok := self.mirrors.mirrors[mirrorId]; !ok {
+		return fmt.Errorf("mirror %d not found", mirrorId)
+	}
+	delete(self.mirrors.mirrors, mirrorId)
+	return nil
+}
+
+// MirrorStats returns the counters of port mirrors by mirror id.
+func (self *Pipeline) MirrorStats() map[uint32]MirrorStats {
+	self.mirrors.lock.RLock()
+	defer self.mirrors.lock.RUnlock()
+	stats := make(map[uint32]MirrorStats)
+	for mirrorId, m := range self.mirrors.mirrors {
+		stats[mirrorId] = m.stats
+	}
+	return stats
+}
+
+// mirror copies the frame received on, or sent out from the port, to the mirror output ports.
+func (pipe *Pipeline) mirror(portNo uint32, egress bool, fr gopenflow.Frame) {
+	var targets []*mirror
+	func() {
+		pipe.mirrors.lock.RLock()
+		defer pipe.mirrors.lock.RUnlock()
+		if len(pipe.mirrors.mirrors) == 0 {
+			return
+		}
+		vlan, _, _ := normalVlanTag(fr.Data)
+		for _, m := range pipe.mirrors.mirrors {
+			if egress && !m.egress[portNo] || !egress && !m.ingress[portNo] {
+				continue
+			}
+			if len(m.vlans) > 0 && !m.vlans[vlan] {
+				continue
+			}
+			targets = append(targets, m)
+		}
+	}()
+	// port lookup takes the pipeline lock
+	for _, m := range targets {
+		err := pipe.mirrorOutput(m.config, fr.Data)
+		func() {
+			pipe.mirrors.lock.Lock()
+			defer pipe.mirrors.lock.Unlock()
+			if err != nil {
+				m.stats.ErrorCount++
+			} else {
+				m.stats.PacketCount++
+				m.stats.ByteCount += uint64(len(fr.Data))
+			}
+		}()
+	}
+}
+
+// mirrorOutput sends the copy of the frame directly to the port, bypassing
+// egress queues and mirrors.
+func (pipe *Pipeline) mirrorOutput(config MirrorConfig, data []byte) error {
+	port := pipe.getPort(config.OutPort)
+	if port == nil {
+		return fmt.Errorf("mirror output port missing %d", config.OutPort)
+	}
+	if portConfig(port)&(ofp4.OFPPC_PORT_DOWN|ofp4.OFPPC_NO_FWD) != 0 {
+		return fmt.Errorf("mirror output port down %d", config.OutPort)
+	}
+	if portState(port)&ofp4.OFPPS_LINK_DOWN != 0 {
+		return fmt.Errorf("mirror output link down %d", config.OutPort)
+	}
+	var copied gopenflow.Frame
+	if config.OutVlan != 0 {
+		_, pcp, _ := normalVlanTag(data)
+		copied.Data = normalRetag(data, true, config.OutVlan, pcp)
+	} else {
+		copied.Data = append([]byte{}, data...)
+	}
+	if config.TunnelId != 0 {
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, config.TunnelId)
+		copied.Oob = append(copied.Oob, OxmKeyBasic(oxm.OXM_OF_TUNNEL_ID).Bytes(OxmValueMask{
+			Value: buf,
+		})...)
+	}
+	if ip := config.TunnelDst.To4(); ip != nil {
+		copied.Oob = append(copied.Oob, OxmKeyBasic(oxm.NXM_NX_TUN_IPV4_DST).Bytes(OxmValueMask{
+			Value: []byte(ip),
+		})...)
+	} else if ip := config.TunnelDst.To16(); ip != nil {
+		copied.Oob = append(copied.Oob, OxmKeyBasic(oxm.NXM_NX_TUN_IPV6_DST).Bytes(OxmValueMask{
+			Value: []byte(ip),
+		})...)
+	}
+	return port.Egress(copied)
+}
@@ -0,0 +1,143 @@
+package ofp4sw
+
+import (
+	"encoding/binary"
+	"github.com/hkwi/gopenflow"
+	"github.com/hkwi/gopenflow/ofp4"
+	"github.com/hkwi/gopenflow/oxm"
+	"testing"
+	"time"
+)
+
+func TestMirror(t *testing.T) {
+	pipe := NewPipeline()
+	host1, sw1 := gopenflow.NewMemPortPair("h1", [6]byte{2, 0, 0, 0, 0, 1}, "sw1", [6]byte{2, 0, 0, 0, 1, 1})
+	host2, sw2 := gopenflow.NewMemPortPair("h2", [6]byte{2, 0, 0, 0, 0, 2}, "sw2", [6]byte{2, 0, 0, 0, 1, 2})
+	host3, sw3 := gopenflow.NewMemPortPair("h3", [6]byte{2, 0, 0, 0, 0, 3}, "sw3", [6]byte{2, 0, 0, 0, 1, 3})
+	for portNo, port := range []gopenflow.Port{sw1, sw2, sw3} {
+		if err := pipe.SetPort(uint32(portNo+1), port); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pipe.addFlowEntry(nxmTestFlowMod(0, nxmTestField(oxm.OXM_OF_IN_PORT, []byte{0, 0, 0, 1}, nil),
+		ofp4.MakeInstructionActions(ofp4.OFPIT_APPLY_ACTIONS, ofp4.MakeActionOutput(2, 0)))); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pipe.SetMirror(1, MirrorConfig{IngressPorts: []uint32{3}, OutPort: 3}); err == nil {
+		t.Error("output port must not be a source")
+	}
+	if err := pipe.SetMirror(1, MirrorConfig{OutPort: 3}); err == nil {
+		t.Error("mirror without source")
+	}
+	if err := pipe.SetMirror(1, MirrorConfig{
+		IngressPorts: []uint32{1},
+		OutPort:      3,
+		TunnelId:     100,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// egress of vlan 10, retagged to vlan 20
+	if err := pipe.SetMirror(2, MirrorConfig{
+		EgressPorts: []uint32{2},
+		Vlans:       []uint16{10},
+		OutPort:     3,
+		OutVlan:     20,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	recv := func(host *gopenflow.MemPort) *gopenflow.Frame {
+		select {
+		case fr := <-host.Ingress():
+			return &fr
+		case <-time.After(100 * time.Millisecond):
+			return nil
+		}
+	}
+
+	untagged := make([]byte, 64)
+	copy(untagged, []byte{2, 0, 0, 0, 0, 2, 2, 0, 0, 0, 0, 1, 0x88, 0xb5})
+	host1.Egress(gopenflow.Frame{Data: untagged})
+	if recv(host2) == nil {
+		t.Fatal("frame not forwarded")
+	}
+	if fr := recv(host3); fr == nil {
+		t.Fatal("ingress not mirrored")
+	} else if len(fr.Data) != 64 || fr.Data[12] != 0x88 {
+		t.Errorf("ingress copy %v", fr.Data)
+	} else if tun := ofp4.Oxm(fr.Oob).Iter(); len(tun) != 1 || tun[0].Header().Type() != oxm.OXM_OF_TUNNEL_ID || binary.BigEndian.Uint64(tun[0].Value()) != 100 {
+		t.Errorf("tunnel id %v", fr.Oob)
+	}
+	if fr := recv(host3); fr != nil {
+		t.Errorf("untagged frame mirrored by vlan filter %v", fr.Data)
+	}
+
+	tagged := make([]byte, 68)
+	copy(tagged, []byte{2, 0, 0, 0, 0, 2, 2, 0, 0, 0, 0, 1, 0x81, 0x00, 0x60, 10, 0x88, 0xb5})
+	host1.Egress(gopenflow.Frame{Data: tagged})
+	if recv(host2) == nil {
+		t.Fatal("frame not forwarded")
+	}
+	copies := 0
+	for fr := recv(host3); fr != nil; fr = recv(host3) {
+		copies++
+		if vid, pcp, ok := normalVlanTag(fr.Data); !ok {
+			t.Errorf("copy not tagged %v", fr.Data)
+		} else if vid == 20 && (pcp != 3 || len(fr.Data) != 68) {
+			t.Errorf("egress copy %v", fr.Data)
+		} else if vid != 20 && vid != 10 {
+			t.Errorf("copy vlan %d", vid)
+		}
+	}
+	if copies != 2 {
+		t.Errorf("copies %d", copies)
+	}
+
+	stats := pipe.MirrorStats()
+	if s := stats[1]; s.PacketCount != 2 || s.ByteCount != 64+68 || s.ErrorCount != 0 {
+		t.Errorf("ingress mirror stats %v", s)
+	}
+	if s := stats[2]; s.PacketCount != 1 || s.ByteCount != 68 {
+		t.Errorf("egress mirror stats %v", s)
+	}
+
+	// output port without forwarding
+	for name, set := range map[string]func(bool){
+		"no_fwd": func(on bool) {
+			if on {
+				sw3.SetConfig([]gopenflow.PortConfig{gopenflow.PortConfigNoFwd(true)})
+			} else {
+				sw3.SetConfig(nil)
+			}
+		},
+		"link_down": sw3.SetLinkDown,
+	} {
+		set(true)
+		host1.Egress(gopenflow.Frame{Data: untagged})
+		if recv(host2) == nil {
+			t.Fatal("frame not forwarded")
+		}
+		if fr := recv(host3); fr != nil {
+			t.Errorf("%s: mirrored %v", name, fr.Data)
+		}
+		set(false)
+	}
+	if s := pipe.MirrorStats()[1]; s.PacketCount != 2 || s.ErrorCount != 2 {
+		t.Errorf("ingress mirror stats %v", s)
+	}
+
+	if err := pipe.RemoveMirror(1); err != nil {
+		t.Error(err)
+	}
+	if err := pipe.RemoveMirror(1); err == nil {
+		t.Error("removed twice")
+	}
+	host1.Egress(gopenflow.Frame{Data: untagged})
+	if recv(host2) == nil {
+		t.Fatal("frame not forwarded")
+	}
+	if fr := recv(host3); fr != nil {
+		t.Errorf("removed mirror %v", fr.Data)
+	}
+}
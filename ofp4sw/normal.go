@@ -0,0 +1,261 @@
+package ofp4sw
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/hkwi/gopenflow/ofp4"
+	"log"
+	"sync"
+	"time"
+)
+
+// NormalPortConfig is the port configuration for OFPP_NORMAL L2 learning bridge.
+//
+// Access port carries untagged frames of Vlan. Trunk port carries tagged
+// frames of Trunks (all vlans if empty), and untagged frames as Vlan (native vlan).
+// Ports without configuration are trunk ports with native vlan 0.
+type NormalPortConfig struct {
+	Trunk  bool
+	Vlan   uint16
+	Trunks []uint16
+}
+
+func (self NormalPortConfig) allows(vlan uint16) bool {
+	if !self.Trunk {
+		return vlan == self.Vlan
+	}
+	if vlan == self.Vlan || len(self.Trunks) == 0 {
+		return true
+	}
+	for _, v := range self.Trunks {
+		if v == vlan {
+			return true
+		}
+	}
+	return false
+}
+
+const defaultMacAgingTime = 300 * time.Second
+
+type normalMacKey struct {
+	vlan uint16
+	mac  [6]byte
+}
+
+type normalMacEntry struct {
+	portNo uint32
+	seen   time.Time
+}
+
+type normalBridge struct {
+	lock  *sync.Mutex
+	ports map[uint32]NormalPortConfig
+	macs  map[normalMacKey]normalMacEntry
+}
+
+func newNormalBridge() *normalBridge {
+	return &normalBridge{
+		lock:  &sync.Mutex{},
+		ports: make(map[uint32]NormalPortConfig),
+		macs:  make(map[normalMacKey]normalMacEntry),
+	}
+}
+
+func (self *normalBridge) portConfig(portNo uint32) NormalPortConfig {
+	if config, ok := self.ports[portNo]; ok {
+		return config
+	}
+	return NormalPortConfig{Trunk: true}
+}
+
+func (self *normalBridge) expire(now time.Time, aging time.Duration) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for key, entry := range self.macs {
+		if now.Sub(entry.seen) > aging {
+			delete(self.macs, key)
+		}
+	}
+}
+
+// flush removes mac table entries learnt on the port.
+func (self *normalBridge) flush(portNo uint32) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for key, entry := range self.macs {
+		if entry.portNo == portNo {
+			delete(self.macs, key)
+		}
+	}
+}
+
+// SetNormalPort sets the port configuration for OFPP_NORMAL bridge.
+// Mac table entries learnt on the port will be flushed.
+func (self *Pipeline) SetNormalPort(portNo uint32, config NormalPortConfig) error {
+	if !isPortNo(portNo) {
+		return fmt.Errorf("invalid port number %d", portNo)
+	}
+	self.normal.lock.Lock()
+	self.normal.ports[portNo] = config
+	self.normal.lock.Unlock()
+
+	self.normal.flush(portNo)
+	return nil
+}
+
+// SetFailStandalone makes the pipeline act as OFPP_NORMAL bridge while no controller is connected.
+func (self *Pipeline) SetFailStandalone(standalone bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.failStandalone = standalone
+}
+
+// SetMacAgingTime sets the aging time of OFPP_NORMAL mac table. Default 300 seconds will be used if zero.
+func (self *Pipeline) SetMacAgingTime(aging time.Duration) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.macAging = aging
+}
+
+func (self *Pipeline) macAgingTime() time.Duration {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	if self.macAging > 0 {
+		return self.macAging
+	}
+	return defaultMacAgingTime
+}
+
+func (self *Pipeline) standalone() bool {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.failStandalone && len(self.channels) == 0
+}
+
+// parses vlan tag in ethernet frame. returns vid, pcp, and whether the frame was tagged.
+func normalVlanTag(eth []byte) (uint16, uint8, bool) {
+	if len(eth) >= 18 && binary.BigEndian.Uint16(eth[12:]) == 0x8100 {
+		tci := binary.BigEndian.Uint16(eth[14:])
+		return tci & 0x0fff, uint8(tci >> 13), true
+	}
+	return 0, 0, false
+}
+
+func normalRetag(eth []byte, tagged bool, vlan uint16, pcp uint8) []byte {
+	var payload []byte
+	if _, _, ok := normalVlanTag(eth); ok {
+		payload = eth[16:]
+	} else {
+		payload = eth[12:]
+	}
+	var ret []byte
+	if tagged {
+		ret = make([]byte, 16+len(payload))
+		binary.BigEndian.PutUint16(ret[12:], 0x8100)
+		binary.BigEndian.PutUint16(ret[14:], uint16(pcp)<<13|vlan)
+		copy(ret[16:], payload)
+	} else {
+		ret = make([]byte, 12+len(payload))
+		copy(ret[12:], payload)
+	}
+	copy(ret, eth[:12])
+	return ret
+}
+
+// sendNormal processes OFPP_NORMAL output as L2 learning bridge.
+func (pipe *Pipeline) sendNormal(output outputToPort) error {
+	eth, err := output.Serialized()
+	if err != nil {
+		return err
+	}
+	if len(eth) < 14 {
+		return fmt.Errorf("too short ethernet frame")
+	}
+	var dst, src [6]byte
+	copy(dst[:], eth[0:6])
+	copy(src[:], eth[6:12])
+
+	bridge := pipe.normal
+	ports := pipe.getAllPorts()
+	aging := pipe.macAgingTime()
+
+	vid, pcp, tagged := normalVlanTag(eth)
+	var vlan uint16
+	_, fromPort := ports[output.inPort]
+	if fromPort {
+		config := func() NormalPortConfig {
+			bridge.lock.Lock()
+			defer bridge.lock.Unlock()
+			return bridge.portConfig(output.inPort)
+		}()
+		if !config.Trunk {
+			if tagged && vid != 0 && vid != config.Vlan {
+				return nil // drop
+			}
+			vlan = config.Vlan
+		} else if tagged && vid != 0 {
+			if !config.allows(vid) {
+				return nil // drop
+			}
+			vlan = vid
+		} else {
+			vlan = config.Vlan
+		}
+	} else if tagged {
+		vlan = vid
+	}
+
+	now := time.Now()
+	outPort := uint32(ofp4.OFPP_FLOOD)
+	configs := make(map[uint32]NormalPortConfig)
+	func() {
+		bridge.lock.Lock()
+		defer bridge.lock.Unlock()
+
+		if fromPort && src[0]&0x01 == 0 {
+			bridge.macs[normalMacKey{vlan, src}] = normalMacEntry{
+				portNo: output.inPort,
+				seen:   now,
+			}
+		}
+		if dst[0]&0x01 == 0 {
+			if entry, ok := bridge.macs[normalMacKey{vlan, dst}]; ok {
+				if now.Sub(entry.seen) > aging {
+					delete(bridge.macs, normalMacKey{vlan, dst})
+				} else {
+					outPort = entry.portNo
+				}
+			}
+		}
+		for portNo, _ := range ports {
+			configs[portNo] = bridge.portConfig(portNo)
+		}
+	}()
+	if outPort == output.inPort {
+		return nil
+	}
+
+	send := func(portNo uint32) error {
+		config := configs[portNo]
+		if !config.allows(vlan) {
+			return nil
+		}
+		out := output
+		out.Frame = output.Frame.clone()
+		out.SetSerialized(normalRetag(eth, config.Trunk && vlan != config.Vlan, vlan, pcp))
+		return pipe.egress(portNo, ports[portNo], out)
+	}
+	if outPort != ofp4.OFPP_FLOOD {
+		if _, ok := ports[outPort]; ok {
+			return send(outPort)
+		}
+	}
+	for portNo, _ := range ports {
+		if portNo != output.inPort {
+			if err := send(portNo); err != nil {
+				log.Print(err)
+			}
+		}
+	}
+	return nil
+}
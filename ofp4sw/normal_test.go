@@ -0,0 +1,62 @@
+package ofp4sw
+
+import (
+	"bytes"
+	"github.com/hkwi/gopenflow"
+	"github.com/hkwi/gopenflow/ofp4"
+	"testing"
+)
+
+func TestNormalRetag(t *testing.T) {
+	untagged := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 0x08, 0x00, 0xaa}
+	tagged := normalRetag(untagged, true, 10, 3)
+	if vid, pcp, ok := normalVlanTag(tagged); !ok || vid != 10 || pcp != 3 {
+		t.Errorf("tag failed %v", tagged)
+	}
+	if !bytes.Equal(normalRetag(tagged, false, 0, 0), untagged) {
+		t.Error("untag failed")
+	}
+}
+
+func TestNormalLearning(t *testing.T) {
+	pipe := NewPipeline()
+	out := make(map[uint32]chan gopenflow.Frame)
+	for portNo := uint32(1); portNo <= 3; portNo++ {
+		out[portNo] = make(chan gopenflow.Frame, 4)
+		pipe.ports[portNo] = queueTestPort{out: out[portNo]}
+	}
+	pipe.SetNormalPort(3, NormalPortConfig{Vlan: 10})
+
+	frame := func(dst, src byte) []byte {
+		return []byte{2, 0, 0, 0, 0, dst, 2, 0, 0, 0, 0, src, 0x08, 0x00, 0, 0}
+	}
+	send := func(inPort uint32, data []byte) {
+		if err := pipe.sendNormal(outputToPort{
+			Frame:   Frame{serialized: data, inPort: inPort},
+			outPort: ofp4.OFPP_NORMAL,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// unknown destination floods in vlan 0, not to access port in vlan 10
+	send(1, frame(2, 1))
+	if len(out[2]) != 1 || len(out[3]) != 0 {
+		t.Errorf("flood failed %d %d", len(out[2]), len(out[3]))
+	}
+	<-out[2]
+
+	// learnt destination
+	send(2, frame(1, 2))
+	if len(out[1]) != 1 || len(out[3]) != 0 {
+		t.Errorf("unicast failed %d %d", len(out[1]), len(out[3]))
+	}
+	<-out[1]
+
+	// flush on port down
+	pipe.normal.flush(1)
+	send(2, frame(1, 2))
+	if len(out[1]) != 1 {
+		t.Errorf("flood after flush failed")
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"github.com/hkwi/gopenflow"
 	"github.com/hkwi/gopenflow/ofp4"
+	"github.com/hkwi/gopenflow/oxm"
 	"io"
 	"log"
 	"math"
@@ -23,19 +24,34 @@ type Pipeline struct {
 	groups   map[uint32]*group
 	meters   map[uint32]*meter
 	datapath chan MapReducable
+	// recirculation by ActionConntrack, dropped when full
+	recirculation      chan MapReducable
+	recirculationDrops uint64
 
 	ports        map[uint32]gopenflow.Port
 	portSnapshot map[uint32]ofp4.Port
 	portAlive    map[uint32]watchTimer
+	schedulers   map[uint32]*portScheduler
+	portLinks    map[uint32]portLink
+	portNames    map[string]uint32 // port number used for the port name
 
 	channels     []*channel
 	buffer       map[uint32]outputToPort
 	nextBufferId uint32
+	normal       *normalBridge
+	conntrack    *conntrack
+	sflows       map[uint32]*sflowExporter // by collector set id
+	ipfix        *ipfixExporter
+	mirrors      *mirrorTable
 
 	DatapathId  uint64
 	Desc        ofp4.Desc
 	flags       uint16 // ofp_config_flags, check capability
 	missSendLen uint16
+
+	failStandalone bool              // see SetFailStandalone
+	macAging       time.Duration     // see SetMacAgingTime
+	ctTimeouts     ConntrackTimeouts // see SetConntrackTimeouts
 }
 
 type channel struct {
@@ -50,48 +66,186 @@ type channel struct {
 
 func NewPipeline() *Pipeline {
 	self := &Pipeline{
-		lock:         &sync.RWMutex{},
-		flows:        make(map[uint8]*flowTable),
-		groups:       make(map[uint32]*group),
-		meters:       make(map[uint32]*meter),
-		datapath:     make(chan MapReducable),
-		ports:        make(map[uint32]gopenflow.Port),
-		portSnapshot: make(map[uint32]ofp4.Port),
-		portAlive:    make(map[uint32]watchTimer),
-		buffer:       make(map[uint32]outputToPort),
-		Desc:         ofp4.Desc(make([]byte, 1056)),
-		missSendLen:  ofp4.OFPCML_NO_BUFFER,
+		lock:          &sync.RWMutex{},
+		flows:         make(map[uint8]*flowTable),
+		groups:        make(map[uint32]*group),
+		meters:        make(map[uint32]*meter),
+		datapath:      make(chan MapReducable),
+		recirculation: make(chan MapReducable, recirculateQueue),
+		ports:         make(map[uint32]gopenflow.Port),
+		portSnapshot:  make(map[uint32]ofp4.Port),
+		portAlive:     make(map[uint32]watchTimer),
+		schedulers:    make(map[uint32]*portScheduler),
+		portLinks:     make(map[uint32]portLink),
+		portNames:     make(map[string]uint32),
+		buffer:        make(map[uint32]outputToPort),
+		normal:        newNormalBridge(),
+		conntrack:     newConntrack(),
+		sflows:        make(map[uint32]*sflowExporter),
+		ipfix:         newIpfixExporter(),
+		mirrors:       newMirrorTable(),
+		Desc:          ofp4.Desc(make([]byte, 1056)),
+		missSendLen:   ofp4.OFPCML_NO_BUFFER,
 	}
 	go func() {
 		for {
 			time.Sleep(time.Second)
-			self.validate(time.Now())
+			now := time.Now()
+			self.validate(now)
+			self.normal.expire(now, self.macAgingTime())
+			self.conntrack.expire(now)
+			self.ipfix.expire(now, self)
 		}
 	}()
+	go func(recirculation chan MapReducable) {
+		for task := range recirculation {
+			self.datapath <- task
+		}
+	}(self.recirculation)
 	go MapReduce(self.datapath, 4) // XXX: NUM_CPUS
 	return self
 }
 
-// SetPort sets a port in a specified portNo. To unset the port, pass nil as port argument.
+// AddPort registers the port in a free port number. The number that was used
+// for the same port name is reused if possible, so that port numbers are
+// stable while a port flaps.
 func (self *Pipeline) AddPort(port gopenflow.Port) error {
 	self.lock.Lock()
 	defer self.lock.Unlock()
 
-	portNo := uint32(1)
-	for idx, p := range self.ports {
+	for _, p := range self.ports {
 		if p == port {
 			return fmt.Errorf("port already registered")
 		}
-		if idx >= portNo {
+	}
+	if portNo, ok := self.portNames[port.Name()]; ok && isPortNo(portNo) && self.ports[portNo] == nil {
+		self.addPort(portNo, port)
+		return nil
+	}
+
+	reserved := make(map[uint32]bool)
+	for _, portNo := range self.portNames {
+		reserved[portNo] = true
+	}
+	portNo := uint32(1)
+	for idx, _ := range self.ports {
+		if idx >= portNo && idx <= ofp4.OFPP_MAX {
+			portNo = idx + 1
+		}
+	}
+	for idx, _ := range reserved {
+		if idx >= portNo && idx <= ofp4.OFPP_MAX {
 			portNo = idx + 1
 		}
 	}
 	if portNo > ofp4.OFPP_MAX {
-		return fmt.Errorf("no port number available")
-		// we may reuse the port number
+		// reuse the lowest number, preferring the one not used by other names.
+		portNo = 0
+		for idx := uint32(1); idx <= ofp4.OFPP_MAX; idx++ {
+			if _, used := self.ports[idx]; !used {
+				if !reserved[idx] {
+					portNo = idx
+					break
+				} else if portNo == 0 {
+					portNo = idx
+				}
+			}
+		}
+		if portNo == 0 {
+			return fmt.Errorf("no port number available")
+		}
+	}
+	self.addPort(portNo, port)
+	return nil
+}
+
+// SetPort sets a port in a specified portNo. To unset the port, pass nil as port argument.
+func (self *Pipeline) SetPort(portNo uint32, port gopenflow.Port) error {
+	if !isPortNo(portNo) {
+		return fmt.Errorf("invalid port number %d", portNo)
+	}
+	if port == nil {
+		if p := self.getPort(portNo); p == nil {
+			return fmt.Errorf("port %d not registered", portNo)
+		} else {
+			return self.RemovePort(p)
+		}
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	for _, p := range self.ports {
+		if p == port {
+			return fmt.Errorf("port already registered")
+		}
+	}
+	if _, exists := self.ports[portNo]; exists {
+		return fmt.Errorf("port %d already registered", portNo)
+	}
+	self.addPort(portNo, port)
+	return nil
+}
+
+// AddLocalPort registers the port as OFPP_LOCAL.
+func (self *Pipeline) AddLocalPort(port gopenflow.Port) error {
+	return self.SetPort(ofp4.OFPP_LOCAL, port)
+}
+
+// RemovePort unregisters the port, and returns after OFPPR_DELETE was sent.
+// The port number is kept for the port name, and will be used when the port
+// of the same name is added again.
+func (self *Pipeline) RemovePort(port gopenflow.Port) error {
+	var link portLink
+	func() {
+		self.lock.Lock()
+		defer self.lock.Unlock()
+		for portNo, p := range self.ports {
+			if p == port {
+				if l, ok := self.portLinks[portNo]; ok {
+					link = l
+					delete(self.portLinks, portNo)
+					close(link.stop)
+				}
+			}
+		}
+	}()
+	if link.done == nil {
+		return fmt.Errorf("port not registered")
+	}
+	<-link.done
+	return nil
+}
+
+// ListPorts returns the registered ports, keyed by port number.
+func (self *Pipeline) ListPorts() map[uint32]gopenflow.Port {
+	return self.getAllPorts()
+}
+
+// portLink stops the goroutines that read the port.
+type portLink struct {
+	stop chan bool
+	done chan bool
+}
+
+// call this inside lock
+func (self *Pipeline) addPort(portNo uint32, port gopenflow.Port) {
+	// a port number is for one port name
+	for name, idx := range self.portNames {
+		if idx == portNo {
+			delete(self.portNames, name)
+		}
 	}
+	self.portNames[port.Name()] = portNo
+
+	link := portLink{
+		stop: make(chan bool),
+		done: make(chan bool),
+	}
+	self.portLinks[portNo] = link
 	self.ports[portNo] = port
 	self.portAlive[portNo] = watchTimer{}
+	// call this inside lock
 	updateTimer := func(ofpPort []byte) {
 		wt := self.portAlive[portNo]
 		if ofp4.Port(ofpPort).State()&ofp4.OFPPS_LIVE != 0 {
@@ -119,46 +273,129 @@ func (self *Pipeline) AddPort(port gopenflow.Port) error {
 
 	pktIngress := make(chan bool)
 	go func() {
-		for pkt := range port.Ingress() {
+		defer close(pktIngress)
+		for {
+			var pkt gopenflow.Frame
+			select {
+			case p, ok := <-port.Ingress():
+				if !ok {
+					return
+				}
+				pkt = p
+			case <-link.stop:
+				return
+			}
+			if portConfig(port)&(ofp4.OFPPC_PORT_DOWN|ofp4.OFPPC_NO_RECV) != 0 {
+				continue
+			}
+			self.mirror(portNo, false, pkt)
 			oob := match(make(map[OxmKey]OxmPayload))
 			if err := oob.UnmarshalBinary(pkt.Oob); err != nil {
 				log.Print(err)
 			} else {
+				// tunnel id and packet mark are pipeline fields, and other basic fields are decided by the pipeline.
+				// registers are cleared, as openvswitch does across patch ports.
+				var tunnelId uint64
+				var pktMark uint32
+				for k, v := range oob {
+					if key, ok := k.(OxmKeyBasic); !ok {
+						continue
+					} else if oxm.Header(key).Class() == ofp4.OFPXMC_OPENFLOW_BASIC {
+						if uint32(key) == oxm.OXM_OF_TUNNEL_ID {
+							if vm := v.(OxmValueMask); len(vm.Value) == 8 {
+								tunnelId = binary.BigEndian.Uint64(vm.Value)
+							}
+						}
+						delete(oob, k)
+					} else if uint32(key) == oxm.NXM_NX_PKT_MARK {
+						if vm := v.(OxmValueMask); len(vm.Value) == 4 {
+							pktMark = binary.BigEndian.Uint32(vm.Value)
+						}
+						delete(oob, k)
+					} else if _, ok := nxmRegister(uint32(key)); ok {
+						delete(oob, k)
+					}
+				}
 				self.datapath <- &flowTask{
 					Frame: Frame{
 						serialized: pkt.Data,
 						inPort:     portNo,
 						inPhyPort:  port.PhysicalPort(),
+						tunnelId:   tunnelId,
+						pktMark:    pktMark,
 						Oob:        oob,
 					},
-					pipe: self,
+					pipe:      self,
+					actionSet: makeActionSet(),
 				}
 			}
 		}
-		pktIngress <- true
 	}()
+	// port status changes are serialized here, and the snapshot is taken from the event.
+	modified := func(ev gopenflow.PortEvent) {
+		self.lock.Lock()
+		defer self.lock.Unlock()
+
+		ofpPort := makePortFromEvent(portNo, ev)
+		if bytes.Equal(ofpPort, self.portSnapshot[portNo]) {
+			return
+		}
+		self.portSnapshot[portNo] = ofpPort
+		for _, ch := range self.channels {
+			ch.Notify(ofp4.MakePortStatus(ofp4.OFPPR_MODIFY, ofpPort))
+		}
+		updateTimer(ofpPort)
+		if ofpPort.State()&ofp4.OFPPS_LINK_DOWN != 0 || ofpPort.Config()&ofp4.OFPPC_PORT_DOWN != 0 {
+			self.normal.flush(portNo)
+		}
+	}
 	go func() {
-		for _ = range port.Monitor() {
-			ofpPort := makePort(portNo, port)
-			if bytes.Equal(ofpPort, self.portSnapshot[portNo]) {
-				continue
-			} else {
-				self.portSnapshot[portNo] = ofpPort
+		defer close(link.done)
+		var deleted *gopenflow.PortEvent
+	monitor:
+		for {
+			select {
+			case ev, ok := <-port.Monitor():
+				if !ok {
+					break monitor
+				} else if ev.Kind == gopenflow.PortDeleted {
+					deleted = &ev
+					break monitor
+				}
+				modified(ev)
+			case <-link.stop:
+				break monitor
 			}
-			for _, ch := range self.channels {
-				ch.Notify(ofp4.MakePortStatus(ofp4.OFPPR_MODIFY, ofpPort))
+		}
+		func() {
+			self.lock.Lock()
+			defer self.lock.Unlock()
+			if l, ok := self.portLinks[portNo]; ok && l.stop == link.stop {
+				delete(self.portLinks, portNo)
+				close(link.stop)
 			}
-			updateTimer(ofpPort)
+		}()
+		<-pktIngress
+
+		self.lock.Lock()
+		defer self.lock.Unlock()
+		ofpPort := self.portSnapshot[portNo]
+		if deleted != nil {
+			ofpPort = makePortFromEvent(portNo, *deleted)
 		}
 		for _, ch := range self.channels {
-			ch.Notify(ofp4.MakePortStatus(ofp4.OFPPR_DELETE, self.portSnapshot[portNo]))
+			ch.Notify(ofp4.MakePortStatus(ofp4.OFPPR_DELETE, ofpPort))
+		}
+
+		if sched := self.schedulers[portNo]; sched != nil {
+			sched.close()
 		}
-		<-pktIngress
 		delete(self.ports, portNo)
 		delete(self.portSnapshot, portNo)
 		delete(self.portAlive, portNo)
+		delete(self.schedulers, portNo)
+		self.normal.flush(portNo)
 	}()
-	return nil
 }
 
 func (self *Pipeline) AddChannel(conn io.ReadWriteCloser) error {
@@ -216,6 +453,17 @@ func (self *Pipeline) AddChannel(conn io.ReadWriteCloser) error {
 	go func() {
 		defer close(worker)
 		defer conn.Close()
+		defer func() {
+			self.lock.Lock()
+			defer self.lock.Unlock()
+			var channels []*channel
+			for _, c := range self.channels {
+				if c != ch {
+					channels = append(channels, c)
+				}
+			}
+			self.channels = channels
+		}()
 
 		multipartCollect := make(map[uint32][][]byte)
 		for {
@@ -403,14 +651,10 @@ func (p Pipeline) watchGroup(groupId uint32) bool {
 }
 
 // Call this function inside a pipeline transaction
+// liveness follows the port events, as reported in port_status.
 func (p Pipeline) watchPort(portNo uint32) bool {
-	if port, ok := p.ports[portNo]; ok {
-		for _, s := range port.State() {
-			switch v := s.(type) {
-			case gopenflow.PortStateLive:
-				return bool(v)
-			}
-		}
+	if snapshot, ok := p.portSnapshot[portNo]; ok {
+		return snapshot.State()&ofp4.OFPPS_LIVE != 0
 	}
 	return false
 }
@@ -439,9 +683,14 @@ func (pipe Pipeline) getMeters(meterId uint32) map[uint32]*meter {
 	return meters
 }
 
+// isPortNo returns true if portNo is a normal port or OFPP_LOCAL.
+func isPortNo(portNo uint32) bool {
+	return (0 < portNo && portNo <= ofp4.OFPP_MAX) || portNo == ofp4.OFPP_LOCAL
+}
+
 // panic in out of range
 func (pipe Pipeline) getPort(portNo uint32) gopenflow.Port {
-	if portNo == 0 || portNo > ofp4.OFPP_MAX {
+	if !isPortNo(portNo) {
 		panic("invalid portNo")
 	}
 	pipe.lock.Lock()
@@ -449,6 +698,13 @@ func (pipe Pipeline) getPort(portNo uint32) gopenflow.Port {
 	return pipe.ports[portNo]
 }
 
+// portDuration returns the total time the port was live.
+func (pipe Pipeline) portDuration(portNo uint32) time.Duration {
+	pipe.lock.Lock()
+	defer pipe.lock.Unlock()
+	return pipe.portAlive[portNo].Total()
+}
+
 // rename to all or any
 func (pipe Pipeline) getAllPorts() map[uint32]gopenflow.Port {
 	pipe.lock.Lock()
@@ -486,6 +742,14 @@ func (self *Pipeline) packetIn(buffer_id uint32, pout outputToPort) error {
 	}
 }
 
+// flowRemoved reports the flow entry removed from the flow table.
+func (self *Pipeline) flowRemoved(tableId uint8, priority uint16, flow *flowEntry, reason uint8) {
+	self.ipfix.removed(flow, reason, time.Now())
+	if flow.flags&ofp4.OFPFF_SEND_FLOW_REM != 0 {
+		self.sendFlowRem(tableId, priority, flow, reason)
+	}
+}
+
 /* OFPT_FLOW_REMOVED async message */
 func (self *Pipeline) sendFlowRem(tableId uint8, priority uint16, flow *flowEntry, reason uint8) {
 	if fields, err := flow.fields.MarshalBinary(); err != nil {
@@ -520,16 +784,14 @@ func (pipe *Pipeline) sendOutput(output outputToPort) error {
 	switch output.outPort {
 	default:
 		portNo := output.outPort
-		if 0 < portNo && portNo <= ofp4.OFPP_MAX {
+		if isPortNo(portNo) {
 			if portNo == output.inPort {
 				return fmt.Errorf("output to ingress will be just dropped")
 			}
 			if port := pipe.getPort(portNo); port == nil {
 				return fmt.Errorf("output port missing %d", portNo)
-			} else if fr, err := output.getFrozen(); err != nil {
-				return err
 			} else {
-				port.Egress(fr)
+				return pipe.egress(portNo, port, output)
 			}
 		} else {
 			return fmt.Errorf("unknown output special port")
@@ -537,10 +799,8 @@ func (pipe *Pipeline) sendOutput(output outputToPort) error {
 	case ofp4.OFPP_IN_PORT:
 		if port := pipe.getPort(output.inPort); port == nil {
 			return fmt.Errorf("output port missing %d", output.inPort)
-		} else if fr, err := output.getFrozen(); err != nil {
-			return err
 		} else {
-			port.Egress(fr)
+			return pipe.egress(output.inPort, port, output)
 		}
 	case ofp4.OFPP_TABLE:
 		defer func() {
@@ -549,27 +809,22 @@ func (pipe *Pipeline) sendOutput(output outputToPort) error {
 				pipe:  pipe,
 			}
 		}()
-	case ofp4.OFPP_NORMAL, ofp4.OFPP_FLOOD, ofp4.OFPP_ALL:
-		inPort := pipe.getPort(output.inPort)
-		if fr, err := output.getFrozen(); err != nil {
-			return err
-		} else {
-			for _, port := range pipe.getAllPorts() {
-				if port != inPort {
-					port.Egress(fr)
+	case ofp4.OFPP_NORMAL:
+		return pipe.sendNormal(output)
+	case ofp4.OFPP_FLOOD, ofp4.OFPP_ALL:
+		// blocked ports will be excluded from OFPP_FLOOD in egress. OFPP_LOCAL is included in both.
+		for portNo, port := range pipe.getAllPorts() {
+			if portNo != output.inPort {
+				if err := pipe.egress(portNo, port, output); err != nil {
+					log.Print(err)
 				}
 			}
 		}
 	case ofp4.OFPP_CONTROLLER:
-		if nopktin := func() bool {
-			for _, config := range pipe.getPort(output.inPort).GetConfig() {
-				if flag, ok := config.(gopenflow.PortConfigNoPacketIn); ok && bool(flag) {
-					return true
-				}
+		if isPortNo(output.inPort) {
+			if port := pipe.getPort(output.inPort); port != nil && portConfig(port)&ofp4.OFPPC_NO_PACKET_IN != 0 {
+				return nil
 			}
-			return false
-		}(); nopktin {
-			return nil
 		}
 		var buffer_id uint32
 		if output.reason == ofp4.OFPR_INVALID_TTL {
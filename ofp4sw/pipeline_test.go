@@ -0,0 +1,429 @@
+package ofp4sw
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/hkwi/gopenflow"
+	"github.com/hkwi/gopenflow/ofp4"
+	"github.com/hkwi/gopenflow/oxm"
+	"net"
+	"testing"
+	"time"
+)
+
+// runs a pipeline with in-memory ports, without controller.
+func TestPipelineMemPort(t *testing.T) {
+	pipe := NewPipeline()
+	pipe.SetFailStandalone(true)
+
+	var hosts []*gopenflow.MemPort
+	for i := byte(1); i <= 3; i++ {
+		host, sw := gopenflow.NewMemPortPair("host", [6]byte{2, 0, 0, 0, 0, i}, "sw", [6]byte{2, 0, 0, 0, 1, i})
+		if err := pipe.AddPort(sw); err != nil {
+			t.Fatal(err)
+		}
+		hosts = append(hosts, host)
+	}
+
+	recv := func(host *gopenflow.MemPort) []byte {
+		select {
+		case fr := <-host.Ingress():
+			return fr.Data
+		case <-time.After(time.Second):
+			return nil
+		}
+	}
+	frame := func(dst, src byte) []byte {
+		return []byte{2, 0, 0, 0, 0, dst, 2, 0, 0, 0, 0, src, 0x08, 0x00, 0, 0}
+	}
+
+	hosts[0].Egress(gopenflow.Frame{Data: frame(2, 1)})
+	if data := recv(hosts[1]); !bytes.Equal(data, frame(2, 1)) {
+		t.Errorf("flood to host2 failed %v", data)
+	}
+	if data := recv(hosts[2]); !bytes.Equal(data, frame(2, 1)) {
+		t.Errorf("flood to host3 failed %v", data)
+	}
+
+	hosts[1].Egress(gopenflow.Frame{Data: frame(1, 2)})
+	if data := recv(hosts[0]); !bytes.Equal(data, frame(1, 2)) {
+		t.Errorf("unicast to host1 failed %v", data)
+	}
+	select {
+	case fr := <-hosts[2].Ingress():
+		t.Errorf("unexpected frame on host3 %v", fr)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// tunnel metadata and packet mark must be kept across patch ports, and registers are cleared.
+func TestPipelinePatchPort(t *testing.T) {
+	var hosts []*gopenflow.MemPort
+	var pipes []*Pipeline
+	for i := byte(1); i <= 2; i++ {
+		pipe := NewPipeline()
+		pipe.SetFailStandalone(true)
+		host, sw := gopenflow.NewMemPortPair("host", [6]byte{2, 0, 0, 0, 0, i}, "sw", [6]byte{2, 0, 0, 0, 1, i})
+		if err := pipe.AddPort(sw); err != nil {
+			t.Fatal(err)
+		}
+		hosts = append(hosts, host)
+		pipes = append(pipes, pipe)
+	}
+	patchA, patchB := gopenflow.NewPatchPortPair("patch-a", "patch-b")
+	if err := pipes[0].AddPort(patchA); err != nil {
+		t.Fatal(err)
+	}
+	if err := pipes[1].AddPort(patchB); err != nil {
+		t.Fatal(err)
+	}
+
+	tunnelId := make([]byte, 8)
+	binary.BigEndian.PutUint64(tunnelId, 77)
+	oob := append(OxmKeyBasic(oxm.OXM_OF_TUNNEL_ID).Bytes(OxmValueMask{Value: tunnelId}),
+		OxmKeyBasic(oxm.NXM_NX_TUN_IPV4_SRC).Bytes(OxmValueMask{Value: []byte{192, 0, 2, 1}})...)
+	oob = append(oob, OxmKeyBasic(oxm.NXM_NX_PKT_MARK).Bytes(OxmValueMask{Value: []byte{0, 0, 0, 5}})...)
+	oob = append(oob, OxmKeyBasic(oxm.NXM_NX_REG0).Bytes(OxmValueMask{Value: []byte{0, 0, 0, 6}})...)
+	data := []byte{2, 0, 0, 0, 0, 9, 2, 0, 0, 0, 0, 1, 0x08, 0x00, 0, 0}
+	hosts[0].Egress(gopenflow.Frame{Data: data, Oob: oob})
+
+	select {
+	case fr := <-hosts[1].Ingress():
+		if !bytes.Equal(fr.Data, data) {
+			t.Errorf("data mismatch %v", fr.Data)
+		}
+		found := 0
+		for _, x := range ofp4.Oxm(fr.Oob).Iter() {
+			switch x.Header().Type() {
+			case oxm.OXM_OF_TUNNEL_ID:
+				if bytes.Equal(x.Value(), tunnelId) {
+					found++
+				}
+			case oxm.NXM_NX_TUN_IPV4_SRC:
+				if bytes.Equal(x.Value(), []byte{192, 0, 2, 1}) {
+					found++
+				}
+			case oxm.NXM_NX_PKT_MARK:
+				if bytes.Equal(x.Value(), []byte{0, 0, 0, 5}) {
+					found++
+				}
+			case oxm.NXM_NX_REG0:
+				t.Errorf("register not cleared %v", fr.Oob)
+			}
+		}
+		if found != 3 {
+			t.Errorf("tunnel metadata lost %v", fr.Oob)
+		}
+	case <-time.After(time.Second):
+		t.Error("frame did not pass the patch port")
+	}
+}
+
+// port numbers are kept for the port names.
+func TestPipelinePortNumber(t *testing.T) {
+	pipe := NewPipeline()
+
+	_, eth1 := gopenflow.NewMemPortPair("h1", [6]byte{2, 0, 0, 0, 0, 1}, "eth1", [6]byte{2, 0, 0, 0, 1, 1})
+	_, eth2 := gopenflow.NewMemPortPair("h2", [6]byte{2, 0, 0, 0, 0, 2}, "eth2", [6]byte{2, 0, 0, 0, 1, 2})
+	_, eth3 := gopenflow.NewMemPortPair("h3", [6]byte{2, 0, 0, 0, 0, 3}, "eth3", [6]byte{2, 0, 0, 0, 1, 3})
+	if err := pipe.SetPort(5, eth1); err != nil {
+		t.Fatal(err)
+	}
+	if err := pipe.SetPort(5, eth2); err == nil {
+		t.Error("port number conflict must be an error")
+	}
+	if err := pipe.AddPort(eth1); err == nil {
+		t.Error("duplicate registration must be an error")
+	}
+	if err := pipe.AddPort(eth2); err != nil {
+		t.Fatal(err)
+	}
+	portNo := func(port gopenflow.Port) uint32 {
+		for n, p := range pipe.ListPorts() {
+			if p == port {
+				return n
+			}
+		}
+		return 0
+	}
+	if n := portNo(eth2); n != 6 {
+		t.Errorf("unexpected port number %d", n)
+	}
+
+	if err := pipe.RemovePort(eth1); err != nil {
+		t.Fatal(err)
+	}
+	if n := portNo(eth1); n != 0 {
+		t.Errorf("port not removed %d", n)
+	}
+	if err := pipe.RemovePort(eth1); err == nil {
+		t.Error("removing unregistered port must be an error")
+	}
+
+	// port number 5 is kept for eth1
+	if err := pipe.AddPort(eth3); err != nil {
+		t.Fatal(err)
+	}
+	if n := portNo(eth3); n != 7 {
+		t.Errorf("unexpected port number %d", n)
+	}
+	if err := pipe.AddPort(eth1); err != nil {
+		t.Fatal(err)
+	}
+	if n := portNo(eth1); n != 5 {
+		t.Errorf("port number not kept %d", n)
+	}
+
+	// closing the port removes it
+	eth2.Close()
+	for i := 0; i < 100 && portNo(eth2) != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := portNo(eth2); n != 0 {
+		t.Errorf("closed port not removed %d", n)
+	}
+	if err := pipe.SetPort(5, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(pipe.ListPorts()) != 1 {
+		t.Errorf("unexpected ports %v", pipe.ListPorts())
+	}
+}
+
+// port_status and liveness follow the port events.
+func TestPipelinePortEvent(t *testing.T) {
+	pipe := NewPipeline()
+	_, sw := gopenflow.NewMemPortPair("host", [6]byte{2, 0, 0, 0, 0, 1}, "sw", [6]byte{2, 0, 0, 0, 1, 1})
+	if err := pipe.SetPort(1, sw); err != nil {
+		t.Fatal(err)
+	}
+	live := func() bool {
+		pipe.lock.RLock()
+		defer pipe.lock.RUnlock()
+		return pipe.watchPort(1)
+	}
+	wait := func(cond func() bool) bool {
+		for i := 0; i < 100; i++ {
+			if cond() {
+				return true
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return false
+	}
+	if !live() {
+		t.Error("port should be live")
+	}
+	sw.SetLinkDown(true)
+	if !wait(func() bool { return !live() }) {
+		t.Error("port should not be live")
+	}
+	sw.SetLinkDown(false)
+	if !wait(live) {
+		t.Error("port should be live")
+	}
+	sw.Close()
+	if !wait(func() bool { return len(pipe.ListPorts()) == 0 }) {
+		t.Error("port not removed by PortDeleted")
+	}
+}
+
+// port config drops frames, and FLOOD and NORMAL skip blocked or link down ports while ALL does not.
+func TestPipelinePortConfig(t *testing.T) {
+	pipe := NewPipeline()
+	var hosts, sws []*gopenflow.MemPort
+	for i := byte(1); i <= 4; i++ {
+		host, sw := gopenflow.NewMemPortPair("host", [6]byte{2, 0, 0, 0, 0, i}, "sw", [6]byte{2, 0, 0, 0, 1, i})
+		if err := pipe.SetPort(uint32(i), sw); err != nil {
+			t.Fatal(err)
+		}
+		hosts = append(hosts, host)
+		sws = append(sws, sw)
+	}
+	for inPort, outPort := range map[byte]uint32{
+		1: ofp4.OFPP_FLOOD,
+		2: ofp4.OFPP_ALL,
+		3: 1,
+		4: ofp4.OFPP_NORMAL,
+	} {
+		if err := pipe.addFlowEntry(nxmTestFlowMod(0, nxmTestField(oxm.OXM_OF_IN_PORT, []byte{0, 0, 0, inPort}, nil),
+			ofp4.MakeInstructionActions(ofp4.OFPIT_APPLY_ACTIONS, ofp4.MakeActionOutput(outPort, 0)))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	frame := []byte{2, 0, 0, 0, 0, 9, 2, 0, 0, 0, 0, 8, 0x08, 0x00, 0, 0}
+	// expect checks the hosts which receive the frame sent from host src.
+	expect := func(name string, src int, dsts ...int) {
+		hosts[src].Egress(gopenflow.Frame{Data: frame})
+		for i, host := range hosts {
+			if i == src {
+				continue
+			}
+			want := false
+			for _, dst := range dsts {
+				want = want || dst == i
+			}
+			wait := 100 * time.Millisecond
+			if want {
+				wait = time.Second
+			}
+			select {
+			case <-host.Ingress():
+				if !want {
+					t.Errorf("%s: unexpected frame on host%d", name, i+1)
+				}
+			case <-time.After(wait):
+				if want {
+					t.Errorf("%s: frame not received on host%d", name, i+1)
+				}
+			}
+		}
+	}
+
+	expect("unicast", 2, 0)
+	sws[2].SetConfig([]gopenflow.PortConfig{gopenflow.PortConfigNoRecv(true)})
+	expect("no_recv", 2)
+	sws[2].SetConfig(nil)
+	sws[0].SetConfig([]gopenflow.PortConfig{gopenflow.PortConfigNoFwd(true)})
+	expect("no_fwd", 2)
+	sws[0].SetConfig(nil)
+
+	// host side goes down with port_down, so inject into the switch side
+	sws[2].SetConfig([]gopenflow.PortConfig{gopenflow.PortConfigPortDown(true)})
+	sws[2].Inject(gopenflow.Frame{Data: frame})
+	select {
+	case <-hosts[0].Ingress():
+		t.Error("port_down: unexpected frame on host1")
+	case <-time.After(100 * time.Millisecond):
+	}
+	sws[2].SetConfig(nil)
+
+	sws[2].SetBlocked(true)
+	expect("flood blocked", 0, 1, 3)
+	expect("all blocked", 1, 0, 2, 3)
+	expect("normal blocked", 3, 0, 1)
+	sws[2].SetBlocked(false)
+
+	sws[2].SetLinkDown(true)
+	dropped := func() uint64 {
+		stats, _ := sws[2].Stats()
+		return stats.TxDropped
+	}
+	expect("flood link_down", 0, 1, 3)
+	if n := dropped(); n != 0 {
+		t.Errorf("flood to link down port %d", n)
+	}
+	expect("all link_down", 1, 0, 3)
+	if n := dropped(); n != 1 {
+		t.Errorf("all to link down port %d", n)
+	}
+	expect("normal link_down", 3, 0, 1)
+	if n := dropped(); n != 1 {
+		t.Errorf("normal to link down port %d", n)
+	}
+}
+
+// OFPP_FLOOD and OFPP_ALL include OFPP_LOCAL.
+func TestPipelineLocalPort(t *testing.T) {
+	pipe := NewPipeline()
+	var hosts []*gopenflow.MemPort
+	for i := byte(1); i <= 2; i++ {
+		host, sw := gopenflow.NewMemPortPair("host", [6]byte{2, 0, 0, 0, 0, i}, "sw", [6]byte{2, 0, 0, 0, 1, i})
+		if err := pipe.SetPort(uint32(i), sw); err != nil {
+			t.Fatal(err)
+		}
+		hosts = append(hosts, host)
+	}
+	host, local := gopenflow.NewMemPortPair("host", [6]byte{2, 0, 0, 0, 0, 0xff}, "local", [6]byte{2, 0, 0, 0, 1, 0xff})
+	if err := pipe.AddLocalPort(local); err != nil {
+		t.Fatal(err)
+	}
+	for inPort, outPort := range map[byte]uint32{
+		1: ofp4.OFPP_FLOOD,
+		2: ofp4.OFPP_ALL,
+	} {
+		if err := pipe.addFlowEntry(nxmTestFlowMod(0, nxmTestField(oxm.OXM_OF_IN_PORT, []byte{0, 0, 0, inPort}, nil),
+			ofp4.MakeInstructionActions(ofp4.OFPIT_APPLY_ACTIONS, ofp4.MakeActionOutput(outPort, 0)))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	frame := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 2, 0, 0, 0, 0, 1, 0x08, 0x06, 0, 0}
+	for i, name := range []string{"flood", "all"} {
+		hosts[i].Egress(gopenflow.Frame{Data: frame})
+		select {
+		case fr := <-host.Ingress():
+			if !bytes.Equal(fr.Data, frame) {
+				t.Errorf("%s: data mismatch %v", name, fr.Data)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s: frame not received on local port", name)
+		}
+		select {
+		case <-hosts[1-i].Ingress():
+		case <-time.After(time.Second):
+			t.Errorf("%s: frame not received on host%d", name, 2-i)
+		}
+	}
+}
+
+// tunnel to tunnel forwarding uses Remote of the output port, not the ingress tunnel metadata.
+func TestPipelineTunnel(t *testing.T) {
+	local := net.ParseIP("127.0.0.2").To4()
+	remote := net.ParseIP("127.0.0.1").To4()
+	// peer sends to port a, and receives from port b
+	peer, err := gopenflow.NewVxlanPort("peer", gopenflow.VxlanConfig{
+		Local:      remote,
+		Port:       24791,
+		Remote:     local,
+		RemotePort: 24789,
+	})
+	if err != nil {
+		t.Skip(err)
+	}
+	defer peer.Close()
+	a, err := gopenflow.NewVxlanPort("vxa", gopenflow.VxlanConfig{
+		Local: local,
+		Port:  24789,
+	})
+	if err != nil {
+		t.Skip(err)
+	}
+	defer a.Close()
+	b, err := gopenflow.NewVxlanPort("vxb", gopenflow.VxlanConfig{
+		Local:      remote,
+		Port:       24790,
+		Remote:     remote,
+		RemotePort: 24791,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	pipe := NewPipeline()
+	if err := pipe.SetPort(1, a); err != nil {
+		t.Fatal(err)
+	}
+	if err := pipe.SetPort(2, b); err != nil {
+		t.Fatal(err)
+	}
+	if err := pipe.addFlowEntry(nxmTestFlowMod(0, nxmTestField(oxm.OXM_OF_IN_PORT, []byte{0, 0, 0, 1}, nil),
+		ofp4.MakeInstructionActions(ofp4.OFPIT_APPLY_ACTIONS, ofp4.MakeActionOutput(2, 0)))); err != nil {
+		t.Fatal(err)
+	}
+
+	eth := []byte{2, 0, 0, 0, 0, 1, 2, 0, 0, 0, 0, 2, 0x08, 0x00, 0xaa, 0xbb}
+	if err := peer.Egress(gopenflow.Frame{Data: eth}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case fr := <-peer.Ingress():
+		if !bytes.Equal(fr.Data, eth) {
+			t.Errorf("data mismatch %v", fr.Data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("frame not sent to the remote of the output port")
+	}
+}
@@ -0,0 +1,384 @@
+package ofp4sw
+
+import (
+	"errors"
+	"fmt"
+	"github.com/hkwi/gopenflow"
+	"github.com/hkwi/gopenflow/ofp4"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// QueueConfig is an egress queue configuration, used in Pipeline.SetQueue.
+//
+// MinRate and MaxRate are in 1/10 of a percent of the port current speed,
+// as in ofp_queue_prop_min_rate. Value larger than 1000 means unconfigured.
+// Queues with higher Priority will be served first, and queues with the
+// same Priority share the port by Weight.
+type QueueConfig struct {
+	MinRate  uint16
+	MaxRate  uint16
+	Priority uint8
+	Weight   uint16
+}
+
+const (
+	queueMaxFrames  = 1024
+	queueBurstTime  = 0.1 // seconds of traffic allowed to burst
+	queueSpeedCache = time.Second
+)
+
+// errSchedulerClosed is returned by enqueue when the scheduler was closed
+// by RemoveQueue in the meantime. The frame should go to the port directly.
+var errSchedulerClosed = errors.New("scheduler closed")
+
+type queue struct {
+	queueId uint32
+	config  QueueConfig
+	created time.Time
+	frames  []gopenflow.Frame
+
+	// token buckets in bits
+	minBucket float64
+	maxBucket float64
+	// virtual finish time for weighted scheduling
+	vtime float64
+
+	txPackets uint64
+	txBytes   uint64
+	txErrors  uint64
+}
+
+func (self queue) weight() float64 {
+	if self.config.Weight == 0 {
+		return 1
+	}
+	return float64(self.config.Weight)
+}
+
+// portScheduler serves queued frames to Port.Egress.
+type portScheduler struct {
+	lock   *sync.Mutex
+	cond   *sync.Cond
+	port   gopenflow.Port
+	queues map[uint32]*queue
+	// frames with unconfigured queue id goes here. it is not a queue in
+	// OFPMP_QUEUE, and those frames are counted in port stats only.
+	defaultQueue *queue
+	vclock       float64
+	closed       bool
+
+	refilled  time.Time
+	speed     float64 // bits per second, 0 means unknown
+	speedTime time.Time
+}
+
+func newPortScheduler(port gopenflow.Port) *portScheduler {
+	self := &portScheduler{
+		lock:   &sync.Mutex{},
+		port:   port,
+		queues: make(map[uint32]*queue),
+		defaultQueue: &queue{
+			config: QueueConfig{
+				MinRate: ofp4.OFPQ_MIN_RATE_UNCFG,
+				MaxRate: ofp4.OFPQ_MAX_RATE_UNCFG,
+			},
+		},
+		refilled: time.Now(),
+	}
+	self.cond = sync.NewCond(self.lock)
+	go self.serve()
+	return self
+}
+
+func (self *portScheduler) close() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.closed = true
+	self.cond.Broadcast()
+}
+
+func (self *portScheduler) enqueue(queueId uint32, fr gopenflow.Frame) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.closed {
+		return errSchedulerClosed
+	}
+	q := self.queues[queueId]
+	if q == nil {
+		q = self.defaultQueue
+	}
+	if len(q.frames) >= queueMaxFrames {
+		if q != self.defaultQueue {
+			q.txErrors++
+		}
+		return fmt.Errorf("queue %d overrun", queueId)
+	}
+	if len(q.frames) == 0 && q.vtime < self.vclock {
+		q.vtime = self.vclock
+	}
+	q.frames = append(q.frames, fr)
+	self.cond.Signal()
+	return nil
+}
+
+// refill token buckets. call this inside lock.
+func (self *portScheduler) refill(now time.Time) {
+	if now.Sub(self.speedTime) > queueSpeedCache {
+		if eth, err := self.port.Ethernet(); err != nil {
+			self.speed = 0
+		} else {
+			self.speed = float64(eth.CurrSpeed) * 1000
+		}
+		self.speedTime = now
+	}
+	elapsed := now.Sub(self.refilled).Seconds()
+	self.refilled = now
+	for _, q := range self.queues {
+		if q.config.MinRate <= 1000 {
+			rate := self.speed * float64(q.config.MinRate) / 1000
+			q.minBucket += rate * elapsed
+			if q.minBucket > rate*queueBurstTime {
+				q.minBucket = rate * queueBurstTime
+			}
+		}
+		if q.config.MaxRate <= 1000 {
+			rate := self.speed * float64(q.config.MaxRate) / 1000
+			q.maxBucket += rate * elapsed
+			if q.maxBucket > rate*queueBurstTime {
+				q.maxBucket = rate * queueBurstTime
+			}
+		}
+	}
+}
+
+// pick chooses the queue to be served next. If there's no eligible queue
+// because of max-rate, the duration to wait will be returned.
+// call this inside lock.
+func (self *portScheduler) pick() (*queue, time.Duration) {
+	var backlog []*queue
+	for _, q := range self.queues {
+		if len(q.frames) > 0 {
+			backlog = append(backlog, q)
+		}
+	}
+	if len(self.defaultQueue.frames) > 0 {
+		backlog = append(backlog, self.defaultQueue)
+	}
+	if len(backlog) == 0 {
+		return nil, 0
+	}
+	sort.Sort(queueOrder(backlog))
+
+	var wait time.Duration
+	var eligible []*queue
+	for _, q := range backlog {
+		if self.speed > 0 && q.config.MaxRate <= 1000 && q.maxBucket < 0 {
+			rate := self.speed * float64(q.config.MaxRate) / 1000
+			w := time.Second
+			if rate > 0 {
+				w = time.Duration(-q.maxBucket / rate * float64(time.Second))
+			}
+			if wait == 0 || w < wait {
+				wait = w
+			}
+			continue
+		}
+		eligible = append(eligible, q)
+	}
+	if len(eligible) == 0 {
+		return nil, wait
+	}
+
+	// queues under min-rate guarantee go first
+	var selected *queue
+	if self.speed > 0 {
+		for _, q := range eligible {
+			if q.config.MinRate <= 1000 && q.minBucket > 0 {
+				if selected == nil || selected.config.Priority < q.config.Priority ||
+					(selected.config.Priority == q.config.Priority && q.vtime < selected.vtime) {
+					selected = q
+				}
+			}
+		}
+	}
+	if selected == nil {
+		// strict priority, then weighted by virtual time in the same priority
+		for _, q := range eligible {
+			if selected == nil || selected.config.Priority < q.config.Priority ||
+				(selected.config.Priority == q.config.Priority && q.vtime < selected.vtime) {
+				selected = q
+			}
+		}
+	}
+	return selected, 0
+}
+
+func (self *portScheduler) serve() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for !self.closed {
+		self.refill(time.Now())
+		q, wait := self.pick()
+		if q == nil {
+			if wait > 0 {
+				self.lock.Unlock()
+				time.Sleep(wait)
+				self.lock.Lock()
+			} else {
+				self.cond.Wait()
+			}
+			continue
+		}
+		fr := q.frames[0]
+		q.frames = q.frames[1:]
+
+		bits := float64(len(fr.Data) * 8)
+		q.minBucket -= bits
+		q.maxBucket -= bits
+		q.vtime += float64(len(fr.Data)) / q.weight()
+		self.vclock = q.vtime
+
+		self.lock.Unlock()
+		err := self.port.Egress(fr)
+		self.lock.Lock()
+
+		if err != nil {
+			log.Print(err)
+		}
+		if q != self.defaultQueue {
+			if err != nil {
+				q.txErrors++
+			} else {
+				q.txPackets++
+				q.txBytes += uint64(len(fr.Data))
+			}
+		}
+	}
+}
+
+type queueOrder []*queue
+
+func (self queueOrder) Len() int {
+	return len(self)
+}
+
+func (self queueOrder) Less(i, j int) bool {
+	return self[i].queueId < self[j].queueId
+}
+
+func (self queueOrder) Swap(i, j int) {
+	self[i], self[j] = self[j], self[i]
+}
+
+// SetQueue adds or modifies an egress queue on the port.
+func (self *Pipeline) SetQueue(portNo uint32, queueId uint32, config QueueConfig) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if queueId == ofp4.OFPQ_ALL {
+		return fmt.Errorf("invalid queue id")
+	}
+	port, ok := self.ports[portNo]
+	if !ok {
+		return fmt.Errorf("port %d not found", portNo)
+	}
+	sched := self.schedulers[portNo]
+	if sched == nil {
+		sched = newPortScheduler(port)
+		self.schedulers[portNo] = sched
+	}
+
+	sched.lock.Lock()
+	defer sched.lock.Unlock()
+	if q, ok := sched.queues[queueId]; ok {
+		q.config = config
+	} else {
+		sched.queues[queueId] = &queue{
+			queueId: queueId,
+			config:  config,
+			created: time.Now(),
+		}
+	}
+	return nil
+}
+
+// RemoveQueue removes the egress queue from the port. Frames left in the queue will be discarded.
+func (self *Pipeline) RemoveQueue(portNo uint32, queueId uint32) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	sched := self.schedulers[portNo]
+	if sched == nil {
+		return fmt.Errorf("queue %d not found", queueId)
+	}
+	found, empty := func() (bool, bool) {
+		sched.lock.Lock()
+		defer sched.lock.Unlock()
+		if _, ok := sched.queues[queueId]; !ok {
+			return false, false
+		}
+		delete(sched.queues, queueId)
+		return true, len(sched.queues) == 0 && len(sched.defaultQueue.frames) == 0
+	}()
+	if !found {
+		return fmt.Errorf("queue %d not found", queueId)
+	}
+	if empty {
+		sched.close()
+		delete(self.schedulers, portNo)
+	}
+	return nil
+}
+
+func (pipe Pipeline) getScheduler(portNo uint32) *portScheduler {
+	pipe.lock.Lock()
+	defer pipe.lock.Unlock()
+	return pipe.schedulers[portNo]
+}
+
+func (pipe Pipeline) getSchedulers(portNo uint32) map[uint32]*portScheduler {
+	scheds := make(map[uint32]*portScheduler)
+
+	pipe.lock.Lock()
+	defer pipe.lock.Unlock()
+
+	if portNo == ofp4.OFPP_ANY {
+		for k, s := range pipe.schedulers {
+			scheds[k] = s
+		}
+	} else {
+		if sched, ok := pipe.schedulers[portNo]; ok {
+			scheds[portNo] = sched
+		}
+	}
+	return scheds
+}
+
+// egress sends the frame to the port, through the queue if configured.
+// Frames will be dropped silently by port config or state.
+func (pipe *Pipeline) egress(portNo uint32, port gopenflow.Port, output outputToPort) error {
+	if portConfig(port)&(ofp4.OFPPC_PORT_DOWN|ofp4.OFPPC_NO_FWD) != 0 {
+		return nil
+	}
+	switch output.outPort {
+	case ofp4.OFPP_FLOOD, ofp4.OFPP_NORMAL:
+		if portState(port)&(ofp4.OFPPS_BLOCKED|ofp4.OFPPS_LINK_DOWN) != 0 {
+			return nil
+		}
+	}
+	fr, err := output.getFrozen()
+	if err != nil {
+		return err
+	}
+	pipe.mirror(portNo, true, fr)
+	if sched := pipe.getScheduler(portNo); sched != nil {
+		if err := sched.enqueue(output.queueId, fr); err != errSchedulerClosed {
+			return err
+		}
+	}
+	return port.Egress(fr)
+}
@@ -0,0 +1,372 @@
+package ofp4sw
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/hkwi/gopenflow"
+	"github.com/hkwi/gopenflow/ofp4"
+	"github.com/hkwi/gopenflow/oxm"
+	"net"
+	"testing"
+	"time"
+)
+
+// queueTestPort blocks in Egress until the frame was received from out, or discards the frame after close.
+type queueTestPort struct {
+	out  chan gopenflow.Frame
+	done chan struct{}
+}
+
+func newQueueTestPort() queueTestPort {
+	return queueTestPort{
+		out:  make(chan gopenflow.Frame),
+		done: make(chan struct{}),
+	}
+}
+
+func (self queueTestPort) close() {
+	close(self.done)
+}
+
+func (self queueTestPort) Name() string                           { return "qtest" }
+func (self queueTestPort) HwAddr() [6]byte                        { return [6]byte{} }
+func (self queueTestPort) PhysicalPort() uint32                   { return 0 }
+func (self queueTestPort) Monitor() <-chan gopenflow.PortEvent    { return nil }
+func (self queueTestPort) Ingress() <-chan gopenflow.Frame        { return nil }
+func (self queueTestPort) GetConfig() []gopenflow.PortConfig      { return nil }
+func (self queueTestPort) SetConfig([]gopenflow.PortConfig) error { return nil }
+func (self queueTestPort) State() []gopenflow.PortState           { return nil }
+func (self queueTestPort) Mtu() uint32                            { return 1500 }
+func (self queueTestPort) Stats() (gopenflow.PortStats, error)    { return gopenflow.PortStats{}, nil }
+func (self queueTestPort) Vendor(interface{}) interface{}         { return nil }
+func (self queueTestPort) Egress(fr gopenflow.Frame) error {
+	select {
+	case self.out <- fr:
+	case <-self.done:
+	}
+	return nil
+}
+func (self queueTestPort) Ethernet() (gopenflow.PortEthernetProperty, error) {
+	return gopenflow.PortEthernetProperty{}, fmt.Errorf("no speed")
+}
+
+func queueTestFrame(mark byte) gopenflow.Frame {
+	data := make([]byte, 100)
+	data[0] = mark
+	return gopenflow.Frame{Data: data}
+}
+
+// blocks the scheduler inside Egress with a frame in the default queue.
+func queueTestPrime(t *testing.T, sched *portScheduler) {
+	sched.enqueue(0xffff, queueTestFrame(0xff))
+	for i := 0; i < 100; i++ {
+		sched.lock.Lock()
+		n := len(sched.defaultQueue.frames)
+		sched.lock.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("scheduler did not start")
+}
+
+func TestQueueStrictPriority(t *testing.T) {
+	port := newQueueTestPort()
+	sched := newPortScheduler(port)
+	defer sched.close()
+	defer port.close()
+	sched.queues[1] = &queue{queueId: 1, config: QueueConfig{MinRate: 0xffff, MaxRate: 0xffff, Priority: 1}}
+	sched.queues[2] = &queue{queueId: 2, config: QueueConfig{MinRate: 0xffff, MaxRate: 0xffff, Priority: 2}}
+
+	queueTestPrime(t, sched)
+	sched.enqueue(1, queueTestFrame(1))
+	sched.enqueue(1, queueTestFrame(1))
+	sched.enqueue(2, queueTestFrame(2))
+	sched.enqueue(2, queueTestFrame(2))
+
+	var order []byte
+	for i := 0; i < 5; i++ {
+		order = append(order, (<-port.out).Data[0])
+	}
+	if string(order) != string([]byte{0xff, 2, 2, 1, 1}) {
+		t.Errorf("unexpected order %v", order)
+	}
+}
+
+func TestQueueWeighted(t *testing.T) {
+	port := newQueueTestPort()
+	sched := newPortScheduler(port)
+	defer sched.close()
+	defer port.close()
+	sched.queues[1] = &queue{queueId: 1, config: QueueConfig{MinRate: 0xffff, MaxRate: 0xffff, Weight: 1}}
+	sched.queues[2] = &queue{queueId: 2, config: QueueConfig{MinRate: 0xffff, MaxRate: 0xffff, Weight: 3}}
+
+	queueTestPrime(t, sched)
+	for i := 0; i < 40; i++ {
+		sched.enqueue(1, queueTestFrame(1))
+		sched.enqueue(2, queueTestFrame(2))
+	}
+	<-port.out
+
+	count := make(map[byte]int)
+	for i := 0; i < 40; i++ {
+		count[(<-port.out).Data[0]]++
+	}
+	if count[2] < 27 || count[2] > 33 {
+		t.Errorf("unexpected share %v", count)
+	}
+	sched.lock.Lock()
+	defer sched.lock.Unlock()
+	if sched.queues[2].txPackets < 27 {
+		t.Errorf("tx counter not updated %d", sched.queues[2].txPackets)
+	}
+	if sched.defaultQueue.txPackets != 0 {
+		t.Errorf("default queue counted %d", sched.defaultQueue.txPackets)
+	}
+}
+
+func TestQueueOverrun(t *testing.T) {
+	port := newQueueTestPort()
+	sched := newPortScheduler(port)
+	defer sched.close()
+	defer port.close()
+	sched.queues[1] = &queue{queueId: 1, config: QueueConfig{MinRate: 0xffff, MaxRate: 0xffff}}
+
+	queueTestPrime(t, sched)
+	for i := 0; i < queueMaxFrames; i++ {
+		if err := sched.enqueue(1, queueTestFrame(1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sched.enqueue(1, queueTestFrame(1)); err == nil {
+		t.Error("overrun expected")
+	}
+	sched.lock.Lock()
+	defer sched.lock.Unlock()
+	if sched.queues[1].txErrors != 1 {
+		t.Errorf("tx_errors %d", sched.queues[1].txErrors)
+	}
+}
+
+func TestQueueRemoved(t *testing.T) {
+	port := newQueueTestPort()
+	defer port.close()
+	pipe := NewPipeline()
+	pipe.ports[1] = port
+	if err := pipe.SetQueue(1, 1, QueueConfig{MinRate: 0xffff, MaxRate: 0xffff}); err != nil {
+		t.Fatal(err)
+	}
+	sched := pipe.getScheduler(1)
+	if err := pipe.RemoveQueue(1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// egress that got the scheduler before RemoveQueue
+	if err := sched.enqueue(1, queueTestFrame(1)); err != errSchedulerClosed {
+		t.Errorf("unexpected %v", err)
+	}
+	go pipe.egress(1, port, outputToPort{
+		Frame:   Frame{serialized: queueTestFrame(1).Data, queueId: 1},
+		outPort: 1,
+	})
+	select {
+	case fr := <-port.out:
+		if fr.Data[0] != 1 {
+			t.Error("unexpected frame")
+		}
+	case <-time.After(time.Second):
+		t.Error("frame not sent")
+	}
+}
+
+// 1Mbps, so that 1000 bytes frame takes 8ms in 100%.
+var queueTestEthernet = gopenflow.PortEthernetProperty{
+	Curr:      ofp4.OFPPF_1GB_FD | ofp4.OFPPF_COPPER,
+	Supported: ofp4.OFPPF_1GB_FD | ofp4.OFPPF_COPPER,
+	CurrSpeed: 1000,
+	MaxSpeed:  1000,
+}
+
+func queueTestLargeFrame(mark byte) gopenflow.Frame {
+	data := make([]byte, 1000)
+	copy(data, []byte{2, 0, 0, 0, 0, 2, 2, 0, 0, 0, 0, 1, 0x08, 0x00, mark})
+	return gopenflow.Frame{Data: data}
+}
+
+// min-rate queue is served before the higher priority queue, until the guarantee is used up.
+func TestQueueMinRate(t *testing.T) {
+	host, sw := gopenflow.NewMemPortPair("host", [6]byte{2, 0, 0, 0, 0, 1}, "sw", [6]byte{2, 0, 0, 0, 1, 1})
+	sw.SetEthernet(queueTestEthernet)
+	sched := newPortScheduler(sw)
+	defer sched.close()
+
+	sched.lock.Lock()
+	sched.queues[1] = &queue{queueId: 1, config: QueueConfig{MinRate: 0xffff, MaxRate: 0xffff, Priority: 1}}
+	sched.queues[2] = &queue{queueId: 2, config: QueueConfig{MinRate: 500, MaxRate: 0xffff}}
+	sched.lock.Unlock()
+
+	// min-rate bucket fills up to the burst size, 50kbit
+	time.Sleep(200 * time.Millisecond)
+
+	// MemPort never blocks, so backlog is made in one shot
+	sched.lock.Lock()
+	for i := 0; i < 20; i++ {
+		sched.queues[1].frames = append(sched.queues[1].frames, queueTestLargeFrame(1))
+		sched.queues[2].frames = append(sched.queues[2].frames, queueTestLargeFrame(2))
+	}
+	sched.cond.Signal()
+	sched.lock.Unlock()
+
+	var order []byte
+	for i := 0; i < 40; i++ {
+		select {
+		case fr := <-host.Ingress():
+			order = append(order, fr.Data[14])
+		case <-time.After(time.Second):
+			t.Fatalf("frame not sent %v", order)
+		}
+	}
+	for _, mark := range order[:6] {
+		if mark != 2 {
+			t.Fatalf("min-rate not guaranteed %v", order)
+		}
+	}
+	if order[39] != 2 {
+		t.Errorf("priority not applied after min-rate %v", order)
+	}
+}
+
+// max-rate queue shapes the traffic through the pipeline.
+func TestQueueMaxRate(t *testing.T) {
+	pipe := NewPipeline()
+	host1, sw1 := gopenflow.NewMemPortPair("host1", [6]byte{2, 0, 0, 0, 0, 1}, "sw1", [6]byte{2, 0, 0, 0, 1, 1})
+	host2, sw2 := gopenflow.NewMemPortPair("host2", [6]byte{2, 0, 0, 0, 0, 2}, "sw2", [6]byte{2, 0, 0, 0, 1, 2})
+	sw2.SetEthernet(queueTestEthernet)
+	if err := pipe.SetPort(1, sw1); err != nil {
+		t.Fatal(err)
+	}
+	if err := pipe.SetPort(2, sw2); err != nil {
+		t.Fatal(err)
+	}
+	// 500kbps
+	if err := pipe.SetQueue(2, 1, QueueConfig{MinRate: 0xffff, MaxRate: 500}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pipe.addFlowEntry(nxmTestFlowMod(0, nxmTestField(oxm.OXM_OF_IN_PORT, []byte{0, 0, 0, 1}, nil),
+		ofp4.MakeInstructionActions(ofp4.OFPIT_APPLY_ACTIONS,
+			append(ofp4.MakeActionSetQueue(1), ofp4.MakeActionOutput(2, 0)...)))); err != nil {
+		t.Fatal(err)
+	}
+
+	// 320kbit takes 0.54 sec at least, after 50kbit burst
+	start := time.Now()
+	for i := 0; i < 40; i++ {
+		if err := host1.Egress(queueTestLargeFrame(1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 40; i++ {
+		select {
+		case <-host2.Ingress():
+		case <-time.After(2 * time.Second):
+			t.Fatalf("frame not sent %d", i)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("max-rate not applied %v", elapsed)
+	}
+
+	ctrl := queueTestChannel(t, pipe)
+	defer ctrl.Close()
+
+	body := make([]byte, 8)
+	binary.BigEndian.PutUint32(body, ofp4.OFPP_ANY)
+	binary.BigEndian.PutUint32(body[4:], ofp4.OFPQ_ALL)
+	reply := queueTestRequest(t, ctrl, ofp4.MakeMultipartRequest(ofp4.OFPMP_QUEUE, 0, body), ofp4.OFPT_MULTIPART_REPLY)
+	stats := ofp4.QueueStats(ofp4.MultipartReply(reply).Body())
+	if len(stats) != 40 {
+		t.Fatalf("unexpected queue stats %v", stats)
+	}
+	if stats.PortNo() != 2 || stats.QueueId() != 1 || stats.TxPackets() != 40 || stats.TxBytes() != 40000 {
+		t.Errorf("unexpected queue stats port=%d queue=%d packets=%d bytes=%d",
+			stats.PortNo(), stats.QueueId(), stats.TxPackets(), stats.TxBytes())
+	}
+}
+
+func TestQueueGetConfig(t *testing.T) {
+	pipe := NewPipeline()
+	_, sw := gopenflow.NewMemPortPair("host", [6]byte{2, 0, 0, 0, 0, 1}, "sw", [6]byte{2, 0, 0, 0, 1, 1})
+	if err := pipe.SetPort(1, sw); err != nil {
+		t.Fatal(err)
+	}
+	if err := pipe.SetQueue(1, 7, QueueConfig{MinRate: 200, MaxRate: 800}); err != nil {
+		t.Fatal(err)
+	}
+	ctrl := queueTestChannel(t, pipe)
+	defer ctrl.Close()
+
+	req := ofp4.MakeHeader(ofp4.OFPT_QUEUE_GET_CONFIG_REQUEST).AppendData([]byte{0, 0, 0, 1, 0, 0, 0, 0})
+	reply := ofp4.QueueGetConfigReply(queueTestRequest(t, ctrl, req, ofp4.OFPT_QUEUE_GET_CONFIG_REPLY))
+	queues := reply.Queues()
+	if reply.Port() != 1 || len(queues) != 1 || queues[0].QueueId() != 7 || queues[0].Port() != 1 {
+		t.Fatalf("unexpected queue config %v", reply)
+	}
+	rates := make(map[uint16]uint16)
+	for _, prop := range queues[0].Properties() {
+		switch prop.Property() {
+		case ofp4.OFPQT_MIN_RATE:
+			rates[prop.Property()] = ofp4.QueuePropMinRate(prop).Rate()
+		case ofp4.OFPQT_MAX_RATE:
+			rates[prop.Property()] = ofp4.QueuePropMaxRate(prop).Rate()
+		}
+	}
+	if rates[ofp4.OFPQT_MIN_RATE] != 200 || rates[ofp4.OFPQT_MAX_RATE] != 800 {
+		t.Errorf("unexpected rates %v", rates)
+	}
+
+	// unknown port
+	req = ofp4.MakeHeader(ofp4.OFPT_QUEUE_GET_CONFIG_REQUEST).AppendData([]byte{0, 0, 0, 9, 0, 0, 0, 0})
+	if msg := queueTestRequest(t, ctrl, req, ofp4.OFPT_ERROR); ofp4.ErrorMsg(msg).Code() != ofp4.OFPQOFC_BAD_PORT {
+		t.Errorf("unexpected error %v", msg)
+	}
+}
+
+// queueTestChannel connects a controller to the pipeline.
+func queueTestChannel(t *testing.T, pipe *Pipeline) net.Conn {
+	conn, ctrl := net.Pipe()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- pipe.AddChannel(conn)
+	}()
+	ctrl.SetDeadline(time.Now().Add(time.Second))
+	if _, err := readOfpMessage(ctrl, nil); err != nil {
+		t.Fatal(err)
+	}
+	hello := ofp4.MakeHello(ofp4.MakeHelloElemVersionbitmap([]uint32{uint32(1 << 4)}))
+	if _, err := ctrl.Write(hello); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	return ctrl
+}
+
+// queueTestRequest sends the request, and returns the response of the type.
+func queueTestRequest(t *testing.T, ctrl net.Conn, req ofp4.Header, ofpt uint8) []byte {
+	req.SetXid(0x1234)
+	ctrl.SetDeadline(time.Now().Add(time.Second))
+	if _, err := ctrl.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		msg, err := readOfpMessage(ctrl, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ofp4.Header(msg).Xid() == 0x1234 && ofp4.Header(msg).Type() == ofpt {
+			return msg
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package ofp4sw
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/hkwi/gopenflow"
+	"github.com/hkwi/gopenflow/ofp4"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// SflowConfig is an sFlow v5 exporter configuration, used in Pipeline.SetSflow.
+//
+// Frames sampled by ActionSample of the collector set are sent to Collector,
+// which is an UDP "host:port". HeaderSize bytes from the head of the frame are
+// exported, 128 if zero. Interface counters from Port.Stats are sent every
+// CounterInterval, 20 seconds if zero. Negative CounterInterval disables them.
+type SflowConfig struct {
+	Collector       string
+	AgentAddress    net.IP // local address of the socket if nil
+	SubAgentId      uint32
+	HeaderSize      int
+	CounterInterval time.Duration
+}
+
+const (
+	defaultSflowHeaderSize      = 128
+	defaultSflowCounterInterval = 20 * time.Second
+	sflowCounterSamplesMax      = 8 // counter samples in a datagram
+	sflowGenericCountersLen     = 88
+	sflowUnknownCounter32       = 0xffffffff
+	sflowIfTypeEthernetCsmacd   = 6
+)
+
+// sFlow v5 data formats, with enterprise 0
+const (
+	SFLOW_FLOW_SAMPLE       = 1
+	SFLOW_COUNTER_SAMPLE    = 2
+	SFLOW_RAW_PACKET_HEADER = 1
+	SFLOW_GENERIC_COUNTERS  = 1
+)
+
+// sFlow v5 enums
+const (
+	SFLOW_HEADER_ETHERNET = 1
+	SFLOW_ADDRESS_IP_V4   = 1
+	SFLOW_ADDRESS_IP_V6   = 2
+)
+
+type sflowExporter struct {
+	lock    *sync.Mutex
+	config  SflowConfig
+	conn    net.Conn
+	agent   net.IP
+	started time.Time
+	closing chan bool
+
+	sequence        uint32            // datagram sequence
+	flowSequence    map[uint32]uint32 // by source_id
+	samplePool      map[uint32]uint32 // by source_id
+	counterSequence map[uint32]uint32 // by source_id
+}
+
+func newSflowExporter(config SflowConfig) (*sflowExporter, error) {
+	conn, err := net.Dial("udp", config.Collector)
+	if err != nil {
+		return nil, err
+	}
+	agent := config.AgentAddress
+	if agent == nil {
+		agent = conn.LocalAddr().(*net.UDPAddr).IP
+	}
+	if config.HeaderSize <= 0 {
+		config.HeaderSize = defaultSflowHeaderSize
+	}
+	if config.CounterInterval == 0 {
+		config.CounterInterval = defaultSflowCounterInterval
+	}
+	return &sflowExporter{
+		lock:            &sync.Mutex{},
+		config:          config,
+		conn:            conn,
+		agent:           agent,
+		started:         time.Now(),
+		closing:         make(chan bool),
+		flowSequence:    make(map[uint32]uint32),
+		samplePool:      make(map[uint32]uint32),
+		counterSequence: make(map[uint32]uint32),
+	}, nil
+}
+
+func (self *sflowExporter) close() {
+	close(self.closing)
+	self.conn.Close()
+}
+
+// SetSflow starts the sFlow exporter for the collector set id of ActionSample.
+// The exporter of the same collector set id will be replaced.
+func (self *Pipeline) SetSflow(collectorSetId uint32, config SflowConfig) error {
+	exporter, err := newSflowExporter(config)
+	if err != nil {
+		return err
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if last, ok := self.sflows[collectorSetId]; ok {
+		last.close()
+	}
+	self.sflows[collectorSetId] = exporter
+
+	if interval := exporter.config.CounterInterval; interval > 0 {
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					if err := exporter.counters(self.getAllPorts()); err != nil {
+						log.Print(err)
+					}
+				case <-exporter.closing:
+					return
+				}
+			}
+		}()
+	}
+	return nil
+}
+
+// RemoveSflow stops the sFlow exporter of the collector set id.
+func (self *Pipeline) RemoveSflow(collectorSetId uint32) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	exporter, ok := self.sflows[collectorSetId]
+	if !ok {
+		return fmt.Errorf("sflow collector set %d not found", collectorSetId)
+	}
+	exporter.close()
+	delete(self.sflows, collectorSetId)
+	return nil
+}
+
+// sample exports the frame by the probability of ActionSample.
+func (pipe *Pipeline) sample(data *Frame, req ActionSample) {
+	pipe.lock.RLock()
+	exporter := pipe.sflows[req.CollectorSetId]
+	pipe.lock.RUnlock()
+	if exporter == nil {
+		return
+	}
+	if err := exporter.sample(data, req); err != nil {
+		log.Print(err)
+	}
+}
+
+// sflowIndex returns the interface index for the port number, or 0 for unknown.
+// ds_index in sFlow source_id is 24 bits.
+func sflowIndex(portNo uint32) uint32 {
+	if portNo > ofp4.OFPP_MAX || portNo > 0xffffff {
+		return 0
+	}
+	return portNo
+}
+
+func (self *sflowExporter) sample(data *Frame, req ActionSample) error {
+	if req.Probability == 0 {
+		return nil
+	}
+	source := sflowIndex(data.inPort)
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.samplePool[source]++
+	if req.Probability != 0xffff && uint16(rand.Intn(0xffff)) >= req.Probability {
+		return nil
+	}
+	eth, err := data.Serialized()
+	if err != nil {
+		return err
+	}
+	header := eth
+	if len(header) > self.config.HeaderSize {
+		header = header[:self.config.HeaderSize]
+	}
+	record := make([]byte, 16+(len(header)+3)/4*4)
+	binary.BigEndian.PutUint32(record, SFLOW_HEADER_ETHERNET)
+	binary.BigEndian.PutUint32(record[4:], uint32(len(eth)))
+	binary.BigEndian.PutUint32(record[8:], 0) // stripped
+	binary.BigEndian.PutUint32(record[12:], uint32(len(header)))
+	copy(record[16:], header)
+
+	self.flowSequence[source]++
+	sample := make([]byte, 32)
+	binary.BigEndian.PutUint32(sample, self.flowSequence[source])
+	binary.BigEndian.PutUint32(sample[4:], source) // ds_class 0, ifIndex
+	binary.BigEndian.PutUint32(sample[8:], uint32(0xffff)/uint32(req.Probability))
+	binary.BigEndian.PutUint32(sample[12:], self.samplePool[source])
+	binary.BigEndian.PutUint32(sample[16:], 0) // drops
+	binary.BigEndian.PutUint32(sample[20:], source)
+	binary.BigEndian.PutUint32(sample[24:], 0) // output is unknown at the action
+	binary.BigEndian.PutUint32(sample[28:], 1)
+	sample = append(sample, sflowRecord(SFLOW_RAW_PACKET_HEADER, record)...)
+
+	return self.send([][]byte{sflowRecord(SFLOW_FLOW_SAMPLE, sample)})
+}
+
+// counters exports generic interface counters of the ports.
+func (self *sflowExporter) counters(ports map[uint32]gopenflow.Port) error {
+	var samples [][]byte
+	for portNo, port := range ports {
+		index := sflowIndex(portNo)
+		if index == 0 {
+			continue
+		}
+		stats, err := port.Stats()
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		record := make([]byte, sflowGenericCountersLen)
+		binary.BigEndian.PutUint32(record, index)
+		binary.BigEndian.PutUint32(record[4:], sflowIfTypeEthernetCsmacd)
+		if eth, err := port.Ethernet(); err == nil {
+			binary.BigEndian.PutUint64(record[8:], uint64(eth.CurrSpeed)*1000)
+		}
+		binary.BigEndian.PutUint32(record[16:], 0) // direction unknown
+		var status uint32
+		if portConfig(port)&ofp4.OFPPC_PORT_DOWN == 0 {
+			status |= 1
+			if portState(port)&ofp4.OFPPS_LINK_DOWN == 0 {
+				status |= 2
+			}
+		}
+		binary.BigEndian.PutUint32(record[20:], status)
+		binary.BigEndian.PutUint64(record[24:], stats.RxBytes)
+		binary.BigEndian.PutUint32(record[32:], uint32(stats.RxPackets))
+		binary.BigEndian.PutUint32(record[36:], sflowUnknownCounter32) // multicast
+		binary.BigEndian.PutUint32(record[40:], sflowUnknownCounter32) // broadcast
+		binary.BigEndian.PutUint32(record[44:], uint32(stats.RxDropped))
+		binary.BigEndian.PutUint32(record[48:], uint32(stats.RxErrors))
+		binary.BigEndian.PutUint32(record[52:], sflowUnknownCounter32) // unknown protos
+		binary.BigEndian.PutUint64(record[56:], stats.TxBytes)
+		binary.BigEndian.PutUint32(record[64:], uint32(stats.TxPackets))
+		binary.BigEndian.PutUint32(record[68:], sflowUnknownCounter32)
+		binary.BigEndian.PutUint32(record[72:], sflowUnknownCounter32)
+		binary.BigEndian.PutUint32(record[76:], uint32(stats.TxDropped))
+		binary.BigEndian.PutUint32(record[80:], uint32(stats.TxErrors))
+		binary.BigEndian.PutUint32(record[84:], 0) // promiscuous mode
+
+		sample := make([]byte, 12)
+		func() {
+			self.lock.Lock()
+			defer self.lock.Unlock()
+			self.counterSequence[index]++
+			binary.BigEndian.PutUint32(sample, self.counterSequence[index])
+		}()
+		binary.BigEndian.PutUint32(sample[4:], index)
+		binary.BigEndian.PutUint32(sample[8:], 1)
+		sample = append(sample, sflowRecord(SFLOW_GENERIC_COUNTERS, record)...)
+		samples = append(samples, sflowRecord(SFLOW_COUNTER_SAMPLE, sample))
+	}
+	for len(samples) > 0 {
+		n := len(samples)
+		if n > sflowCounterSamplesMax {
+			n = sflowCounterSamplesMax
+		}
+		if err := func() error {
+			self.lock.Lock()
+			defer self.lock.Unlock()
+			return self.send(samples[:n])
+		}(); err != nil {
+			return err
+		}
+		samples = samples[n:]
+	}
+	return nil
+}
+
+// send writes the datagram. invoke this method inside a mutex guard.
+func (self *sflowExporter) send(samples [][]byte) error {
+	var buf []byte
+	if ip := self.agent.To4(); ip != nil {
+		buf = make([]byte, 28)
+		binary.BigEndian.PutUint32(buf[4:], SFLOW_ADDRESS_IP_V4)
+		copy(buf[8:], ip)
+	} else {
+		buf = make([]byte, 40)
+		binary.BigEndian.PutUint32(buf[4:], SFLOW_ADDRESS_IP_V6)
+		copy(buf[8:], self.agent.To16())
+	}
+	p := buf[len(buf)-16:]
+	binary.BigEndian.PutUint32(buf, 5) // version
+	self.sequence++
+	binary.BigEndian.PutUint32(p, self.config.SubAgentId)
+	binary.BigEndian.PutUint32(p[4:], self.sequence)
+	binary.BigEndian.PutUint32(p[8:], uint32(time.Since(self.started)/time.Millisecond))
+	binary.BigEndian.PutUint32(p[12:], uint32(len(samples)))
+	for _, sample := range samples {
+		buf = append(buf, sample...)
+	}
+	_, err := self.conn.Write(buf)
+	return err
+}
+
+// sflowRecord prepends data_format and the length.
+func sflowRecord(format uint32, data []byte) []byte {
+	buf := make([]byte, 8, 8+len(data))
+	binary.BigEndian.PutUint32(buf, format)
+	binary.BigEndian.PutUint32(buf[4:], uint32(len(data)))
+	return append(buf, data...)
+}
@@ -0,0 +1,132 @@
+package ofp4sw
+
+import (
+	"encoding/binary"
+	"github.com/hkwi/gopenflow"
+	"github.com/hkwi/gopenflow/ofp4"
+	"github.com/hkwi/gopenflow/oxm"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSflow(t *testing.T) {
+	AddActionHandler(flowTaskTestExperimenter, flowTaskTestAction{})
+
+	collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+
+	pipe := NewPipeline()
+	host1, sw1 := gopenflow.NewMemPortPair("h1", [6]byte{2, 0, 0, 0, 0, 1}, "sw1", [6]byte{2, 0, 0, 0, 1, 1})
+	host2, sw2 := gopenflow.NewMemPortPair("h2", [6]byte{2, 0, 0, 0, 0, 2}, "sw2", [6]byte{2, 0, 0, 0, 1, 2})
+	if err := pipe.SetPort(1, sw1); err != nil {
+		t.Fatal(err)
+	}
+	if err := pipe.SetPort(2, sw2); err != nil {
+		t.Fatal(err)
+	}
+	if err := pipe.SetSflow(5, SflowConfig{
+		Collector:       collector.LocalAddr().String(),
+		AgentAddress:    net.IP{192, 0, 2, 100},
+		HeaderSize:      20,
+		CounterInterval: -1,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pipe.addFlowEntry(nxmTestFlowMod(0, nxmTestField(oxm.OXM_OF_IN_PORT, []byte{0, 0, 0, 1}, nil),
+		ofp4.MakeInstructionActions(ofp4.OFPIT_APPLY_ACTIONS,
+			append(flowTaskTestActionBytes(7, 5), ofp4.MakeActionOutput(2, 0)...)))); err != nil {
+		t.Fatal(err)
+	}
+
+	read := func() []byte {
+		buf := make([]byte, 2048)
+		collector.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := collector.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf = buf[:n]
+		if binary.BigEndian.Uint32(buf) != 5 || binary.BigEndian.Uint32(buf[4:]) != SFLOW_ADDRESS_IP_V4 {
+			t.Fatalf("sflow header %v", buf)
+		}
+		return buf
+	}
+
+	data := make([]byte, 64)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	host1.Egress(gopenflow.Frame{Data: data})
+	select {
+	case <-host2.Ingress():
+	case <-time.After(time.Second):
+		t.Fatal("sampled frame not forwarded")
+	}
+	dgram := read()
+	if !net.IP(dgram[8:12]).Equal(net.IP{192, 0, 2, 100}) {
+		t.Errorf("agent address %v", dgram[8:12])
+	}
+	if binary.BigEndian.Uint32(dgram[24:]) != 1 {
+		t.Fatalf("samples %v", dgram)
+	}
+	sample := dgram[28:]
+	if binary.BigEndian.Uint32(sample) != SFLOW_FLOW_SAMPLE {
+		t.Fatalf("sample format %v", sample)
+	}
+	if binary.BigEndian.Uint32(sample[8+8:]) != 1 || binary.BigEndian.Uint32(sample[8+12:]) != 1 {
+		t.Errorf("sampling rate and pool %v", sample)
+	}
+	if binary.BigEndian.Uint32(sample[8+20:]) != 1 {
+		t.Errorf("input %v", sample)
+	}
+	record := sample[8+32:]
+	if binary.BigEndian.Uint32(record) != SFLOW_RAW_PACKET_HEADER {
+		t.Fatalf("record format %v", record)
+	}
+	if binary.BigEndian.Uint32(record[8+4:]) != 64 || binary.BigEndian.Uint32(record[8+12:]) != 20 {
+		t.Errorf("frame length %v", record)
+	}
+	if header := record[8+16:]; len(header) != 20 || header[19] != 19 {
+		t.Errorf("header %v", header)
+	}
+
+	// counters
+	if err := pipe.SetSflow(5, SflowConfig{
+		Collector:       collector.LocalAddr().String(),
+		CounterInterval: 10 * time.Millisecond,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[uint32]bool)
+	for len(seen) < 2 {
+		dgram := read()
+		for i, p := 0, dgram[28:]; i < int(binary.BigEndian.Uint32(dgram[24:])); i++ {
+			if binary.BigEndian.Uint32(p) != SFLOW_COUNTER_SAMPLE {
+				t.Fatalf("sample format %v", p)
+			}
+			record := p[8+12:]
+			if binary.BigEndian.Uint32(record) != SFLOW_GENERIC_COUNTERS || binary.BigEndian.Uint32(record[4:]) != 88 {
+				t.Fatalf("record %v", record)
+			}
+			index := binary.BigEndian.Uint32(record[8:])
+			if index != binary.BigEndian.Uint32(p[12:]) {
+				t.Errorf("source id %v", p)
+			}
+			seen[index] = true
+			p = p[8+binary.BigEndian.Uint32(p[4:]):]
+		}
+	}
+	if !seen[1] || !seen[2] {
+		t.Errorf("counter samples %v", seen)
+	}
+	if err := pipe.RemoveSflow(5); err != nil {
+		t.Error(err)
+	}
+	if err := pipe.RemoveSflow(5); err == nil {
+		t.Error("removed twice")
+	}
+}
@@ -2,6 +2,7 @@ package ofp4sw
 
 import (
 	"github.com/hkwi/gopenflow/ofp4"
+	"sort"
 )
 
 type oxmId interface{}
@@ -73,6 +74,37 @@ type flowTableFeature struct {
 	miss      flowTableFeatureProps
 }
 
+// supportedActions returns all the actions including registered experimenters.
+func supportedActions() []actionKey {
+	keys := []actionKey{
+		uint16(ofp4.OFPAT_OUTPUT),
+		uint16(ofp4.OFPAT_COPY_TTL_OUT),
+		uint16(ofp4.OFPAT_COPY_TTL_IN),
+		uint16(ofp4.OFPAT_SET_MPLS_TTL),
+		uint16(ofp4.OFPAT_DEC_MPLS_TTL),
+		uint16(ofp4.OFPAT_PUSH_VLAN),
+		uint16(ofp4.OFPAT_POP_VLAN),
+		uint16(ofp4.OFPAT_PUSH_MPLS),
+		uint16(ofp4.OFPAT_POP_MPLS),
+		uint16(ofp4.OFPAT_SET_QUEUE),
+		uint16(ofp4.OFPAT_GROUP),
+		uint16(ofp4.OFPAT_SET_NW_TTL),
+		uint16(ofp4.OFPAT_DEC_NW_TTL),
+		uint16(ofp4.OFPAT_SET_FIELD),
+		uint16(ofp4.OFPAT_PUSH_PBB),
+		uint16(ofp4.OFPAT_POP_PBB),
+	}
+	var exps []int
+	for exp, _ := range actionHandlers {
+		exps = append(exps, int(exp))
+	}
+	sort.Ints(exps)
+	for _, exp := range exps {
+		keys = append(keys, uint32(exp))
+	}
+	return keys
+}
+
 func makeFlowTableFeature() flowTableFeature {
 	return flowTableFeature{
 		metadataMatch: 0xFFFFFFFFFFFFFFFF,
@@ -139,7 +171,8 @@ func (self flowTableFeature) exportProps() []byte {
 
 	actionExport := func(pType uint16, keys []actionKey) {
 		if keys == nil {
-			return
+			// advertise what we can, so that the controller can find experimenter actions
+			keys = supportedActions()
 		}
 		var ids []byte
 		for _, key := range keys {
@@ -345,9 +378,11 @@ func (self flowTableFeature) accepts(entry *flowEntry, priority uint16) error {
 			for _, oxm := range ofp4.Oxm(k.Bytes(p)).Iter() {
 				var id oxmId
 				hdr := oxm.Header()
-				switch hdr.Type() {
+				switch hdr.Class() {
 				case ofp4.OFPXMC_OPENFLOW_BASIC:
 					id = oxmBasicHandler.OxmId(uint32(hdr))
+				case ofp4.OFPXMC_NXM_0, ofp4.OFPXMC_NXM_1:
+					id = oxmNxmHandler.OxmId(uint32(hdr))
 				case ofp4.OFPXMC_EXPERIMENTER:
 					exp := ofp4.OxmExperimenterHeader(oxm).Experimenter()
 					id = [...]uint32{
@@ -428,12 +463,14 @@ func (self flowTableFeature) accepts(entry *flowEntry, priority uint16) error {
 					)
 				}
 			}
-			for k, _ := range entry.instWrite.exp {
-				if !actionKeyList(keys).Have(k) {
-					return ofp4.MakeErrorMsg(
-						ofp4.OFPET_BAD_ACTION,
-						ofp4.OFPBAC_BAD_TYPE,
-					)
+			for _, exps := range entry.instWrite.exp {
+				for _, exp := range exps {
+					if !actionKeyList(keys).Have(exp.Experimenter) {
+						return ofp4.MakeErrorMsg(
+							ofp4.OFPET_BAD_ACTION,
+							ofp4.OFPBAC_BAD_TYPE,
+						)
+					}
 				}
 			}
 		}
@@ -16,6 +16,8 @@ import (
 	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -38,61 +40,230 @@ func (self Wrapper) Write(p []byte) (n int, err error) {
 	return self.con.Write(p)
 }
 
+// datapath options, which can be repeated with "--" separator to host multiple datapaths.
+type datapathFlags struct {
+	debug      string
+	dsock      string
+	ports      string
+	host       string
+	port       int
+	datapathId int64
+	local      string
+	failMode   string
+	patches    string
+	sflows     string
+	ipfix      string
+}
+
+func parseDatapathFlags(args []string) (datapathFlags, []string, error) {
+	var self datapathFlags
+	fs := flag.NewFlagSet("datapath", flag.ContinueOnError)
+	fs.StringVar(&self.debug, "d", "", "debug http server port number. ex 127.0.0.1:6060")
+	fs.StringVar(&self.dsock, "l", "", "local listening socket. ex unix:/socket/path or tcp:host:port")
+	fs.StringVar(&self.ports, "e", "", "comma separated switch ports (netdev names), with optional port number. ex eth1=1,eth2=2")
+	fs.StringVar(&self.host, "c", "127.0.0.1", "openflow controller host name")
+	fs.IntVar(&self.port, "p", 6653, "openflow controller port")
+	fs.Int64Var(&self.datapathId, "i", 0, "datapath id")
+	fs.StringVar(&self.local, "t", "", "tap device name for OFPP_LOCAL port")
+	fs.StringVar(&self.failMode, "f", "secure", "fail mode, secure or standalone")
+	fs.StringVar(&self.patches, "x", "", "comma separated patch ports to other datapaths, with optional port number. ex patch-int:patch-tun=10")
+	fs.StringVar(&self.sflows, "s", "", "comma separated sFlow collectors for NXAST_SAMPLE, with optional collector set id. ex 127.0.0.1:6343=1")
+	fs.StringVar(&self.ipfix, "a", "", "IPFIX collector for flow records, with optional active timeout seconds. ex 127.0.0.1:4739=60")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [datapath options] [-- datapath options]...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return self, nil, err
+	}
+	// positional arguments are not allowed, rest must start after "--" separator.
+	rest := fs.Args()
+	if len(rest) > 0 && (len(args) == len(rest) || args[len(args)-len(rest)-1] != "--") {
+		err := fmt.Errorf("unexpected argument %s", rest[0])
+		fmt.Fprintln(os.Stderr, err)
+		fs.Usage()
+		return self, nil, err
+	}
+	return self, rest, nil
+}
+
+// parsePortSpec splits "name=portNo". portNo 0 means any.
+func parsePortSpec(spec string) (string, uint32, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) == 1 {
+		return parts[0], 0, nil
+	}
+	if n, err := strconv.ParseUint(parts[1], 0, 32); err != nil || n == 0 {
+		return "", 0, fmt.Errorf("invalid port number in %s", spec)
+	} else {
+		return parts[0], uint32(n), nil
+	}
+}
+
+// parseSflowSpec splits "host:port=collectorSetId". collectorSetId defaults to 0.
+func parseSflowSpec(spec string) (string, uint32, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) == 1 {
+		return parts[0], 0, nil
+	}
+	if n, err := strconv.ParseUint(parts[1], 0, 32); err != nil {
+		return "", 0, fmt.Errorf("invalid collector set id in %s", spec)
+	} else {
+		return parts[0], uint32(n), nil
+	}
+}
+
+// parseIpfixSpec splits "host:port=activeTimeout". activeTimeout defaults to 60 seconds.
+func parseIpfixSpec(spec string) (ofp4sw.IpfixConfig, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	config := ofp4sw.IpfixConfig{Collector: parts[0]}
+	if len(parts) == 1 {
+		return config, nil
+	}
+	if n, err := strconv.ParseUint(parts[1], 0, 32); err != nil || n == 0 {
+		return config, fmt.Errorf("invalid active timeout in %s", spec)
+	} else {
+		config.ActiveTimeout = time.Duration(n) * time.Second
+	}
+	return config, nil
+}
+
+// patchPorts creates patch port pairs on demand, by "name:peer" pair.
+type patchPorts map[string]*gopenflow.PatchPort
+
+func (self patchPorts) get(spec string) (*gopenflow.PatchPort, error) {
+	names := strings.SplitN(spec, ":", 2)
+	if len(names) != 2 || len(names[0]) == 0 || len(names[1]) == 0 || names[0] == names[1] {
+		return nil, fmt.Errorf("invalid patch port %s", spec)
+	}
+	if p, ok := self[names[0]]; ok {
+		return p, nil
+	}
+	a, b := gopenflow.NewPatchPortPair(names[0], names[1])
+	self[names[0]] = a
+	self[names[1]] = b
+	return a, nil
+}
+
 func main() {
-	var debug string
-	flag.StringVar(&debug, "d", "", "debug http server port number. ex 127.0.0.1:6060")
-	var dsock string
-	flag.StringVar(&dsock, "l", "", "local listening socket. ex unix:/socket/path or tcp:host:port")
-	var ports string
-	flag.StringVar(&ports, "e", "", "comma separated switch ports (netdev names)")
-	var host string
-	flag.StringVar(&host, "c", "127.0.0.1", "openflow controller host name")
-	var port int
-	flag.IntVar(&port, "p", 6653, "openflow controller port")
-	var datapathId int64
-	flag.Int64Var(&datapathId, "i", 0, "datapath id")
-	flag.Parse()
+	var dps []datapathFlags
+	for args := os.Args[1:]; len(dps) == 0 || len(args) > 0; {
+		if dp, rest, err := parseDatapathFlags(args); err != nil {
+			os.Exit(2)
+		} else {
+			dps = append(dps, dp)
+			args = rest
+		}
+	}
 
 	ofp4sw.AddOxmHandler(0xFF00E04D, ofp4ext.StratosOxm{})
+	ofp4sw.AddMeterBandHandler(0xFF00E04D, ofp4ext.StratosMeterBand{})
+	ofp4sw.AddActionHandler(ofp4ext.NX_EXPERIMENTER_ID, ofp4ext.NxAction{})
+	ofp4sw.AddMessageHandler(ofp4ext.STRATOS_EXPERIMENTER_ID, ofp4ext.STRATOS_MIRROR_MOD, ofp4ext.StratosMirrorMod{})
+	ofp4sw.AddMessageHandler(ofp4ext.STRATOS_EXPERIMENTER_ID, ofp4ext.STRATOS_MIRROR_STATS, ofp4ext.StratosMirrorStats{})
 
-	if len(debug) > 0 {
-		go func() {
-			log.Println(http.ListenAndServe(debug, nil))
-		}()
+	for _, dp := range dps {
+		if len(dp.debug) > 0 {
+			go func(debug string) {
+				log.Println(http.ListenAndServe(debug, nil))
+			}(dp.debug)
+		}
 	}
+	patches := make(patchPorts)
+	for _, dp := range dps {
+		if pipe, err := dp.setup(patches); err != nil {
+			log.Print(err)
+			return
+		} else {
+			go dp.connect(pipe)
+		}
+	}
+	select {}
+}
+
+func (self datapathFlags) setup(patches patchPorts) (*ofp4sw.Pipeline, error) {
 	pipe := ofp4sw.NewPipeline()
-	pipe.DatapathId = uint64(datapathId)
+	pipe.DatapathId = uint64(self.datapathId)
+	pipe.SetFailStandalone(self.failMode == "standalone")
 
+	if len(self.local) > 0 {
+		if tap, err := gopenflow.NewTapPort(self.local); err != nil {
+			return nil, err
+		} else if err := pipe.AddLocalPort(tap); err != nil {
+			return nil, err
+		}
+	}
 	if pman, err := gopenflow.NewNamedPortManager(pipe); err != nil {
-		log.Print(err)
-		return
+		return nil, err
 	} else {
-		for _, e := range strings.Split(ports, ",") {
-			pman.AddName(e)
+		for _, e := range strings.Split(self.ports, ",") {
+			if len(e) == 0 {
+				continue
+			} else if name, portNo, err := parsePortSpec(e); err != nil {
+				return nil, err
+			} else if err := pman.AddNameAt(name, portNo); err != nil {
+				log.Print(err)
+			}
+		}
+	}
+	if len(self.patches) > 0 {
+		for _, spec := range strings.Split(self.patches, ",") {
+			if spec, portNo, err := parsePortSpec(spec); err != nil {
+				return nil, err
+			} else if patch, err := patches.get(spec); err != nil {
+				return nil, err
+			} else if portNo != 0 {
+				if err := pipe.SetPort(portNo, patch); err != nil {
+					return nil, err
+				}
+			} else if err := pipe.AddPort(patch); err != nil {
+				return nil, err
+			}
 		}
 	}
-	if len(dsock) > 0 {
+	for _, spec := range strings.Split(self.sflows, ",") {
+		if len(spec) == 0 {
+			continue
+		} else if collector, setId, err := parseSflowSpec(spec); err != nil {
+			return nil, err
+		} else if err := pipe.SetSflow(setId, ofp4sw.SflowConfig{Collector: collector}); err != nil {
+			return nil, err
+		}
+	}
+	if len(self.ipfix) > 0 {
+		if config, err := parseIpfixSpec(self.ipfix); err != nil {
+			return nil, err
+		} else if err := pipe.SetIpfix(config); err != nil {
+			return nil, err
+		}
+	}
+	if len(self.dsock) > 0 {
+		dsock := self.dsock
 		parts := strings.SplitN(dsock, ":", 2)
 		if li, err := net.Listen(parts[0], parts[1]); err != nil {
-			fmt.Errorf("opening unix domain socket %v failed %v", dsock, err)
+			log.Printf("opening unix domain socket %v failed %v", dsock, err)
 		} else {
 			go func() {
 				defer li.Close()
 				for {
 					if con, err := li.Accept(); err != nil {
-						fmt.Errorf("socket %v accept failed %v", dsock, err)
+						log.Printf("socket %v accept failed %v", dsock, err)
 						break
 					} else if err := pipe.AddChannel(con); err != nil {
-						fmt.Errorf("socket %v channel registeration failed", dsock)
+						log.Printf("socket %v channel registeration failed", dsock)
 					}
 				}
 			}()
 		}
 	}
+	return pipe, nil
+}
+
+func (self datapathFlags) connect(pipe *ofp4sw.Pipeline) {
 	for {
-		if addr, err := net.ResolveIPAddr("ip", host); err != nil {
+		if addr, err := net.ResolveIPAddr("ip", self.host); err != nil {
 			panic(err)
-		} else if con, err := net.DialTCP("tcp", nil, &net.TCPAddr{IP: addr.IP, Port: port}); err != nil {
+		} else if con, err := net.DialTCP("tcp", nil, &net.TCPAddr{IP: addr.IP, Port: self.port}); err != nil {
 			log.Print(err)
 		} else {
 			ch := Wrapper{
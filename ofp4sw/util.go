@@ -61,9 +61,15 @@ func makeOxmBasic(oxmType uint32) []byte {
 	return buf
 }
 
-func makePort(portNo uint32, port gopenflow.Port) ofp4.Port {
+// portConfig returns ofp_port_config bits of the port.
+func portConfig(port gopenflow.Port) uint32 {
+	return configBits(port.GetConfig())
+}
+
+// configBits returns ofp_port_config bits.
+func configBits(confs []gopenflow.PortConfig) uint32 {
 	var config uint32
-	for _, conf := range port.GetConfig() {
+	for _, conf := range confs {
 		switch c := conf.(type) {
 		case gopenflow.PortConfigPortDown:
 			if bool(c) {
@@ -83,9 +89,18 @@ func makePort(portNo uint32, port gopenflow.Port) ofp4.Port {
 			}
 		}
 	}
+	return config
+}
 
+// portState returns ofp_port_state bits of the port.
+func portState(port gopenflow.Port) uint32 {
+	return stateBits(port.State())
+}
+
+// stateBits returns ofp_port_state bits.
+func stateBits(states []gopenflow.PortState) uint32 {
 	var state uint32
-	for _, st := range port.State() {
+	for _, st := range states {
 		switch s := st.(type) {
 		case gopenflow.PortStateLinkDown:
 			if bool(s) {
@@ -101,6 +116,12 @@ func makePort(portNo uint32, port gopenflow.Port) ofp4.Port {
 			}
 		}
 	}
+	return state
+}
+
+func makePort(portNo uint32, port gopenflow.Port) ofp4.Port {
+	config := portConfig(port)
+	state := portState(port)
 
 	eth, err := port.Ethernet()
 	if err != nil {
@@ -119,6 +140,21 @@ func makePort(portNo uint32, port gopenflow.Port) ofp4.Port {
 		eth.MaxSpeed)
 }
 
+func makePortFromEvent(portNo uint32, ev gopenflow.PortEvent) ofp4.Port {
+	eth := ev.Ethernet
+	return ofp4.MakePort(portNo,
+		ev.HwAddr,
+		[]byte(ev.Name),
+		configBits(ev.Config),
+		stateBits(ev.State),
+		eth.Curr,
+		eth.Advertised,
+		eth.Supported,
+		eth.Peer,
+		eth.CurrSpeed,
+		eth.MaxSpeed)
+}
+
 func IntMax(x ...int) int {
 	sort.Ints(x)
 	return x[len(x)-1]
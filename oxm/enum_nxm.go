@@ -63,3 +63,98 @@ const (
 	NXM_NX_TUN_GBP_ID
 	NXM_NX_TUN_GBP_FLAGS
 )
+
+// tun_metadata fields for tunnel options, such as geneve TLV.
+const (
+	NXM_NX_TUN_METADATA0 = OFPXMC_NXM_1<<OXM_CLASS_SHIFT | (iota+40)<<OXM_FIELD_SHIFT
+	NXM_NX_TUN_METADATA1
+	NXM_NX_TUN_METADATA2
+	NXM_NX_TUN_METADATA3
+	NXM_NX_TUN_METADATA4
+	NXM_NX_TUN_METADATA5
+	NXM_NX_TUN_METADATA6
+	NXM_NX_TUN_METADATA7
+	NXM_NX_TUN_METADATA8
+	NXM_NX_TUN_METADATA9
+	NXM_NX_TUN_METADATA10
+	NXM_NX_TUN_METADATA11
+	NXM_NX_TUN_METADATA12
+	NXM_NX_TUN_METADATA13
+	NXM_NX_TUN_METADATA14
+	NXM_NX_TUN_METADATA15
+	NXM_NX_TUN_METADATA16
+	NXM_NX_TUN_METADATA17
+	NXM_NX_TUN_METADATA18
+	NXM_NX_TUN_METADATA19
+	NXM_NX_TUN_METADATA20
+	NXM_NX_TUN_METADATA21
+	NXM_NX_TUN_METADATA22
+	NXM_NX_TUN_METADATA23
+	NXM_NX_TUN_METADATA24
+	NXM_NX_TUN_METADATA25
+	NXM_NX_TUN_METADATA26
+	NXM_NX_TUN_METADATA27
+	NXM_NX_TUN_METADATA28
+	NXM_NX_TUN_METADATA29
+	NXM_NX_TUN_METADATA30
+	NXM_NX_TUN_METADATA31
+	NXM_NX_TUN_METADATA32
+	NXM_NX_TUN_METADATA33
+	NXM_NX_TUN_METADATA34
+	NXM_NX_TUN_METADATA35
+	NXM_NX_TUN_METADATA36
+	NXM_NX_TUN_METADATA37
+	NXM_NX_TUN_METADATA38
+	NXM_NX_TUN_METADATA39
+	NXM_NX_TUN_METADATA40
+	NXM_NX_TUN_METADATA41
+	NXM_NX_TUN_METADATA42
+	NXM_NX_TUN_METADATA43
+	NXM_NX_TUN_METADATA44
+	NXM_NX_TUN_METADATA45
+	NXM_NX_TUN_METADATA46
+	NXM_NX_TUN_METADATA47
+	NXM_NX_TUN_METADATA48
+	NXM_NX_TUN_METADATA49
+	NXM_NX_TUN_METADATA50
+	NXM_NX_TUN_METADATA51
+	NXM_NX_TUN_METADATA52
+	NXM_NX_TUN_METADATA53
+	NXM_NX_TUN_METADATA54
+	NXM_NX_TUN_METADATA55
+	NXM_NX_TUN_METADATA56
+	NXM_NX_TUN_METADATA57
+	NXM_NX_TUN_METADATA58
+	NXM_NX_TUN_METADATA59
+	NXM_NX_TUN_METADATA60
+	NXM_NX_TUN_METADATA61
+	NXM_NX_TUN_METADATA62
+	NXM_NX_TUN_METADATA63
+)
+
+const NX_EXPERIMENTER_ID = 0x00002320
+
+// connection tracking fields
+const (
+	NXM_NX_CT_STATE = OFPXMC_NXM_1<<OXM_CLASS_SHIFT | (iota+105)<<OXM_FIELD_SHIFT
+	NXM_NX_CT_ZONE
+	NXM_NX_CT_MARK
+	NXM_NX_CT_LABEL
+)
+
+// ct_state bits
+const (
+	NX_CT_STATE_NEW = 1 << iota
+	NX_CT_STATE_EST
+	NX_CT_STATE_REL
+	NX_CT_STATE_RPL
+	NX_CT_STATE_INV
+	NX_CT_STATE_TRK
+	NX_CT_STATE_SNAT
+	NX_CT_STATE_DNAT
+)
+
+const (
+	NXM_NX_TUN_IPV6_SRC = OFPXMC_NXM_1<<OXM_CLASS_SHIFT | 109<<OXM_FIELD_SHIFT
+	NXM_NX_TUN_IPV6_DST = OFPXMC_NXM_1<<OXM_CLASS_SHIFT | 110<<OXM_FIELD_SHIFT
+)
@@ -504,6 +504,32 @@ func (oxm single) String() string {
 		} else {
 			s = fmt.Sprintf("nxm_tun_gbp_flags=0x%x", p[0])
 		}
+	case NXM_NX_CT_STATE:
+		if hdr.HasMask() {
+			s = fmt.Sprintf("nxm_ct_state=0x%x/0x%x",
+				binary.BigEndian.Uint32(p),
+				binary.BigEndian.Uint32(p[4:]))
+		} else {
+			s = fmt.Sprintf("nxm_ct_state=0x%x",
+				binary.BigEndian.Uint32(p))
+		}
+	case NXM_NX_CT_ZONE:
+		s = fmt.Sprintf("nxm_ct_zone=%d", binary.BigEndian.Uint16(p))
+	case NXM_NX_CT_MARK:
+		if hdr.HasMask() {
+			s = fmt.Sprintf("nxm_ct_mark=0x%x/0x%x",
+				binary.BigEndian.Uint32(p),
+				binary.BigEndian.Uint32(p[4:]))
+		} else {
+			s = fmt.Sprintf("nxm_ct_mark=0x%x",
+				binary.BigEndian.Uint32(p))
+		}
+	case NXM_NX_CT_LABEL:
+		if hdr.HasMask() {
+			s = fmt.Sprintf("nxm_ct_label=0x%x/0x%x", p[:16], p[16:])
+		} else {
+			s = fmt.Sprintf("nxm_ct_label=0x%x", p)
+		}
 	default:
 		switch hdr.Class() {
 		case OFPXMC_EXPERIMENTER:
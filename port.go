@@ -31,8 +31,10 @@ type NamedPort struct {
 	port         uint32
 	physicalPort uint32
 	ingress      chan Frame
-	monitor      chan bool
+	monitor      chan PortEvent
 	lock         *sync.Mutex
+	notifier     *sync.Mutex // serializes monitor senders
+	closed       bool
 
 	// socket handling
 	hatype   uint16
@@ -60,7 +62,7 @@ func (self NamedPort) PhysicalPort() uint32 {
 	return self.physicalPort
 }
 
-func (self NamedPort) Monitor() <-chan bool {
+func (self NamedPort) Monitor() <-chan PortEvent {
 	return self.monitor
 }
 
@@ -172,40 +174,87 @@ func (self NamedPort) GetConfig() []PortConfig {
 	}, self.config...)
 }
 
-func (self NamedPort) SetConfig(mods []PortConfig) {
-	self.lock.Lock()
-	defer self.lock.Unlock()
-
+// SetConfig applies the config synchronously. PortConfigPortDown is
+// applied to the netdev, and other config bits are kept in the port.
+func (self *NamedPort) SetConfig(mods []PortConfig) error {
 	var config []PortConfig
 	for _, mod := range mods {
 		switch m := mod.(type) {
 		case PortConfigPortDown:
+			self.lock.Lock()
+			down := self.flags&syscall.IFF_UP == 0
+			self.lock.Unlock()
+			if down == bool(m) {
+				continue
+			}
 			if hub, err := nlgo.NewRtHub(); err != nil {
-				log.Print(err)
+				return PortConfigError{mod, err}
 			} else {
-				defer hub.Close()
-				ifinfo := syscall.IfInfomsg{
-					Index: int32(self.ifIndex),
-				}
-				if !bool(m) {
-					ifinfo.Flags |= syscall.IFF_UP
-				}
-				ifinfo.Change |= syscall.IFF_UP
-				// xxx:should add error check?
-				req := syscall.NetlinkMessage{
-					Header: syscall.NlMsghdr{
-						Type: syscall.RTM_SETLINK,
-					},
+				err := setLinkUp(hub, self.ifIndex, !bool(m))
+				hub.Close()
+				if err != nil {
+					return PortConfigError{mod, err}
 				}
-				(*nlgo.IfInfoMessage)(&req).Set(ifinfo, nil)
-				hub.Async(req, nil)
+			}
+			self.lock.Lock()
+			self.flags ^= syscall.IFF_UP
+			self.lock.Unlock()
+		case PortConfigAdvertise:
+			if err := self.setAdvertise(uint32(m)); err != nil {
+				return PortConfigError{mod, err}
 			}
 		default:
 			config = append(config, mod)
 		}
 	}
+	self.lock.Lock()
 	self.config = config
-	self.monitor <- true
+	self.lock.Unlock()
+	self.notify(PortModified)
+	return nil
+}
+
+// notify is non-blocking, pending notifications are coalesced.
+func (self *NamedPort) notify(kind PortEventKind) {
+	self.notifier.Lock()
+	defer self.notifier.Unlock()
+
+	ev := MakePortEvent(kind, self)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if !self.closed {
+		offerPortEvent(self.monitor, ev)
+	}
+}
+
+// setLinkUp changes IFF_UP, and waits for the kernel ack.
+func setLinkUp(hub *nlgo.RtHub, ifIndex uint32, up bool) error {
+	ifinfo := syscall.IfInfomsg{
+		Index:  int32(ifIndex),
+		Change: syscall.IFF_UP,
+	}
+	if up {
+		ifinfo.Flags |= syscall.IFF_UP
+	}
+	req := syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{
+			Type:  syscall.RTM_SETLINK,
+			Flags: syscall.NLM_F_ACK,
+		},
+	}
+	(*nlgo.IfInfoMessage)(&req).Set(ifinfo, nil)
+	if res, err := hub.Sync(req); err != nil {
+		return err
+	} else {
+		for _, r := range res {
+			if r.Header.Type == syscall.NLMSG_ERROR {
+				if e := nlgo.NlMsgerr(r).Payload().Error; e != 0 {
+					return syscall.Errno(-e)
+				}
+			}
+		}
+	}
+	return nil
 }
 
 func (self NamedPort) State() []PortState {
@@ -221,11 +270,38 @@ func (self NamedPort) Mtu() uint32 {
 }
 
 func (self NamedPort) Stats() (PortStats, error) {
+	if s, err := linkStats(self.ifIndex); err != nil {
+		return PortStats{}, err
+	} else {
+		ret := PortStats{
+			RxPackets: s.RxPackets,
+			TxPackets: s.TxPackets,
+			RxBytes:   s.RxBytes,
+			TxBytes:   s.TxBytes,
+			RxDropped: s.RxDropped,
+			TxDropped: s.TxDropped,
+			RxErrors:  s.RxErrors,
+			TxErrors:  s.TxErrors,
+		}
+		if self.hatype == syscall.ARPHRD_ETHER {
+			ret.Ethernet = &PortStatsEthernet{
+				RxFrameErr: s.RxFrameErrors,
+				RxOverErr:  s.RxOverErrors,
+				RxCrcErr:   s.RxCrcErrors,
+				Collisions: s.Collisions,
+			}
+		}
+		return ret, nil
+	}
+}
+
+// linkStats queries the kernel netdev statistics via rtnetlink.
+func linkStats(ifIndex uint32) (nlgo.RtnlLinkStats64, error) {
 	ifinfo := syscall.IfInfomsg{
-		Index: int32(self.ifIndex),
+		Index: int32(ifIndex),
 	}
 	if hub, err := nlgo.NewRtHub(); err != nil {
-		return PortStats{}, err
+		return nlgo.RtnlLinkStats64{}, err
 	} else {
 		defer hub.Close()
 		req := syscall.NetlinkMessage{
@@ -236,44 +312,25 @@ func (self NamedPort) Stats() (PortStats, error) {
 		}
 		(*nlgo.IfInfoMessage)(&req).Set(ifinfo, nil)
 		if res, err := hub.Sync(req); err != nil {
-			return PortStats{}, err
+			return nlgo.RtnlLinkStats64{}, err
 		} else {
 			for _, r := range res {
 				switch r.Header.Type {
 				case syscall.RTM_NEWLINK:
 					msg := nlgo.IfInfoMessage(r)
-					if msg.IfInfo().Index != int32(self.ifIndex) {
+					if msg.IfInfo().Index != int32(ifIndex) {
 						// pass
 					} else if attrs, err := msg.Attrs(); err != nil {
-						return PortStats{}, err
+						return nlgo.RtnlLinkStats64{}, err
 					} else if blk := attrs.(nlgo.AttrMap).Get(nlgo.IFLA_STATS64); blk != nil {
 						stat := []byte(blk.(nlgo.Binary))
-						s := (*nlgo.RtnlLinkStats64)(unsafe.Pointer(&stat[0]))
-						ret := PortStats{
-							RxPackets: s.RxPackets,
-							TxPackets: s.TxPackets,
-							RxBytes:   s.RxBytes,
-							TxBytes:   s.TxBytes,
-							RxDropped: s.RxDropped,
-							TxDropped: s.TxDropped,
-							RxErrors:  s.RxErrors,
-							TxErrors:  s.TxErrors,
-						}
-						if self.hatype == syscall.ARPHRD_ETHER {
-							ret.Ethernet = &PortStatsEthernet{
-								RxFrameErr: s.RxFrameErrors,
-								RxOverErr:  s.RxOverErrors,
-								RxCrcErr:   s.RxCrcErrors,
-								Collisions: s.Collisions,
-							}
-						}
-						return ret, nil
+						return *(*nlgo.RtnlLinkStats64)(unsafe.Pointer(&stat[0])), nil
 					}
 				}
 			}
 		}
 	}
-	return PortStats{}, fmt.Errorf("rtnetlink query failed")
+	return nlgo.RtnlLinkStats64{}, fmt.Errorf("rtnetlink query failed")
 }
 
 // Up activates packet processing.
@@ -565,9 +622,17 @@ func (self *NamedPort) Down() {
 	}
 }
 
-func (self NamedPort) Close() error {
-	close(self.monitor)
-	close(self.ingress)
+// Close closes the channels. Calling Close more than once is safe.
+func (self *NamedPort) Close() error {
+	self.notifier.Lock()
+	defer self.notifier.Unlock()
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if !self.closed {
+		self.closed = true
+		close(self.monitor)
+		close(self.ingress)
+	}
 	return nil
 }
 
@@ -640,6 +705,8 @@ type NamedPortManager struct {
 	lock          *sync.Mutex
 	trackingNames []string
 	trackingWiphy []uint32
+	// requested port numbers, key is the port name.
+	portNumbers map[string]uint32
 	// all ports this manager handles. key is ifindex.
 	ports map[uint32]*NamedPort
 
@@ -651,9 +718,10 @@ type NamedPortManager struct {
 
 func NewNamedPortManager(datapath Datapath) (*NamedPortManager, error) {
 	self := &NamedPortManager{
-		datapath: datapath,
-		ports:    make(map[uint32]*NamedPort),
-		lock:     &sync.Mutex{},
+		datapath:    datapath,
+		portNumbers: make(map[string]uint32),
+		ports:       make(map[uint32]*NamedPort),
+		lock:        &sync.Mutex{},
 	}
 	if ghub, err := nlgo.NewGenlHub(); err != nil {
 		return nil, err
@@ -685,9 +753,18 @@ func (self NamedPortManager) Close() error {
 }
 
 func (self *NamedPortManager) AddName(name string) error {
+	return self.AddNameAt(name, 0)
+}
+
+// AddNameAt tracks the netdev name, and registers it in the openflow port number.
+// portNo 0 means any free port number.
+func (self *NamedPortManager) AddNameAt(name string, portNo uint32) error {
 	self.lock.Lock()
 	defer self.lock.Unlock()
 	self.trackingNames = append(self.trackingNames, name)
+	if portNo != 0 {
+		self.portNumbers[name] = portNo
+	}
 
 	req := syscall.NetlinkMessage{
 		Header: syscall.NlMsghdr{
@@ -715,6 +792,7 @@ func (self *NamedPortManager) AddName(name string) error {
 	return nil
 }
 
+// RemoveName stops tracking the netdev name, and removes the port from the datapath.
 func (self *NamedPortManager) RemoveName(name string) {
 	self.lock.Lock()
 	defer self.lock.Unlock()
@@ -726,6 +804,23 @@ func (self *NamedPortManager) RemoveName(name string) {
 		}
 	}
 	self.trackingNames = active
+	delete(self.portNumbers, name)
+
+	for idx, port := range self.ports {
+		if port.name == name {
+			self.removePort(idx)
+		}
+	}
+}
+
+func (self *NamedPortManager) removePort(ifIndex uint32) {
+	port := self.ports[ifIndex]
+	if err := self.datapath.RemovePort(port); err != nil {
+		log.Print(err)
+	}
+	port.Down()
+	port.Close()
+	delete(self.ports, ifIndex)
 }
 
 func (self *NamedPortManager) NetlinkListen(ev syscall.NetlinkMessage) {
@@ -773,7 +868,7 @@ func (self *NamedPortManager) NetlinkListen(ev syscall.NetlinkMessage) {
 			if len(evPort.mac) != 0 {
 				port.mac = evPort.mac
 			}
-			port.monitor <- true
+			port.notify(PortModified)
 			if err := port.Up(); err != nil { // maybe ready for up
 				log.Print(err)
 			}
@@ -829,7 +924,8 @@ func (self *NamedPortManager) NetlinkListen(ev syscall.NetlinkMessage) {
 		if tracking(evPort) {
 			port := evPort
 			port.ingress = make(chan Frame)
-			port.monitor = make(chan bool)
+			port.monitor = make(chan PortEvent, 1)
+			port.notifier = &sync.Mutex{}
 			self.ports[uint32(ifinfo.Index)] = port
 			func() {
 				if port.hasWiphy {
@@ -841,17 +937,25 @@ func (self *NamedPortManager) NetlinkListen(ev syscall.NetlinkMessage) {
 					self.trackingWiphy = append(self.trackingWiphy, port.wiphy)
 				}
 			}()
-			self.datapath.AddPort(port)
-			port.monitor <- true
+			var err error
+			if portNo, ok := self.portNumbers[port.name]; ok {
+				err = self.datapath.SetPort(portNo, port)
+			} else {
+				err = self.datapath.AddPort(port)
+			}
+			if err != nil {
+				log.Print(err)
+				delete(self.ports, port.ifIndex)
+				return
+			}
+			port.notify(PortAdded)
 			if err := port.Up(); err != nil { // maybe ready for up
 				log.Print(err)
 			}
 		}
 	case syscall.RTM_DELLINK:
 		if port, ok := self.ports[evPort.ifIndex]; ok && port != nil {
-			port.Down()
-			port.Close()
-			delete(self.ports, evPort.ifIndex)
+			self.removePort(evPort.ifIndex)
 		}
 		// for wiphy unplug
 		if res, err := self.ghub.Sync(nl80211.DumpRequest(nlgo.NL80211_CMD_GET_WIPHY)); err != nil {
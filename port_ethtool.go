@@ -0,0 +1,398 @@
+// +build linux
+
+package gopenflow
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/hkwi/gopenflow/ofp4"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	SIOCETHTOOL           = 0x8946
+	ETHTOOL_GSET          = 0x00000001
+	ETHTOOL_SSET          = 0x00000002
+	ETHTOOL_GLINKSETTINGS = 0x0000004c
+	ETHTOOL_SLINKSETTINGS = 0x0000004d
+)
+
+const (
+	ethtoolSpeedUnknown   = 0xFFFFFFFF
+	ethtoolDuplexHalf     = 0x00
+	ethtoolDuplexFull     = 0x01
+	ethtoolPortTp         = 0x00
+	ethtoolPortFibre      = 0x03
+	ethtoolPortDa         = 0x05
+	ethtoolAutonegDisable = 0x00
+)
+
+// ethtool_link_mode_bit_indices
+const (
+	ETHTOOL_LINK_MODE_10baseT_Half_BIT = iota
+	ETHTOOL_LINK_MODE_10baseT_Full_BIT
+	ETHTOOL_LINK_MODE_100baseT_Half_BIT
+	ETHTOOL_LINK_MODE_100baseT_Full_BIT
+	ETHTOOL_LINK_MODE_1000baseT_Half_BIT
+	ETHTOOL_LINK_MODE_1000baseT_Full_BIT
+	ETHTOOL_LINK_MODE_Autoneg_BIT
+	ETHTOOL_LINK_MODE_TP_BIT
+	ETHTOOL_LINK_MODE_AUI_BIT
+	ETHTOOL_LINK_MODE_MII_BIT
+	ETHTOOL_LINK_MODE_FIBRE_BIT
+	ETHTOOL_LINK_MODE_BNC_BIT
+	ETHTOOL_LINK_MODE_10000baseT_Full_BIT
+	ETHTOOL_LINK_MODE_Pause_BIT
+	ETHTOOL_LINK_MODE_Asym_Pause_BIT
+	ETHTOOL_LINK_MODE_2500baseX_Full_BIT
+	ETHTOOL_LINK_MODE_Backplane_BIT
+	ETHTOOL_LINK_MODE_1000baseKX_Full_BIT
+	ETHTOOL_LINK_MODE_10000baseKX4_Full_BIT
+	ETHTOOL_LINK_MODE_10000baseKR_Full_BIT
+	ETHTOOL_LINK_MODE_10000baseR_FEC_BIT
+	ETHTOOL_LINK_MODE_20000baseMLD2_Full_BIT
+	ETHTOOL_LINK_MODE_20000baseKR2_Full_BIT
+	ETHTOOL_LINK_MODE_40000baseKR4_Full_BIT
+	ETHTOOL_LINK_MODE_40000baseCR4_Full_BIT
+	ETHTOOL_LINK_MODE_40000baseSR4_Full_BIT
+	ETHTOOL_LINK_MODE_40000baseLR4_Full_BIT
+	ETHTOOL_LINK_MODE_56000baseKR4_Full_BIT
+	ETHTOOL_LINK_MODE_56000baseCR4_Full_BIT
+	ETHTOOL_LINK_MODE_56000baseSR4_Full_BIT
+	ETHTOOL_LINK_MODE_56000baseLR4_Full_BIT
+	ETHTOOL_LINK_MODE_25000baseCR_Full_BIT
+	ETHTOOL_LINK_MODE_25000baseKR_Full_BIT
+	ETHTOOL_LINK_MODE_25000baseSR_Full_BIT
+	ETHTOOL_LINK_MODE_50000baseCR2_Full_BIT
+	ETHTOOL_LINK_MODE_50000baseKR2_Full_BIT
+	ETHTOOL_LINK_MODE_100000baseKR4_Full_BIT
+	ETHTOOL_LINK_MODE_100000baseSR4_Full_BIT
+	ETHTOOL_LINK_MODE_100000baseCR4_Full_BIT
+	ETHTOOL_LINK_MODE_100000baseLR4_ER4_Full_BIT
+	ETHTOOL_LINK_MODE_50000baseSR2_Full_BIT
+	ETHTOOL_LINK_MODE_1000baseX_Full_BIT
+	ETHTOOL_LINK_MODE_10000baseCR_Full_BIT
+	ETHTOOL_LINK_MODE_10000baseSR_Full_BIT
+	ETHTOOL_LINK_MODE_10000baseLR_Full_BIT
+	ETHTOOL_LINK_MODE_10000baseLRM_Full_BIT
+	ETHTOOL_LINK_MODE_10000baseER_Full_BIT
+	ETHTOOL_LINK_MODE_2500baseT_Full_BIT
+	ETHTOOL_LINK_MODE_5000baseT_Full_BIT
+)
+
+type ethtoolLinkMode struct {
+	feature uint32 // ofp_port_features
+	speed   uint32 // kbps
+}
+
+// link modes to ofp_port_features. Modes not listed here are OFPPF_OTHER.
+var ethtoolLinkModes = map[int]ethtoolLinkMode{
+	ETHTOOL_LINK_MODE_10baseT_Half_BIT:           {ofp4.OFPPF_10MB_HD, 10000},
+	ETHTOOL_LINK_MODE_10baseT_Full_BIT:           {ofp4.OFPPF_10MB_FD, 10000},
+	ETHTOOL_LINK_MODE_100baseT_Half_BIT:          {ofp4.OFPPF_100MB_HD, 100000},
+	ETHTOOL_LINK_MODE_100baseT_Full_BIT:          {ofp4.OFPPF_100MB_FD, 100000},
+	ETHTOOL_LINK_MODE_1000baseT_Half_BIT:         {ofp4.OFPPF_1GB_HD, 1000000},
+	ETHTOOL_LINK_MODE_1000baseT_Full_BIT:         {ofp4.OFPPF_1GB_FD, 1000000},
+	ETHTOOL_LINK_MODE_Autoneg_BIT:                {ofp4.OFPPF_AUTONEG, 0},
+	ETHTOOL_LINK_MODE_TP_BIT:                     {ofp4.OFPPF_COPPER, 0},
+	ETHTOOL_LINK_MODE_FIBRE_BIT:                  {ofp4.OFPPF_FIBER, 0},
+	ETHTOOL_LINK_MODE_10000baseT_Full_BIT:        {ofp4.OFPPF_10GB_FD, 10000000},
+	ETHTOOL_LINK_MODE_Pause_BIT:                  {ofp4.OFPPF_PAUSE, 0},
+	ETHTOOL_LINK_MODE_Asym_Pause_BIT:             {ofp4.OFPPF_PAUSE_ASYM, 0},
+	ETHTOOL_LINK_MODE_2500baseX_Full_BIT:         {ofp4.OFPPF_OTHER, 2500000},
+	ETHTOOL_LINK_MODE_1000baseKX_Full_BIT:        {ofp4.OFPPF_1GB_FD, 1000000},
+	ETHTOOL_LINK_MODE_10000baseKX4_Full_BIT:      {ofp4.OFPPF_10GB_FD, 10000000},
+	ETHTOOL_LINK_MODE_10000baseKR_Full_BIT:       {ofp4.OFPPF_10GB_FD, 10000000},
+	ETHTOOL_LINK_MODE_10000baseR_FEC_BIT:         {ofp4.OFPPF_10GB_FD, 10000000},
+	ETHTOOL_LINK_MODE_20000baseMLD2_Full_BIT:     {ofp4.OFPPF_OTHER, 20000000},
+	ETHTOOL_LINK_MODE_20000baseKR2_Full_BIT:      {ofp4.OFPPF_OTHER, 20000000},
+	ETHTOOL_LINK_MODE_40000baseKR4_Full_BIT:      {ofp4.OFPPF_40GB_FD, 40000000},
+	ETHTOOL_LINK_MODE_40000baseCR4_Full_BIT:      {ofp4.OFPPF_40GB_FD, 40000000},
+	ETHTOOL_LINK_MODE_40000baseSR4_Full_BIT:      {ofp4.OFPPF_40GB_FD, 40000000},
+	ETHTOOL_LINK_MODE_40000baseLR4_Full_BIT:      {ofp4.OFPPF_40GB_FD, 40000000},
+	ETHTOOL_LINK_MODE_56000baseKR4_Full_BIT:      {ofp4.OFPPF_OTHER, 56000000},
+	ETHTOOL_LINK_MODE_56000baseCR4_Full_BIT:      {ofp4.OFPPF_OTHER, 56000000},
+	ETHTOOL_LINK_MODE_56000baseSR4_Full_BIT:      {ofp4.OFPPF_OTHER, 56000000},
+	ETHTOOL_LINK_MODE_56000baseLR4_Full_BIT:      {ofp4.OFPPF_OTHER, 56000000},
+	ETHTOOL_LINK_MODE_25000baseCR_Full_BIT:       {ofp4.OFPPF_OTHER, 25000000},
+	ETHTOOL_LINK_MODE_25000baseKR_Full_BIT:       {ofp4.OFPPF_OTHER, 25000000},
+	ETHTOOL_LINK_MODE_25000baseSR_Full_BIT:       {ofp4.OFPPF_OTHER, 25000000},
+	ETHTOOL_LINK_MODE_50000baseCR2_Full_BIT:      {ofp4.OFPPF_OTHER, 50000000},
+	ETHTOOL_LINK_MODE_50000baseKR2_Full_BIT:      {ofp4.OFPPF_OTHER, 50000000},
+	ETHTOOL_LINK_MODE_100000baseKR4_Full_BIT:     {ofp4.OFPPF_100GB_FD, 100000000},
+	ETHTOOL_LINK_MODE_100000baseSR4_Full_BIT:     {ofp4.OFPPF_100GB_FD, 100000000},
+	ETHTOOL_LINK_MODE_100000baseCR4_Full_BIT:     {ofp4.OFPPF_100GB_FD, 100000000},
+	ETHTOOL_LINK_MODE_100000baseLR4_ER4_Full_BIT: {ofp4.OFPPF_100GB_FD, 100000000},
+	ETHTOOL_LINK_MODE_50000baseSR2_Full_BIT:      {ofp4.OFPPF_OTHER, 50000000},
+	ETHTOOL_LINK_MODE_1000baseX_Full_BIT:         {ofp4.OFPPF_1GB_FD, 1000000},
+	ETHTOOL_LINK_MODE_10000baseCR_Full_BIT:       {ofp4.OFPPF_10GB_FD, 10000000},
+	ETHTOOL_LINK_MODE_10000baseSR_Full_BIT:       {ofp4.OFPPF_10GB_FD, 10000000},
+	ETHTOOL_LINK_MODE_10000baseLR_Full_BIT:       {ofp4.OFPPF_10GB_FD, 10000000},
+	ETHTOOL_LINK_MODE_10000baseLRM_Full_BIT:      {ofp4.OFPPF_10GB_FD, 10000000},
+	ETHTOOL_LINK_MODE_10000baseER_Full_BIT:       {ofp4.OFPPF_10GB_FD, 10000000},
+	ETHTOOL_LINK_MODE_2500baseT_Full_BIT:         {ofp4.OFPPF_OTHER, 2500000},
+	ETHTOOL_LINK_MODE_5000baseT_Full_BIT:         {ofp4.OFPPF_OTHER, 5000000},
+}
+
+// ethtool structs are in host byte order.
+var hostEndian binary.ByteOrder = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// linkModes is a link mode bitmap of any length.
+type linkModes []uint32
+
+func (self linkModes) has(bit int) bool {
+	return bit/32 < len(self) && self[bit/32]&(1<<uint(bit%32)) != 0
+}
+
+func (self linkModes) set(bit int) {
+	if bit/32 < len(self) {
+		self[bit/32] |= 1 << uint(bit%32)
+	}
+}
+
+// features converts to ofp_port_features, and returns the max speed in kbps.
+func (self linkModes) features() (uint32, uint32) {
+	var features, speed uint32
+	for bit := 0; bit < len(self)*32; bit++ {
+		if !self.has(bit) {
+			continue
+		}
+		if mode, ok := ethtoolLinkModes[bit]; ok {
+			features |= mode.feature
+			if mode.speed > speed {
+				speed = mode.speed
+			}
+		} else if bit > ETHTOOL_LINK_MODE_5000baseT_Full_BIT {
+			features |= ofp4.OFPPF_OTHER // newer speed or fec modes
+		}
+	}
+	return features, speed
+}
+
+// ethtoolLinkSettings is struct ethtool_link_settings, with the link mode masks.
+type ethtoolLinkSettings struct {
+	speed         uint32 // Mbps
+	duplex        uint8
+	port          uint8
+	autoneg       uint8
+	supported     linkModes
+	advertising   linkModes
+	lpAdvertising linkModes
+
+	raw    []byte // keeps unknown fields for set
+	legacy bool   // ETHTOOL_GSET was used
+}
+
+// data is unsafe.Pointer, so that the buffer is kept alive and not moved during the syscall.
+type ethtoolIfreq struct {
+	name [syscall.IFNAMSIZ]byte
+	data unsafe.Pointer
+	pad  [16]byte
+}
+
+func ethtoolIoctl(name string, data []byte) error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	ifr := ethtoolIfreq{
+		data: unsafe.Pointer(&data[0]),
+	}
+	copy(ifr.name[:syscall.IFNAMSIZ-1], name)
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), SIOCETHTOOL, uintptr(unsafe.Pointer(&ifr)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// getLinkSettings uses ETHTOOL_GLINKSETTINGS, or ETHTOOL_GSET on old kernels.
+func getLinkSettings(name string) (*ethtoolLinkSettings, error) {
+	// link_mode_masks_nwords handshake, kernel returns the negative size.
+	buf := make([]byte, 48)
+	hostEndian.PutUint32(buf, ETHTOOL_GLINKSETTINGS)
+	if err := ethtoolIoctl(name, buf); err == syscall.EOPNOTSUPP {
+		return getLegacySettings(name)
+	} else if err != nil {
+		return nil, err
+	}
+	nwords := -int(int8(buf[15]))
+	if nwords <= 0 {
+		return nil, fmt.Errorf("ethtool link mode handshake failed")
+	}
+	buf = make([]byte, 48+3*4*nwords)
+	hostEndian.PutUint32(buf, ETHTOOL_GLINKSETTINGS)
+	buf[15] = uint8(nwords)
+	if err := ethtoolIoctl(name, buf); err != nil {
+		return nil, err
+	}
+	masks := func(index int) linkModes {
+		ret := make(linkModes, nwords)
+		for i := range ret {
+			ret[i] = hostEndian.Uint32(buf[48+4*(nwords*index+i):])
+		}
+		return ret
+	}
+	return &ethtoolLinkSettings{
+		speed:         hostEndian.Uint32(buf[4:]),
+		duplex:        buf[8],
+		port:          buf[9],
+		autoneg:       buf[11],
+		supported:     masks(0),
+		advertising:   masks(1),
+		lpAdvertising: masks(2),
+		raw:           buf,
+	}, nil
+}
+
+func getLegacySettings(name string) (*ethtoolLinkSettings, error) {
+	buf := make([]byte, 44)
+	hostEndian.PutUint32(buf, ETHTOOL_GSET)
+	if err := ethtoolIoctl(name, buf); err != nil {
+		return nil, err
+	}
+	speed := uint32(hostEndian.Uint16(buf[12:])) | uint32(hostEndian.Uint16(buf[28:]))<<16
+	if speed == 0xFFFF {
+		speed = ethtoolSpeedUnknown
+	}
+	return &ethtoolLinkSettings{
+		speed:         speed,
+		duplex:        buf[14],
+		port:          buf[15],
+		autoneg:       buf[18],
+		supported:     linkModes{hostEndian.Uint32(buf[4:])},
+		advertising:   linkModes{hostEndian.Uint32(buf[8:])},
+		lpAdvertising: linkModes{hostEndian.Uint32(buf[32:])},
+		raw:           buf,
+		legacy:        true,
+	}, nil
+}
+
+// setAdvertising applies the advertising link modes, with ETHTOOL_SLINKSETTINGS or ETHTOOL_SSET.
+func setAdvertising(name string, settings *ethtoolLinkSettings) error {
+	buf := settings.raw
+	if settings.legacy {
+		hostEndian.PutUint32(buf, ETHTOOL_SSET)
+		hostEndian.PutUint32(buf[8:], settings.advertising[0])
+	} else {
+		nwords := len(settings.advertising)
+		hostEndian.PutUint32(buf, ETHTOOL_SLINKSETTINGS)
+		for i, w := range settings.advertising {
+			hostEndian.PutUint32(buf[48+4*(nwords+i):], w)
+		}
+	}
+	return ethtoolIoctl(name, buf)
+}
+
+// advertise converts ofp_port_features into the link modes, within the supported modes.
+func (self *ethtoolLinkSettings) advertise(features uint32) linkModes {
+	ret := make(linkModes, len(self.advertising))
+	for bit := 0; bit < len(ret)*32; bit++ {
+		if !self.supported.has(bit) {
+			continue
+		}
+		if mode, ok := ethtoolLinkModes[bit]; ok {
+			if mode.feature&features != 0 {
+				ret.set(bit)
+			}
+		} else if features&ofp4.OFPPF_OTHER != 0 && bit > ETHTOOL_LINK_MODE_5000baseT_Full_BIT {
+			ret.set(bit)
+		}
+	}
+	return ret
+}
+
+// current returns ofp_port_features of the current link, and the speed in kbps.
+func (self *ethtoolLinkSettings) current() (uint32, uint32) {
+	var curr uint32
+	var speed uint32
+	if self.speed != ethtoolSpeedUnknown && self.speed != 0 {
+		speed = self.speed * 1000
+	}
+	switch {
+	case self.speed == 10 && self.duplex == ethtoolDuplexHalf:
+		curr = ofp4.OFPPF_10MB_HD
+	case self.speed == 10 && self.duplex == ethtoolDuplexFull:
+		curr = ofp4.OFPPF_10MB_FD
+	case self.speed == 100 && self.duplex == ethtoolDuplexHalf:
+		curr = ofp4.OFPPF_100MB_HD
+	case self.speed == 100 && self.duplex == ethtoolDuplexFull:
+		curr = ofp4.OFPPF_100MB_FD
+	case self.speed == 1000 && self.duplex == ethtoolDuplexHalf:
+		curr = ofp4.OFPPF_1GB_HD
+	case self.speed == 1000 && self.duplex == ethtoolDuplexFull:
+		curr = ofp4.OFPPF_1GB_FD
+	case self.speed == 10000 && self.duplex == ethtoolDuplexFull:
+		curr = ofp4.OFPPF_10GB_FD
+	case self.speed == 40000 && self.duplex == ethtoolDuplexFull:
+		curr = ofp4.OFPPF_40GB_FD
+	case self.speed == 100000 && self.duplex == ethtoolDuplexFull:
+		curr = ofp4.OFPPF_100GB_FD
+	case self.speed == 1000000 && self.duplex == ethtoolDuplexFull:
+		curr = ofp4.OFPPF_1TB_FD
+	default:
+		curr = ofp4.OFPPF_OTHER
+	}
+	switch self.port {
+	case ethtoolPortTp:
+		curr |= ofp4.OFPPF_COPPER
+	case ethtoolPortFibre:
+		curr |= ofp4.OFPPF_FIBER
+	case ethtoolPortDa:
+		curr |= ofp4.OFPPF_COPPER
+	}
+	if self.autoneg != ethtoolAutonegDisable {
+		curr |= ofp4.OFPPF_AUTONEG
+	}
+	return curr, speed
+}
+
+func (self *ethtoolLinkSettings) property() PortEthernetProperty {
+	var ret PortEthernetProperty
+	ret.Curr, ret.CurrSpeed = self.current()
+	ret.Supported, ret.MaxSpeed = self.supported.features()
+	ret.Advertised, _ = self.advertising.features()
+	ret.Peer, _ = self.lpAdvertising.features()
+	return ret
+}
+
+func (self NamedPort) Ethernet() (PortEthernetProperty, error) {
+	switch self.hatype {
+	case 0:
+		return PortEthernetProperty{}, nil
+	case syscall.ARPHRD_ETHER:
+		// pass
+	default:
+		return PortEthernetProperty{}, fmt.Errorf("%s not an ether", self.name)
+	}
+	if settings, err := getLinkSettings(self.name); err != nil {
+		return PortEthernetProperty{}, fmt.Errorf("ethtool for %s: %s", self.name, err.Error())
+	} else {
+		return settings.property(), nil
+	}
+}
+
+// setAdvertise applies ofp_port_features to the device advertisement.
+func (self NamedPort) setAdvertise(features uint32) error {
+	settings, err := getLinkSettings(self.name)
+	if err != nil {
+		return err
+	}
+	advertising := settings.advertise(features)
+	for _, w := range advertising {
+		if w != 0 {
+			settings.advertising = advertising
+			return setAdvertising(self.name, settings)
+		}
+	}
+	return fmt.Errorf("no supported link mode in advertise %x", features)
+}
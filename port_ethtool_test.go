@@ -0,0 +1,36 @@
+// +build linux
+
+package gopenflow
+
+import (
+	"github.com/hkwi/gopenflow/ofp4"
+	"testing"
+)
+
+func TestEthtoolLinkSettings(t *testing.T) {
+	settings := &ethtoolLinkSettings{
+		speed:         1000,
+		duplex:        ethtoolDuplexFull,
+		port:          ethtoolPortTp,
+		autoneg:       1,
+		supported:     linkModes{1<<ETHTOOL_LINK_MODE_100baseT_Full_BIT | 1<<ETHTOOL_LINK_MODE_1000baseT_Full_BIT | 1<<ETHTOOL_LINK_MODE_Autoneg_BIT | 1<<ETHTOOL_LINK_MODE_TP_BIT, 1 << (ETHTOOL_LINK_MODE_50000baseSR2_Full_BIT - 32)},
+		advertising:   linkModes{1<<ETHTOOL_LINK_MODE_1000baseT_Full_BIT | 1<<ETHTOOL_LINK_MODE_Autoneg_BIT, 0},
+		lpAdvertising: linkModes{1 << ETHTOOL_LINK_MODE_100baseT_Full_BIT, 0},
+	}
+	prop := settings.property()
+	if prop.Curr != ofp4.OFPPF_1GB_FD|ofp4.OFPPF_COPPER|ofp4.OFPPF_AUTONEG || prop.CurrSpeed != 1000000 {
+		t.Errorf("unexpected current %x %d", prop.Curr, prop.CurrSpeed)
+	}
+	if prop.Supported != ofp4.OFPPF_100MB_FD|ofp4.OFPPF_1GB_FD|ofp4.OFPPF_AUTONEG|ofp4.OFPPF_COPPER|ofp4.OFPPF_OTHER || prop.MaxSpeed != 50000000 {
+		t.Errorf("unexpected supported %x %d", prop.Supported, prop.MaxSpeed)
+	}
+	if prop.Advertised != ofp4.OFPPF_1GB_FD|ofp4.OFPPF_AUTONEG || prop.Peer != ofp4.OFPPF_100MB_FD {
+		t.Errorf("unexpected advertised %x peer %x", prop.Advertised, prop.Peer)
+	}
+
+	// unsupported modes are not advertised
+	adv := settings.advertise(ofp4.OFPPF_100MB_FD | ofp4.OFPPF_10GB_FD | ofp4.OFPPF_AUTONEG | ofp4.OFPPF_OTHER)
+	if adv[0] != 1<<ETHTOOL_LINK_MODE_100baseT_Full_BIT|1<<ETHTOOL_LINK_MODE_Autoneg_BIT || adv[1] != 1<<(ETHTOOL_LINK_MODE_50000baseSR2_Full_BIT-32) {
+		t.Errorf("unexpected advertise %x", adv)
+	}
+}
@@ -0,0 +1,408 @@
+package gopenflow
+
+import (
+	"container/heap"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// GilbertElliott is a two state loss model. P is the probability of
+// good to bad transition, R is that of bad to good, per frame.
+type GilbertElliott struct {
+	P        float64
+	R        float64
+	LossGood float64 // loss probability in good state
+	LossBad  float64 // loss probability in bad state
+}
+
+// FaultConfig describes netem-like impairments for one direction.
+// Probabilities are in 0.0 to 1.0.
+type FaultConfig struct {
+	Delay     time.Duration
+	Jitter    time.Duration // delay varies uniformly in Delay +/- Jitter
+	Loss      float64       // random loss, used if Gilbert is nil
+	Gilbert   *GilbertElliott
+	Reorder   float64 // frames sent immediately, overtaking delayed frames
+	Duplicate float64
+	Corrupt   float64 // single bit flip
+	Rate      uint64  // bits per second. 0 means unlimited.
+	Limit     int     // frames waiting in the line, excess frames are dropped. 0 means 1000, as netem.
+	Seed      int64   // random seed. 0 means time based seed.
+}
+
+const faultDefaultLimit = 1000
+
+// FaultEvent overrides the wrapped port state at the time.
+type FaultEvent struct {
+	At       time.Duration // offset from Schedule call
+	LinkDown bool
+	Live     bool
+}
+
+type faultItem struct {
+	at    time.Time
+	seq   uint64
+	frame Frame
+}
+
+type faultItems []faultItem
+
+func (self faultItems) Len() int {
+	return len(self)
+}
+
+func (self faultItems) Less(i, j int) bool {
+	if self[i].at.Equal(self[j].at) {
+		return self[i].seq < self[j].seq
+	}
+	return self[i].at.Before(self[j].at)
+}
+
+func (self faultItems) Swap(i, j int) {
+	self[i], self[j] = self[j], self[i]
+}
+
+func (self *faultItems) Push(x interface{}) {
+	*self = append(*self, x.(faultItem))
+}
+
+func (self *faultItems) Pop() interface{} {
+	old := *self
+	n := len(old)
+	x := old[n-1]
+	*self = old[:n-1]
+	return x
+}
+
+// faultLine applies impairments to the frames in one direction.
+type faultLine struct {
+	config  FaultConfig
+	deliver func(Frame)
+
+	lock    *sync.Mutex
+	cond    *sync.Cond
+	random  *rand.Rand
+	bad     bool      // gilbert-elliott state
+	next    time.Time // rate limit departure time
+	seq     uint64
+	items   faultItems
+	closed  bool
+	dropped uint64
+}
+
+func newFaultLine(config FaultConfig, deliver func(Frame), done func()) *faultLine {
+	seed := config.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	self := &faultLine{
+		config:  config,
+		deliver: deliver,
+		lock:    &sync.Mutex{},
+		random:  rand.New(rand.NewSource(seed)),
+	}
+	self.cond = sync.NewCond(self.lock)
+	go func() {
+		self.serve()
+		if done != nil {
+			done()
+		}
+	}()
+	return self
+}
+
+func (self *faultLine) lost() bool {
+	if ge := self.config.Gilbert; ge != nil {
+		if self.bad {
+			if self.random.Float64() < ge.R {
+				self.bad = false
+			}
+		} else if self.random.Float64() < ge.P {
+			self.bad = true
+		}
+		if self.bad {
+			return self.random.Float64() < ge.LossBad
+		}
+		return self.random.Float64() < ge.LossGood
+	}
+	return self.random.Float64() < self.config.Loss
+}
+
+func (self *faultLine) push(fr Frame, drop bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.closed {
+		return
+	}
+	if drop || self.lost() {
+		self.dropped++
+		return
+	}
+	if self.random.Float64() < self.config.Corrupt && len(fr.Data) > 0 {
+		data := make([]byte, len(fr.Data))
+		copy(data, fr.Data)
+		bit := self.random.Intn(len(data) * 8)
+		data[bit/8] ^= 1 << uint(bit%8)
+		fr = Frame{Data: data, Oob: fr.Oob}
+	}
+	limit := self.config.Limit
+	if limit <= 0 {
+		limit = faultDefaultLimit
+	}
+	if len(self.items) >= limit {
+		self.dropped++
+		return
+	}
+
+	now := time.Now()
+	at := now
+	if self.config.Rate > 0 {
+		if self.next.Before(now) {
+			self.next = now
+		}
+		self.next = self.next.Add(time.Duration(uint64(len(fr.Data)*8) * uint64(time.Second) / self.config.Rate))
+		at = self.next
+	}
+	if self.random.Float64() >= self.config.Reorder {
+		delay := self.config.Delay
+		if self.config.Jitter > 0 {
+			delay += time.Duration(self.random.Int63n(int64(self.config.Jitter)*2+1)) - self.config.Jitter
+		}
+		if delay > 0 {
+			at = at.Add(delay)
+		}
+	}
+	copies := 1
+	if self.random.Float64() < self.config.Duplicate {
+		copies = 2
+	}
+	for i := 0; i < copies; i++ {
+		self.seq++
+		heap.Push(&self.items, faultItem{at: at, seq: self.seq, frame: fr})
+	}
+	self.cond.Signal()
+}
+
+// close stops accepting frames. Frames in the line will be delivered.
+func (self *faultLine) close() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.closed = true
+	self.cond.Signal()
+}
+
+func (self *faultLine) serve() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for {
+		if len(self.items) == 0 {
+			if self.closed {
+				return
+			}
+			self.cond.Wait()
+			continue
+		}
+		if wait := self.items[0].at.Sub(time.Now()); wait > 0 {
+			// wake up on new frame, which may be scheduled earlier
+			timer := time.AfterFunc(wait, func() {
+				self.lock.Lock()
+				defer self.lock.Unlock()
+				self.cond.Signal()
+			})
+			self.cond.Wait()
+			timer.Stop()
+			continue
+		}
+		item := heap.Pop(&self.items).(faultItem)
+		self.lock.Unlock()
+		self.deliver(item.frame)
+		self.lock.Lock()
+	}
+}
+
+func (self *faultLine) droppedCount() uint64 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.dropped
+}
+
+// FaultPort is a Port decorator that applies impairments to Ingress and
+// Egress of the wrapped port, for testing failover and retransmission.
+//
+// Link state and OFPPS_LIVE can be overridden by SetState or Schedule,
+// which triggers Monitor notification, so that OFPGT_FF groups and
+// port_status messages can be exercised.
+type FaultPort struct {
+	Port
+	lock     *sync.Mutex
+	notifier *sync.Mutex // serializes snapshots for Monitor
+	override *FaultEvent
+	closed   bool
+	cancel   chan bool
+
+	ingress     chan Frame
+	monitor     chan PortEvent
+	ingressLine *faultLine
+	egressLine  *faultLine
+}
+
+// NewFaultPort wraps the port. Egress errors of the wrapped port are logged,
+// because frames are sent asynchronously.
+func NewFaultPort(port Port, ingress FaultConfig, egress FaultConfig) *FaultPort {
+	self := &FaultPort{
+		Port:     port,
+		lock:     &sync.Mutex{},
+		notifier: &sync.Mutex{},
+		ingress:  make(chan Frame),
+		monitor:  make(chan PortEvent, 1),
+	}
+	self.ingressLine = newFaultLine(ingress, func(fr Frame) {
+		self.ingress <- fr
+	}, func() {
+		close(self.ingress)
+	})
+	self.egressLine = newFaultLine(egress, func(fr Frame) {
+		if err := port.Egress(fr); err != nil {
+			log.Print(err)
+		}
+	}, nil)
+	go func() {
+		for fr := range port.Ingress() {
+			self.ingressLine.push(fr, self.linkDown())
+		}
+		self.ingressLine.close()
+	}()
+	go func() {
+		for ev := range port.Monitor() {
+			self.notify(ev.Kind)
+			if ev.Kind == PortDeleted {
+				break
+			}
+		}
+		self.lock.Lock()
+		defer self.lock.Unlock()
+		self.closed = true
+		close(self.monitor)
+		self.egressLine.close()
+	}()
+	return self
+}
+
+// notify is non-blocking, pending notifications are coalesced.
+func (self *FaultPort) notify(kind PortEventKind) {
+	self.notifier.Lock()
+	defer self.notifier.Unlock()
+
+	ev := MakePortEvent(kind, self)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if !self.closed {
+		offerPortEvent(self.monitor, ev)
+	}
+}
+
+func (self *FaultPort) linkDown() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.override != nil && self.override.LinkDown
+}
+
+// SetState overrides the link state and OFPPS_LIVE of the wrapped port.
+// While the link is down, frames are dropped in both directions.
+func (self *FaultPort) SetState(linkDown, live bool) {
+	self.lock.Lock()
+	self.override = &FaultEvent{
+		LinkDown: linkDown,
+		Live:     live,
+	}
+	self.lock.Unlock()
+	self.notify(PortModified)
+}
+
+// ClearState removes the override.
+func (self *FaultPort) ClearState() {
+	self.lock.Lock()
+	self.override = nil
+	self.lock.Unlock()
+	self.notify(PortModified)
+}
+
+// Schedule applies the events in order. If period is not zero, the events
+// are repeated in the period. Calling Schedule cancels the previous schedule,
+// and nil events just cancel.
+func (self *FaultPort) Schedule(events []FaultEvent, period time.Duration) {
+	cancel := make(chan bool)
+	self.lock.Lock()
+	if self.cancel != nil {
+		close(self.cancel)
+	}
+	self.cancel = cancel
+	self.lock.Unlock()
+
+	if len(events) == 0 {
+		return
+	}
+	go func() {
+		start := time.Now()
+		for {
+			for _, ev := range events {
+				select {
+				case <-time.After(start.Add(ev.At).Sub(time.Now())):
+					self.SetState(ev.LinkDown, ev.Live)
+				case <-cancel:
+					return
+				}
+			}
+			if period <= 0 {
+				return
+			}
+			start = start.Add(period)
+		}
+	}()
+}
+
+func (self *FaultPort) Monitor() <-chan PortEvent {
+	return self.monitor
+}
+
+func (self *FaultPort) Ingress() <-chan Frame {
+	return self.ingress
+}
+
+func (self *FaultPort) Egress(fr Frame) error {
+	self.egressLine.push(fr, self.linkDown())
+	return nil
+}
+
+func (self *FaultPort) State() []PortState {
+	self.lock.Lock()
+	override := self.override
+	self.lock.Unlock()
+
+	states := self.Port.State()
+	if override == nil {
+		return states
+	}
+	var ret []PortState
+	for _, s := range states {
+		switch s.(type) {
+		case PortStateLinkDown, PortStateLive:
+		default:
+			ret = append(ret, s)
+		}
+	}
+	return append(ret,
+		PortStateLinkDown(override.LinkDown),
+		PortStateLive(override.Live))
+}
+
+// Stats adds frames dropped by the impairments to the wrapped port stats.
+func (self *FaultPort) Stats() (PortStats, error) {
+	stats, err := self.Port.Stats()
+	stats.RxDropped += self.ingressLine.droppedCount()
+	stats.TxDropped += self.egressLine.droppedCount()
+	return stats, err
+}
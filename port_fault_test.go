@@ -0,0 +1,188 @@
+package gopenflow
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func faultTestPair(ingress, egress FaultConfig) (*FaultPort, *MemPort, *MemPort) {
+	a, b := NewMemPortPair("a", [6]byte{2, 0, 0, 0, 0, 1}, "b", [6]byte{2, 0, 0, 0, 0, 2})
+	return NewFaultPort(a, ingress, egress), a, b
+}
+
+func faultTestRecv(t *testing.T, ch <-chan Frame, timeout time.Duration) *Frame {
+	select {
+	case fr, ok := <-ch:
+		if ok {
+			return &fr
+		}
+		return nil
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+func TestFaultPortDelay(t *testing.T) {
+	f, a, b := faultTestPair(FaultConfig{}, FaultConfig{Delay: 50 * time.Millisecond})
+	defer a.Close()
+	defer b.Close()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		f.Egress(Frame{Data: []byte{byte(i)}})
+	}
+	for i := 0; i < 3; i++ {
+		if fr := faultTestRecv(t, b.Ingress(), time.Second); fr == nil {
+			t.Fatal("frame not delivered")
+		} else if fr.Data[0] != byte(i) {
+			t.Errorf("order not preserved %v", fr.Data)
+		}
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("delay too short %v", d)
+	}
+}
+
+func TestFaultPortLoss(t *testing.T) {
+	f, a, b := faultTestPair(FaultConfig{Loss: 1.0}, FaultConfig{
+		Gilbert: &GilbertElliott{P: 1.0, LossBad: 1.0},
+	})
+	defer a.Close()
+	defer b.Close()
+
+	for i := 0; i < 10; i++ {
+		f.Egress(Frame{Data: []byte{1}})
+		b.Egress(Frame{Data: []byte{2}})
+	}
+	if fr := faultTestRecv(t, b.Ingress(), 50*time.Millisecond); fr != nil {
+		t.Errorf("egress frame not dropped %v", fr)
+	}
+	if fr := faultTestRecv(t, f.Ingress(), 50*time.Millisecond); fr != nil {
+		t.Errorf("ingress frame not dropped %v", fr)
+	}
+	if s, _ := f.Stats(); s.RxDropped != 10 || s.TxDropped != 10 {
+		t.Errorf("unexpected stats %v", s)
+	}
+}
+
+func TestFaultPortDuplicateCorrupt(t *testing.T) {
+	f, a, b := faultTestPair(FaultConfig{Corrupt: 1.0, Seed: 1}, FaultConfig{Duplicate: 1.0})
+	defer a.Close()
+	defer b.Close()
+
+	f.Egress(Frame{Data: []byte{1, 2, 3}})
+	for i := 0; i < 2; i++ {
+		if fr := faultTestRecv(t, b.Ingress(), time.Second); fr == nil || !bytes.Equal(fr.Data, []byte{1, 2, 3}) {
+			t.Errorf("duplicate not delivered %v", fr)
+		}
+	}
+
+	data := []byte{0, 0, 0, 0}
+	b.Egress(Frame{Data: data})
+	if fr := faultTestRecv(t, f.Ingress(), time.Second); fr == nil {
+		t.Error("corrupted frame not delivered")
+	} else {
+		bits := 0
+		for _, c := range fr.Data {
+			for ; c != 0; c &= c - 1 {
+				bits++
+			}
+		}
+		if bits != 1 {
+			t.Errorf("unexpected corruption %v", fr.Data)
+		}
+	}
+}
+
+func TestFaultPortRate(t *testing.T) {
+	// 1000 bytes in 80kbps is 100ms
+	f, a, b := faultTestPair(FaultConfig{}, FaultConfig{Rate: 80000})
+	defer a.Close()
+	defer b.Close()
+
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		f.Egress(Frame{Data: make([]byte, 1000)})
+	}
+	for i := 0; i < 2; i++ {
+		if fr := faultTestRecv(t, b.Ingress(), time.Second); fr == nil {
+			t.Fatal("frame not delivered")
+		}
+	}
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Errorf("rate not limited %v", d)
+	}
+}
+
+func TestFaultPortLimit(t *testing.T) {
+	// 1000 bytes in 80kbps is 100ms, so frames stay in the line
+	f, a, b := faultTestPair(FaultConfig{}, FaultConfig{Rate: 80000, Limit: 2})
+	defer a.Close()
+	defer b.Close()
+
+	for i := 0; i < 5; i++ {
+		f.Egress(Frame{Data: make([]byte, 1000)})
+	}
+	if s, _ := f.Stats(); s.TxDropped != 3 {
+		t.Errorf("unexpected stats %v", s)
+	}
+	for i := 0; i < 2; i++ {
+		if fr := faultTestRecv(t, b.Ingress(), time.Second); fr == nil {
+			t.Fatal("frame not delivered")
+		}
+	}
+	if fr := faultTestRecv(t, b.Ingress(), 300*time.Millisecond); fr != nil {
+		t.Errorf("frame over the limit delivered %v", fr)
+	}
+}
+
+func TestFaultPortSchedule(t *testing.T) {
+	f, a, b := faultTestPair(FaultConfig{}, FaultConfig{})
+	defer a.Close()
+	defer b.Close()
+
+	live := func() bool {
+		for _, s := range f.State() {
+			if l, ok := s.(PortStateLive); ok {
+				return bool(l)
+			}
+		}
+		return false
+	}
+	f.Schedule([]FaultEvent{
+		{At: 10 * time.Millisecond, LinkDown: true, Live: false},
+		{At: 60 * time.Millisecond, LinkDown: false, Live: true},
+	}, 0)
+
+	select {
+	case <-f.Monitor():
+	case <-time.After(time.Second):
+		t.Fatal("no monitor notification")
+	}
+	if live() {
+		t.Error("port should not be live")
+	}
+	f.Egress(Frame{Data: []byte{1}})
+	if fr := faultTestRecv(t, b.Ingress(), 20*time.Millisecond); fr != nil {
+		t.Error("frame delivered in link down")
+	}
+
+	select {
+	case <-f.Monitor():
+	case <-time.After(time.Second):
+		t.Fatal("no monitor notification")
+	}
+	if !live() {
+		t.Error("port should be live")
+	}
+	f.ClearState()
+
+	a.Close()
+	if _, ok := <-f.Monitor(); ok {
+		<-f.Monitor() // coalesced notification may remain
+	}
+	if fr := faultTestRecv(t, f.Ingress(), time.Second); fr != nil {
+		t.Errorf("unexpected frame %v", fr)
+	}
+}
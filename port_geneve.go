@@ -0,0 +1,243 @@
+package gopenflow
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/hkwi/gopenflow/oxm"
+	"net"
+	"sync"
+)
+
+const geneveDefaultPort = 6081
+
+// GeneveTlv maps a geneve option to NXM_NX_TUN_METADATA<Index>.
+type GeneveTlv struct {
+	Class uint16
+	Type  uint8
+	Index uint8 // 0-63
+}
+
+// GeneveConfig is the configuration for GenevePort.
+type GeneveConfig struct {
+	Local      net.IP // underlay local address. nil means any address.
+	Port       int    // local udp port. 0 means 6081.
+	Remote     net.IP // used when NXM_NX_TUN_IPV4_DST or NXM_NX_TUN_IPV6_DST is not set.
+	RemotePort int    // remote udp port. 0 means the same as Port.
+	Vni        uint32 // fixed VNI, used if FlowVni is false.
+	FlowVni    bool   // VNI is taken from tunnel_id.
+	Mtu        int    // 0 means 1450.
+	HwAddr     [6]byte
+	Tlvs       []GeneveTlv
+}
+
+// GenevePort is a Port that carries frames over Geneve (RFC 8926) in userspace.
+//
+// Tunnel metadata is the same as VxlanPort. In addition, geneve options
+// registered in Tlvs are exposed as NXM_NX_TUN_METADATA fields. Frames with
+// unknown critical options are dropped on ingress.
+type GenevePort struct {
+	softPort
+	config GeneveConfig
+	conn   *net.UDPConn
+	done   chan bool
+	closer sync.Once
+}
+
+// NewGenevePort opens the underlay udp socket and starts receiving.
+func NewGenevePort(name string, config GeneveConfig) (*GenevePort, error) {
+	if config.Port == 0 {
+		config.Port = geneveDefaultPort
+	}
+	if config.Mtu == 0 {
+		config.Mtu = 1450
+	}
+	if config.Vni > 0xFFFFFF {
+		return nil, fmt.Errorf("vni out of range %d", config.Vni)
+	}
+	for _, tlv := range config.Tlvs {
+		if tlv.Index > 63 {
+			return nil, fmt.Errorf("tun_metadata index out of range %d", tlv.Index)
+		}
+	}
+	network := "udp"
+	if config.Local != nil {
+		if config.Local.To4() != nil {
+			network = "udp4"
+		} else {
+			network = "udp6"
+		}
+	}
+	conn, err := net.ListenUDP(network, &net.UDPAddr{
+		IP:   config.Local,
+		Port: config.Port,
+	})
+	if err != nil {
+		return nil, err
+	}
+	self := &GenevePort{
+		softPort: makeSoftPort(name, config.HwAddr, config.Mtu),
+		config:   config,
+		conn:     conn,
+		done:     make(chan bool),
+	}
+	go self.serve()
+	return self, nil
+}
+
+func (self *GenevePort) serve() {
+	defer close(self.ingress)
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := self.conn.ReadFromUDP(buf)
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				continue
+			}
+			return
+		}
+		if fr, err := self.decap(buf[:n], addr.IP); err != nil {
+			self.count(func(s *PortStats) { s.RxErrors++ })
+		} else if fr == nil {
+			self.count(func(s *PortStats) { s.RxDropped++ })
+		} else {
+			self.count(func(s *PortStats) {
+				s.RxPackets++
+				s.RxBytes += uint64(len(fr.Data))
+			})
+			select {
+			case self.ingress <- *fr:
+			case <-self.done:
+				return
+			}
+		}
+	}
+}
+
+// decap returns nil Frame if the frame should be dropped.
+func (self *GenevePort) decap(msg []byte, src net.IP) (*Frame, error) {
+	if len(msg) < 8 {
+		return nil, fmt.Errorf("too short geneve header")
+	}
+	if msg[0]>>6 != 0 {
+		return nil, fmt.Errorf("unsupported geneve version %d", msg[0]>>6)
+	}
+	hdrLen := 8 + int(msg[0]&0x3F)*4
+	if len(msg) < hdrLen+14 {
+		return nil, fmt.Errorf("too short geneve frame")
+	}
+	if binary.BigEndian.Uint16(msg[2:]) != 0x6558 {
+		return nil, nil
+	}
+	vni := uint32(msg[4])<<16 | uint32(msg[5])<<8 | uint32(msg[6])
+	if !self.config.FlowVni && vni != self.config.Vni {
+		return nil, nil
+	}
+	oob := makeTunnelOob(uint64(vni), src)
+	for opts := msg[8:hdrLen]; len(opts) > 0; {
+		if len(opts) < 4 {
+			return nil, fmt.Errorf("broken geneve option")
+		}
+		class := binary.BigEndian.Uint16(opts)
+		optType := opts[2]
+		optLen := 4 + int(opts[3]&0x1F)*4
+		if len(opts) < optLen {
+			return nil, fmt.Errorf("broken geneve option")
+		}
+		found := false
+		for _, tlv := range self.config.Tlvs {
+			if tlv.Class == class && tlv.Type == optType {
+				oob = append(oob, nxm_bytes(oxm.NXM_NX_TUN_METADATA0+uint32(tlv.Index)<<oxm.OXM_FIELD_SHIFT, opts[4:optLen])...)
+				found = true
+				break
+			}
+		}
+		if !found && optType&0x80 != 0 {
+			return nil, nil // unknown critical option
+		}
+		opts = opts[optLen:]
+	}
+	fr := &Frame{
+		Data: make([]byte, len(msg)-hdrLen),
+		Oob:  oob,
+	}
+	copy(fr.Data, msg[hdrLen:])
+	return fr, nil
+}
+
+func (self *GenevePort) Egress(fr Frame) error {
+	tun := parseTunnelOob(fr.Oob)
+	dst := tun.dst
+	vni := self.config.Vni
+	if self.config.FlowVni && tun.hasTunnelId {
+		vni = uint32(tun.tunnelId) & 0xFFFFFF
+	}
+	if dst == nil {
+		dst = self.config.Remote
+	}
+	if dst == nil {
+		self.count(func(s *PortStats) { s.TxDropped++ })
+		return fmt.Errorf("geneve remote not specified")
+	}
+	port := self.config.RemotePort
+	if port == 0 {
+		port = self.config.Port
+	}
+
+	var opts []byte
+	for _, tlv := range self.config.Tlvs {
+		if value, ok := tun.metadata[int(tlv.Index)]; ok {
+			optLen := (len(value) + 3) / 4
+			if optLen > 0x1F {
+				self.count(func(s *PortStats) { s.TxErrors++ })
+				return fmt.Errorf("geneve option too long")
+			}
+			opt := make([]byte, 4+optLen*4)
+			binary.BigEndian.PutUint16(opt, tlv.Class)
+			opt[2] = tlv.Type
+			opt[3] = uint8(optLen)
+			copy(opt[4:], value)
+			opts = append(opts, opt...)
+		}
+	}
+	if len(opts) > 0x3F*4 {
+		self.count(func(s *PortStats) { s.TxErrors++ })
+		return fmt.Errorf("geneve options too long")
+	}
+
+	geneve := make([]byte, 8+len(opts)+len(fr.Data))
+	geneve[0] = uint8(len(opts) / 4)
+	binary.BigEndian.PutUint16(geneve[2:], 0x6558) // transparent ethernet bridging
+	geneve[4] = uint8(vni >> 16)
+	geneve[5] = uint8(vni >> 8)
+	geneve[6] = uint8(vni)
+	copy(geneve[8:], opts)
+	copy(geneve[8+len(opts):], fr.Data)
+	if n, err := self.conn.WriteToUDP(geneve, &net.UDPAddr{
+		IP:   dst,
+		Port: port,
+	}); err != nil {
+		self.count(func(s *PortStats) { s.TxErrors++ })
+		return err
+	} else if n < len(geneve) {
+		self.count(func(s *PortStats) { s.TxErrors++ })
+		return fmt.Errorf("write not complete")
+	}
+	self.count(func(s *PortStats) {
+		s.TxPackets++
+		s.TxBytes += uint64(len(fr.Data))
+	})
+	return nil
+}
+
+// Close closes the underlay socket. Datapath will remove this port.
+// Calling Close more than once is safe.
+func (self *GenevePort) Close() error {
+	var err error
+	self.closer.Do(func() {
+		close(self.done)
+		err = self.conn.Close()
+		self.closeMonitor()
+	})
+	return err
+}
@@ -0,0 +1,80 @@
+package gopenflow
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/hkwi/gopenflow/oxm"
+	"net"
+	"testing"
+)
+
+func TestGeneveLoopback(t *testing.T) {
+	local := net.ParseIP("127.0.0.1").To4()
+	a, err := NewGenevePort("gna", GeneveConfig{
+		Local:      local,
+		Port:       16081,
+		RemotePort: 16082,
+		FlowVni:    true,
+		Tlvs: []GeneveTlv{
+			{Class: 0x0102, Type: 0x80, Index: 0},
+			{Class: 0x0103, Type: 0x81, Index: 1},
+		},
+	})
+	if err != nil {
+		t.Skip(err)
+	}
+	defer a.Close()
+	b, err := NewGenevePort("gnb", GeneveConfig{
+		Local:      local,
+		Port:       16082,
+		Remote:     local,
+		RemotePort: 16081,
+		Vni:        5,
+		Tlvs: []GeneveTlv{
+			{Class: 0x0102, Type: 0x80, Index: 0},
+		},
+	})
+	if err != nil {
+		t.Skip(err)
+	}
+	defer b.Close()
+
+	eth := []byte{2, 0, 0, 0, 0, 1, 2, 0, 0, 0, 0, 2, 0x08, 0x00, 0xaa, 0xbb}
+	meta0 := nxm_bytes(oxm.NXM_NX_TUN_METADATA0, []byte{1, 2, 3, 4})
+	meta1 := nxm_bytes(oxm.NXM_NX_TUN_METADATA1, []byte{5, 6, 7, 8, 9, 10, 11, 12})
+
+	// option to tun_metadata
+	if err := b.Egress(Frame{Data: eth, Oob: meta0}); err != nil {
+		t.Fatal(err)
+	}
+	fr := tunnelTestRecv(t, a)
+	if !bytes.Equal(fr.Data, eth) {
+		t.Errorf("data mismatch %v", fr.Data)
+	}
+	if id := tunnelTestOob(fr, oxm.OXM_OF_TUNNEL_ID); binary.BigEndian.Uint64(id) != 5 {
+		t.Errorf("tunnel id %v", id)
+	}
+	if m := tunnelTestOob(fr, oxm.NXM_NX_TUN_METADATA0); !bytes.Equal(m, []byte{1, 2, 3, 4}) {
+		t.Errorf("tun_metadata0 %v", m)
+	}
+
+	// unknown critical option is dropped
+	for _, oob := range [][]byte{
+		append(append(tunnelTestTunnelId(5), meta0...), meta1...),
+		append(tunnelTestTunnelId(5), meta0...),
+	} {
+		if err := a.Egress(Frame{Data: eth, Oob: append(oob, nxm_bytes(oxm.NXM_NX_TUN_IPV4_DST, local)...)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fr = tunnelTestRecv(t, b)
+	if m := tunnelTestOob(fr, oxm.NXM_NX_TUN_METADATA0); !bytes.Equal(m, []byte{1, 2, 3, 4}) {
+		t.Errorf("tun_metadata0 %v", m)
+	}
+	if m := tunnelTestOob(fr, oxm.NXM_NX_TUN_METADATA1); m != nil {
+		t.Errorf("unexpected tun_metadata1 %v", m)
+	}
+	if stats, _ := b.Stats(); stats.RxDropped != 1 || stats.RxPackets != 1 {
+		t.Errorf("unexpected stats %v", stats)
+	}
+}
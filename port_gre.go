@@ -0,0 +1,190 @@
+package gopenflow
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+)
+
+const (
+	greFlagChecksum = 0x8000
+	greFlagKey      = 0x2000
+	greFlagSequence = 0x1000
+)
+
+// GreConfig is the configuration for GrePort.
+type GreConfig struct {
+	Local   net.IP // underlay local address, which decides ipv4 or ipv6 underlay.
+	Remote  net.IP // used when NXM_NX_TUN_IPV4_DST or NXM_NX_TUN_IPV6_DST is not set.
+	Key     uint32 // fixed key, used if FlowKey is false. 0 means no key.
+	FlowKey bool   // key is taken from tunnel_id.
+	Mtu     int    // 0 means 1458.
+	HwAddr  [6]byte
+}
+
+// GrePort is a Port that carries frames over GRE (RFC 2890) on a raw ip socket.
+// Ethernet frames are carried as transparent ethernet bridging (0x6558).
+//
+// Tunnel metadata is the same as VxlanPort, and the GRE key is reported in
+// OXM_OF_TUNNEL_ID. With fixed key, frames with other key are dropped on ingress.
+type GrePort struct {
+	softPort
+	config GreConfig
+	conn   *net.IPConn
+	done   chan bool
+	closer sync.Once
+}
+
+// NewGrePort opens the raw ip socket, which requires CAP_NET_RAW.
+func NewGrePort(name string, config GreConfig) (*GrePort, error) {
+	if config.Local == nil {
+		return nil, fmt.Errorf("gre local address required")
+	}
+	if config.Mtu == 0 {
+		config.Mtu = 1458
+	}
+	network := "ip4:gre"
+	if config.Local.To4() == nil {
+		network = "ip6:gre"
+	}
+	conn, err := net.ListenIP(network, &net.IPAddr{
+		IP: config.Local,
+	})
+	if err != nil {
+		return nil, err
+	}
+	self := &GrePort{
+		softPort: makeSoftPort(name, config.HwAddr, config.Mtu),
+		config:   config,
+		conn:     conn,
+		done:     make(chan bool),
+	}
+	go self.serve()
+	return self, nil
+}
+
+func (self *GrePort) serve() {
+	defer close(self.ingress)
+
+	buf := make([]byte, 64*1024)
+	for {
+		// ip header is stripped by net package.
+		n, addr, err := self.conn.ReadFromIP(buf)
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				continue
+			}
+			return
+		}
+		if fr, err := self.decap(buf[:n], addr.IP); err != nil {
+			self.count(func(s *PortStats) { s.RxErrors++ })
+		} else if fr == nil {
+			self.count(func(s *PortStats) { s.RxDropped++ })
+		} else {
+			self.count(func(s *PortStats) {
+				s.RxPackets++
+				s.RxBytes += uint64(len(fr.Data))
+			})
+			select {
+			case self.ingress <- *fr:
+			case <-self.done:
+				return
+			}
+		}
+	}
+}
+
+// decap returns nil Frame if the frame should be dropped.
+func (self *GrePort) decap(msg []byte, src net.IP) (*Frame, error) {
+	if len(msg) < 4 {
+		return nil, fmt.Errorf("too short gre header")
+	}
+	flags := binary.BigEndian.Uint16(msg)
+	if flags&0x7 != 0 {
+		return nil, fmt.Errorf("unsupported gre version %d", flags&0x7)
+	}
+	if binary.BigEndian.Uint16(msg[2:]) != 0x6558 {
+		return nil, nil
+	}
+	hdrLen := 4
+	if flags&greFlagChecksum != 0 {
+		hdrLen += 4
+	}
+	var key uint32
+	if flags&greFlagKey != 0 {
+		if len(msg) < hdrLen+4 {
+			return nil, fmt.Errorf("too short gre header")
+		}
+		key = binary.BigEndian.Uint32(msg[hdrLen:])
+		hdrLen += 4
+	}
+	if flags&greFlagSequence != 0 {
+		hdrLen += 4
+	}
+	if len(msg) < hdrLen+14 {
+		return nil, fmt.Errorf("too short gre frame")
+	}
+	if !self.config.FlowKey && key != self.config.Key {
+		return nil, nil
+	}
+	fr := &Frame{
+		Data: make([]byte, len(msg)-hdrLen),
+		Oob:  makeTunnelOob(uint64(key), src),
+	}
+	copy(fr.Data, msg[hdrLen:])
+	return fr, nil
+}
+
+func (self *GrePort) Egress(fr Frame) error {
+	tun := parseTunnelOob(fr.Oob)
+	dst := tun.dst
+	key := self.config.Key
+	if self.config.FlowKey && tun.hasTunnelId {
+		key = uint32(tun.tunnelId)
+	}
+	if dst == nil {
+		dst = self.config.Remote
+	}
+	if dst == nil {
+		self.count(func(s *PortStats) { s.TxDropped++ })
+		return fmt.Errorf("gre remote not specified")
+	}
+
+	var gre []byte
+	if key != 0 || self.config.FlowKey {
+		gre = make([]byte, 8+len(fr.Data))
+		binary.BigEndian.PutUint16(gre, greFlagKey)
+		binary.BigEndian.PutUint32(gre[4:], key)
+	} else {
+		gre = make([]byte, 4+len(fr.Data))
+	}
+	binary.BigEndian.PutUint16(gre[2:], 0x6558) // transparent ethernet bridging
+	copy(gre[len(gre)-len(fr.Data):], fr.Data)
+	if n, err := self.conn.WriteToIP(gre, &net.IPAddr{
+		IP: dst,
+	}); err != nil {
+		self.count(func(s *PortStats) { s.TxErrors++ })
+		return err
+	} else if n < len(gre) {
+		self.count(func(s *PortStats) { s.TxErrors++ })
+		return fmt.Errorf("write not complete")
+	}
+	self.count(func(s *PortStats) {
+		s.TxPackets++
+		s.TxBytes += uint64(len(fr.Data))
+	})
+	return nil
+}
+
+// Close closes the raw socket. Datapath will remove this port.
+// Calling Close more than once is safe.
+func (self *GrePort) Close() error {
+	var err error
+	self.closer.Do(func() {
+		close(self.done)
+		err = self.conn.Close()
+		self.closeMonitor()
+	})
+	return err
+}
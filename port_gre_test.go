@@ -0,0 +1,63 @@
+package gopenflow
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/hkwi/gopenflow/oxm"
+	"net"
+	"testing"
+)
+
+func TestGreLoopback(t *testing.T) {
+	localA := net.ParseIP("127.0.0.1").To4()
+	localB := net.ParseIP("127.0.0.2").To4()
+	a, err := NewGrePort("grea", GreConfig{
+		Local:   localA,
+		FlowKey: true,
+	})
+	if err != nil {
+		t.Skip(err)
+	}
+	defer a.Close()
+	b, err := NewGrePort("greb", GreConfig{
+		Local:  localB,
+		Remote: localA,
+		Key:    9,
+	})
+	if err != nil {
+		t.Skip(err)
+	}
+	defer b.Close()
+
+	eth := []byte{2, 0, 0, 0, 0, 1, 2, 0, 0, 0, 0, 2, 0x08, 0x00, 0xaa, 0xbb}
+
+	// default remote with fixed key
+	if err := b.Egress(Frame{Data: eth}); err != nil {
+		t.Fatal(err)
+	}
+	fr := tunnelTestRecv(t, a)
+	if !bytes.Equal(fr.Data, eth) {
+		t.Errorf("data mismatch %v", fr.Data)
+	}
+	if id := tunnelTestOob(fr, oxm.OXM_OF_TUNNEL_ID); binary.BigEndian.Uint64(id) != 9 {
+		t.Errorf("tunnel id %v", id)
+	}
+	if src := tunnelTestOob(fr, oxm.NXM_NX_TUN_IPV4_SRC); !net.IP(src).Equal(localB) {
+		t.Errorf("tunnel src %v", src)
+	}
+
+	// fixed key port drops other key
+	for _, key := range []uint64{7, 9} {
+		oob := append(tunnelTestTunnelId(key), nxm_bytes(oxm.NXM_NX_TUN_IPV4_DST, localB)...)
+		if err := a.Egress(Frame{Data: eth, Oob: oob}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fr = tunnelTestRecv(t, b)
+	if !bytes.Equal(fr.Data, eth) {
+		t.Errorf("data mismatch %v", fr.Data)
+	}
+	if stats, _ := b.Stats(); stats.RxDropped != 1 || stats.RxPackets != 1 {
+		t.Errorf("unexpected stats %v", stats)
+	}
+}
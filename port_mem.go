@@ -0,0 +1,309 @@
+package gopenflow
+
+import (
+	"fmt"
+	"github.com/hkwi/gopenflow/ofp4"
+	"sync"
+)
+
+const memPortQueueLen = 1024
+
+// MemPort is an in-memory Port, intended for tests and embedding.
+//
+// Frames passed to Inject appear on Ingress. Frames sent to Egress are
+// delivered to the peer's Ingress if connected by NewMemPortPair, otherwise
+// they appear on Output. Frames are dropped when the receiving queue is full,
+// as a real nic does.
+//
+// Like veth, setting PortConfigPortDown on one side makes the link of both
+// sides down.
+type MemPort struct {
+	name   string
+	hwAddr [6]byte
+
+	lock     *sync.Mutex
+	notifier *sync.Mutex // serializes snapshots for Monitor
+	mtu      uint32
+	config   []PortConfig
+	linkDown bool
+	blocked  bool
+	ethernet PortEthernetProperty
+	stats    PortStats
+	peer     *MemPort
+	closed   bool
+
+	ingress chan Frame
+	output  chan Frame
+	monitor chan PortEvent
+}
+
+// NewMemPort creates an unconnected MemPort.
+func NewMemPort(name string, hwAddr [6]byte) *MemPort {
+	return &MemPort{
+		name:     name,
+		hwAddr:   hwAddr,
+		lock:     &sync.Mutex{},
+		notifier: &sync.Mutex{},
+		mtu:      1500,
+		ethernet: PortEthernetProperty{
+			Curr:      ofp4.OFPPF_10GB_FD | ofp4.OFPPF_COPPER,
+			Supported: ofp4.OFPPF_10GB_FD | ofp4.OFPPF_COPPER,
+			CurrSpeed: 10000000,
+			MaxSpeed:  10000000,
+		},
+		ingress: make(chan Frame, memPortQueueLen),
+		output:  make(chan Frame, memPortQueueLen),
+		monitor: make(chan PortEvent, 1),
+	}
+}
+
+// NewMemPortPair creates a connected pair, where egress of one side is ingress of the other.
+func NewMemPortPair(nameA string, hwAddrA [6]byte, nameB string, hwAddrB [6]byte) (*MemPort, *MemPort) {
+	a := NewMemPort(nameA, hwAddrA)
+	b := NewMemPort(nameB, hwAddrB)
+	a.peer = b
+	b.peer = a
+	return a, b
+}
+
+func copyFrame(fr Frame) Frame {
+	ret := Frame{
+		Data: make([]byte, len(fr.Data)),
+	}
+	copy(ret.Data, fr.Data)
+	if len(fr.Oob) > 0 {
+		ret.Oob = make([]byte, len(fr.Oob))
+		copy(ret.Oob, fr.Oob)
+	}
+	return ret
+}
+
+// notify is non-blocking, pending notifications are coalesced.
+func (self *MemPort) notify() {
+	self.notifier.Lock()
+	defer self.notifier.Unlock()
+
+	ev := makePortEvent(PortModified, self)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if !self.closed {
+		offerPortEvent(self.monitor, ev)
+	}
+}
+
+// call this inside lock
+func (self *MemPort) portDown() bool {
+	for _, c := range self.config {
+		if down, ok := c.(PortConfigPortDown); ok && bool(down) {
+			return true
+		}
+	}
+	return false
+}
+
+// receive puts the frame into ingress queue.
+func (self *MemPort) receive(fr Frame) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.closed {
+		return fmt.Errorf("port closed")
+	}
+	select {
+	case self.ingress <- copyFrame(fr):
+		self.stats.RxPackets++
+		self.stats.RxBytes += uint64(len(fr.Data))
+		return nil
+	default:
+		self.stats.RxDropped++
+		return fmt.Errorf("ingress queue full")
+	}
+}
+
+// Inject feeds the frame as if it were received from the wire.
+func (self *MemPort) Inject(fr Frame) error {
+	return self.receive(fr)
+}
+
+// Output returns frames sent out to the port, if the port is not connected.
+func (self *MemPort) Output() <-chan Frame {
+	return self.output
+}
+
+// SetLinkDown changes the link state, as if the cable was pulled.
+func (self *MemPort) SetLinkDown(down bool) {
+	self.lock.Lock()
+	self.linkDown = down
+	peer := self.peer
+	self.lock.Unlock()
+
+	self.notify()
+	if peer != nil {
+		peer.notify()
+	}
+}
+
+// SetBlocked changes OFPPS_BLOCKED state, as if by a spanning tree protocol.
+func (self *MemPort) SetBlocked(blocked bool) {
+	self.lock.Lock()
+	self.blocked = blocked
+	self.lock.Unlock()
+	self.notify()
+}
+
+func (self *MemPort) SetMtu(mtu uint32) {
+	self.lock.Lock()
+	self.mtu = mtu
+	self.lock.Unlock()
+	self.notify()
+}
+
+func (self *MemPort) SetEthernet(ethernet PortEthernetProperty) {
+	self.lock.Lock()
+	self.ethernet = ethernet
+	self.lock.Unlock()
+	self.notify()
+}
+
+// SetStats overwrites the counters.
+func (self *MemPort) SetStats(stats PortStats) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.stats = stats
+}
+
+func (self *MemPort) Name() string {
+	return self.name
+}
+
+func (self *MemPort) HwAddr() [6]byte {
+	return self.hwAddr
+}
+
+func (self *MemPort) PhysicalPort() uint32 {
+	return 0
+}
+
+func (self *MemPort) Monitor() <-chan PortEvent {
+	return self.monitor
+}
+
+func (self *MemPort) Ingress() <-chan Frame {
+	return self.ingress
+}
+
+func (self *MemPort) Egress(fr Frame) error {
+	linkDown := bool(self.State()[0].(PortStateLinkDown))
+
+	self.lock.Lock()
+	if self.closed {
+		self.lock.Unlock()
+		return fmt.Errorf("port closed")
+	}
+	if linkDown {
+		self.stats.TxDropped++
+		self.lock.Unlock()
+		return nil
+	}
+	self.stats.TxPackets++
+	self.stats.TxBytes += uint64(len(fr.Data))
+	peer := self.peer
+	self.lock.Unlock()
+
+	if peer != nil {
+		peer.receive(fr) // drop will be counted by the peer
+		return nil
+	}
+	select {
+	case self.output <- copyFrame(fr):
+	default:
+		self.lock.Lock()
+		self.stats.TxDropped++
+		self.lock.Unlock()
+	}
+	return nil
+}
+
+func (self *MemPort) GetConfig() []PortConfig {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.config
+}
+
+func (self *MemPort) SetConfig(mods []PortConfig) error {
+	self.lock.Lock()
+	self.config = mods
+	peer := self.peer
+	self.lock.Unlock()
+
+	self.notify()
+	if peer != nil {
+		peer.notify()
+	}
+	return nil
+}
+
+func (self *MemPort) State() []PortState {
+	self.lock.Lock()
+	linkDown := self.linkDown || self.portDown()
+	blocked := self.blocked
+	peer := self.peer
+	self.lock.Unlock()
+
+	if peer != nil {
+		peer.lock.Lock()
+		linkDown = linkDown || peer.linkDown || peer.portDown() || peer.closed
+		peer.lock.Unlock()
+	}
+	return []PortState{
+		PortStateLinkDown(linkDown),
+		PortStateBlocked(blocked),
+		PortStateLive(!linkDown && !blocked),
+	}
+}
+
+func (self *MemPort) Mtu() uint32 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.mtu
+}
+
+func (self *MemPort) Ethernet() (PortEthernetProperty, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.ethernet, nil
+}
+
+func (self *MemPort) Stats() (PortStats, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.stats, nil
+}
+
+func (self *MemPort) Vendor(interface{}) interface{} {
+	return nil
+}
+
+// Close removes the port. Datapath will remove this port, and the link of the peer goes down.
+func (self *MemPort) Close() error {
+	self.notifier.Lock()
+	defer self.notifier.Unlock()
+
+	ev := makePortEvent(PortDeleted, self)
+	self.lock.Lock()
+	if self.closed {
+		self.lock.Unlock()
+		return fmt.Errorf("port closed")
+	}
+	self.closed = true
+	close(self.ingress)
+	offerPortEvent(self.monitor, ev)
+	close(self.monitor)
+	peer := self.peer
+	self.lock.Unlock()
+
+	if peer != nil {
+		peer.notify()
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package gopenflow
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMemPortPair(t *testing.T) {
+	a, b := NewMemPortPair("a", [6]byte{2, 0, 0, 0, 0, 1}, "b", [6]byte{2, 0, 0, 0, 0, 2})
+	defer a.Close()
+	defer b.Close()
+
+	data := []byte{1, 2, 3}
+	if err := a.Egress(Frame{Data: data, Oob: []byte{4}}); err != nil {
+		t.Fatal(err)
+	}
+	data[0] = 0 // must be copied
+	if fr := <-b.Ingress(); !bytes.Equal(fr.Data, []byte{1, 2, 3}) || !bytes.Equal(fr.Oob, []byte{4}) {
+		t.Errorf("unexpected frame %v", fr)
+	}
+	if s, _ := a.Stats(); s.TxPackets != 1 || s.TxBytes != 3 {
+		t.Errorf("unexpected stats %v", s)
+	}
+	if s, _ := b.Stats(); s.RxPackets != 1 || s.RxBytes != 3 {
+		t.Errorf("unexpected stats %v", s)
+	}
+
+	// port down on one side makes both links down
+	b.SetConfig([]PortConfig{PortConfigPortDown(true)})
+	<-a.Monitor()
+	if !a.State()[0].(PortStateLinkDown) {
+		t.Error("peer link should be down")
+	}
+	a.Egress(Frame{Data: data})
+	if s, _ := a.Stats(); s.TxDropped != 1 {
+		t.Errorf("unexpected stats %v", s)
+	}
+	b.SetConfig(nil)
+	if a.State()[0].(PortStateLinkDown) {
+		t.Error("peer link should be up")
+	}
+}
+
+func TestMemPortInject(t *testing.T) {
+	p := NewMemPort("p", [6]byte{2, 0, 0, 0, 0, 1})
+	if err := p.Inject(Frame{Data: []byte{1}}); err != nil {
+		t.Fatal(err)
+	}
+	if fr := <-p.Ingress(); !bytes.Equal(fr.Data, []byte{1}) {
+		t.Errorf("unexpected frame %v", fr)
+	}
+	p.Egress(Frame{Data: []byte{2}})
+	if fr := <-p.Output(); !bytes.Equal(fr.Data, []byte{2}) {
+		t.Errorf("unexpected frame %v", fr)
+	}
+	p.SetLinkDown(true)
+	if !bool(p.State()[0].(PortStateLinkDown)) || bool(p.State()[2].(PortStateLive)) {
+		t.Error("link state not changed")
+	}
+	p.Close()
+	if _, ok := <-p.Ingress(); ok {
+		t.Error("ingress should be closed")
+	}
+	if err := p.Inject(Frame{Data: []byte{1}}); err == nil {
+		t.Error("inject after close should fail")
+	}
+}
+
+func TestMemPortEvent(t *testing.T) {
+	p := NewMemPort("p", [6]byte{2, 0, 0, 0, 0, 1})
+	p.SetBlocked(true)
+	p.SetLinkDown(true) // coalesced with the previous
+	if ev := <-p.Monitor(); ev.Kind != PortModified || ev.Name != "p" || ev.HwAddr != p.HwAddr() {
+		t.Errorf("unexpected event %v", ev)
+	} else if !bool(ev.State[0].(PortStateLinkDown)) || !bool(ev.State[1].(PortStateBlocked)) {
+		t.Errorf("event must carry the latest state %v", ev.State)
+	}
+	p.Close()
+	if ev := <-p.Monitor(); ev.Kind != PortDeleted {
+		t.Errorf("unexpected event %v", ev)
+	}
+	if _, ok := <-p.Monitor(); ok {
+		t.Error("monitor should be closed")
+	}
+}
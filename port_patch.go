@@ -0,0 +1,27 @@
+package gopenflow
+
+import (
+	"crypto/rand"
+)
+
+// PatchPort interconnects two datapaths in one process, like ovs patch port.
+//
+// Frames are handed to the peer in memory, and Frame.Oob is kept as is,
+// so that tunnel metadata survives across datapaths. Pipeline fields such as
+// in_port or metadata are decided by the receiving datapath.
+type PatchPort struct {
+	*MemPort
+}
+
+func patchHwAddr() [6]byte {
+	var mac [6]byte
+	rand.Read(mac[:])
+	mac[0] = mac[0]&^0x01 | 0x02 // locally administered unicast
+	return mac
+}
+
+// NewPatchPortPair creates a pair of patch ports, each of which should be added to a datapath.
+func NewPatchPortPair(nameA, nameB string) (*PatchPort, *PatchPort) {
+	a, b := NewMemPortPair(nameA, patchHwAddr(), nameB, patchHwAddr())
+	return &PatchPort{a}, &PatchPort{b}
+}
@@ -0,0 +1,236 @@
+package gopenflow
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// PcapConfig is the configuration for PcapPort.
+type PcapConfig struct {
+	Input  string // pcap or pcapng file to be replayed on ingress. empty means no ingress.
+	Output string // pcapng file to capture egress. empty means egress frames are discarded.
+	Timing bool   // keep the packet intervals of Input.
+	Loop   bool   // replay Input repeatedly.
+	Mtu    int    // 0 means 1500.
+	HwAddr [6]byte
+}
+
+// PcapPort is a Port backed by files, for replay and capture without privileges.
+//
+// Ingress replays ethernet frames from Input, and will be closed at the end of
+// the file unless Loop is set, or if the file has no frames. Egress frames are written to Output in pcapng,
+// with the port name as the interface name and description.
+type PcapPort struct {
+	softPort
+	config PcapConfig
+	done   chan bool
+	closer sync.Once
+
+	output *os.File
+	writer *pcapgo.NgWriter
+}
+
+type pcapReader interface {
+	ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+}
+
+// opens pcap or pcapng, by looking at the magic number.
+func openPcap(name string) (*os.File, pcapReader, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	buf := bufio.NewReader(file)
+	var reader pcapReader
+	var linkType layers.LinkType
+	if magic, err := buf.Peek(4); err != nil {
+		file.Close()
+		return nil, nil, err
+	} else if binary.BigEndian.Uint32(magic) == 0x0A0D0D0A {
+		if r, err := pcapgo.NewNgReader(buf, pcapgo.DefaultNgReaderOptions); err != nil {
+			file.Close()
+			return nil, nil, err
+		} else {
+			reader = r
+			linkType = r.LinkType()
+		}
+	} else {
+		if r, err := pcapgo.NewReader(buf); err != nil {
+			file.Close()
+			return nil, nil, err
+		} else {
+			reader = r
+			linkType = r.LinkType()
+		}
+	}
+	if linkType != layers.LinkTypeEthernet {
+		file.Close()
+		return nil, nil, fmt.Errorf("unsupported link type %v", linkType)
+	}
+	return file, reader, nil
+}
+
+// NewPcapPort opens the files and starts replaying.
+func NewPcapPort(name string, config PcapConfig) (*PcapPort, error) {
+	if config.Mtu == 0 {
+		config.Mtu = 1500
+	}
+	self := &PcapPort{
+		softPort: makeSoftPort(name, config.HwAddr, config.Mtu),
+		config:   config,
+		done:     make(chan bool),
+	}
+	if len(config.Input) > 0 {
+		// check the file format here, to return error
+		if file, _, err := openPcap(config.Input); err != nil {
+			return nil, err
+		} else {
+			file.Close()
+		}
+	}
+	if len(config.Output) > 0 {
+		if file, err := os.Create(config.Output); err != nil {
+			return nil, err
+		} else if writer, err := pcapgo.NewNgWriterInterface(file, pcapgo.NgInterface{
+			Name:                name,
+			Description:         name,
+			OS:                  runtime.GOOS,
+			LinkType:            layers.LinkTypeEthernet,
+			TimestampResolution: 9,
+		}, pcapgo.DefaultNgWriterOptions); err != nil {
+			file.Close()
+			return nil, err
+		} else if err := writer.Flush(); err != nil {
+			file.Close()
+			return nil, err
+		} else {
+			self.output = file
+			self.writer = writer
+		}
+	}
+	if len(config.Input) > 0 {
+		go self.replay()
+	}
+	return self, nil
+}
+
+func (self *PcapPort) replay() {
+	defer close(self.ingress)
+	for {
+		if n, err := self.replayOnce(); err != nil {
+			if err != io.EOF {
+				self.count(func(s *PortStats) { s.RxErrors++ })
+			}
+			return
+		} else if n == 0 {
+			return // nothing to loop
+		}
+		if !self.config.Loop {
+			return
+		}
+	}
+}
+
+// replayOnce returns the number of frames, and nil error when the whole file was replayed.
+func (self *PcapPort) replayOnce() (int, error) {
+	file, reader, err := openPcap(self.config.Input)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	count := 0
+
+	var start time.Time
+	var first time.Time
+	for {
+		data, ci, err := reader.ReadPacketData()
+		if err == io.EOF {
+			return count, nil
+		} else if err != nil {
+			return count, err
+		}
+		if self.config.Timing {
+			if first.IsZero() {
+				start = time.Now()
+				first = ci.Timestamp
+			} else if wait := ci.Timestamp.Sub(first) - time.Since(start); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-self.done:
+					return count, io.EOF
+				}
+			}
+		}
+		fr := Frame{
+			Data: make([]byte, len(data)),
+		}
+		copy(fr.Data, data)
+		select {
+		case self.ingress <- fr:
+			count++
+			self.count(func(s *PortStats) {
+				s.RxPackets++
+				s.RxBytes += uint64(len(fr.Data))
+			})
+		case <-self.done:
+			return count, io.EOF
+		}
+	}
+}
+
+func (self *PcapPort) Egress(fr Frame) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.writer == nil {
+		self.stats.TxDropped++
+		return nil
+	}
+	if err := self.writer.WritePacket(gopacket.CaptureInfo{
+		Timestamp:     time.Now(),
+		CaptureLength: len(fr.Data),
+		Length:        len(fr.Data),
+	}, fr.Data); err != nil {
+		self.stats.TxErrors++
+		return err
+	} else if err := self.writer.Flush(); err != nil {
+		self.stats.TxErrors++
+		return err
+	}
+	self.stats.TxPackets++
+	self.stats.TxBytes += uint64(len(fr.Data))
+	return nil
+}
+
+// Close stops replaying and closes the output file. Datapath will remove this port.
+// Calling Close more than once is safe.
+func (self *PcapPort) Close() error {
+	var err error
+	self.closer.Do(func() {
+		close(self.done)
+		self.closeMonitor()
+		if len(self.config.Input) == 0 {
+			close(self.ingress)
+		}
+
+		self.lock.Lock()
+		defer self.lock.Unlock()
+		if self.output != nil {
+			self.writer.Flush()
+			err = self.output.Close()
+			self.writer = nil
+			self.output = nil
+		}
+	})
+	return err
+}
@@ -0,0 +1,177 @@
+package gopenflow
+
+import (
+	"bytes"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func pcapTestFrame(mark byte) []byte {
+	return []byte{2, 0, 0, 0, 0, 1, 2, 0, 0, 0, 0, 2, 0x08, 0x00, mark}
+}
+
+func pcapTestInput(t *testing.T, name string, interval time.Duration, marks ...byte) {
+	file, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	w := pcapgo.NewWriter(file)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Now()
+	for _, mark := range marks {
+		data := pcapTestFrame(mark)
+		if err := w.WritePacket(gopacket.CaptureInfo{
+			Timestamp:     ts,
+			CaptureLength: len(data),
+			Length:        len(data),
+		}, data); err != nil {
+			t.Fatal(err)
+		}
+		ts = ts.Add(interval)
+	}
+}
+
+func TestPcapPortReplayCapture(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcapport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	input := filepath.Join(dir, "in.pcap")
+	output := filepath.Join(dir, "out.pcapng")
+	pcapTestInput(t, input, 50*time.Millisecond, 1, 2, 3)
+
+	port, err := NewPcapPort("replay0", PcapConfig{
+		Input:  input,
+		Output: output,
+		Timing: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	var marks []byte
+	for fr := range port.Ingress() {
+		marks = append(marks, fr.Data[14])
+	}
+	if !bytes.Equal(marks, []byte{1, 2, 3}) {
+		t.Errorf("unexpected replay %v", marks)
+	}
+	if time.Since(start) < 90*time.Millisecond {
+		t.Errorf("timing not kept %v", time.Since(start))
+	}
+
+	for _, mark := range []byte{4, 5} {
+		if err := port.Egress(Frame{Data: pcapTestFrame(mark)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats, _ := port.Stats(); stats.RxPackets != 3 || stats.TxPackets != 2 {
+		t.Errorf("unexpected stats %v", stats)
+	}
+	if err := port.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	r, err := pcapgo.NewNgReader(file, pcapgo.DefaultNgReaderOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	marks = nil
+	for {
+		data, _, err := r.ReadPacketData()
+		if err != nil {
+			break
+		}
+		marks = append(marks, data[14])
+	}
+	if !bytes.Equal(marks, []byte{4, 5}) {
+		t.Errorf("unexpected capture %v", marks)
+	}
+	if intf, err := r.Interface(0); err != nil {
+		t.Error(err)
+	} else if intf.Description != "replay0" {
+		t.Errorf("unexpected interface description %v", intf.Description)
+	}
+}
+
+func TestPcapPortLoop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcapport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	capture := filepath.Join(dir, "capture.pcapng")
+
+	// pcapng written by another PcapPort
+	if port, err := NewPcapPort("capture0", PcapConfig{Output: capture}); err != nil {
+		t.Fatal(err)
+	} else {
+		port.Egress(Frame{Data: pcapTestFrame(1)})
+		port.Egress(Frame{Data: pcapTestFrame(2)})
+		port.Close()
+	}
+
+	port, err := NewPcapPort("replay0", PcapConfig{
+		Input: capture,
+		Loop:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var marks []byte
+	for i := 0; i < 5; i++ {
+		marks = append(marks, (<-port.Ingress()).Data[14])
+	}
+	port.Close()
+	if !bytes.Equal(marks, []byte{1, 2, 1, 2, 1}) {
+		t.Errorf("unexpected replay %v", marks)
+	}
+}
+
+// header only input must not spin in Loop.
+func TestPcapPortLoopEmpty(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcapport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	input := filepath.Join(dir, "empty.pcap")
+	pcapTestInput(t, input, 0)
+
+	port, err := NewPcapPort("replay0", PcapConfig{
+		Input: input,
+		Loop:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case fr, ok := <-port.Ingress():
+		if ok {
+			t.Errorf("unexpected frame %v", fr)
+		}
+	case <-time.After(time.Second):
+		t.Error("replay did not stop")
+	}
+	if err := port.Close(); err != nil {
+		t.Error(err)
+	}
+	if err := port.Close(); err != nil {
+		t.Error(err)
+	}
+}
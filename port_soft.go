@@ -0,0 +1,128 @@
+package gopenflow
+
+import (
+	"github.com/hkwi/gopenflow/ofp4"
+	"sync"
+)
+
+// softPort holds the common part of userspace ports.
+type softPort struct {
+	name     string
+	hwAddr   [6]byte
+	mtu      int
+	ingress  chan Frame
+	monitor  chan PortEvent
+	lock     *sync.Mutex
+	notifier *sync.Mutex // serializes monitor senders
+	closed   bool
+	pconfig  []PortConfig
+	stats    PortStats
+}
+
+func makeSoftPort(name string, hwAddr [6]byte, mtu int) softPort {
+	return softPort{
+		name:     name,
+		hwAddr:   hwAddr,
+		mtu:      mtu,
+		ingress:  make(chan Frame),
+		monitor:  make(chan PortEvent, 1),
+		lock:     &sync.Mutex{},
+		notifier: &sync.Mutex{},
+	}
+}
+
+func (self *softPort) count(f func(*PortStats)) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	f(&self.stats)
+}
+
+func (self *softPort) Name() string {
+	return self.name
+}
+
+func (self *softPort) HwAddr() [6]byte {
+	return self.hwAddr
+}
+
+func (self *softPort) PhysicalPort() uint32 {
+	return 0
+}
+
+func (self *softPort) Monitor() <-chan PortEvent {
+	return self.monitor
+}
+
+func (self *softPort) Ingress() <-chan Frame {
+	return self.ingress
+}
+
+func (self *softPort) GetConfig() []PortConfig {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.pconfig
+}
+
+func (self *softPort) SetConfig(mods []PortConfig) error {
+	self.lock.Lock()
+	self.pconfig = mods
+	self.lock.Unlock()
+	self.notify(PortModified)
+	return nil
+}
+
+// notify is non-blocking, pending notifications are coalesced.
+func (self *softPort) notify(kind PortEventKind) {
+	self.notifier.Lock()
+	defer self.notifier.Unlock()
+
+	ev := makePortEvent(kind, self)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if !self.closed {
+		offerPortEvent(self.monitor, ev)
+	}
+}
+
+// closeMonitor closes the monitor, and no more events will be sent.
+func (self *softPort) closeMonitor() {
+	self.notifier.Lock()
+	defer self.notifier.Unlock()
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if !self.closed {
+		self.closed = true
+		close(self.monitor)
+	}
+}
+
+func (self *softPort) State() []PortState {
+	return []PortState{
+		PortStateLinkDown(false),
+		PortStateBlocked(false),
+		PortStateLive(true),
+	}
+}
+
+func (self *softPort) Mtu() uint32 {
+	return uint32(self.mtu)
+}
+
+func (self *softPort) Ethernet() (PortEthernetProperty, error) {
+	return PortEthernetProperty{
+		Curr:      ofp4.OFPPF_10GB_FD | ofp4.OFPPF_OTHER,
+		Supported: ofp4.OFPPF_10GB_FD | ofp4.OFPPF_OTHER,
+		CurrSpeed: 10000000,
+		MaxSpeed:  10000000,
+	}, nil
+}
+
+func (self *softPort) Stats() (PortStats, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.stats, nil
+}
+
+func (self *softPort) Vendor(interface{}) interface{} {
+	return nil
+}
@@ -0,0 +1,320 @@
+// +build linux
+
+package gopenflow
+
+import (
+	"fmt"
+	"github.com/hkwi/gopenflow/ofp4"
+	"github.com/hkwi/nlgo"
+	syscall2 "github.com/hkwi/suppl/syscall"
+	"log"
+	"net"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// TapPort is a Port on top of linux TAP device, which is intended to be
+// registered as OFPP_LOCAL, so that host processes can talk through the pipeline.
+// Frames sent out to this port will be received by the host network stack.
+type TapPort struct {
+	name    string
+	ifIndex uint32
+	flags   uint32
+	mac     []byte
+	mtu     uint32
+	config  []PortConfig
+
+	fd       int
+	hub      *nlgo.RtHub
+	ingress  chan Frame
+	monitor  chan PortEvent
+	lock     *sync.Mutex
+	notifier *sync.Mutex // serializes monitor senders
+	closed   bool
+}
+
+type tapIfreq struct {
+	Name  [syscall.IFNAMSIZ]byte
+	Flags uint16
+	_     [22]byte
+}
+
+// NewTapPort creates or attaches a TAP device.
+// name may be empty, and kernel chooses the name in that case.
+func NewTapPort(name string) (*TapPort, error) {
+	fd, err := syscall.Open("/dev/net/tun", syscall.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	ifr := tapIfreq{
+		Flags: syscall.IFF_TAP | syscall.IFF_NO_PI,
+	}
+	copy(ifr.Name[:syscall.IFNAMSIZ-1], name)
+	if _, _, e := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TUNSETIFF, uintptr(unsafe.Pointer(&ifr))); e != 0 {
+		syscall.Close(fd)
+		return nil, e
+	}
+	for i, c := range ifr.Name {
+		if c == 0 {
+			name = string(ifr.Name[:i])
+			break
+		}
+	}
+	self := &TapPort{
+		name:     name,
+		fd:       fd,
+		ingress:  make(chan Frame),
+		monitor:  make(chan PortEvent, 1),
+		lock:     &sync.Mutex{},
+		notifier: &sync.Mutex{},
+	}
+	if iface, err := net.InterfaceByName(name); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	} else {
+		self.ifIndex = uint32(iface.Index)
+		self.mac = []byte(iface.HardwareAddr)
+		self.mtu = uint32(iface.MTU)
+	}
+	if hub, err := nlgo.NewRtHub(); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	} else if err := hub.Add(syscall.RTNLGRP_LINK, self); err != nil {
+		hub.Close()
+		syscall.Close(fd)
+		return nil, err
+	} else {
+		self.hub = hub
+	}
+	req := syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{
+			Type:  syscall.RTM_GETLINK,
+			Flags: syscall.NLM_F_DUMP,
+		},
+	}
+	(*nlgo.IfInfoMessage)(&req).Set(syscall.IfInfomsg{Index: int32(self.ifIndex)}, nil)
+	if res, err := self.hub.Sync(req); err != nil {
+		self.Close()
+		return nil, err
+	} else {
+		for _, r := range res {
+			self.updateLink(r)
+		}
+	}
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			if n, err := syscall.Read(fd, buf); err != nil {
+				if e, ok := err.(syscall.Errno); ok && e.Temporary() {
+					continue
+				}
+				break
+			} else if n == 0 {
+				break
+			} else {
+				pkt := make([]byte, n)
+				copy(pkt, buf)
+				func() {
+					defer func() {
+						if r := recover(); r != nil {
+							fmt.Println("dropping packet on closed ingress.")
+						}
+					}()
+					self.ingress <- Frame{Data: pkt}
+				}()
+			}
+		}
+	}()
+	return self, nil
+}
+
+// updateLink returns true if the link state changed.
+func (self *TapPort) updateLink(ev syscall.NetlinkMessage) bool {
+	if ev.Header.Type != syscall.RTM_NEWLINK {
+		return false
+	}
+	msg := nlgo.IfInfoMessage(ev)
+	ifinfo := msg.IfInfo()
+	if uint32(ifinfo.Index) != self.ifIndex {
+		return false
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	changed := self.flags != ifinfo.Flags
+	self.flags = ifinfo.Flags
+	if attrs, err := msg.Attrs(); err != nil {
+		log.Print(err)
+	} else if amap, ok := attrs.(nlgo.AttrMap); ok {
+		if t := amap.Get(nlgo.IFLA_MTU); t != nil && self.mtu != uint32(t.(nlgo.U32)) {
+			self.mtu = uint32(t.(nlgo.U32))
+			changed = true
+		}
+		if t := amap.Get(nlgo.IFLA_ADDRESS); t != nil && string(self.mac) != string(t.(nlgo.Binary)) {
+			self.mac = []byte(t.(nlgo.Binary))
+			changed = true
+		}
+	}
+	return changed
+}
+
+func (self *TapPort) NetlinkListen(ev syscall.NetlinkMessage) {
+	if self.updateLink(ev) {
+		self.notify()
+	}
+}
+
+// notify is non-blocking, pending notifications are coalesced.
+func (self *TapPort) notify() {
+	self.notifier.Lock()
+	defer self.notifier.Unlock()
+
+	ev := MakePortEvent(PortModified, self)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if !self.closed {
+		offerPortEvent(self.monitor, ev)
+	}
+}
+
+func (self TapPort) Name() string {
+	return self.name
+}
+
+func (self TapPort) HwAddr() [6]byte {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	var ret [6]byte
+	copy(ret[:], self.mac)
+	return ret
+}
+
+func (self TapPort) PhysicalPort() uint32 {
+	return 0
+}
+
+func (self TapPort) Monitor() <-chan PortEvent {
+	return self.monitor
+}
+
+func (self TapPort) Ingress() <-chan Frame {
+	return self.ingress
+}
+
+func (self TapPort) Egress(pkt Frame) error {
+	if n, err := syscall.Write(self.fd, pkt.Data); err != nil {
+		return err
+	} else if n != len(pkt.Data) {
+		return fmt.Errorf("write not complete")
+	}
+	return nil
+}
+
+func (self TapPort) GetConfig() []PortConfig {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return append([]PortConfig{
+		PortConfigPortDown(self.flags&syscall.IFF_UP == 0),
+	}, self.config...)
+}
+
+func (self *TapPort) SetConfig(mods []PortConfig) error {
+	var config []PortConfig
+	for _, mod := range mods {
+		switch m := mod.(type) {
+		case PortConfigPortDown:
+			self.lock.Lock()
+			down := self.flags&syscall.IFF_UP == 0
+			self.lock.Unlock()
+			if down == bool(m) {
+				continue
+			}
+			if err := setLinkUp(self.hub, self.ifIndex, !bool(m)); err != nil {
+				return PortConfigError{mod, err}
+			}
+			self.lock.Lock()
+			self.flags ^= syscall.IFF_UP
+			self.lock.Unlock()
+		default:
+			config = append(config, mod)
+		}
+	}
+	self.lock.Lock()
+	self.config = config
+	self.lock.Unlock()
+	self.notify()
+	return nil
+}
+
+func (self TapPort) State() []PortState {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return []PortState{
+		PortStateLinkDown(self.flags&syscall2.IFF_LOWER_UP == 0),
+		PortStateBlocked(false),
+		PortStateLive(self.flags&syscall.IFF_RUNNING != 0),
+	}
+}
+
+func (self TapPort) Mtu() uint32 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.mtu
+}
+
+func (self TapPort) Ethernet() (PortEthernetProperty, error) {
+	return PortEthernetProperty{
+		Curr:      ofp4.OFPPF_10GB_FD | ofp4.OFPPF_COPPER,
+		Supported: ofp4.OFPPF_10GB_FD | ofp4.OFPPF_COPPER,
+		CurrSpeed: 10000000,
+		MaxSpeed:  10000000,
+	}, nil
+}
+
+// Stats returns the kernel netdev statistics, where rx and tx are swapped
+// because frames sent out to this port are received by the host.
+func (self TapPort) Stats() (PortStats, error) {
+	if s, err := linkStats(self.ifIndex); err != nil {
+		return PortStats{}, err
+	} else {
+		return PortStats{
+			RxPackets: s.TxPackets,
+			TxPackets: s.RxPackets,
+			RxBytes:   s.TxBytes,
+			TxBytes:   s.RxBytes,
+			RxDropped: s.TxDropped,
+			TxDropped: s.RxDropped,
+			RxErrors:  s.TxErrors,
+			TxErrors:  s.RxErrors,
+			Ethernet:  &PortStatsEthernet{},
+		}, nil
+	}
+}
+
+func (self TapPort) Vendor(interface{}) interface{} {
+	return nil
+}
+
+// Close detaches the TAP device. Datapath will remove this port.
+// Calling Close more than once is safe.
+func (self *TapPort) Close() error {
+	self.notifier.Lock()
+	self.lock.Lock()
+	closed := self.closed
+	if !closed {
+		self.closed = true
+		close(self.monitor)
+	}
+	self.lock.Unlock()
+	self.notifier.Unlock()
+	if closed {
+		return nil
+	}
+
+	self.hub.Close()
+	err := syscall.Close(self.fd)
+	close(self.ingress)
+	return err
+}
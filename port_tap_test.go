@@ -0,0 +1,34 @@
+// +build linux
+
+package gopenflow
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTapPortMonitor(t *testing.T) {
+	port, err := NewTapPort("")
+	if err != nil {
+		t.Skip(err)
+	}
+	// monitor is not read before the port was added to the datapath
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 3; i++ {
+			port.SetConfig(nil)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("SetConfig blocked")
+	}
+	if err := port.Close(); err != nil {
+		t.Error(err)
+	}
+	if err := port.Close(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,77 @@
+package gopenflow
+
+import (
+	"encoding/binary"
+	"github.com/hkwi/gopenflow/oxm"
+	"net"
+)
+
+func nxm_bytes(oxmtype uint32, value []byte) []byte {
+	ret := make([]byte, 4+len(value))
+	binary.BigEndian.PutUint32(ret, oxmtype+uint32(len(value)))
+	copy(ret[4:], value)
+	return ret
+}
+
+// returns oxm value part, without mask.
+func nxm_value(x oxm.Oxm) []byte {
+	hdr := x.Header()
+	if hdr.HasMask() {
+		return x[4 : 4+hdr.Length()/2]
+	}
+	return x[4 : 4+hdr.Length()]
+}
+
+// tunnelOob is the tunnel metadata carried in Frame.Oob.
+type tunnelOob struct {
+	tunnelId    uint64
+	hasTunnelId bool
+	src         net.IP
+	dst         net.IP
+	metadata    map[int][]byte // tun_metadata index to value
+}
+
+func parseTunnelOob(oob []byte) tunnelOob {
+	var ret tunnelOob
+	for _, x := range oxm.Oxm(oob).Iter() {
+		value := nxm_value(x)
+		switch t := x.Header().Type(); t {
+		case oxm.OXM_OF_TUNNEL_ID:
+			if len(value) == 8 {
+				ret.tunnelId = binary.BigEndian.Uint64(value)
+				ret.hasTunnelId = true
+			}
+		case oxm.NXM_NX_TUN_IPV4_SRC, oxm.NXM_NX_TUN_IPV6_SRC:
+			if len(value) == 4 || len(value) == 16 {
+				ret.src = net.IP(value)
+			}
+		case oxm.NXM_NX_TUN_IPV4_DST, oxm.NXM_NX_TUN_IPV6_DST:
+			if len(value) == 4 || len(value) == 16 {
+				ret.dst = net.IP(value)
+			}
+		default:
+			if t >= oxm.NXM_NX_TUN_METADATA0 && t <= oxm.NXM_NX_TUN_METADATA63 {
+				if ret.metadata == nil {
+					ret.metadata = make(map[int][]byte)
+				}
+				ret.metadata[int(t-oxm.NXM_NX_TUN_METADATA0)>>oxm.OXM_FIELD_SHIFT] = value
+			}
+		}
+	}
+	return ret
+}
+
+// makeTunnelOob builds ingress Frame.Oob. The local address is not reported
+// as tun_dst, because the pipeline keeps Oob on output, and the output tunnel
+// port would take it as the destination instead of its Remote.
+func makeTunnelOob(tunnelId uint64, src net.IP) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, tunnelId)
+	oob := nxm_bytes(oxm.OXM_OF_TUNNEL_ID, buf)
+	if src4 := src.To4(); src4 != nil {
+		oob = append(oob, nxm_bytes(oxm.NXM_NX_TUN_IPV4_SRC, []byte(src4))...)
+	} else if src6 := src.To16(); src6 != nil {
+		oob = append(oob, nxm_bytes(oxm.NXM_NX_TUN_IPV6_SRC, []byte(src6))...)
+	}
+	return oob
+}
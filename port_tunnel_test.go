@@ -0,0 +1,33 @@
+package gopenflow
+
+import (
+	"encoding/binary"
+	"github.com/hkwi/gopenflow/oxm"
+	"testing"
+	"time"
+)
+
+func tunnelTestRecv(t *testing.T, port Port) Frame {
+	select {
+	case fr := <-port.Ingress():
+		return fr
+	case <-time.After(time.Second):
+		t.Fatal("tunnel receive timeout")
+	}
+	return Frame{}
+}
+
+func tunnelTestOob(fr Frame, oxmType uint32) []byte {
+	for _, x := range oxm.Oxm(fr.Oob).Iter() {
+		if x.Header().Type() == oxmType {
+			return nxm_value(x)
+		}
+	}
+	return nil
+}
+
+func tunnelTestTunnelId(id uint64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, id)
+	return nxm_bytes(oxm.OXM_OF_TUNNEL_ID, buf)
+}
@@ -1,95 +1,163 @@
-package gopenflow
-
-import (
-	"net"
-	"encoding/binary"
-	"github.com/hkwi/gopenflow/oxm"
-	"fmt"
-	"log"
-)
-
-type VxlanPort struct {
-	name string
-	mac [6]byte
-	port int
-	mtu int
-	ingress chan<-Frame
-	conn *net.UDPConn
-}
-
-func (self VxlanPort) Name() string{
-	return self.name
-}
-
-func (self VxlanPort) HwAddr() [6]byte {
-	return self.mac
-}
-
-func nxm_bytes(oxmtype uint32, value []byte) []byte {
-	ret := make([]byte, 4+len(value))
-	binary.BigEndian.PutUint32(ret, oxmtype + uint32(len(ret)))
-	copy(ret[4:], value)
-	return ret
-}
-
-func (self VxlanPort) Egress(fr Frame) error {
-	var dst net.IP
-	vxlan := make([]byte, 8+len(fr.Data))
-	vxlan[0] = 0x08 // valid flag
-	for _, x := range oxm.Oxm(fr.Oob).Iter() {
-		switch x.Header().Type(){
-		case oxm.OXM_OF_TUNNEL_ID:
-			copy(vxlan[4:7], x[9:12])
-		case oxm.NXM_NX_TUN_IPV4_DST:
-			dst = net.IP(x[4:8])
-		}
-	}
-	copy(vxlan[8:], fr.Data)
-	if n, err := self.conn.WriteToUDP(vxlan, &net.UDPAddr{
-		IP: dst,
-		Port: self.port,
-	}); err != nil {
-		return err
-	} else if n < len(vxlan) {
-		fmt.Printf("MTU error?")
-	}
-	return nil
-}
-
-func (self *VxlanPort) Up() error {
-	if conn, err := net.ListenUDP("udp", &net.UDPAddr{
-		Port: self.port,
-	}); err != nil {
-		return err
-	} else {
-		self.conn = conn
-		go func(){
-			buf := make([]byte, 8 + self.mtu)
-			for {
-				if n, addr, err := conn.ReadFromUDP(buf); err != nil {
-					log.Print(err)
-					break
-				} else {
-					fr := Frame {
-						Data: buf[8:n],
-					}
-					fr.Oob = append(fr.Oob, nxm_bytes(oxm.OXM_OF_TUNNEL_ID, []byte{
-						0,0,0,0,0,buf[4],buf[5],buf[6]})...)
-					if src4 := addr.IP.To4(); src4 != nil {
-						fr.Oob = append(fr.Oob, nxm_bytes(oxm.NXM_NX_TUN_IPV4_SRC, []byte(src4))...)
-					}
-					self.ingress <- fr
-				}
-			}
-		}()
-	}
-	return nil
-}
-
-func (self *VxlanPort) Down() error {
-	if self.conn != nil {
-		self.conn.Close()
-	}
-	self.conn = nil
-	return nil
-}
+package gopenflow
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+const vxlanDefaultPort = 4789
+
+// VxlanConfig is the configuration for VxlanPort.
+type VxlanConfig struct {
+	Local      net.IP // underlay local address. nil means any address.
+	Port       int    // local udp port. 0 means 4789.
+	Remote     net.IP // used when NXM_NX_TUN_IPV4_DST or NXM_NX_TUN_IPV6_DST is not set.
+	RemotePort int    // remote udp port. 0 means the same as Port.
+	Vni        uint32 // fixed VNI, used if FlowVni is false.
+	FlowVni    bool   // VNI is taken from tunnel_id, like ovs "key=flow".
+	Mtu        int    // 0 means 1450.
+	HwAddr     [6]byte
+}
+
+// VxlanPort is a Port that carries frames over VXLAN (RFC 7348) in userspace.
+//
+// On ingress, the VNI is reported in OXM_OF_TUNNEL_ID and the underlay source
+// address in NXM_NX_TUN_IPV4_SRC or NXM_NX_TUN_IPV6_SRC. On egress, the
+// destination is taken from NXM_NX_TUN_IPV4_DST or NXM_NX_TUN_IPV6_DST.
+// With fixed VNI, frames with other VNI are dropped on ingress.
+type VxlanPort struct {
+	softPort
+	config VxlanConfig
+	conn   *net.UDPConn
+	done   chan bool
+	closer sync.Once
+}
+
+// NewVxlanPort opens the underlay udp socket and starts receiving.
+func NewVxlanPort(name string, config VxlanConfig) (*VxlanPort, error) {
+	if config.Port == 0 {
+		config.Port = vxlanDefaultPort
+	}
+	if config.Mtu == 0 {
+		config.Mtu = 1450
+	}
+	if config.Vni > 0xFFFFFF {
+		return nil, fmt.Errorf("vni out of range %d", config.Vni)
+	}
+	network := "udp"
+	if config.Local != nil {
+		if config.Local.To4() != nil {
+			network = "udp4"
+		} else {
+			network = "udp6"
+		}
+	}
+	conn, err := net.ListenUDP(network, &net.UDPAddr{
+		IP:   config.Local,
+		Port: config.Port,
+	})
+	if err != nil {
+		return nil, err
+	}
+	self := &VxlanPort{
+		softPort: makeSoftPort(name, config.HwAddr, config.Mtu),
+		config:   config,
+		conn:     conn,
+		done:     make(chan bool),
+	}
+	go self.serve()
+	return self, nil
+}
+
+func (self *VxlanPort) serve() {
+	defer close(self.ingress)
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := self.conn.ReadFromUDP(buf)
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				continue
+			}
+			return
+		}
+		if n < 8+14 || buf[0]&0x08 == 0 {
+			self.count(func(s *PortStats) { s.RxErrors++ })
+			continue
+		}
+		vni := uint32(buf[4])<<16 | uint32(buf[5])<<8 | uint32(buf[6])
+		if !self.config.FlowVni && vni != self.config.Vni {
+			self.count(func(s *PortStats) { s.RxDropped++ })
+			continue
+		}
+		fr := Frame{
+			Data: make([]byte, n-8),
+		}
+		copy(fr.Data, buf[8:n])
+		fr.Oob = makeTunnelOob(uint64(vni), addr.IP)
+		self.count(func(s *PortStats) {
+			s.RxPackets++
+			s.RxBytes += uint64(len(fr.Data))
+		})
+		select {
+		case self.ingress <- fr:
+		case <-self.done:
+			return
+		}
+	}
+}
+
+func (self *VxlanPort) Egress(fr Frame) error {
+	tun := parseTunnelOob(fr.Oob)
+	dst := tun.dst
+	vni := self.config.Vni
+	if self.config.FlowVni && tun.hasTunnelId {
+		vni = uint32(tun.tunnelId) & 0xFFFFFF
+	}
+	if dst == nil {
+		dst = self.config.Remote
+	}
+	if dst == nil {
+		self.count(func(s *PortStats) { s.TxDropped++ })
+		return fmt.Errorf("vxlan remote not specified")
+	}
+	port := self.config.RemotePort
+	if port == 0 {
+		port = self.config.Port
+	}
+
+	vxlan := make([]byte, 8+len(fr.Data))
+	vxlan[0] = 0x08 // valid flag
+	vxlan[4] = uint8(vni >> 16)
+	vxlan[5] = uint8(vni >> 8)
+	vxlan[6] = uint8(vni)
+	copy(vxlan[8:], fr.Data)
+	if n, err := self.conn.WriteToUDP(vxlan, &net.UDPAddr{
+		IP:   dst,
+		Port: port,
+	}); err != nil {
+		self.count(func(s *PortStats) { s.TxErrors++ })
+		return err
+	} else if n < len(vxlan) {
+		self.count(func(s *PortStats) { s.TxErrors++ })
+		return fmt.Errorf("write not complete")
+	}
+	self.count(func(s *PortStats) {
+		s.TxPackets++
+		s.TxBytes += uint64(len(fr.Data))
+	})
+	return nil
+}
+
+// Close closes the underlay socket. Datapath will remove this port.
+// Calling Close more than once is safe.
+func (self *VxlanPort) Close() error {
+	var err error
+	self.closer.Do(func() {
+		close(self.done)
+		err = self.conn.Close()
+		self.closeMonitor()
+	})
+	return err
+}
@@ -0,0 +1,150 @@
+package gopenflow
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/hkwi/gopenflow/oxm"
+	"net"
+	"testing"
+	"time"
+)
+
+func vxlanTestPair(t *testing.T, local net.IP) (*VxlanPort, *VxlanPort) {
+	a, err := NewVxlanPort("vxa", VxlanConfig{
+		Local:      local,
+		Port:       14789,
+		RemotePort: 14790,
+		FlowVni:    true,
+	})
+	if err != nil {
+		t.Skip(err)
+	}
+	b, err := NewVxlanPort("vxb", VxlanConfig{
+		Local:      local,
+		Port:       14790,
+		Remote:     local,
+		RemotePort: 14789,
+		Vni:        42,
+	})
+	if err != nil {
+		a.Close()
+		t.Skip(err)
+	}
+	return a, b
+}
+
+func testVxlanLoopback(t *testing.T, local net.IP, srcType, dstType uint32) {
+	a, b := vxlanTestPair(t, local)
+	defer a.Close()
+	defer b.Close()
+
+	eth := []byte{2, 0, 0, 0, 0, 1, 2, 0, 0, 0, 0, 2, 0x08, 0x00, 0xaa, 0xbb}
+
+	// default remote with fixed vni
+	if err := b.Egress(Frame{Data: eth}); err != nil {
+		t.Fatal(err)
+	}
+	fr := tunnelTestRecv(t, a)
+	if !bytes.Equal(fr.Data, eth) {
+		t.Errorf("data mismatch %v", fr.Data)
+	}
+	if id := tunnelTestOob(fr, oxm.OXM_OF_TUNNEL_ID); binary.BigEndian.Uint64(id) != 42 {
+		t.Errorf("tunnel id %v", id)
+	}
+	if src := tunnelTestOob(fr, srcType); !net.IP(src).Equal(local) {
+		t.Errorf("tunnel src %v", src)
+	}
+
+	// fixed vni port drops other vni
+	for _, vni := range []uint64{7, 42} {
+		oob := append(tunnelTestTunnelId(vni), nxm_bytes(dstType, []byte(local))...)
+		if err := a.Egress(Frame{Data: eth, Oob: oob}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fr = tunnelTestRecv(t, b)
+	if !bytes.Equal(fr.Data, eth) {
+		t.Errorf("data mismatch %v", fr.Data)
+	}
+
+	if stats, err := b.Stats(); err != nil {
+		t.Error(err)
+	} else if stats.TxPackets != 1 || stats.RxPackets != 1 || stats.RxDropped != 1 {
+		t.Errorf("unexpected stats %v", stats)
+	}
+
+	// no remote
+	if err := a.Egress(Frame{Data: eth}); err == nil {
+		t.Error("egress without remote should fail")
+	} else if stats, _ := a.Stats(); stats.TxDropped != 1 {
+		t.Errorf("unexpected stats %v", stats)
+	}
+}
+
+func TestVxlanLoopback(t *testing.T) {
+	testVxlanLoopback(t, net.ParseIP("127.0.0.1").To4(), oxm.NXM_NX_TUN_IPV4_SRC, oxm.NXM_NX_TUN_IPV4_DST)
+}
+
+func TestVxlanLoopback6(t *testing.T) {
+	testVxlanLoopback(t, net.ParseIP("::1"), oxm.NXM_NX_TUN_IPV6_SRC, oxm.NXM_NX_TUN_IPV6_DST)
+}
+
+func TestVxlanClose(t *testing.T) {
+	a, b := vxlanTestPair(t, net.ParseIP("127.0.0.1").To4())
+	defer b.Close()
+
+	// ingress of a is not read, and the receiver blocks
+	if err := b.Egress(Frame{Data: []byte{2, 0, 0, 0, 0, 1, 2, 0, 0, 0, 0, 2, 0x08, 0x00}}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		if stats, _ := a.Stats(); stats.RxPackets == 1 {
+			break
+		} else if i > 100 {
+			t.Fatal("frame not received")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := a.Close(); err != nil {
+		t.Error(err)
+	}
+	a.Close()
+	timeout := time.After(time.Second)
+	for closed := false; !closed; {
+		select {
+		case _, ok := <-a.Ingress():
+			closed = !ok
+		case <-timeout:
+			t.Fatal("receiver not stopped")
+		}
+	}
+	if _, ok := <-a.Monitor(); ok {
+		t.Error("monitor not closed")
+	}
+}
+
+func TestVxlanSetConfig(t *testing.T) {
+	a, b := vxlanTestPair(t, net.ParseIP("127.0.0.1").To4())
+	defer b.Close()
+
+	// monitor is not read, and port-mod must not block
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 3; i++ {
+			a.SetConfig([]PortConfig{PortConfigNoFwd(i%2 == 0)})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("SetConfig blocked")
+	}
+	if ev := <-a.Monitor(); ev.Kind != PortModified {
+		t.Error("unexpected event", ev)
+	}
+	a.Close()
+	if err := a.SetConfig(nil); err != nil {
+		t.Error(err)
+	}
+}